@@ -8,10 +8,47 @@ fn main() -> Result<(), Box<dyn std::error::Error>> {
             "opentelemetry/proto/common/v1/common.proto",
             "opentelemetry/proto/resource/v1/resource.proto", 
             "opentelemetry/proto/trace/v1/trace.proto",
+            "opentelemetry/proto/logs/v1/logs.proto",
         ],
         &["."],
     )?;
 
     println!("Protobuf compilation completed");
+
+    emit_filter_version();
     Ok(())
+}
+
+/// Version reported by the filter: SP_FILTER_VERSION when set (release builds), else the
+/// crate version plus the git commit, e.g. `0.0.21+g1a2b3c4d5e6f`
+fn emit_filter_version() {
+    println!("cargo:rerun-if-env-changed=SP_FILTER_VERSION");
+    println!("cargo:rerun-if-changed=.git/HEAD");
+    println!("cargo:rerun-if-changed=.git/refs/heads");
+
+    let version = std::env::var("SP_FILTER_VERSION")
+        .ok()
+        .filter(|v| !v.trim().is_empty())
+        .map(|v| v.trim().to_string())
+        .unwrap_or_else(|| {
+            let package_version = std::env::var("CARGO_PKG_VERSION").unwrap_or_default();
+            let commit = std::process::Command::new("git")
+                .args(["rev-parse", "--short=12", "HEAD"])
+                .output()
+                .ok()
+                .filter(|output| output.status.success())
+                .map(|output| String::from_utf8_lossy(&output.stdout).trim().to_string())
+                .filter(|commit| !commit.is_empty());
+            match commit {
+                Some(commit) => format!("{}+g{}", package_version, commit),
+                None => package_version,
+            }
+        });
+    // Stat names only keep [A-Za-z0-9_]; dots would split the name into Envoy stat segments
+    let stat_version: String = version
+        .chars()
+        .map(|c| if c.is_ascii_alphanumeric() { c } else { '_' })
+        .collect();
+    println!("cargo:rustc-env=SP_FILTER_VERSION={}", version);
+    println!("cargo:rustc-env=SP_FILTER_VERSION_STAT={}", stat_version);
 }
\ No newline at end of file
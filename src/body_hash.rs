@@ -0,0 +1,71 @@
+// Request body fingerprints for dedup and replay grouping (captureBodyHash)
+//
+// The hash is fed every request body chunk as it arrives, before the capture cap, gRPC-web
+// unframing, decompression or redaction touch anything. Two requests with the same bytes
+// on the wire get the same sp.request.body_hash even when their stored copies were
+// truncated or redacted.
+
+use sha2::{Digest, Sha256};
+use xxhash_rust::xxh3::Xxh3;
+
+use crate::config::BodyHashAlgorithm;
+
+pub enum BodyHasher {
+    Sha256(Sha256),
+    XxHash(Box<Xxh3>),
+}
+
+impl BodyHasher {
+    pub fn new(algorithm: BodyHashAlgorithm) -> Self {
+        match algorithm {
+            BodyHashAlgorithm::Sha256 => BodyHasher::Sha256(Sha256::new()),
+            BodyHashAlgorithm::XxHash => BodyHasher::XxHash(Box::new(Xxh3::new())),
+        }
+    }
+
+    pub fn update(&mut self, chunk: &[u8]) {
+        match self {
+            BodyHasher::Sha256(hasher) => hasher.update(chunk),
+            BodyHasher::XxHash(hasher) => hasher.update(chunk),
+        }
+    }
+
+    /// Lowercase hex digest: 64 characters for sha256, 16 for xxhash (XXH3, 64-bit)
+    pub fn finish(self) -> String {
+        match self {
+            BodyHasher::Sha256(hasher) => hasher.finalize().iter().map(|b| format!("{:02x}", b)).collect(),
+            BodyHasher::XxHash(hasher) => format!("{:016x}", hasher.digest()),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn hash(algorithm: BodyHashAlgorithm, chunks: &[&[u8]]) -> String {
+        let mut hasher = BodyHasher::new(algorithm);
+        for chunk in chunks {
+            hasher.update(chunk);
+        }
+        hasher.finish()
+    }
+
+    #[test]
+    fn test_sha256_known_digest() {
+        assert_eq!(
+            hash(BodyHashAlgorithm::Sha256, &[b"abc"]),
+            "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+        );
+    }
+
+    #[test]
+    fn test_chunking_does_not_change_the_hash() {
+        for algorithm in [BodyHashAlgorithm::Sha256, BodyHashAlgorithm::XxHash] {
+            let whole = hash(algorithm, &[b"{\"order\": 42, \"items\": []}"]);
+            assert_eq!(hash(algorithm, &[b"{\"order\": 4", b"2, \"items\"", b"", b": []}"]), whole);
+            assert_ne!(hash(algorithm, &[b"{\"order\": 43, \"items\": []}"]), whole);
+        }
+        assert_eq!(hash(BodyHashAlgorithm::XxHash, &[b"abc"]).len(), 16);
+    }
+}
@@ -0,0 +1,240 @@
+// Circuit breaker around backend export, shared by all worker VMs through shared data
+//
+// Closed: exports go out and consecutive failures are counted. After
+// circuitFailureThreshold failures the circuit opens for circuitOpenMs, and batches are
+// dropped without a dispatch. Once the window passes, the first worker to ask becomes
+// the half-open probe (and pushes the window out, so a lost probe cannot wedge the
+// circuit); its outcome closes the circuit or opens it again.
+//
+// Each export backend has its own circuit, so one failing backend never stops exports
+// to the others.
+
+use proxy_wasm::traits::Context;
+use proxy_wasm::types::Status;
+
+use crate::shared_data::{self, Feature};
+
+const CIRCUIT_KEY: &str = "sp.export.circuit";
+/// Encoded state: failures (u32 LE), open_until_ms (u64 LE), half_open (u8)
+const STATE_LEN: usize = 13;
+
+// sp_export_circuit_state gauge values
+const GAUGE_CLOSED: u64 = 0;
+const GAUGE_OPEN: u64 = 1;
+const GAUGE_HALF_OPEN: u64 = 2;
+
+#[derive(Debug, Clone, Copy, PartialEq, Default)]
+struct CircuitState {
+    failures: u32,
+    open_until_ms: u64,  // 0 while closed
+    half_open: bool,  // A probe export is in flight
+}
+
+impl CircuitState {
+    fn encode(&self) -> Vec<u8> {
+        let mut value = Vec::with_capacity(STATE_LEN);
+        value.extend_from_slice(&self.failures.to_le_bytes());
+        value.extend_from_slice(&self.open_until_ms.to_le_bytes());
+        value.push(self.half_open as u8);
+        value
+    }
+
+    fn decode(value: &[u8]) -> Self {
+        if value.len() != STATE_LEN {
+            return Self::default();
+        }
+        Self {
+            failures: u32::from_le_bytes(value[0..4].try_into().unwrap_or_default()),
+            open_until_ms: u64::from_le_bytes(value[4..12].try_into().unwrap_or_default()),
+            half_open: value[12] != 0,
+        }
+    }
+
+    fn gauge(&self) -> u64 {
+        if self.half_open {
+            GAUGE_HALF_OPEN
+        } else if self.open_until_ms > 0 {
+            GAUGE_OPEN
+        } else {
+            GAUGE_CLOSED
+        }
+    }
+}
+
+/// Shared data key of a backend's circuit; the default backend keeps the original key
+fn circuit_key(backend: &str) -> String {
+    if backend == crate::config::DEFAULT_BACKEND_NAME {
+        CIRCUIT_KEY.to_string()
+    } else {
+        format!("{}.{}", CIRCUIT_KEY, backend)
+    }
+}
+
+/// Whether an export may be dispatched now, and the state to store if that changes it
+fn on_dispatch(state: CircuitState, now_ms: u64, open_ms: u64) -> (bool, Option<CircuitState>) {
+    if state.open_until_ms == 0 {
+        return (true, None);
+    }
+    if now_ms < state.open_until_ms {
+        return (false, None);
+    }
+    // Window over: this caller becomes the probe
+    let probing = CircuitState {
+        failures: state.failures,
+        open_until_ms: now_ms.saturating_add(open_ms),
+        half_open: true,
+    };
+    (true, Some(probing))
+}
+
+fn on_failure(state: CircuitState, now_ms: u64, threshold: u32, open_ms: u64) -> CircuitState {
+    let failures = state.failures.saturating_add(1);
+    if state.half_open || failures >= threshold {
+        CircuitState {
+            failures,
+            open_until_ms: now_ms.saturating_add(open_ms),
+            half_open: false,
+        }
+    } else {
+        CircuitState {
+            failures,
+            ..state
+        }
+    }
+}
+
+/// Check the circuit before dispatching an export. Host errors fail open (closed
+/// circuit) so a shared data problem never stops exports.
+pub fn allow_dispatch(ctx: &dyn Context, backend: &str, now_ms: u64, threshold: u32, open_ms: u64) -> bool {
+    if threshold == 0 {
+        return true;
+    }
+    let key = circuit_key(backend);
+    for _ in 0..2 {
+        let (value, cas) = shared_data::get(ctx, Feature::Circuit, &key);
+        let state = value.as_deref().map(CircuitState::decode).unwrap_or_default();
+        let (allowed, next) = on_dispatch(state, now_ms, open_ms);
+        let next = match next {
+            Some(next) => next,
+            None => return allowed,
+        };
+        match shared_data::set(ctx, Feature::Circuit, &key, &next.encode(), cas) {
+            Ok(()) => {
+                crate::sp_info!("Export circuit of backend '{}' half-open, sending a probe batch", backend);
+                crate::metrics::set_backend_gauge(crate::metrics::EXPORT_CIRCUIT_STATE, backend, next.gauge());
+                return true;
+            }
+            // Another worker took the probe (or changed the state); re-read and decide again
+            Err(Status::CasMismatch) => continue,
+            Err(_) => return true,
+        }
+    }
+    false
+}
+
+/// Record an export the backend answered, closing the circuit
+pub fn record_success(ctx: &dyn Context, backend: &str) {
+    update(ctx, backend, |state| {
+        if state.open_until_ms > 0 {
+            crate::sp_info!("Export circuit of backend '{}' closed", backend);
+        }
+        CircuitState::default()
+    });
+}
+
+/// Record a failed export (dispatch error, retryable status or lost callback)
+pub fn record_failure(ctx: &dyn Context, backend: &str, now_ms: u64, threshold: u32, open_ms: u64) {
+    if threshold == 0 {
+        return;
+    }
+    update(ctx, backend, |state| {
+        let next = on_failure(state, now_ms, threshold, open_ms);
+        if next.open_until_ms != state.open_until_ms {
+            crate::sp_warn!(
+                "Export circuit of backend '{}' open for {}ms after {} consecutive failures",
+                backend,
+                open_ms,
+                next.failures
+            );
+        }
+        next
+    });
+}
+
+fn update(ctx: &dyn Context, backend: &str, transition: impl Fn(CircuitState) -> CircuitState) {
+    let key = circuit_key(backend);
+    for _ in 0..2 {
+        let (value, cas) = shared_data::get(ctx, Feature::Circuit, &key);
+        let state = value.as_deref().map(CircuitState::decode).unwrap_or_default();
+        let next = transition(state);
+        if next == state {
+            return;
+        }
+        match shared_data::set(ctx, Feature::Circuit, &key, &next.encode(), cas) {
+            Ok(()) => {
+                crate::metrics::set_backend_gauge(crate::metrics::EXPORT_CIRCUIT_STATE, backend, next.gauge());
+                return;
+            }
+            Err(Status::CasMismatch) => continue,
+            Err(_) => return,
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_state_round_trip() {
+        let state = CircuitState {
+            failures: 7,
+            open_until_ms: 1_700_000_000_000,
+            half_open: true,
+        };
+        assert_eq!(CircuitState::decode(&state.encode()), state);
+        assert_eq!(CircuitState::decode(b"short"), CircuitState::default());
+    }
+
+    #[test]
+    fn test_opens_after_threshold() {
+        let mut state = CircuitState::default();
+        for _ in 0..2 {
+            state = on_failure(state, 1_000, 3, 500);
+            assert_eq!(state.open_until_ms, 0);
+        }
+        state = on_failure(state, 1_000, 3, 500);
+        assert_eq!(state.open_until_ms, 1_500);
+        assert_eq!(state.gauge(), GAUGE_OPEN);
+
+        assert_eq!(on_dispatch(state, 1_200, 500), (false, None));
+    }
+
+    #[test]
+    fn test_half_open_probe() {
+        let open = CircuitState {
+            failures: 3,
+            open_until_ms: 1_500,
+            half_open: false,
+        };
+        let (allowed, next) = on_dispatch(open, 1_600, 500);
+        assert!(allowed);
+        let probing = next.unwrap();
+        assert!(probing.half_open);
+        assert_eq!(probing.open_until_ms, 2_100);
+        assert_eq!(probing.gauge(), GAUGE_HALF_OPEN);
+
+        // Other dispatches wait while the probe is out
+        assert_eq!(on_dispatch(probing, 1_700, 500), (false, None));
+
+        // A failed probe reopens at once, regardless of the threshold
+        let reopened = on_failure(probing, 1_800, 100, 500);
+        assert!(!reopened.half_open);
+        assert_eq!(reopened.open_until_ms, 2_300);
+    }
+
+    #[test]
+    fn test_closed_circuit_allows() {
+        assert_eq!(on_dispatch(CircuitState::default(), 1_000, 500), (true, None));
+    }
+}
@@ -1,5 +1,11 @@
+use base64::{engine::general_purpose, Engine as _};
 use serde_json;
 
+use crate::http_helpers::{HeaderPredicate, StatusCodePattern};
+use crate::sink::SinkConfig;
+use crate::tee::TeeConfig;
+use crate::span_name::{default_segment_patterns, SegmentPattern, SpanNameTemplate};
+
 #[derive(Debug, Clone)]
 pub struct CollectionRule {
     pub http: HttpCollectionRule,
@@ -28,6 +34,210 @@ pub struct ExemptionRule {
     pub path_patterns: Vec<String>,
 }
 
+/// What to do when the export retry queue is full
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum OverflowPolicy {
+    DropOldest,
+    DropNewest,
+}
+
+/// Content encoding applied to export payloads
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum Compression {
+    None,
+    Gzip,
+}
+
+/// Wire protocol used to send batches to the backend
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum ExportProtocol {
+    HttpProtobuf,
+    Grpc,
+}
+
+/// How the status and duration capture filters combine when both are configured
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum FilterCombine {
+    And,
+    Or,
+}
+
+/// Which side of the sidecar is recorded
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum CaptureDirection {
+    Inbound,
+    Outbound,
+    Both,
+}
+
+impl CaptureDirection {
+    /// Whether a detected traffic direction ("inbound", "outbound", "auto") is captured.
+    /// An undetermined direction is only captured in Both mode.
+    pub fn allows(&self, traffic_direction: &str) -> bool {
+        match self {
+            CaptureDirection::Both => true,
+            CaptureDirection::Inbound => traffic_direction == "inbound",
+            CaptureDirection::Outbound => traffic_direction == "outbound",
+        }
+    }
+}
+
+/// Where captured bodies are exported
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum BodyExport {
+    Attribute,  // Inline span attributes
+    Log,  // OTLP log records linked to the span
+}
+
+/// Where span timestamps come from
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum TimestampSource {
+    Wall,  // The wall clock at request start, per exchange
+    MonotonicAnchored,  // One wall-clock anchor per export batch plus monotonic offsets
+}
+
+/// Digest recorded as sp.request.body_hash
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum BodyHashAlgorithm {
+    Sha256,
+    XxHash,  // XXH3 64-bit: much cheaper, not collision resistant
+}
+
+impl BodyHashAlgorithm {
+    /// Value recorded as sp.request.body_hash_algorithm
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            BodyHashAlgorithm::Sha256 => "sha256",
+            BodyHashAlgorithm::XxHash => "xxhash",
+        }
+    }
+}
+
+/// Base64 alphabet for non-text bodies stored as span attributes or log records
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum BinaryBodyEncoding {
+    Std,  // RFC 4648 section 4: + and /
+    Url,  // RFC 4648 section 5: - and _, for ingest that rejects + and /
+}
+
+impl BinaryBodyEncoding {
+    pub fn encode(&self, bytes: &[u8]) -> String {
+        match self {
+            BinaryBodyEncoding::Std => general_purpose::STANDARD.encode(bytes),
+            BinaryBodyEncoding::Url => general_purpose::URL_SAFE.encode(bytes),
+        }
+    }
+
+    /// Value recorded as sp.body.encoding
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            BinaryBodyEncoding::Std => "base64",
+            BinaryBodyEncoding::Url => "base64url",
+        }
+    }
+}
+
+/// Plugin log line format
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum LogFormat {
+    Text,
+    Json,
+}
+
+/// A protoSchemas entry: the descriptor set used for paths matching the glob. Message
+/// types come from requestType/responseType, or from the gRPC method named by the path.
+#[derive(Clone, PartialEq)]
+pub struct ProtoSchema {
+    pub path_pattern: String,
+    pub descriptor_set: Vec<u8>,
+    pub request_type: Option<String>,
+    pub response_type: Option<String>,
+}
+
+impl std::fmt::Debug for ProtoSchema {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("ProtoSchema")
+            .field("path_pattern", &self.path_pattern)
+            .field("descriptor_set_bytes", &self.descriptor_set.len())
+            .field("request_type", &self.request_type)
+            .field("response_type", &self.response_type)
+            .finish()
+    }
+}
+
+/// Backend authentication injected on every export request.
+/// Credential values are never logged; Debug output masks them.
+#[derive(Clone, Default, PartialEq)]
+pub struct AuthConfig {
+    pub enabled: bool,
+    pub bearer_token: String,
+    pub api_key_header: String,
+    pub api_key_value: String,
+    pub metadata_key: String,  // Envoy node metadata key holding the credential, re-read on each export
+}
+
+impl std::fmt::Debug for AuthConfig {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let mask = |v: &str| if v.is_empty() { "" } else { "****" };
+        f.debug_struct("AuthConfig")
+            .field("enabled", &self.enabled)
+            .field("bearer_token", &mask(&self.bearer_token))
+            .field("api_key_header", &self.api_key_header)
+            .field("api_key_value", &mask(&self.api_key_value))
+            .field("metadata_key", &self.metadata_key)
+            .finish()
+    }
+}
+
+impl AuthConfig {
+    /// Header to inject, using the metadata credential when present and the static one otherwise
+    pub fn header(&self, metadata_value: Option<&str>) -> Option<(String, String)> {
+        if !self.enabled {
+            return None;
+        }
+        let static_value = if self.api_key_header.is_empty() {
+            &self.bearer_token
+        } else {
+            &self.api_key_value
+        };
+        let credential = metadata_value.filter(|v| !v.is_empty()).unwrap_or(static_value);
+        if credential.is_empty() {
+            return None;
+        }
+
+        if self.api_key_header.is_empty() {
+            Some(("authorization".to_string(), format!("Bearer {}", credential)))
+        } else {
+            Some((self.api_key_header.clone(), credential.to_string()))
+        }
+    }
+
+    /// Check that an enabled auth block can produce a credential
+    pub fn validate(&self, metadata_value: Option<&str>) -> Result<(), String> {
+        if self.enabled && self.header(metadata_value).is_none() {
+            let field = if self.api_key_header.is_empty() { "auth.bearerToken" } else { "auth.apiKeyValue" };
+            return Err(format!(
+                "auth is enabled but the credential is empty: set {} or point auth.metadataKey at a non-empty node metadata value",
+                field
+            ));
+        }
+        Ok(())
+    }
+}
+
+/// Name of the backend built from the top-level backendUrl/auth/compression
+pub const DEFAULT_BACKEND_NAME: &str = "default";
+
+/// One export destination. Every batch goes to each backend, with its own auth,
+/// compression, retries and circuit breaker.
+#[derive(Debug, Clone, PartialEq)]
+pub struct BackendConfig {
+    pub name: String,  // Label for stats and logs
+    pub url: String,
+    pub auth: AuthConfig,
+    pub compression: Compression,
+}
+
 impl Default for ExemptionRule {
     fn default() -> Self {
         Self {
@@ -47,6 +257,267 @@ impl Default for ExemptionRule {
     }
 }
 
+/// Session id headers consulted when sessionIdHeaders is not configured
+pub fn default_session_id_headers() -> Vec<String> {
+    vec!["x-sp-session-id".to_string(), "sp_session_id".to_string(), "x-session-id".to_string()]
+}
+
+/// Headers left out of captures with stripHopByHopHeaders, when hopByHopHeaders is not
+/// configured: the RFC 9110 section 7.6.1 hop-by-hop set, plus the legacy Proxy-Connection
+/// and the RFC 2616 spelling Trailers
+pub fn default_hop_by_hop_headers() -> Vec<String> {
+    [
+        "connection",
+        "keep-alive",
+        "proxy-connection",
+        "proxy-authenticate",
+        "proxy-authorization",
+        "te",
+        "trailer",
+        "trailers",
+        "transfer-encoding",
+        "upgrade",
+    ]
+    .iter()
+    .map(|name| name.to_string())
+    .collect()
+}
+
+fn parse_auth_block(auth_json: &serde_json::Map<String, serde_json::Value>) -> AuthConfig {
+    let get_str = |key: &str| {
+        auth_json
+            .get(key)
+            .and_then(|v| v.as_str())
+            .map(|v| v.trim().to_string())
+            .unwrap_or_default()
+    };
+    AuthConfig {
+        enabled: auth_json.get("enabled").and_then(|v| v.as_bool()).unwrap_or(true),
+        bearer_token: get_str("bearerToken"),
+        api_key_header: get_str("apiKeyHeader").to_ascii_lowercase(),
+        api_key_value: get_str("apiKeyValue"),
+        metadata_key: get_str("metadataKey"),
+    }
+}
+
+fn parse_compression_value(value: &str) -> Option<Compression> {
+    match value.trim().to_ascii_lowercase().as_str() {
+        "none" => Some(Compression::None),
+        "gzip" => Some(Compression::Gzip),
+        _ => None,
+    }
+}
+
+/// Stat-safe backend name from its URL host, e.g. `collector_team_svc` for
+/// `http://collector.team.svc:4318`; `backend-<i>` when there is no host
+fn backend_name_from_url(url: &str, index: usize) -> String {
+    let host = url.split("://").nth(1).unwrap_or("").split(|c| c == '/' || c == ':').next().unwrap_or("");
+    if host.is_empty() {
+        return format!("backend-{}", index);
+    }
+    host.chars().map(|c| if c.is_ascii_alphanumeric() || c == '-' { c } else { '_' }).collect()
+}
+
+/// Type problems of one `backends` entry, named by its position
+fn backend_entry_problems(index: usize, entry: &serde_json::Value) -> Vec<String> {
+    let entry = match entry.as_object() {
+        Some(entry) => entry,
+        None => return vec![format!("backends[{}] must be an object, got {}", index, entry)],
+    };
+    let mut problems = Vec::new();
+    if !entry.get("url").map_or(false, |v| v.is_string()) {
+        problems.push(format!("backends[{}].url must be a string", index));
+    }
+    for (key, kind) in [("name", JsonKind::String), ("auth", JsonKind::Object), ("compression", JsonKind::String)] {
+        match entry.get(key) {
+            Some(value) if !value.is_null() && !kind.matches(value) => {
+                problems.push(format!("backends[{}].{} must be {}, got {}", index, key, kind.describe(), value));
+            }
+            _ => {}
+        }
+    }
+    if let Some(compression) = entry.get("compression").and_then(|v| v.as_str()) {
+        if parse_compression_value(compression).is_none() {
+            problems.push(format!("backends[{}].compression must be one of none, gzip, got \"{}\"", index, compression));
+        }
+    }
+    problems
+}
+
+/// Default cap on captured request body bytes (64 KiB)
+pub const DEFAULT_MAX_REQUEST_BODY_BYTES: usize = 64 * 1024;
+pub const DEFAULT_MAX_RESPONSE_BODY_BYTES: usize = 1024 * 1024;
+pub const DEFAULT_MAX_BAGGAGE_VALUE_BYTES: usize = 256;
+pub const DEFAULT_BATCH_MAX_SPANS: usize = 100;
+pub const DEFAULT_BATCH_MAX_BYTES: usize = 512 * 1024;
+pub const DEFAULT_BATCH_FLUSH_INTERVAL_MS: u64 = 1000;
+pub const DEFAULT_MAX_EXPORT_RETRIES: u32 = 3;
+pub const DEFAULT_RETRY_BACKOFF_MS: u64 = 500;
+pub const DEFAULT_RETRY_MAX_BACKOFF_MS: u64 = 30_000;
+pub const DEFAULT_MAX_QUEUED_BATCHES: usize = 64;
+pub const DEFAULT_CIRCUIT_FAILURE_THRESHOLD: u32 = 5;
+pub const DEFAULT_CIRCUIT_OPEN_MS: u64 = 30_000;
+pub const DEFAULT_SESSION_IDLE_MS: u64 = 30 * 60 * 1000;
+pub const DEFAULT_MAX_SESSIONS: u64 = 10_000;
+pub const DEFAULT_MAX_QUERY_PARAMS: usize = 32;
+pub const DEFAULT_MAX_FORM_FIELDS: usize = 32;
+pub const DEFAULT_MAX_TENANT_BUCKETS: u64 = 1024;
+pub const DEFAULT_MAX_SPANS_PER_TRACE: u64 = 1000;
+pub const DEFAULT_MAX_SPAN_LINKS: usize = 32;
+pub const DEFAULT_MAX_SPAN_EVENTS: usize = 8;
+pub const DEFAULT_FLUSH_ENDPOINT_PATH: &str = "/__sp_flush";
+pub const DEFAULT_EXPORT_PATH_TEMPLATE: &str = "/api/tenants/{tenant}/v1/traces";
+pub const DEFAULT_PROTO_DESCRIPTOR_CACHE_SIZE: usize = 8;
+
+/// JSON type a config key must have; `validate` reports keys of another type, which the
+/// parsers would otherwise skip silently
+#[derive(Debug, Clone, Copy)]
+enum JsonKind {
+    Bool,
+    UInt,
+    Number,
+    String,
+    Array,
+    Object,
+}
+
+impl JsonKind {
+    fn matches(&self, value: &serde_json::Value) -> bool {
+        match self {
+            JsonKind::Bool => value.is_boolean(),
+            JsonKind::UInt => value.is_u64(),
+            JsonKind::Number => value.is_number(),
+            JsonKind::String => value.is_string(),
+            JsonKind::Array => value.is_array(),
+            JsonKind::Object => value.is_object(),
+        }
+    }
+
+    fn describe(&self) -> &'static str {
+        match self {
+            JsonKind::Bool => "true or false",
+            JsonKind::UInt => "a non-negative integer",
+            JsonKind::Number => "a number",
+            JsonKind::String => "a string",
+            JsonKind::Array => "a list",
+            JsonKind::Object => "an object",
+        }
+    }
+}
+
+const CONFIG_KEY_KINDS: &[(&str, JsonKind)] = &[
+    ("auth", JsonKind::Object),
+    ("backendTlsSkipVerify", JsonKind::Bool),
+    ("backendUrl", JsonKind::String),
+    ("batchFlushIntervalMs", JsonKind::UInt),
+    ("batchMaxBytes", JsonKind::UInt),
+    ("backends", JsonKind::Array),
+    ("batchMaxSpans", JsonKind::UInt),
+    ("binaryBodyEncoding", JsonKind::String),
+    ("bodyExport", JsonKind::String),
+    ("bodyHashAlgorithm", JsonKind::String),
+    ("bodyPreviewBytes", JsonKind::UInt),
+    ("captureBaggageKeys", JsonKind::Array),
+    ("captureBodyHash", JsonKind::Bool),
+    ("captureBodyMaxContentLength", JsonKind::UInt),
+    ("captureDirection", JsonKind::String),
+    ("captureGrpcWeb", JsonKind::Bool),
+    ("captureHeaderStats", JsonKind::Bool),
+    ("captureHost", JsonKind::Bool),
+    ("captureHostExclude", JsonKind::Array),
+    ("captureIfHeader", JsonKind::Array),
+    ("captureMethods", JsonKind::Array),
+    ("captureMtlsIdentity", JsonKind::Bool),
+    ("capturePaths", JsonKind::Array),
+    ("captureResponseHeaders", JsonKind::Array),
+    ("captureServerTiming", JsonKind::Bool),
+    ("captureSpanEvents", JsonKind::Bool),
+    ("captureStatusCodes", JsonKind::Array),
+    ("captureTlsInfo", JsonKind::Bool),
+    ("captureTrailers", JsonKind::Array),
+    ("circuitFailureThreshold", JsonKind::UInt),
+    ("circuitOpenMs", JsonKind::UInt),
+    ("collectionRules", JsonKind::Object),
+    ("compression", JsonKind::String),
+    ("decodeProtobuf", JsonKind::Bool),
+    ("dedupWindowMs", JsonKind::UInt),
+    ("defaultTenant", JsonKind::String),
+    ("disableCaptureHeader", JsonKind::String),
+    ("dryRun", JsonKind::Bool),
+    ("enableFlushEndpoint", JsonKind::Bool),
+    ("exemptionRules", JsonKind::Array),
+    ("exportPathTemplate", JsonKind::String),
+    ("exportProtocol", JsonKind::String),
+    ("filterCombine", JsonKind::String),
+    ("flushEndpointPath", JsonKind::String),
+    ("heartbeatIntervalMs", JsonKind::UInt),
+    ("hopByHopHeaders", JsonKind::Array),
+    ("ignorePaths", JsonKind::Array),
+    ("injectSessionId", JsonKind::Bool),
+    ("keepHeader", JsonKind::String),
+    ("linkHeaders", JsonKind::Array),
+    ("logFormat", JsonKind::String),
+    ("maxAttributeValueBytes", JsonKind::UInt),
+    ("maxBaggageValueBytes", JsonKind::UInt),
+    ("maxExportRetries", JsonKind::UInt),
+    ("maxFormFields", JsonKind::UInt),
+    ("maxQueryParams", JsonKind::UInt),
+    ("maxQueuedBatches", JsonKind::UInt),
+    ("maxRequestBodyBytes", JsonKind::UInt),
+    ("maxResponseBodyBytes", JsonKind::UInt),
+    ("maxSessions", JsonKind::UInt),
+    ("maxSpanEvents", JsonKind::UInt),
+    ("maxSpanLinks", JsonKind::UInt),
+    ("maxSpansPerTrace", JsonKind::UInt),
+    ("maxTenantBuckets", JsonKind::UInt),
+    ("minDurationMs", JsonKind::UInt),
+    ("overflowPolicy", JsonKind::String),
+    ("perTenantExportBurst", JsonKind::UInt),
+    ("perTenantExportRate", JsonKind::Number),
+    ("propagators", JsonKind::Array),
+    ("protoDescriptorCacheSize", JsonKind::UInt),
+    ("protoSchemas", JsonKind::Object),
+    ("public_key", JsonKind::String),
+    ("redactHeaders", JsonKind::Array),
+    ("redactJsonPaths", JsonKind::Array),
+    ("redactQueryParams", JsonKind::Array),
+    ("resourceAttributes", JsonKind::Object),
+    ("responseBodyContentTypes", JsonKind::Array),
+    ("retryBackoffMs", JsonKind::UInt),
+    ("retryMaxBackoffMs", JsonKind::UInt),
+    ("sampleRate", JsonKind::Number),
+    ("service_name", JsonKind::String),
+    ("sessionIdHeaders", JsonKind::Array),
+    ("sessionIdInjectHeader", JsonKind::String),
+    ("sessionIdleMs", JsonKind::UInt),
+    ("sessionSeqHeader", JsonKind::String),
+    ("sessionSequence", JsonKind::Bool),
+    ("sink", JsonKind::Object),
+    ("sp_backend_url", JsonKind::String),
+    ("spanNameTemplate", JsonKind::Object),
+    ("stripHopByHopHeaders", JsonKind::Bool),
+    ("synthesizeSessionId", JsonKind::Bool),
+    ("tee", JsonKind::Object),
+    ("tenantHeader", JsonKind::String),
+    ("timestampSource", JsonKind::String),
+    ("traffic_direction", JsonKind::String),
+    ("xffTrustHops", JsonKind::UInt),
+];
+
+/// Accepted values of the enum-like keys, lowercase
+const CONFIG_KEY_VALUES: &[(&str, &[&str])] = &[
+    ("binaryBodyEncoding", &["std", "url"]),
+    ("bodyExport", &["attribute", "log"]),
+    ("bodyHashAlgorithm", &["sha256", "xxhash"]),
+    ("captureDirection", &["inbound", "outbound", "both"]),
+    ("compression", &["none", "gzip"]),
+    ("exportProtocol", &["http/protobuf", "grpc"]),
+    ("filterCombine", &["and", "or"]),
+    ("logFormat", &["text", "json"]),
+    ("overflowPolicy", &["drop-oldest", "drop-newest"]),
+    ("timestampSource", &["wall", "monotonic-anchored"]),
+];
+
 #[derive(Debug, Clone)]
 pub struct Config {
     pub sp_backend_url: String,
@@ -55,6 +526,97 @@ pub struct Config {
     pub collection_rules: Vec<CollectionRule>,
     pub exemption_rules: Vec<ExemptionRule>,
     pub public_key: String,
+    pub max_request_body_bytes: usize,
+    pub capture_body_max_content_length: u64,  // 0 disables the content-length check
+    pub response_body_content_types: Vec<String>,
+    pub redact_headers: Vec<String>,
+    pub redact_json_paths: Vec<String>,
+    pub sample_rate: f64,
+    pub propagators: Vec<String>,
+    pub capture_baggage_keys: Vec<String>,
+    pub max_baggage_value_bytes: usize,
+    pub batch_max_spans: usize,
+    pub batch_max_bytes: usize,
+    pub batch_flush_interval_ms: u64,
+    pub max_export_retries: u32,
+    pub retry_backoff_ms: u64,
+    pub retry_max_backoff_ms: u64,
+    pub max_queued_batches: usize,
+    pub overflow_policy: OverflowPolicy,
+    pub compression: Compression,
+    pub auth: AuthConfig,
+    pub tenant_header: String,
+    pub default_tenant: String,
+    pub capture_grpc_web: bool,
+    pub capture_paths: Vec<String>,
+    pub ignore_paths: Vec<String>,
+    pub capture_methods: Vec<String>,
+    pub capture_status_codes: Vec<StatusCodePattern>,
+    pub min_duration_ms: Option<u64>,
+    pub filter_combine: FilterCombine,
+    pub log_format: LogFormat,
+    pub capture_direction: CaptureDirection,
+    pub dedup_window_ms: u64,  // 0 disables deduplication
+    pub xff_trust_hops: usize,  // 0 ignores x-forwarded-for
+    pub capture_if_header: Vec<HeaderPredicate>,  // Any match bypasses sampleRate
+    pub disable_capture_header: String,  // Empty turns the kill switch off
+    pub span_name_template: Option<SpanNameTemplate>,  // None keeps the raw path as the span name
+    pub body_export: BodyExport,
+    pub sink: Option<SinkConfig>,  // Write spans locally as NDJSON
+    pub max_form_fields: usize,  // 0 keeps form bodies as one opaque body
+    pub keep_header: String,  // Response header that overrides sampling; empty turns it off
+    pub capture_mtls_identity: bool,  // Record the downstream peer's URI SAN
+    pub heartbeat_interval_ms: u64,  // 0 disables heartbeat spans
+    pub per_tenant_export_rate: f64,  // Spans per second per tenant; 0 disables the limit
+    pub per_tenant_export_burst: u64,  // 0: one second's worth of spans
+    pub max_tenant_buckets: u64,
+    pub max_attribute_value_bytes: usize,  // 0 leaves attribute values uncapped
+    pub backends: Vec<BackendConfig>,  // Empty: export to backendUrl only
+    pub tee: Option<TeeConfig>,  // Mirror captured requests to a capture endpoint
+    pub capture_trailers: Vec<String>,
+    pub capture_header_stats: bool,
+    pub capture_server_timing: bool,
+    pub max_spans_per_trace: u64,  // 0 disables the cap
+    pub body_preview_bytes: usize,  // 0 disables previews
+    pub dry_run: bool,
+    pub backend_tls_skip_verify: bool,  // Always rejected by validate; kept so the key is not silently ignored
+    pub redact_query_params: Vec<String>,
+    pub max_query_params: usize,
+    pub session_id_headers: Vec<String>,
+    pub synthesize_session_id: bool,
+    pub inject_session_id: bool,
+    pub session_id_inject_header: String,
+    pub session_sequence: bool,
+    pub session_seq_header: String,  // Empty: the sequence number is not forwarded
+    pub session_idle_ms: u64,  // 0: sequences never restart
+    pub max_sessions: u64,
+    pub resource_attributes: Vec<(String, String)>,
+    pub workload_name: Option<String>,  // From Istio node metadata at configure time, not a config key
+    pub plugin_name: String,  // From the plugin_name property at configure time, not a config key
+    pub export_protocol: ExportProtocol,
+    pub decode_protobuf: bool,
+    pub proto_schemas: Vec<ProtoSchema>,
+    pub proto_descriptor_cache_size: usize,
+    pub max_response_body_bytes: usize,  // Bounds the buffered and decompressed response body
+    pub circuit_failure_threshold: u32,  // 0 disables the export circuit breaker
+    pub circuit_open_ms: u64,
+    pub binary_body_encoding: BinaryBodyEncoding,
+    pub capture_host: bool,  // Record the request authority as server.address / sp.http.host
+    pub capture_host_exclude: Vec<String>,  // Host globs whose authority is left off the span
+    pub link_headers: Vec<String>,  // Request headers carrying traceparent values to link; empty: no links
+    pub max_span_links: usize,
+    pub enable_flush_endpoint: bool,  // Test aid: requests to flush_endpoint_path flush the export batch
+    pub flush_endpoint_path: String,
+    pub capture_response_headers: Vec<String>,  // Response header names (or prefix*) exported; empty: all
+    pub timestamp_source: TimestampSource,
+    pub capture_body_hash: bool,  // Record sp.request.body_hash over the full wire body
+    pub body_hash_algorithm: BodyHashAlgorithm,
+    pub strip_hop_by_hop_headers: bool,  // Leave hop_by_hop_headers out of captured headers
+    pub hop_by_hop_headers: Vec<String>,  // Lowercase names (or prefix*)
+    pub capture_tls_info: bool,  // Record the downstream connection's SNI and ALPN protocol
+    pub capture_span_events: bool,  // Redirects and auth challenges become span events
+    pub max_span_events: usize,
+    pub export_path_template: String,  // Backend path with {tenant} and {service} placeholders
 }
 
 impl Default for Config {
@@ -66,6 +628,97 @@ impl Default for Config {
             collection_rules: vec![],
             exemption_rules: vec![],
             public_key: String::new(),
+            max_request_body_bytes: DEFAULT_MAX_REQUEST_BODY_BYTES,
+            capture_body_max_content_length: 0,
+            response_body_content_types: vec![],
+            redact_headers: vec![],
+            redact_json_paths: vec![],
+            sample_rate: 1.0,
+            propagators: vec!["tracecontext".to_string()],
+            capture_baggage_keys: vec![],
+            max_baggage_value_bytes: DEFAULT_MAX_BAGGAGE_VALUE_BYTES,
+            batch_max_spans: DEFAULT_BATCH_MAX_SPANS,
+            batch_max_bytes: DEFAULT_BATCH_MAX_BYTES,
+            batch_flush_interval_ms: DEFAULT_BATCH_FLUSH_INTERVAL_MS,
+            max_export_retries: DEFAULT_MAX_EXPORT_RETRIES,
+            retry_backoff_ms: DEFAULT_RETRY_BACKOFF_MS,
+            retry_max_backoff_ms: DEFAULT_RETRY_MAX_BACKOFF_MS,
+            max_queued_batches: DEFAULT_MAX_QUEUED_BATCHES,
+            overflow_policy: OverflowPolicy::DropOldest,
+            compression: Compression::None,
+            auth: AuthConfig::default(),
+            tenant_header: "x-tenant-id".to_string(),
+            default_tenant: String::new(),
+            capture_grpc_web: false,
+            capture_paths: vec![],
+            ignore_paths: vec!["/health".to_string(), "/metrics".to_string()],
+            capture_methods: vec![],
+            capture_status_codes: vec![],
+            min_duration_ms: None,
+            filter_combine: FilterCombine::Or,
+            log_format: LogFormat::Text,
+            capture_direction: CaptureDirection::Both,
+            dedup_window_ms: 0,
+            xff_trust_hops: 0,
+            capture_if_header: vec![],
+            disable_capture_header: "x-sp-disable-capture".to_string(),
+            span_name_template: None,
+            body_export: BodyExport::Attribute,
+            sink: None,
+            max_form_fields: DEFAULT_MAX_FORM_FIELDS,
+            keep_header: "x-sp-keep".to_string(),
+            capture_mtls_identity: false,
+            heartbeat_interval_ms: 0,
+            per_tenant_export_rate: 0.0,
+            per_tenant_export_burst: 0,
+            max_tenant_buckets: DEFAULT_MAX_TENANT_BUCKETS,
+            max_attribute_value_bytes: 0,
+            backends: vec![],
+            tee: None,
+            capture_trailers: vec![],
+            capture_header_stats: true,
+            capture_server_timing: false,
+            max_spans_per_trace: DEFAULT_MAX_SPANS_PER_TRACE,
+            body_preview_bytes: 0,
+            dry_run: false,
+            backend_tls_skip_verify: false,
+            redact_query_params: vec![],
+            max_query_params: DEFAULT_MAX_QUERY_PARAMS,
+            session_id_headers: default_session_id_headers(),
+            synthesize_session_id: false,
+            inject_session_id: false,
+            session_id_inject_header: "x-sp-session-id".to_string(),
+            session_sequence: false,
+            session_seq_header: String::new(),
+            session_idle_ms: DEFAULT_SESSION_IDLE_MS,
+            max_sessions: DEFAULT_MAX_SESSIONS,
+            resource_attributes: vec![],
+            workload_name: None,
+            plugin_name: String::new(),
+            export_protocol: ExportProtocol::HttpProtobuf,
+            decode_protobuf: false,
+            proto_schemas: vec![],
+            proto_descriptor_cache_size: DEFAULT_PROTO_DESCRIPTOR_CACHE_SIZE,
+            max_response_body_bytes: DEFAULT_MAX_RESPONSE_BODY_BYTES,
+            circuit_failure_threshold: DEFAULT_CIRCUIT_FAILURE_THRESHOLD,
+            circuit_open_ms: DEFAULT_CIRCUIT_OPEN_MS,
+            binary_body_encoding: BinaryBodyEncoding::Std,
+            capture_host: true,
+            capture_host_exclude: vec![],
+            link_headers: vec![],
+            max_span_links: DEFAULT_MAX_SPAN_LINKS,
+            enable_flush_endpoint: false,
+            flush_endpoint_path: DEFAULT_FLUSH_ENDPOINT_PATH.to_string(),
+            capture_response_headers: vec![],
+            timestamp_source: TimestampSource::Wall,
+            capture_body_hash: false,
+            body_hash_algorithm: BodyHashAlgorithm::Sha256,
+            strip_hop_by_hop_headers: true,
+            hop_by_hop_headers: default_hop_by_hop_headers(),
+            capture_tls_info: false,
+            capture_span_events: false,
+            max_span_events: DEFAULT_MAX_SPAN_EVENTS,
+            export_path_template: DEFAULT_EXPORT_PATH_TEMPLATE.to_string(),
         }
     }
 }
@@ -80,16 +733,195 @@ impl Config {
                 self.parse_public_key(&config_json);
                 self.parse_collection_rules(&config_json);
                 self.parse_exemption_rules(&config_json);
+                self.parse_body_limits(&config_json);
+                self.parse_response_body_content_types(&config_json);
+                self.parse_redact_headers(&config_json);
+                self.parse_redact_json_paths(&config_json);
+                self.parse_sample_rate(&config_json);
+                self.parse_propagators(&config_json);
+                self.parse_baggage(&config_json);
+                self.parse_batching(&config_json);
+                self.parse_export_retries(&config_json);
+                self.parse_export_queue(&config_json);
+                self.parse_compression(&config_json);
+                self.parse_auth(&config_json);
+                self.parse_tenant(&config_json);
+                self.parse_capture_grpc_web(&config_json);
+                self.parse_capture_paths(&config_json);
+                self.parse_capture_methods(&config_json);
+                self.parse_capture_status_codes(&config_json);
+                self.parse_capture_duration(&config_json);
+                self.parse_log_format(&config_json);
+                self.parse_capture_direction(&config_json);
+                self.parse_dedup_window(&config_json);
+                self.parse_capture_trailers(&config_json);
+                self.parse_capture_header_stats(&config_json);
+                self.parse_body_preview(&config_json);
+                self.parse_dry_run(&config_json);
+                self.parse_query_params(&config_json);
+                self.parse_session_id(&config_json);
+                self.parse_resource_attributes(&config_json);
+                self.parse_export_protocol(&config_json);
+                self.parse_protobuf_decoding(&config_json);
+                self.parse_circuit_breaker(&config_json);
+                self.parse_xff_trust_hops(&config_json);
+                self.parse_capture_if_header(&config_json);
+                self.parse_disable_capture_header(&config_json);
+                self.parse_span_name_template(&config_json);
+                self.parse_body_export(&config_json);
+                self.parse_sink(&config_json);
+                self.parse_max_form_fields(&config_json);
+                self.parse_keep_header(&config_json);
+                self.parse_capture_mtls_identity(&config_json);
+                self.parse_heartbeat(&config_json);
+                self.parse_tenant_rate_limit(&config_json);
+                self.parse_max_attribute_value_bytes(&config_json);
+                self.parse_backends(&config_json);
+                self.parse_tee(&config_json);
+                self.parse_capture_server_timing(&config_json);
+                self.parse_max_spans_per_trace(&config_json);
+                self.parse_binary_body_encoding(&config_json);
+                self.parse_capture_host(&config_json);
+                self.parse_span_links(&config_json);
+                self.parse_flush_endpoint(&config_json);
+                self.parse_capture_response_headers(&config_json);
+                self.parse_timestamp_source(&config_json);
+                self.parse_body_hash(&config_json);
+                self.parse_hop_by_hop_headers(&config_json);
+                self.parse_capture_tls_info(&config_json);
+                self.parse_span_events(&config_json);
+                self.parse_export_path_template(&config_json);
                 return true;
             }
         }
         false
     }
 
+    /// Check the plugin configuration as written and as parsed. Parsers skip values they
+    /// cannot use, so this pass reports them instead, every problem at once.
+    pub fn validate(&self, config_bytes: &[u8]) -> Result<(), Vec<String>> {
+        let mut problems = Vec::new();
+
+        if !config_bytes.is_empty() {
+            match serde_json::from_slice::<serde_json::Value>(config_bytes) {
+                Ok(serde_json::Value::Object(config_json)) => {
+                    for (key, kind) in CONFIG_KEY_KINDS {
+                        match config_json.get(*key) {
+                            Some(value) if !value.is_null() && !kind.matches(value) => {
+                                problems.push(format!("{} must be {}, got {}", key, kind.describe(), value));
+                            }
+                            _ => {}
+                        }
+                    }
+                    for (key, allowed) in CONFIG_KEY_VALUES {
+                        if let Some(value) = config_json.get(*key).and_then(|v| v.as_str()) {
+                            if !allowed.contains(&value.trim().to_ascii_lowercase().as_str()) {
+                                problems.push(format!("{} must be one of {}, got \"{}\"", key, allowed.join(", "), value));
+                            }
+                        }
+                    }
+                    for (i, entry) in config_json.get("backends").and_then(|v| v.as_array()).into_iter().flatten().enumerate() {
+                        problems.extend(backend_entry_problems(i, entry));
+                    }
+                    for key in ["batchMaxSpans", "batchMaxBytes", "batchFlushIntervalMs", "maxQueuedBatches"] {
+                        if config_json.get(key).and_then(|v| v.as_u64()) == Some(0) {
+                            problems.push(format!("{} must be greater than 0", key));
+                        }
+                    }
+                }
+                Ok(_) => problems.push("plugin configuration must be a JSON object".to_string()),
+                Err(e) => problems.push(format!("plugin configuration is not valid JSON: {}", e)),
+            }
+        }
+
+        if !self.sample_rate.is_finite() || !(0.0..=1.0).contains(&self.sample_rate) {
+            problems.push(format!("sampleRate must be between 0 and 1, got {}", self.sample_rate));
+        }
+        if !self.per_tenant_export_rate.is_finite() || self.per_tenant_export_rate < 0.0 {
+            problems.push(format!("perTenantExportRate must not be negative, got {}", self.per_tenant_export_rate));
+        }
+        if let Some(tee) = &self.tee {
+            if let Err(e) = crate::http_helpers::validate_backend_url(&tee.url) {
+                problems.push(format!("tee: {}", e));
+            }
+            if !tee.rate_per_sec.is_finite() || tee.rate_per_sec <= 0.0 {
+                problems.push(format!("tee.ratePerSec must be greater than 0, got {}", tee.rate_per_sec));
+            }
+        }
+        if self.retry_backoff_ms > self.retry_max_backoff_ms {
+            problems.push(format!(
+                "retryBackoffMs ({}) must not exceed retryMaxBackoffMs ({})",
+                self.retry_backoff_ms, self.retry_max_backoff_ms
+            ));
+        }
+        for (key, patterns) in [("capturePaths", &self.capture_paths), ("ignorePaths", &self.ignore_paths)] {
+            for pattern in patterns.iter().filter(|p| !p.starts_with('/') && !p.starts_with('*')) {
+                problems.push(format!("{} entry \"{}\" never matches: paths start with / (or use a leading *)", key, pattern));
+            }
+        }
+        if self.enable_flush_endpoint && !self.flush_endpoint_path.starts_with('/') {
+            problems.push(format!("flushEndpointPath must start with /, got \"{}\"", self.flush_endpoint_path));
+        }
+        if let Err(e) = crate::http_helpers::validate_backend_url(&self.sp_backend_url) {
+            problems.push(e);
+        }
+        if self.backend_tls_skip_verify {
+            // Upstream TLS belongs to the Envoy cluster; the plugin cannot relax it on its own
+            problems.push(
+                "backendTlsSkipVerify is not supported: set tls.insecureSkipVerify on the backend's DestinationRule instead".to_string(),
+            );
+        }
+        if let Err(e) = crate::export::validate_path_template(&self.export_path_template) {
+            problems.push(format!("exportPathTemplate: {}", e));
+        } else if self.body_export == BodyExport::Log && !self.export_path_template.ends_with("traces") {
+            problems.push("exportPathTemplate must end in \"traces\" with bodyExport log, which swaps it for \"logs\"".to_string());
+        }
+        for (i, backend) in self.backends.iter().enumerate() {
+            if let Err(e) = crate::http_helpers::validate_backend_url(&backend.url) {
+                problems.push(format!("backends[{}]: {}", i, e));
+            }
+            if let Some(j) = self.backends[..i].iter().position(|other| other.url == backend.url) {
+                problems.push(format!("backends[{}] has the same url as backends[{}]: {}", i, j, backend.url));
+            } else if let Some(j) = self.backends[..i].iter().position(|other| other.name == backend.name) {
+                problems.push(format!("backends[{}] has the same name as backends[{}]: {}", i, j, backend.name));
+            }
+        }
+
+        if problems.is_empty() {
+            Ok(())
+        } else {
+            Err(problems)
+        }
+    }
+
+    /// Backends every batch is exported to: the `backends` list, or the top-level
+    /// backendUrl, auth and compression as a single backend
+    pub fn export_backends(&self) -> Vec<BackendConfig> {
+        if !self.backends.is_empty() {
+            return self.backends.clone();
+        }
+        vec![BackendConfig {
+            name: DEFAULT_BACKEND_NAME.to_string(),
+            url: self.sp_backend_url.clone(),
+            auth: self.auth.clone(),
+            compression: self.compression,
+        }]
+    }
+
     fn parse_backend_url(&mut self, config_json: &serde_json::Value) {
-        if let Some(backend_url) = config_json.get("sp_backend_url").and_then(|v| v.as_str()) {
-            self.sp_backend_url = backend_url.to_string();
-            crate::sp_info!("Configured backend URL: {}", self.sp_backend_url);
+        // backendUrl is the camelCase spelling; it wins if both are set
+        let backend_url = config_json
+            .get("backendUrl")
+            .or_else(|| config_json.get("sp_backend_url"))
+            .and_then(|v| v.as_str());
+        if let Some(backend_url) = backend_url {
+            self.sp_backend_url = backend_url.trim().to_string();
+            crate::sp_info!("Configured backend URL");
+        }
+
+        if let Some(skip_verify) = config_json.get("backendTlsSkipVerify").and_then(|v| v.as_bool()) {
+            self.backend_tls_skip_verify = skip_verify;
+            crate::sp_info!("Configured backend TLS skip verify: {}", self.backend_tls_skip_verify);
         }
     }
 
@@ -118,286 +950,2251 @@ impl Config {
         }
     }
 
-    fn parse_collection_rules(&mut self, config_json: &serde_json::Value) {
-        if let Some(rules) = config_json.get("collectionRules") {
-            let (server_paths, client_configs) = self.extract_collection_data(rules);
-            self.create_collection_rules(server_paths, client_configs);
+    fn parse_body_limits(&mut self, config_json: &serde_json::Value) {
+        // 0 means capture headers only
+        if let Some(max_bytes) = config_json.get("maxRequestBodyBytes").and_then(|v| v.as_u64()) {
+            self.max_request_body_bytes = max_bytes as usize;
+            crate::sp_info!("Configured max request body bytes: {}", self.max_request_body_bytes);
         }
-    }
 
-    fn extract_collection_data(&self, rules: &serde_json::Value) -> (Vec<String>, Vec<(String, Vec<String>)>) {
-        let mut server_paths = Vec::new();
-        let mut client_configs = Vec::new();
+        // Checked against content-length before any body chunk is read
+        if let Some(max_len) = config_json.get("captureBodyMaxContentLength").and_then(|v| v.as_u64()) {
+            self.capture_body_max_content_length = max_len;
+            crate::sp_info!("Configured capture body max content length: {}", self.capture_body_max_content_length);
+        }
 
-        // Extract server paths
-        if let Some(server_obj) = rules.get("http").and_then(|v| v.get("server")) {
-            if let Some(server_array) = server_obj.as_array() {
-                for server_entry in server_array {
-                    if let Some(path) = server_entry.get("path").and_then(|v| v.as_str()) {
-                        server_paths.push(path.to_string());
-                    }
-                }
-            }
+        if let Some(max_bytes) = config_json.get("maxResponseBodyBytes").and_then(|v| v.as_u64()) {
+            self.max_response_body_bytes = max_bytes as usize;
+            crate::sp_info!("Configured max response body bytes: {}", self.max_response_body_bytes);
         }
+    }
 
-        // Extract client configs
-        if let Some(client_obj) = rules.get("http").and_then(|v| v.get("client")) {
-            if let Some(client_array) = client_obj.as_array() {
-                for client_entry in client_array {
-                    if let Some(host) = client_entry.get("host").and_then(|v| v.as_str()) {
-                        let mut paths = Vec::new();
-                        if let Some(paths_obj) = client_entry.get("paths") {
-                            if let Some(paths_array) = paths_obj.as_array() {
-                                for path_entry in paths_array {
-                                    if let Some(path) = path_entry.as_str() {
-                                        paths.push(path.to_string());
-                                    }
-                                }
-                            }
-                        }
-                        client_configs.push((host.to_string(), paths));
-                    }
-                }
-            }
+    fn parse_response_body_content_types(&mut self, config_json: &serde_json::Value) {
+        if let Some(types_array) = config_json.get("responseBodyContentTypes").and_then(|v| v.as_array()) {
+            self.response_body_content_types = types_array
+                .iter()
+                .filter_map(|v| v.as_str())
+                .map(|v| v.trim().to_ascii_lowercase())
+                .filter(|v| !v.is_empty())
+                .collect();
+            crate::sp_info!("Configured response body content types: {:?}", self.response_body_content_types);
         }
+    }
 
-        (server_paths, client_configs)
+    fn parse_redact_headers(&mut self, config_json: &serde_json::Value) {
+        if let Some(headers_array) = config_json.get("redactHeaders").and_then(|v| v.as_array()) {
+            self.redact_headers = headers_array
+                .iter()
+                .filter_map(|v| v.as_str())
+                .map(|v| v.trim().to_ascii_lowercase())
+                .filter(|v| !v.is_empty())
+                .collect();
+            crate::sp_info!("Configured redacted headers: {:?}", self.redact_headers);
+        }
     }
 
-    fn create_collection_rules(&mut self, server_paths: Vec<String>, client_configs: Vec<(String, Vec<String>)>) {
-        // Create rules for each server path
-        for server_path in server_paths {
-            crate::sp_info!("Added server collection rule: {}", server_path);
-            self.collection_rules.push(CollectionRule {
-                http: HttpCollectionRule {
-                    server: ServerConfig {
-                        path: server_path,
-                    },
-                    client: vec![],
-                },
-            });
+    fn parse_redact_json_paths(&mut self, config_json: &serde_json::Value) {
+        if let Some(paths_array) = config_json.get("redactJsonPaths").and_then(|v| v.as_array()) {
+            self.redact_json_paths = paths_array
+                .iter()
+                .filter_map(|v| v.as_str())
+                .map(|v| v.trim().to_string())
+                .filter(|v| !v.is_empty())
+                .collect();
+            crate::sp_info!("Configured JSON redaction paths: {:?}", self.redact_json_paths);
         }
+    }
 
-        // Create rules for each client config
-        for (client_host, client_paths) in &client_configs {
-            crate::sp_info!("Added client collection rule: host={}, paths={:?}", client_host, client_paths);
-            self.collection_rules.push(CollectionRule {
-                http: HttpCollectionRule {
-                    server: ServerConfig {
-                        path: String::new(),
-                    },
-                    client: vec![ClientConfig {
-                        host: client_host.clone(),
-                        paths: client_paths.clone(),
-                    }],
-                },
-            });
+    fn parse_sample_rate(&mut self, config_json: &serde_json::Value) {
+        if let Some(sample_rate) = config_json.get("sampleRate").and_then(|v| v.as_f64()) {
+            self.sample_rate = sample_rate;
+            crate::sp_info!("Configured sample rate: {}", self.sample_rate);
         }
     }
 
-    fn parse_exemption_rules(&mut self, config_json: &serde_json::Value) {
-        if let Some(exemption_rules) = config_json.get("exemptionRules") {
-            if let Some(exemption_array) = exemption_rules.as_array() {
-                for exemption_entry in exemption_array {
-                    let (host_patterns, path_patterns) = self.extract_exemption_patterns(exemption_entry);
-                    
-                    if !path_patterns.is_empty() {
-                        crate::sp_info!("Added exemption rule: hostPatterns={:?}, pathPatterns={:?}", host_patterns, path_patterns);
-                        self.exemption_rules.push(ExemptionRule {
-                            host_patterns,
-                            path_patterns,
-                        });
+    fn parse_propagators(&mut self, config_json: &serde_json::Value) {
+        if let Some(propagators_array) = config_json.get("propagators").and_then(|v| v.as_array()) {
+            let mut propagators = Vec::new();
+            for propagator in propagators_array.iter().filter_map(|v| v.as_str()) {
+                let propagator = propagator.trim().to_ascii_lowercase();
+                match propagator.as_str() {
+                    "tracecontext" | "b3" => {
+                        if !propagators.contains(&propagator) {
+                            propagators.push(propagator);
+                        }
+                    }
+                    _ => {
+                        crate::sp_warn!("Ignoring unknown propagator: {}", propagator);
                     }
                 }
             }
-        } else {
-            // Add default exemption rule if none configured
-            let default_rule = ExemptionRule::default();
-            crate::sp_info!("Added default exemption rule: pathPatterns={:?}", default_rule.path_patterns);
-            self.exemption_rules.push(default_rule);
+            self.propagators = propagators;
+            crate::sp_info!("Configured propagators: {:?}", self.propagators);
         }
     }
 
-    fn extract_exemption_patterns(&self, exemption_entry: &serde_json::Value) -> (Vec<String>, Vec<String>) {
-        let mut host_patterns = Vec::new();
-        let mut path_patterns = Vec::new();
+    fn parse_baggage(&mut self, config_json: &serde_json::Value) {
+        if let Some(keys_array) = config_json.get("captureBaggageKeys").and_then(|v| v.as_array()) {
+            self.capture_baggage_keys = keys_array
+                .iter()
+                .filter_map(|v| v.as_str())
+                .map(|v| v.trim().to_string())
+                .filter(|v| !v.is_empty())
+                .collect();
+            crate::sp_info!("Configured baggage keys to capture: {:?}", self.capture_baggage_keys);
+        }
 
-        if let Some(hosts) = exemption_entry.get("hostPatterns") {
-            if let Some(hosts_array) = hosts.as_array() {
-                for host_entry in hosts_array {
-                    if let Some(host) = host_entry.as_str() {
-                        host_patterns.push(host.to_string());
-                    }
-                }
+        if let Some(max_bytes) = config_json.get("maxBaggageValueBytes").and_then(|v| v.as_u64()) {
+            self.max_baggage_value_bytes = max_bytes as usize;
+            crate::sp_info!("Configured max baggage value bytes: {}", self.max_baggage_value_bytes);
+        }
+    }
+
+    fn parse_batching(&mut self, config_json: &serde_json::Value) {
+        if let Some(max_spans) = config_json.get("batchMaxSpans").and_then(|v| v.as_u64()) {
+            if max_spans > 0 {
+                self.batch_max_spans = max_spans as usize;
+                crate::sp_info!("Configured batch max spans: {}", self.batch_max_spans);
+            } else {
+                crate::sp_warn!("Ignoring batchMaxSpans=0, keeping {}", self.batch_max_spans);
             }
         }
 
-        if let Some(paths) = exemption_entry.get("pathPatterns") {
-            if let Some(paths_array) = paths.as_array() {
-                for path_entry in paths_array {
-                    if let Some(path) = path_entry.as_str() {
-                        path_patterns.push(path.to_string());
-                    }
-                }
+        if let Some(max_bytes) = config_json.get("batchMaxBytes").and_then(|v| v.as_u64()) {
+            if max_bytes > 0 {
+                self.batch_max_bytes = max_bytes as usize;
+                crate::sp_info!("Configured batch max bytes: {}", self.batch_max_bytes);
+            } else {
+                crate::sp_warn!("Ignoring batchMaxBytes=0, keeping {}", self.batch_max_bytes);
             }
-        } else {
-            // Use default path patterns if none specified
-            path_patterns = ExemptionRule::default().path_patterns;
         }
 
-        (host_patterns, path_patterns)
+        if let Some(interval_ms) = config_json.get("batchFlushIntervalMs").and_then(|v| v.as_u64()) {
+            if interval_ms > 0 {
+                self.batch_flush_interval_ms = interval_ms;
+                crate::sp_info!("Configured batch flush interval: {}ms", self.batch_flush_interval_ms);
+            } else {
+                crate::sp_warn!("Ignoring batchFlushIntervalMs=0, keeping {}ms", self.batch_flush_interval_ms);
+            }
+        }
     }
-}
 
-#[cfg(test)]
-mod tests {
-    use super::*;
-    use serde_json::json;
+    fn parse_export_retries(&mut self, config_json: &serde_json::Value) {
+        if let Some(max_retries) = config_json.get("maxExportRetries").and_then(|v| v.as_u64()) {
+            self.max_export_retries = max_retries.min(u32::MAX as u64) as u32;
+            crate::sp_info!("Configured max export retries: {}", self.max_export_retries);
+        }
 
-    #[test]
-    fn test_config_default() {
+        if let Some(backoff_ms) = config_json.get("retryBackoffMs").and_then(|v| v.as_u64()) {
+            self.retry_backoff_ms = backoff_ms;
+            crate::sp_info!("Configured retry backoff: {}ms", self.retry_backoff_ms);
+        }
+
+        if let Some(max_backoff_ms) = config_json.get("retryMaxBackoffMs").and_then(|v| v.as_u64()) {
+            self.retry_max_backoff_ms = max_backoff_ms;
+            crate::sp_info!("Configured retry max backoff: {}ms", self.retry_max_backoff_ms);
+        }
+    }
+
+    fn parse_circuit_breaker(&mut self, config_json: &serde_json::Value) {
+        if let Some(threshold) = config_json.get("circuitFailureThreshold").and_then(|v| v.as_u64()) {
+            self.circuit_failure_threshold = threshold.min(u32::MAX as u64) as u32;
+            crate::sp_info!("Configured export circuit failure threshold: {}", self.circuit_failure_threshold);
+        }
+
+        if let Some(open_ms) = config_json.get("circuitOpenMs").and_then(|v| v.as_u64()) {
+            self.circuit_open_ms = open_ms;
+            crate::sp_info!("Configured export circuit open time: {}ms", self.circuit_open_ms);
+        }
+    }
+
+    fn parse_export_queue(&mut self, config_json: &serde_json::Value) {
+        if let Some(max_batches) = config_json.get("maxQueuedBatches").and_then(|v| v.as_u64()) {
+            self.max_queued_batches = max_batches as usize;
+            crate::sp_info!("Configured max queued batches: {}", self.max_queued_batches);
+        }
+
+        if let Some(policy) = config_json.get("overflowPolicy").and_then(|v| v.as_str()) {
+            match policy.trim().to_ascii_lowercase().as_str() {
+                "drop-oldest" => self.overflow_policy = OverflowPolicy::DropOldest,
+                "drop-newest" => self.overflow_policy = OverflowPolicy::DropNewest,
+                other => {
+                    crate::sp_warn!("Unknown overflowPolicy '{}', keeping {:?}", other, self.overflow_policy);
+                    return;
+                }
+            }
+            crate::sp_info!("Configured overflow policy: {:?}", self.overflow_policy);
+        }
+    }
+
+    fn parse_compression(&mut self, config_json: &serde_json::Value) {
+        if let Some(compression) = config_json.get("compression").and_then(|v| v.as_str()) {
+            match parse_compression_value(compression) {
+                Some(compression) => self.compression = compression,
+                None => {
+                    crate::sp_warn!("Unknown compression '{}', keeping {:?}", compression.trim(), self.compression);
+                    return;
+                }
+            }
+            crate::sp_info!("Configured export compression: {:?}", self.compression);
+        }
+    }
+
+    fn parse_export_protocol(&mut self, config_json: &serde_json::Value) {
+        if let Some(protocol) = config_json.get("exportProtocol").and_then(|v| v.as_str()) {
+            match protocol.trim().to_ascii_lowercase().as_str() {
+                "http/protobuf" => self.export_protocol = ExportProtocol::HttpProtobuf,
+                "grpc" => self.export_protocol = ExportProtocol::Grpc,
+                other => {
+                    crate::sp_warn!("Unknown exportProtocol '{}', keeping {:?}", other, self.export_protocol);
+                    return;
+                }
+            }
+            crate::sp_info!("Configured export protocol: {:?}", self.export_protocol);
+        }
+    }
+
+    /// protoSchemas maps a path glob to a base64 FileDescriptorSet, or to an object with
+    /// descriptorSet plus optional requestType/responseType for non-gRPC endpoints
+    fn parse_protobuf_decoding(&mut self, config_json: &serde_json::Value) {
+        if let Some(enabled) = config_json.get("decodeProtobuf").and_then(|v| v.as_bool()) {
+            self.decode_protobuf = enabled;
+            crate::sp_info!("Configured protobuf body decoding: {}", self.decode_protobuf);
+        }
+
+        if let Some(cache_size) = config_json.get("protoDescriptorCacheSize").and_then(|v| v.as_u64()) {
+            self.proto_descriptor_cache_size = cache_size as usize;
+            crate::sp_info!("Configured protobuf descriptor cache size: {}", self.proto_descriptor_cache_size);
+        }
+
+        if let Some(schemas) = config_json.get("protoSchemas").and_then(|v| v.as_object()) {
+            let mut proto_schemas = Vec::new();
+            for (pattern, schema) in schemas {
+                let (encoded, request_type, response_type) = match schema {
+                    serde_json::Value::String(encoded) => (Some(encoded.as_str()), None, None),
+                    serde_json::Value::Object(schema) => {
+                        let get_str = |key: &str| schema.get(key).and_then(|v| v.as_str());
+                        (
+                            get_str("descriptorSet"),
+                            get_str("requestType").map(|t| t.to_string()),
+                            get_str("responseType").map(|t| t.to_string()),
+                        )
+                    }
+                    _ => (None, None, None),
+                };
+                let descriptor_set = match encoded.and_then(|e| general_purpose::STANDARD.decode(e.trim()).ok()) {
+                    Some(descriptor_set) => descriptor_set,
+                    None => {
+                        crate::sp_warn!("Ignoring protoSchemas entry '{}': descriptor set is not valid base64", pattern);
+                        continue;
+                    }
+                };
+                proto_schemas.push(ProtoSchema {
+                    path_pattern: pattern.trim().to_string(),
+                    descriptor_set,
+                    request_type,
+                    response_type,
+                });
+            }
+            self.proto_schemas = proto_schemas;
+            crate::sp_info!("Configured protobuf schemas: {:?}", self.proto_schemas);
+        }
+    }
+
+    fn parse_auth(&mut self, config_json: &serde_json::Value) {
+        if let Some(auth_json) = config_json.get("auth").and_then(|v| v.as_object()) {
+            self.auth = parse_auth_block(auth_json);
+            crate::sp_info!("Configured backend auth: {:?}", self.auth);
+        }
+    }
+
+    fn parse_backends(&mut self, config_json: &serde_json::Value) {
+        let entries = match config_json.get("backends").and_then(|v| v.as_array()) {
+            Some(entries) => entries,
+            None => return,
+        };
+        self.backends = entries
+            .iter()
+            .enumerate()
+            .filter_map(|(i, entry)| {
+                let entry = entry.as_object()?;
+                let url = entry.get("url").and_then(|v| v.as_str()).unwrap_or_default().trim().to_string();
+                let name = entry
+                    .get("name")
+                    .and_then(|v| v.as_str())
+                    .map(|v| v.trim().to_string())
+                    .filter(|v| !v.is_empty())
+                    .unwrap_or_else(|| backend_name_from_url(&url, i));
+                // Auth is never inherited: a team collector must not receive the shared credential
+                let auth = entry
+                    .get("auth")
+                    .and_then(|v| v.as_object())
+                    .map(parse_auth_block)
+                    .unwrap_or_default();
+                let compression = entry
+                    .get("compression")
+                    .and_then(|v| v.as_str())
+                    .and_then(parse_compression_value)
+                    .unwrap_or(self.compression);
+                Some(BackendConfig { name, url, auth, compression })
+            })
+            .collect();
+        for backend in &self.backends {
+            crate::sp_info!(
+                "Configured export backend '{}' (compression {:?}, auth {:?})",
+                backend.name,
+                backend.compression,
+                backend.auth
+            );
+        }
+    }
+
+    fn parse_tenant(&mut self, config_json: &serde_json::Value) {
+        if let Some(header) = config_json.get("tenantHeader").and_then(|v| v.as_str()) {
+            let header = header.trim().to_ascii_lowercase();
+            if !header.is_empty() {
+                self.tenant_header = header;
+                crate::sp_info!("Configured tenant header: {}", self.tenant_header);
+            }
+        }
+
+        if let Some(tenant) = config_json.get("defaultTenant").and_then(|v| v.as_str()) {
+            let tenant = tenant.trim();
+            if tenant.is_empty() || crate::http_helpers::is_safe_path_segment(tenant) {
+                self.default_tenant = tenant.to_string();
+                crate::sp_info!("Configured default tenant: {}", self.default_tenant);
+            } else {
+                crate::sp_warn!("Ignoring defaultTenant with characters unsafe for a URL path: {}", tenant);
+            }
+        }
+    }
+
+    fn parse_capture_grpc_web(&mut self, config_json: &serde_json::Value) {
+        if let Some(enabled) = config_json.get("captureGrpcWeb").and_then(|v| v.as_bool()) {
+            self.capture_grpc_web = enabled;
+            crate::sp_info!("Configured gRPC-Web body unframing: {}", self.capture_grpc_web);
+        }
+    }
+
+    /// capturePaths / ignorePaths are glob lists matched against `:path` (query excluded).
+    /// Precedence: a path matching any ignorePaths pattern is never captured, even if it
+    /// also matches capturePaths; an empty capturePaths means capture everything else.
+    /// Setting ignorePaths replaces the defaults (/health, /metrics).
+    fn parse_capture_paths(&mut self, config_json: &serde_json::Value) {
+        let parse_list = |key: &str| {
+            config_json.get(key).and_then(|v| v.as_array()).map(|patterns| {
+                patterns
+                    .iter()
+                    .filter_map(|v| v.as_str())
+                    .map(|v| v.trim().to_string())
+                    .filter(|v| !v.is_empty())
+                    .collect::<Vec<String>>()
+            })
+        };
+
+        if let Some(capture_paths) = parse_list("capturePaths") {
+            self.capture_paths = capture_paths;
+            crate::sp_info!("Configured capture paths: {:?}", self.capture_paths);
+        }
+        if let Some(ignore_paths) = parse_list("ignorePaths") {
+            self.ignore_paths = ignore_paths;
+            crate::sp_info!("Configured ignore paths: {:?}", self.ignore_paths);
+        }
+
+        let shadowed: Vec<&String> = self
+            .capture_paths
+            .iter()
+            .filter(|p| self.ignore_paths.contains(p))
+            .collect();
+        if !shadowed.is_empty() {
+            crate::sp_warn!("capturePaths {:?} are also in ignorePaths; ignorePaths takes precedence", shadowed);
+        }
+    }
+
+    fn parse_capture_methods(&mut self, config_json: &serde_json::Value) {
+        if let Some(methods_array) = config_json.get("captureMethods").and_then(|v| v.as_array()) {
+            self.capture_methods = methods_array
+                .iter()
+                .filter_map(|v| v.as_str())
+                .map(|v| v.trim().to_ascii_uppercase())
+                .filter(|v| !v.is_empty())
+                .collect();
+            crate::sp_info!("Configured capture methods: {:?}", self.capture_methods);
+        }
+    }
+
+    fn parse_capture_status_codes(&mut self, config_json: &serde_json::Value) {
+        if let Some(codes_array) = config_json.get("captureStatusCodes").and_then(|v| v.as_array()) {
+            let mut patterns = Vec::new();
+            for spec in codes_array.iter().filter_map(|v| v.as_str()) {
+                match StatusCodePattern::parse(spec) {
+                    Some(pattern) => patterns.push(pattern),
+                    None => {
+                        crate::sp_warn!("Ignoring invalid captureStatusCodes entry: {}", spec);
+                    }
+                }
+            }
+            self.capture_status_codes = patterns;
+            crate::sp_info!("Configured capture status codes: {:?}", self.capture_status_codes);
+        }
+    }
+
+    fn parse_capture_if_header(&mut self, config_json: &serde_json::Value) {
+        if let Some(entries) = config_json.get("captureIfHeader").and_then(|v| v.as_array()) {
+            let mut predicates = Vec::new();
+            for entry in entries {
+                let name = match entry.get("name").and_then(|v| v.as_str()).map(|n| n.trim()) {
+                    Some(name) if !name.is_empty() => name.to_ascii_lowercase(),
+                    _ => {
+                        crate::sp_warn!("Ignoring captureIfHeader entry without a name: {}", entry);
+                        continue;
+                    }
+                };
+                let regex = match entry.get("regex").and_then(|v| v.as_str()) {
+                    Some(pattern) => match regex::Regex::new(pattern) {
+                        Ok(regex) => Some(regex),
+                        Err(e) => {
+                            crate::sp_warn!("Ignoring captureIfHeader entry for {}: invalid regex '{}': {}", name, pattern, e);
+                            continue;
+                        }
+                    },
+                    None => None,
+                };
+                predicates.push(HeaderPredicate {
+                    name,
+                    value: entry.get("value").and_then(|v| v.as_str()).map(|v| v.to_string()),
+                    regex,
+                });
+            }
+            self.capture_if_header = predicates;
+            crate::sp_info!("Configured capture-if-header predicates: {:?}", self.capture_if_header);
+        }
+    }
+
+    fn parse_disable_capture_header(&mut self, config_json: &serde_json::Value) {
+        if let Some(header) = config_json.get("disableCaptureHeader").and_then(|v| v.as_str()) {
+            self.disable_capture_header = header.trim().to_ascii_lowercase();
+            crate::sp_info!("Configured disable capture header: {:?}", self.disable_capture_header);
+        }
+    }
+
+    fn parse_body_export(&mut self, config_json: &serde_json::Value) {
+        if let Some(mode) = config_json.get("bodyExport").and_then(|v| v.as_str()) {
+            match mode.trim().to_ascii_lowercase().as_str() {
+                "attribute" => self.body_export = BodyExport::Attribute,
+                "log" => self.body_export = BodyExport::Log,
+                other => {
+                    crate::sp_warn!("Unknown bodyExport '{}', keeping {:?}", other, self.body_export);
+                    return;
+                }
+            }
+            crate::sp_info!("Configured body export: {:?}", self.body_export);
+        }
+    }
+
+    fn parse_keep_header(&mut self, config_json: &serde_json::Value) {
+        if let Some(header) = config_json.get("keepHeader").and_then(|v| v.as_str()) {
+            self.keep_header = header.trim().to_ascii_lowercase();
+            crate::sp_info!("Configured keep header: {:?}", self.keep_header);
+        }
+    }
+
+    fn parse_capture_mtls_identity(&mut self, config_json: &serde_json::Value) {
+        if let Some(enabled) = config_json.get("captureMtlsIdentity").and_then(|v| v.as_bool()) {
+            self.capture_mtls_identity = enabled;
+            crate::sp_info!("Configured mTLS identity capture: {}", self.capture_mtls_identity);
+        }
+    }
+
+    fn parse_heartbeat(&mut self, config_json: &serde_json::Value) {
+        if let Some(interval_ms) = config_json.get("heartbeatIntervalMs").and_then(|v| v.as_u64()) {
+            self.heartbeat_interval_ms = interval_ms;
+            crate::sp_info!("Configured heartbeat interval: {}ms", self.heartbeat_interval_ms);
+        }
+    }
+
+    fn parse_tenant_rate_limit(&mut self, config_json: &serde_json::Value) {
+        if let Some(rate) = config_json.get("perTenantExportRate").and_then(|v| v.as_f64()) {
+            self.per_tenant_export_rate = rate;
+            crate::sp_info!("Configured per-tenant export rate: {} spans/s", self.per_tenant_export_rate);
+        }
+        if let Some(burst) = config_json.get("perTenantExportBurst").and_then(|v| v.as_u64()) {
+            self.per_tenant_export_burst = burst;
+            crate::sp_info!("Configured per-tenant export burst: {} spans", self.per_tenant_export_burst);
+        }
+        if let Some(max_buckets) = config_json.get("maxTenantBuckets").and_then(|v| v.as_u64()) {
+            self.max_tenant_buckets = max_buckets;
+            crate::sp_info!("Configured max tenant buckets: {}", self.max_tenant_buckets);
+        }
+    }
+
+    fn parse_max_attribute_value_bytes(&mut self, config_json: &serde_json::Value) {
+        if let Some(max_bytes) = config_json.get("maxAttributeValueBytes").and_then(|v| v.as_u64()) {
+            self.max_attribute_value_bytes = max_bytes as usize;
+            crate::sp_info!("Configured max attribute value bytes: {}", self.max_attribute_value_bytes);
+        }
+    }
+
+    fn parse_max_form_fields(&mut self, config_json: &serde_json::Value) {
+        // 0 turns form field capture off
+        if let Some(max) = config_json.get("maxFormFields").and_then(|v| v.as_u64()) {
+            self.max_form_fields = max as usize;
+            crate::sp_info!("Configured max form fields: {}", self.max_form_fields);
+        }
+    }
+
+    /// `sink: {file, alsoExport}` writes captured spans as NDJSON; `sink: null` turns it off
+    fn parse_sink(&mut self, config_json: &serde_json::Value) {
+        match config_json.get("sink") {
+            Some(serde_json::Value::Null) => {
+                self.sink = None;
+                crate::sp_info!("Configured sink: off");
+            }
+            Some(serde_json::Value::Object(sink_json)) => {
+                let file = sink_json.get("file").and_then(|v| v.as_str()).unwrap_or("").trim().to_string();
+                if file.is_empty() {
+                    crate::sp_warn!("Ignoring sink without a file");
+                    return;
+                }
+                self.sink = Some(SinkConfig {
+                    file,
+                    also_export: sink_json.get("alsoExport").and_then(|v| v.as_bool()).unwrap_or(false),
+                });
+                crate::sp_info!("Configured sink: {:?}", self.sink);
+            }
+            _ => {}
+        }
+    }
+
+    /// `tee: {url, ratePerSec, burst}` mirrors captured requests to `url`; `tee: null` turns it off
+    fn parse_tee(&mut self, config_json: &serde_json::Value) {
+        match config_json.get("tee") {
+            Some(serde_json::Value::Null) => {
+                self.tee = None;
+                crate::sp_info!("Configured tee: off");
+            }
+            Some(serde_json::Value::Object(tee_json)) => {
+                let url = tee_json.get("url").and_then(|v| v.as_str()).unwrap_or("").trim().to_string();
+                if url.is_empty() {
+                    crate::sp_warn!("Ignoring tee without a url");
+                    return;
+                }
+                self.tee = Some(TeeConfig {
+                    url,
+                    rate_per_sec: tee_json
+                        .get("ratePerSec")
+                        .and_then(|v| v.as_f64())
+                        .unwrap_or(crate::tee::DEFAULT_RATE_PER_SEC),
+                    burst: tee_json.get("burst").and_then(|v| v.as_u64()).unwrap_or(0),
+                });
+                crate::sp_info!("Configured tee: {:?}", self.tee);
+            }
+            _ => {}
+        }
+    }
+
+    fn parse_span_name_template(&mut self, config_json: &serde_json::Value) {
+        let template_json = match config_json.get("spanNameTemplate").and_then(|v| v.as_object()) {
+            Some(template_json) => template_json,
+            None => return,
+        };
+
+        let routes = template_json
+            .get("routes")
+            .and_then(|v| v.as_object())
+            .map(|routes| {
+                routes
+                    .iter()
+                    .filter_map(|(route, name)| Some((route.clone(), name.as_str()?.trim().to_string())))
+                    .filter(|(_, name)| !name.is_empty())
+                    .collect()
+            })
+            .unwrap_or_default();
+
+        let segment_patterns = match template_json.get("segmentPatterns").and_then(|v| v.as_array()) {
+            Some(entries) => {
+                let mut patterns = Vec::new();
+                for entry in entries {
+                    let regex = entry.get("regex").and_then(|v| v.as_str()).unwrap_or("");
+                    let replacement = entry.get("replacement").and_then(|v| v.as_str()).unwrap_or("");
+                    match regex::Regex::new(regex) {
+                        Ok(compiled) if !regex.is_empty() => patterns.push(SegmentPattern {
+                            regex: compiled,
+                            replacement: replacement.to_string(),
+                        }),
+                        _ => {
+                            crate::sp_warn!("Ignoring invalid spanNameTemplate segment pattern: {}", entry);
+                        }
+                    }
+                }
+                patterns
+            }
+            None => default_segment_patterns(),
+        };
+
+        self.span_name_template = Some(SpanNameTemplate { routes, segment_patterns });
+        crate::sp_info!("Configured span name template: {:?}", self.span_name_template);
+    }
+
+    fn parse_capture_duration(&mut self, config_json: &serde_json::Value) {
+        if let Some(min_duration_ms) = config_json.get("minDurationMs").and_then(|v| v.as_u64()) {
+            // 0 would let every request through, same as not filtering
+            self.min_duration_ms = if min_duration_ms > 0 { Some(min_duration_ms) } else { None };
+            crate::sp_info!("Configured min duration: {:?} ms", self.min_duration_ms);
+        }
+
+        if let Some(combine) = config_json.get("filterCombine").and_then(|v| v.as_str()) {
+            match combine.trim().to_ascii_lowercase().as_str() {
+                "and" => self.filter_combine = FilterCombine::And,
+                "or" => self.filter_combine = FilterCombine::Or,
+                other => {
+                    crate::sp_warn!("Unknown filterCombine '{}', keeping {:?}", other, self.filter_combine);
+                    return;
+                }
+            }
+            crate::sp_info!("Configured filter combine: {:?}", self.filter_combine);
+        }
+    }
+
+    fn parse_log_format(&mut self, config_json: &serde_json::Value) {
+        if let Some(log_format) = config_json.get("logFormat").and_then(|v| v.as_str()) {
+            match log_format.trim().to_ascii_lowercase().as_str() {
+                "text" => self.log_format = LogFormat::Text,
+                "json" => self.log_format = LogFormat::Json,
+                other => {
+                    crate::sp_warn!("Unknown logFormat '{}', keeping {:?}", other, self.log_format);
+                    return;
+                }
+            }
+            crate::sp_info!("Configured log format: {:?}", self.log_format);
+        }
+    }
+
+    fn parse_capture_direction(&mut self, config_json: &serde_json::Value) {
+        if let Some(direction) = config_json.get("captureDirection").and_then(|v| v.as_str()) {
+            match direction.trim().to_ascii_lowercase().as_str() {
+                "inbound" => self.capture_direction = CaptureDirection::Inbound,
+                "outbound" => self.capture_direction = CaptureDirection::Outbound,
+                "both" => self.capture_direction = CaptureDirection::Both,
+                other => {
+                    crate::sp_warn!("Unknown captureDirection '{}', keeping {:?}", other, self.capture_direction);
+                    return;
+                }
+            }
+            crate::sp_info!("Configured capture direction: {:?}", self.capture_direction);
+        }
+    }
+
+    fn parse_binary_body_encoding(&mut self, config_json: &serde_json::Value) {
+        if let Some(encoding) = config_json.get("binaryBodyEncoding").and_then(|v| v.as_str()) {
+            match encoding.trim().to_ascii_lowercase().as_str() {
+                "std" => self.binary_body_encoding = BinaryBodyEncoding::Std,
+                "url" => self.binary_body_encoding = BinaryBodyEncoding::Url,
+                other => {
+                    crate::sp_warn!("Unknown binaryBodyEncoding '{}', keeping {:?}", other, self.binary_body_encoding);
+                    return;
+                }
+            }
+            crate::sp_info!("Configured binary body encoding: {:?}", self.binary_body_encoding);
+        }
+    }
+
+    /// captureHostExclude globs match the host without its port, case-insensitively
+    fn parse_capture_host(&mut self, config_json: &serde_json::Value) {
+        if let Some(enabled) = config_json.get("captureHost").and_then(|v| v.as_bool()) {
+            self.capture_host = enabled;
+            crate::sp_info!("Configured host capture: {}", self.capture_host);
+        }
+        if let Some(patterns) = config_json.get("captureHostExclude").and_then(|v| v.as_array()) {
+            self.capture_host_exclude = patterns
+                .iter()
+                .filter_map(|v| v.as_str())
+                .map(|v| v.trim().to_ascii_lowercase())
+                .filter(|v| !v.is_empty())
+                .collect();
+            crate::sp_info!("Configured host capture exclusions: {:?}", self.capture_host_exclude);
+        }
+    }
+
+    fn parse_span_links(&mut self, config_json: &serde_json::Value) {
+        if let Some(headers_array) = config_json.get("linkHeaders").and_then(|v| v.as_array()) {
+            self.link_headers = headers_array
+                .iter()
+                .filter_map(|v| v.as_str())
+                .map(|v| v.trim().to_ascii_lowercase())
+                .filter(|v| !v.is_empty())
+                .collect();
+            crate::sp_info!("Configured span link headers: {:?}", self.link_headers);
+        }
+        if let Some(max_links) = config_json.get("maxSpanLinks").and_then(|v| v.as_u64()) {
+            self.max_span_links = max_links as usize;
+            crate::sp_info!("Configured max span links: {}", self.max_span_links);
+        }
+    }
+
+    fn parse_flush_endpoint(&mut self, config_json: &serde_json::Value) {
+        if let Some(enabled) = config_json.get("enableFlushEndpoint").and_then(|v| v.as_bool()) {
+            self.enable_flush_endpoint = enabled;
+            crate::sp_info!("Configured flush endpoint: {}", self.enable_flush_endpoint);
+        }
+        if let Some(path) = config_json.get("flushEndpointPath").and_then(|v| v.as_str()) {
+            self.flush_endpoint_path = path.trim().to_string();
+            crate::sp_info!("Configured flush endpoint path: {}", self.flush_endpoint_path);
+        }
+    }
+
+    /// captureResponseHeaders: only these response headers become span attributes.
+    /// Names match case-insensitively, `prefix*` matches a family and `*` matches all.
+    fn parse_capture_response_headers(&mut self, config_json: &serde_json::Value) {
+        if let Some(headers_array) = config_json.get("captureResponseHeaders").and_then(|v| v.as_array()) {
+            self.capture_response_headers = headers_array
+                .iter()
+                .filter_map(|v| v.as_str())
+                .map(|v| v.trim().to_ascii_lowercase())
+                .filter(|v| !v.is_empty())
+                .collect();
+            crate::sp_info!("Configured captured response headers: {:?}", self.capture_response_headers);
+        }
+    }
+
+    fn parse_timestamp_source(&mut self, config_json: &serde_json::Value) {
+        if let Some(source) = config_json.get("timestampSource").and_then(|v| v.as_str()) {
+            match source.trim().to_ascii_lowercase().as_str() {
+                "wall" => self.timestamp_source = TimestampSource::Wall,
+                "monotonic-anchored" => self.timestamp_source = TimestampSource::MonotonicAnchored,
+                other => {
+                    crate::sp_warn!("Unknown timestampSource '{}', keeping {:?}", other, self.timestamp_source);
+                    return;
+                }
+            }
+            crate::sp_info!("Configured timestamp source: {:?}", self.timestamp_source);
+        }
+    }
+
+    fn parse_body_hash(&mut self, config_json: &serde_json::Value) {
+        if let Some(enabled) = config_json.get("captureBodyHash").and_then(|v| v.as_bool()) {
+            self.capture_body_hash = enabled;
+            crate::sp_info!("Configured request body hashing: {}", enabled);
+        }
+        if let Some(algorithm) = config_json.get("bodyHashAlgorithm").and_then(|v| v.as_str()) {
+            match algorithm.trim().to_ascii_lowercase().as_str() {
+                "sha256" => self.body_hash_algorithm = BodyHashAlgorithm::Sha256,
+                "xxhash" => self.body_hash_algorithm = BodyHashAlgorithm::XxHash,
+                other => {
+                    crate::sp_warn!("Unknown bodyHashAlgorithm '{}', keeping {:?}", other, self.body_hash_algorithm);
+                    return;
+                }
+            }
+            crate::sp_info!("Configured body hash algorithm: {:?}", self.body_hash_algorithm);
+        }
+    }
+
+    /// hopByHopHeaders replaces the default set; an empty list strips only the headers a
+    /// request's Connection header names
+    fn parse_hop_by_hop_headers(&mut self, config_json: &serde_json::Value) {
+        if let Some(enabled) = config_json.get("stripHopByHopHeaders").and_then(|v| v.as_bool()) {
+            self.strip_hop_by_hop_headers = enabled;
+            crate::sp_info!("Configured hop-by-hop header stripping: {}", enabled);
+        }
+        if let Some(headers_array) = config_json.get("hopByHopHeaders").and_then(|v| v.as_array()) {
+            self.hop_by_hop_headers = headers_array
+                .iter()
+                .filter_map(|v| v.as_str())
+                .map(|v| v.trim().to_ascii_lowercase())
+                .filter(|v| !v.is_empty())
+                .collect();
+            crate::sp_info!("Configured hop-by-hop headers: {:?}", self.hop_by_hop_headers);
+        }
+    }
+
+    fn parse_capture_tls_info(&mut self, config_json: &serde_json::Value) {
+        if let Some(enabled) = config_json.get("captureTlsInfo").and_then(|v| v.as_bool()) {
+            self.capture_tls_info = enabled;
+            crate::sp_info!("Configured TLS info capture: {}", self.capture_tls_info);
+        }
+    }
+
+    fn parse_span_events(&mut self, config_json: &serde_json::Value) {
+        if let Some(enabled) = config_json.get("captureSpanEvents").and_then(|v| v.as_bool()) {
+            self.capture_span_events = enabled;
+            crate::sp_info!("Configured span event capture: {}", self.capture_span_events);
+        }
+        if let Some(max_events) = config_json.get("maxSpanEvents").and_then(|v| v.as_u64()) {
+            self.max_span_events = max_events as usize;
+            crate::sp_info!("Configured max span events: {}", self.max_span_events);
+        }
+    }
+
+    fn parse_export_path_template(&mut self, config_json: &serde_json::Value) {
+        if let Some(template) = config_json.get("exportPathTemplate").and_then(|v| v.as_str()) {
+            self.export_path_template = template.trim().to_string();
+            crate::sp_info!("Configured export path template: {}", self.export_path_template);
+        }
+    }
+
+    fn parse_xff_trust_hops(&mut self, config_json: &serde_json::Value) {
+        if let Some(hops) = config_json.get("xffTrustHops").and_then(|v| v.as_u64()) {
+            self.xff_trust_hops = hops as usize;
+            crate::sp_info!("Configured x-forwarded-for trusted hops: {}", self.xff_trust_hops);
+        }
+    }
+
+    fn parse_dedup_window(&mut self, config_json: &serde_json::Value) {
+        if let Some(dedup_window_ms) = config_json.get("dedupWindowMs").and_then(|v| v.as_u64()) {
+            self.dedup_window_ms = dedup_window_ms;
+            crate::sp_info!("Configured dedup window: {} ms", self.dedup_window_ms);
+        }
+    }
+
+    fn parse_capture_trailers(&mut self, config_json: &serde_json::Value) {
+        if let Some(trailers_array) = config_json.get("captureTrailers").and_then(|v| v.as_array()) {
+            self.capture_trailers = trailers_array
+                .iter()
+                .filter_map(|v| v.as_str())
+                .map(|v| v.trim().to_ascii_lowercase())
+                .filter(|v| !v.is_empty())
+                .collect();
+            crate::sp_info!("Configured captured trailers: {:?}", self.capture_trailers);
+        }
+    }
+
+    fn parse_capture_server_timing(&mut self, config_json: &serde_json::Value) {
+        if let Some(enabled) = config_json.get("captureServerTiming").and_then(|v| v.as_bool()) {
+            self.capture_server_timing = enabled;
+            crate::sp_info!("Configured Server-Timing capture: {}", self.capture_server_timing);
+        }
+    }
+
+    fn parse_max_spans_per_trace(&mut self, config_json: &serde_json::Value) {
+        if let Some(max_spans) = config_json.get("maxSpansPerTrace").and_then(|v| v.as_u64()) {
+            self.max_spans_per_trace = max_spans;
+            crate::sp_info!("Configured max spans per trace: {}", self.max_spans_per_trace);
+        }
+    }
+
+    fn parse_capture_header_stats(&mut self, config_json: &serde_json::Value) {
+        if let Some(enabled) = config_json.get("captureHeaderStats").and_then(|v| v.as_bool()) {
+            self.capture_header_stats = enabled;
+            crate::sp_info!("Configured header stats capture: {}", self.capture_header_stats);
+        }
+    }
+
+    fn parse_body_preview(&mut self, config_json: &serde_json::Value) {
+        if let Some(preview_bytes) = config_json.get("bodyPreviewBytes").and_then(|v| v.as_u64()) {
+            self.body_preview_bytes = preview_bytes as usize;
+            crate::sp_info!("Configured body preview bytes: {}", self.body_preview_bytes);
+        }
+    }
+
+    fn parse_dry_run(&mut self, config_json: &serde_json::Value) {
+        if let Some(dry_run) = config_json.get("dryRun").and_then(|v| v.as_bool()) {
+            self.dry_run = dry_run;
+            crate::sp_info!("Configured dry run: {}", self.dry_run);
+        }
+    }
+
+    fn parse_query_params(&mut self, config_json: &serde_json::Value) {
+        if let Some(params_array) = config_json.get("redactQueryParams").and_then(|v| v.as_array()) {
+            self.redact_query_params = params_array
+                .iter()
+                .filter_map(|v| v.as_str())
+                .map(|v| v.trim().to_ascii_lowercase())
+                .filter(|v| !v.is_empty())
+                .collect();
+            crate::sp_info!("Configured redacted query params: {:?}", self.redact_query_params);
+        }
+
+        // 0 turns query parameter capture off
+        if let Some(max_params) = config_json.get("maxQueryParams").and_then(|v| v.as_u64()) {
+            self.max_query_params = max_params as usize;
+            crate::sp_info!("Configured max query params: {}", self.max_query_params);
+        }
+    }
+
+    fn parse_session_id(&mut self, config_json: &serde_json::Value) {
+        if let Some(headers_array) = config_json.get("sessionIdHeaders").and_then(|v| v.as_array()) {
+            let headers: Vec<String> = headers_array
+                .iter()
+                .filter_map(|v| v.as_str())
+                .map(|v| v.trim().to_ascii_lowercase())
+                .filter(|v| !v.is_empty())
+                .collect();
+            if headers.is_empty() {
+                crate::sp_warn!("sessionIdHeaders is empty, keeping {:?}", self.session_id_headers);
+            } else {
+                self.session_id_headers = headers;
+                crate::sp_info!("Configured session id headers: {:?}", self.session_id_headers);
+            }
+        }
+
+        if let Some(synthesize) = config_json.get("synthesizeSessionId").and_then(|v| v.as_bool()) {
+            self.synthesize_session_id = synthesize;
+            crate::sp_info!("Configured session id synthesis: {}", self.synthesize_session_id);
+        }
+
+        if let Some(inject) = config_json.get("injectSessionId").and_then(|v| v.as_bool()) {
+            self.inject_session_id = inject;
+            crate::sp_info!("Configured session id injection: {}", self.inject_session_id);
+        }
+
+        if let Some(header) = config_json.get("sessionIdInjectHeader").and_then(|v| v.as_str()) {
+            let header = header.trim().to_ascii_lowercase();
+            if !header.is_empty() {
+                self.session_id_inject_header = header;
+                crate::sp_info!("Configured session id inject header: {}", self.session_id_inject_header);
+            }
+        }
+
+        if let Some(enabled) = config_json.get("sessionSequence").and_then(|v| v.as_bool()) {
+            self.session_sequence = enabled;
+            crate::sp_info!("Configured session sequence numbers: {}", self.session_sequence);
+        }
+
+        if let Some(header) = config_json.get("sessionSeqHeader").and_then(|v| v.as_str()) {
+            self.session_seq_header = header.trim().to_ascii_lowercase();
+            crate::sp_info!("Configured session sequence header: {:?}", self.session_seq_header);
+        }
+
+        if let Some(idle_ms) = config_json.get("sessionIdleMs").and_then(|v| v.as_u64()) {
+            self.session_idle_ms = idle_ms;
+            crate::sp_info!("Configured session idle time: {}ms", self.session_idle_ms);
+        }
+
+        if let Some(max_sessions) = config_json.get("maxSessions").and_then(|v| v.as_u64()) {
+            self.max_sessions = max_sessions;
+            crate::sp_info!("Configured max sessions: {}", self.max_sessions);
+        }
+    }
+
+    fn parse_resource_attributes(&mut self, config_json: &serde_json::Value) {
+        if let Some(attributes) = config_json.get("resourceAttributes").and_then(|v| v.as_object()) {
+            let mut resource_attributes = Vec::new();
+            for (key, value) in attributes {
+                let key = key.trim();
+                if key.is_empty() || key.starts_with("sp.") {
+                    crate::sp_warn!("Ignoring resource attribute '{}': sp.* keys are reserved", key);
+                    continue;
+                }
+                let value = match value {
+                    serde_json::Value::String(s) => s.clone(),
+                    serde_json::Value::Number(n) => n.to_string(),
+                    serde_json::Value::Bool(b) => b.to_string(),
+                    _ => {
+                        crate::sp_warn!("Ignoring resource attribute '{}': value must be a string, number or bool", key);
+                        continue;
+                    }
+                };
+                resource_attributes.push((key.to_string(), value));
+            }
+            self.resource_attributes = resource_attributes;
+            crate::sp_info!("Configured resource attributes: {:?}", self.resource_attributes);
+        }
+    }
+
+    fn parse_collection_rules(&mut self, config_json: &serde_json::Value) {
+        if let Some(rules) = config_json.get("collectionRules") {
+            let (server_paths, client_configs) = self.extract_collection_data(rules);
+            self.create_collection_rules(server_paths, client_configs);
+        }
+    }
+
+    fn extract_collection_data(&self, rules: &serde_json::Value) -> (Vec<String>, Vec<(String, Vec<String>)>) {
+        let mut server_paths = Vec::new();
+        let mut client_configs = Vec::new();
+
+        // Extract server paths
+        if let Some(server_obj) = rules.get("http").and_then(|v| v.get("server")) {
+            if let Some(server_array) = server_obj.as_array() {
+                for server_entry in server_array {
+                    if let Some(path) = server_entry.get("path").and_then(|v| v.as_str()) {
+                        server_paths.push(path.to_string());
+                    }
+                }
+            }
+        }
+
+        // Extract client configs
+        if let Some(client_obj) = rules.get("http").and_then(|v| v.get("client")) {
+            if let Some(client_array) = client_obj.as_array() {
+                for client_entry in client_array {
+                    if let Some(host) = client_entry.get("host").and_then(|v| v.as_str()) {
+                        let mut paths = Vec::new();
+                        if let Some(paths_obj) = client_entry.get("paths") {
+                            if let Some(paths_array) = paths_obj.as_array() {
+                                for path_entry in paths_array {
+                                    if let Some(path) = path_entry.as_str() {
+                                        paths.push(path.to_string());
+                                    }
+                                }
+                            }
+                        }
+                        client_configs.push((host.to_string(), paths));
+                    }
+                }
+            }
+        }
+
+        (server_paths, client_configs)
+    }
+
+    fn create_collection_rules(&mut self, server_paths: Vec<String>, client_configs: Vec<(String, Vec<String>)>) {
+        // Create rules for each server path
+        for server_path in server_paths {
+            crate::sp_info!("Added server collection rule: {}", server_path);
+            self.collection_rules.push(CollectionRule {
+                http: HttpCollectionRule {
+                    server: ServerConfig {
+                        path: server_path,
+                    },
+                    client: vec![],
+                },
+            });
+        }
+
+        // Create rules for each client config
+        for (client_host, client_paths) in &client_configs {
+            crate::sp_info!("Added client collection rule: host={}, paths={:?}", client_host, client_paths);
+            self.collection_rules.push(CollectionRule {
+                http: HttpCollectionRule {
+                    server: ServerConfig {
+                        path: String::new(),
+                    },
+                    client: vec![ClientConfig {
+                        host: client_host.clone(),
+                        paths: client_paths.clone(),
+                    }],
+                },
+            });
+        }
+    }
+
+    fn parse_exemption_rules(&mut self, config_json: &serde_json::Value) {
+        if let Some(exemption_rules) = config_json.get("exemptionRules") {
+            if let Some(exemption_array) = exemption_rules.as_array() {
+                for exemption_entry in exemption_array {
+                    let (host_patterns, path_patterns) = self.extract_exemption_patterns(exemption_entry);
+                    
+                    if !path_patterns.is_empty() {
+                        crate::sp_info!("Added exemption rule: hostPatterns={:?}, pathPatterns={:?}", host_patterns, path_patterns);
+                        self.exemption_rules.push(ExemptionRule {
+                            host_patterns,
+                            path_patterns,
+                        });
+                    }
+                }
+            }
+        } else {
+            // Add default exemption rule if none configured
+            let default_rule = ExemptionRule::default();
+            crate::sp_info!("Added default exemption rule: pathPatterns={:?}", default_rule.path_patterns);
+            self.exemption_rules.push(default_rule);
+        }
+    }
+
+    fn extract_exemption_patterns(&self, exemption_entry: &serde_json::Value) -> (Vec<String>, Vec<String>) {
+        let mut host_patterns = Vec::new();
+        let mut path_patterns = Vec::new();
+
+        if let Some(hosts) = exemption_entry.get("hostPatterns") {
+            if let Some(hosts_array) = hosts.as_array() {
+                for host_entry in hosts_array {
+                    if let Some(host) = host_entry.as_str() {
+                        host_patterns.push(host.to_string());
+                    }
+                }
+            }
+        }
+
+        if let Some(paths) = exemption_entry.get("pathPatterns") {
+            if let Some(paths_array) = paths.as_array() {
+                for path_entry in paths_array {
+                    if let Some(path) = path_entry.as_str() {
+                        path_patterns.push(path.to_string());
+                    }
+                }
+            }
+        } else {
+            // Use default path patterns if none specified
+            path_patterns = ExemptionRule::default().path_patterns;
+        }
+
+        (host_patterns, path_patterns)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    #[test]
+    fn test_config_default() {
+        let config = Config::default();
+        assert_eq!(config.sp_backend_url, "https://o.softprobe.ai");
+        assert_eq!(config.service_name, "default-service");
+        assert!(config.traffic_direction.is_none());
+        assert!(config.collection_rules.is_empty());
+        assert!(config.public_key.is_empty());
+        assert_eq!(config.max_request_body_bytes, 64 * 1024);
+        assert_eq!(config.sample_rate, 1.0);
+        assert_eq!(config.propagators, vec!["tracecontext".to_string()]);
+        assert!(config.capture_baggage_keys.is_empty());
+        assert_eq!(config.max_baggage_value_bytes, 256);
+        assert_eq!(config.batch_max_spans, 100);
+        assert_eq!(config.batch_max_bytes, 512 * 1024);
+        assert_eq!(config.batch_flush_interval_ms, 1000);
+        assert_eq!(config.max_export_retries, 3);
+        assert_eq!(config.retry_backoff_ms, 500);
+        assert_eq!(config.retry_max_backoff_ms, 30_000);
+        assert_eq!(config.max_queued_batches, 64);
+        assert_eq!(config.overflow_policy, OverflowPolicy::DropOldest);
+        assert_eq!(config.compression, Compression::None);
+        assert!(!config.auth.enabled);
+        assert_eq!(config.tenant_header, "x-tenant-id");
+        assert!(config.default_tenant.is_empty());
+        assert!(!config.capture_grpc_web);
+        assert!(config.capture_paths.is_empty());
+        assert_eq!(config.ignore_paths, vec!["/health".to_string(), "/metrics".to_string()]);
+        assert!(config.capture_methods.is_empty());
+        assert!(config.capture_status_codes.is_empty());
+        assert_eq!(config.min_duration_ms, None);
+        assert_eq!(config.filter_combine, FilterCombine::Or);
+        assert_eq!(config.log_format, LogFormat::Text);
+        assert_eq!(config.capture_direction, CaptureDirection::Both);
+        assert_eq!(config.dedup_window_ms, 0);
+        assert!(config.capture_trailers.is_empty());
+        assert!(config.capture_header_stats);
+        assert_eq!(config.body_preview_bytes, 0);
+        assert!(!config.dry_run);
+        assert!(!config.backend_tls_skip_verify);
+        assert!(config.redact_query_params.is_empty());
+        assert_eq!(config.max_query_params, DEFAULT_MAX_QUERY_PARAMS);
+        assert_eq!(config.session_id_headers, default_session_id_headers());
+        assert!(!config.synthesize_session_id);
+        assert!(!config.inject_session_id);
+        assert_eq!(config.session_id_inject_header, "x-sp-session-id");
+        assert!(!config.session_sequence);
+        assert!(config.session_seq_header.is_empty());
+        assert_eq!(config.session_idle_ms, DEFAULT_SESSION_IDLE_MS);
+        assert_eq!(config.max_sessions, DEFAULT_MAX_SESSIONS);
+        assert!(config.resource_attributes.is_empty());
+        assert_eq!(config.workload_name, None);
+        assert_eq!(config.export_protocol, ExportProtocol::HttpProtobuf);
+        assert!(!config.decode_protobuf);
+        assert!(config.proto_schemas.is_empty());
+        assert_eq!(config.proto_descriptor_cache_size, DEFAULT_PROTO_DESCRIPTOR_CACHE_SIZE);
+        assert_eq!(config.max_response_body_bytes, DEFAULT_MAX_RESPONSE_BODY_BYTES);
+        assert_eq!(config.circuit_failure_threshold, DEFAULT_CIRCUIT_FAILURE_THRESHOLD);
+        assert_eq!(config.circuit_open_ms, DEFAULT_CIRCUIT_OPEN_MS);
+        assert_eq!(config.xff_trust_hops, 0);
+        assert!(config.capture_if_header.is_empty());
+        assert_eq!(config.disable_capture_header, "x-sp-disable-capture");
+        assert!(config.span_name_template.is_none());
+        assert_eq!(config.body_export, BodyExport::Attribute);
+        assert!(config.sink.is_none());
+        assert_eq!(config.max_form_fields, DEFAULT_MAX_FORM_FIELDS);
+        assert_eq!(config.keep_header, "x-sp-keep");
+        assert!(!config.capture_mtls_identity);
+        assert_eq!(config.heartbeat_interval_ms, 0);
+        assert_eq!(config.per_tenant_export_rate, 0.0);
+        assert_eq!(config.per_tenant_export_burst, 0);
+        assert_eq!(config.max_tenant_buckets, DEFAULT_MAX_TENANT_BUCKETS);
+        assert_eq!(config.max_attribute_value_bytes, 0);
+        assert!(config.backends.is_empty());
+        assert_eq!(config.tee, None);
+        assert_eq!(config.capture_body_max_content_length, 0);
+        assert!(!config.capture_server_timing);
+        assert_eq!(config.max_spans_per_trace, DEFAULT_MAX_SPANS_PER_TRACE);
+        assert_eq!(config.binary_body_encoding, BinaryBodyEncoding::Std);
+        assert!(config.capture_host);
+        assert!(config.capture_host_exclude.is_empty());
+        assert!(config.link_headers.is_empty());
+        assert_eq!(config.max_span_links, DEFAULT_MAX_SPAN_LINKS);
+        assert!(!config.enable_flush_endpoint);
+        assert_eq!(config.flush_endpoint_path, DEFAULT_FLUSH_ENDPOINT_PATH);
+        assert!(config.capture_response_headers.is_empty());
+        assert_eq!(config.timestamp_source, TimestampSource::Wall);
+        assert!(!config.capture_body_hash);
+        assert_eq!(config.body_hash_algorithm, BodyHashAlgorithm::Sha256);
+        assert!(config.strip_hop_by_hop_headers);
+        assert_eq!(config.hop_by_hop_headers, default_hop_by_hop_headers());
+        assert!(!config.capture_tls_info);
+        assert!(!config.capture_span_events);
+        assert_eq!(config.max_span_events, DEFAULT_MAX_SPAN_EVENTS);
+        assert_eq!(config.export_path_template, DEFAULT_EXPORT_PATH_TEMPLATE);
+    }
+
+    #[test]
+    fn test_exemption_rule_default() {
+        let rule = ExemptionRule::default();
+        assert!(rule.host_patterns.is_empty());
+        assert!(rule.path_patterns.contains(&"/v1/traces".to_string()));
+        assert!(rule.path_patterns.contains(&"/api/traces".to_string()));
+    }
+
+    #[test]
+    fn test_config_parse_backend_url() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "sp_backend_url": "https://custom.backend.com"
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+        
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.sp_backend_url, "https://custom.backend.com");
+    }
+
+    #[test]
+    fn test_config_parse_backend_url_camel_case() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "sp_backend_url": "https://custom.backend.com",
+            "backendUrl": "https://staging.softprobe.internal:8443",
+            "backendTlsSkipVerify": true
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.sp_backend_url, "https://staging.softprobe.internal:8443");
+        assert!(config.backend_tls_skip_verify);
+        let problems = config.validate(config_str.as_bytes()).unwrap_err();
+        assert!(problems.iter().any(|p| p.starts_with("backendTlsSkipVerify is not supported")), "{:?}", problems);
+        assert_eq!(Config::default().validate(br#"{"backendTlsSkipVerify": false}"#), Ok(()));
+    }
+
+    #[test]
+    fn test_config_parse_service_name() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "service_name": "test-service"
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+        
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.service_name, "test-service");
+    }
+
+    #[test]
+    fn test_config_parse_traffic_direction() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "traffic_direction": "outbound"
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+        
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.traffic_direction, Some("outbound".to_string()));
+    }
+
+    #[test]
+    fn test_config_parse_api_key() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "api_key": "test-api-key-123"
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+        
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.public_key, "test-api-key-123");
+    }
+
+    #[test]
+    fn test_config_parse_collection_rules() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "collectionRules": {
+                "http": {
+                    "server": [
+                        {"path": "/api/test"}
+                    ],
+                    "client": [
+                        {
+                            "host": "example.com",
+                            "paths": ["/api/endpoint1", "/api/endpoint2"]
+                        }
+                    ]
+                }
+            }
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+        
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.collection_rules.len(), 2);
+        
+        // Check server rule
+        assert_eq!(config.collection_rules[0].http.server.path, "/api/test");
+        assert!(config.collection_rules[0].http.client.is_empty());
+        
+        // Check client rule
+        assert!(config.collection_rules[1].http.server.path.is_empty());
+        assert_eq!(config.collection_rules[1].http.client.len(), 1);
+        assert_eq!(config.collection_rules[1].http.client[0].host, "example.com");
+        assert_eq!(config.collection_rules[1].http.client[0].paths.len(), 2);
+    }
+
+    #[test]
+    fn test_config_parse_exemption_rules() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "exemptionRules": [
+                {
+                    "hostPatterns": ["internal.com", "localhost"],
+                    "pathPatterns": ["/health", "/metrics"]
+                }
+            ]
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+        
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.exemption_rules.len(), 1);
+        assert_eq!(config.exemption_rules[0].host_patterns.len(), 2);
+        assert_eq!(config.exemption_rules[0].path_patterns.len(), 2);
+        assert!(config.exemption_rules[0].host_patterns.contains(&"internal.com".to_string()));
+        assert!(config.exemption_rules[0].path_patterns.contains(&"/health".to_string()));
+    }
+
+    #[test]
+    fn test_config_parse_invalid_json() {
+        let mut config = Config::default();
+        let original_backend = config.sp_backend_url.clone();
+        
+        // Test with invalid JSON
+        assert!(!config.parse_from_json(b"invalid json"));
+        assert_eq!(config.sp_backend_url, original_backend);
+        
+        // Test with invalid UTF-8
+        assert!(!config.parse_from_json(&[0xFF, 0xFE]));
+        assert_eq!(config.sp_backend_url, original_backend);
+    }
+
+    #[test]
+    fn test_config_parse_empty_exemption_rules() {
+        let mut config = Config::default();
+        let json_config = json!({});
+        let config_str = serde_json::to_string(&json_config).unwrap();
+        
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        // Should add default exemption rule
+        assert_eq!(config.exemption_rules.len(), 1);
+        assert!(config.exemption_rules[0].path_patterns.contains(&"/v1/traces".to_string()));
+    }
+
+    #[test]
+    fn test_config_parse_max_request_body_bytes() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "maxRequestBodyBytes": 1024
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.max_request_body_bytes, 1024);
+
+        // Zero disables body capture entirely
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"maxRequestBodyBytes": 0}"#));
+        assert_eq!(config.max_request_body_bytes, 0);
+    }
+
+    #[test]
+    fn test_config_parse_max_response_body_bytes() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"maxResponseBodyBytes": 4096}"#));
+        assert_eq!(config.max_response_body_bytes, 4096);
+    }
+
+    #[test]
+    fn test_config_parse_redact_headers() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "redactHeaders": ["Authorization", "X-Internal-*"]
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.redact_headers, vec!["authorization".to_string(), "x-internal-*".to_string()]);
+    }
+
+    #[test]
+    fn test_config_parse_redact_json_paths() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "redactJsonPaths": ["$.user.password", "$.cards[*].number"]
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.redact_json_paths.len(), 2);
+        assert_eq!(config.redact_json_paths[1], "$.cards[*].number");
+    }
+
+    #[test]
+    fn test_config_parse_propagators() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "propagators": ["B3", "tracecontext", "jaeger", "b3"]
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.propagators, vec!["b3".to_string(), "tracecontext".to_string()]);
+    }
+
+    #[test]
+    fn test_config_parse_baggage() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "captureBaggageKeys": ["tenant", " user.id ", ""],
+            "maxBaggageValueBytes": 64
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.capture_baggage_keys, vec!["tenant".to_string(), "user.id".to_string()]);
+        assert_eq!(config.max_baggage_value_bytes, 64);
+    }
+
+    #[test]
+    fn test_config_parse_batching() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "batchMaxSpans": 20,
+            "batchMaxBytes": 65536,
+            "batchFlushIntervalMs": 0
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.batch_max_spans, 20);
+        assert_eq!(config.batch_max_bytes, 65536);
+        assert_eq!(config.batch_flush_interval_ms, 1000);
+    }
+
+    #[test]
+    fn test_config_parse_export_retries() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "maxExportRetries": 5,
+            "retryBackoffMs": 250,
+            "retryMaxBackoffMs": 10000
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.max_export_retries, 5);
+        assert_eq!(config.retry_backoff_ms, 250);
+        assert_eq!(config.retry_max_backoff_ms, 10000);
+    }
+
+    #[test]
+    fn test_config_parse_export_queue() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "maxQueuedBatches": 8,
+            "overflowPolicy": "drop-newest"
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.max_queued_batches, 8);
+        assert_eq!(config.overflow_policy, OverflowPolicy::DropNewest);
+
+        let json_config = json!({ "overflowPolicy": "drop-random" });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.overflow_policy, OverflowPolicy::DropNewest);
+    }
+
+    #[test]
+    fn test_config_parse_compression() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "compression": "GZIP"
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.compression, Compression::Gzip);
+    }
+
+    #[test]
+    fn test_config_parse_export_protocol() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "exportProtocol": "grpc"
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.export_protocol, ExportProtocol::Grpc);
+
+        let json_config = json!({
+            "exportProtocol": "http/json"
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.export_protocol, ExportProtocol::Grpc);
+    }
+
+    #[test]
+    fn test_config_parse_protobuf_decoding() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "decodeProtobuf": true,
+            "protoDescriptorCacheSize": 2,
+            "protoSchemas": {
+                "/shop.Orders/*": "CgVzaG9w",
+                "/api/orders": {
+                    "descriptorSet": "CgVzaG9w",
+                    "requestType": "shop.Order",
+                    "responseType": "shop.Order"
+                },
+                "/bad": "not base64!"
+            }
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert!(config.decode_protobuf);
+        assert_eq!(config.proto_descriptor_cache_size, 2);
+        assert_eq!(config.proto_schemas.len(), 2);
+
+        let api = config.proto_schemas.iter().find(|s| s.path_pattern == "/api/orders").unwrap();
+        assert_eq!(api.descriptor_set, b"\n\x05shop".to_vec());
+        assert_eq!(api.request_type.as_deref(), Some("shop.Order"));
+
+        let grpc = config.proto_schemas.iter().find(|s| s.path_pattern == "/shop.Orders/*").unwrap();
+        assert_eq!(grpc.request_type, None);
+    }
+
+    #[test]
+    fn test_config_parse_circuit_breaker() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "circuitFailureThreshold": 0,
+            "circuitOpenMs": 5000
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.circuit_failure_threshold, 0);
+        assert_eq!(config.circuit_open_ms, 5000);
+    }
+
+    #[test]
+    fn test_config_parse_auth_bearer() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "auth": { "bearerToken": "secret-token" }
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert!(config.auth.enabled);
+        assert!(config.auth.validate(None).is_ok());
+        assert_eq!(
+            config.auth.header(None),
+            Some(("authorization".to_string(), "Bearer secret-token".to_string()))
+        );
+        assert_eq!(
+            config.auth.header(Some("rotated")),
+            Some(("authorization".to_string(), "Bearer rotated".to_string()))
+        );
+        assert!(!format!("{:?}", config.auth).contains("secret-token"));
+    }
+
+    #[test]
+    fn test_config_parse_auth_api_key() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "auth": { "apiKeyHeader": "X-Api-Key", "apiKeyValue": "k-123" }
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.auth.header(None), Some(("x-api-key".to_string(), "k-123".to_string())));
+    }
+
+    #[test]
+    fn test_config_auth_empty_credential_is_an_error() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "auth": { "bearerToken": "", "metadataKey": "SP_TOKEN" }
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert!(config.auth.validate(None).is_err());
+        assert!(config.auth.validate(Some("from-metadata")).is_ok());
+
+        let json_config = json!({ "auth": { "enabled": false } });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert!(config.auth.validate(None).is_ok());
+        assert_eq!(config.auth.header(None), None);
+    }
+
+    #[test]
+    fn test_config_parse_tenant() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "tenantHeader": "X-Org",
+            "defaultTenant": "shared"
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.tenant_header, "x-org");
+        assert_eq!(config.default_tenant, "shared");
+
+        let json_config = json!({ "defaultTenant": "a/b" });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.default_tenant, "shared");
+    }
+
+    #[test]
+    fn test_config_parse_capture_grpc_web() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "captureGrpcWeb": true
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert!(config.capture_grpc_web);
+    }
+
+    #[test]
+    fn test_config_parse_capture_paths() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "capturePaths": ["/api/*"],
+            "ignorePaths": ["/internal/*", ""]
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.capture_paths, vec!["/api/*".to_string()]);
+        assert_eq!(config.ignore_paths, vec!["/internal/*".to_string()]);
+    }
+
+    #[test]
+    fn test_config_parse_capture_methods() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "captureMethods": ["post", " PUT ", ""]
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.capture_methods, vec!["POST".to_string(), "PUT".to_string()]);
+    }
+
+    #[test]
+    fn test_config_parse_capture_status_codes() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "captureStatusCodes": ["4xx", "500-599", "2xx-3xx"]
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(
+            config.capture_status_codes,
+            vec![
+                StatusCodePattern::Digits([Some(4), None, None]),
+                StatusCodePattern::Range(500, 599),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_config_parse_capture_if_header() {
+        let mut config = Config::default();
+        let json_config = json!({
+            "captureIfHeader": [
+                {"name": "X-Debug", "value": "true"},
+                {"name": "x-trace-user", "regex": "^qa-"},
+                {"name": "x-bad", "regex": "("},
+                {"value": "no-name"}
+            ]
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.capture_if_header.len(), 2);
+        assert_eq!(config.capture_if_header[0].name, "x-debug");
+        assert_eq!(config.capture_if_header[0].value.as_deref(), Some("true"));
+        assert!(config.capture_if_header[1].regex.is_some());
+    }
+
+    #[test]
+    fn test_config_parse_disable_capture_header() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"disableCaptureHeader": " X-No-Capture "}"#));
+        assert_eq!(config.disable_capture_header, "x-no-capture");
+
+        assert!(config.parse_from_json(br#"{"disableCaptureHeader": ""}"#));
+        assert!(config.disable_capture_header.is_empty());
+    }
+
+    #[test]
+    fn test_config_parse_keep_header() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"keepHeader": "X-Keep-Trace"}"#));
+        assert_eq!(config.keep_header, "x-keep-trace");
+
+        assert!(config.parse_from_json(br#"{"keepHeader": ""}"#));
+        assert!(config.keep_header.is_empty());
+    }
+
+    #[test]
+    fn test_config_parse_capture_mtls_identity() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"captureMtlsIdentity": true}"#));
+        assert!(config.capture_mtls_identity);
+        assert!(config.validate(br#"{"captureMtlsIdentity": "yes"}"#).is_err());
+    }
+
+    #[test]
+    fn test_config_parse_heartbeat() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"heartbeatIntervalMs": 30000}"#));
+        assert_eq!(config.heartbeat_interval_ms, 30000);
+        assert!(config.validate(br#"{"heartbeatIntervalMs": -1}"#).is_err());
+    }
+
+    #[test]
+    fn test_config_parse_tenant_rate_limit() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"perTenantExportRate": 12.5, "perTenantExportBurst": 100, "maxTenantBuckets": 64}"#));
+        assert_eq!(config.per_tenant_export_rate, 12.5);
+        assert_eq!(config.per_tenant_export_burst, 100);
+        assert_eq!(config.max_tenant_buckets, 64);
+
+        let mut config = Config::default();
+        config.parse_from_json(br#"{"perTenantExportRate": -1}"#);
+        let problems = config.validate(br#"{"perTenantExportRate": -1}"#).unwrap_err();
+        assert!(problems.iter().any(|p| p.contains("perTenantExportRate")));
+    }
+
+    #[test]
+    fn test_config_parse_max_attribute_value_bytes() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"maxAttributeValueBytes": 65536}"#));
+        assert_eq!(config.max_attribute_value_bytes, 65536);
+    }
+
+    #[test]
+    fn test_config_parse_backends() {
+        // Shorthand: the top-level settings are the only backend
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"backendUrl": "https://o.softprobe.ai", "compression": "gzip", "auth": {"bearerToken": "t"}}"#));
+        let backends = config.export_backends();
+        assert_eq!(backends.len(), 1);
+        assert_eq!(backends[0].name, DEFAULT_BACKEND_NAME);
+        assert_eq!(backends[0].url, "https://o.softprobe.ai");
+        assert_eq!(backends[0].compression, Compression::Gzip);
+        assert!(backends[0].auth.enabled);
+
+        let config_json = br#"{
+            "compression": "gzip",
+            "auth": {"bearerToken": "shared"},
+            "backends": [
+                {"name": "softprobe", "url": "https://o.softprobe.ai", "auth": {"bearerToken": "t"}},
+                {"url": "http://collector.team.svc:4318", "compression": "none"}
+            ]
+        }"#;
+        let mut config = Config::default();
+        assert!(config.parse_from_json(config_json));
+        assert_eq!(config.validate(config_json), Ok(()));
+        let backends = config.export_backends();
+        assert_eq!(backends.len(), 2);
+        assert_eq!(backends[0].name, "softprobe");
+        assert_eq!(backends[0].compression, Compression::Gzip);
+        assert_eq!(backends[0].auth.bearer_token, "t");
+        assert_eq!(backends[1].name, "collector_team_svc");
+        assert_eq!(backends[1].compression, Compression::None);
+        // The shared credential is not handed to other backends
+        assert!(!backends[1].auth.enabled);
+    }
+
+    #[test]
+    fn test_config_validate_backends() {
+        let config_json = br#"{"backends": [
+            {"url": "https://a.example.com"},
+            {"url": "https://a.example.com", "compression": "brotli"},
+            {"name": "a_example_com", "url": "ftp://b.example.com"},
+            "https://c.example.com"
+        ]}"#;
+        let mut config = Config::default();
+        config.parse_from_json(config_json);
+        let problems = config.validate(config_json).unwrap_err();
+        assert!(problems.iter().any(|p| p.starts_with("backends[1].compression must be one of")));
+        assert!(problems.iter().any(|p| p.starts_with("backends[3] must be an object")));
+        assert!(problems.iter().any(|p| p.starts_with("backends[1] has the same url as backends[0]")));
+        assert!(problems.iter().any(|p| p.starts_with("backends[2]: ")));
+        assert!(problems.iter().any(|p| p.starts_with("backends[2] has the same name as backends[0]")));
+    }
+
+    #[test]
+    fn test_config_parse_tee() {
+        let mut config = Config::default();
+        config.parse_from_json(br#"{"tee": {"url": "http://replay.internal:9000/ingest", "burst": 20}}"#);
+        let tee = config.tee.clone().unwrap();
+        assert_eq!(tee.url, "http://replay.internal:9000/ingest");
+        assert_eq!(tee.rate_per_sec, crate::tee::DEFAULT_RATE_PER_SEC);
+        assert_eq!(tee.burst, 20);
+
+        config.parse_from_json(br#"{"tee": null}"#);
+        assert_eq!(config.tee, None);
+        config.parse_from_json(br#"{"tee": {"ratePerSec": 5}}"#);
+        assert_eq!(config.tee, None);
+    }
+
+    #[test]
+    fn test_config_validate_tee() {
+        let config_json = br#"{"tee": {"url": "ftp://replay.internal", "ratePerSec": 0}}"#;
+        let mut config = Config::default();
+        config.parse_from_json(config_json);
+        let problems = config.validate(config_json).unwrap_err();
+        assert!(problems.iter().any(|p| p.starts_with("tee: backend URL scheme")));
+        assert!(problems.iter().any(|p| p.starts_with("tee.ratePerSec must be greater than 0")));
+    }
+
+    #[test]
+    fn test_config_parse_capture_body_max_content_length() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"captureBodyMaxContentLength": 10485760, "maxRequestBodyBytes": 4096}"#));
+        assert_eq!(config.capture_body_max_content_length, 10 * 1024 * 1024);
+        assert_eq!(config.max_request_body_bytes, 4096);
+    }
+
+    #[test]
+    fn test_config_parse_capture_server_timing() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"captureServerTiming": true}"#));
+        assert!(config.capture_server_timing);
+    }
+
+    #[test]
+    fn test_config_parse_max_spans_per_trace() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"maxSpansPerTrace": 50}"#));
+        assert_eq!(config.max_spans_per_trace, 50);
+        assert!(config.parse_from_json(br#"{"maxSpansPerTrace": 0}"#));
+        assert_eq!(config.max_spans_per_trace, 0);
+    }
+
+    #[test]
+    fn test_config_parse_binary_body_encoding() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"binaryBodyEncoding": "url"}"#));
+        assert_eq!(config.binary_body_encoding, BinaryBodyEncoding::Url);
+        // Unknown values keep the current alphabet
+        assert!(config.parse_from_json(br#"{"binaryBodyEncoding": "hex"}"#));
+        assert_eq!(config.binary_body_encoding, BinaryBodyEncoding::Url);
+
+        let bytes = [0xfb, 0xff, 0xbf];
+        assert_eq!(BinaryBodyEncoding::Std.encode(&bytes), "+/+/");
+        assert_eq!(BinaryBodyEncoding::Url.encode(&bytes), "-_-_");
+    }
+
+    #[test]
+    fn test_config_parse_capture_host() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"captureHost": false, "captureHostExclude": ["*.Internal", " ", "metadata"]}"#));
+        assert!(!config.capture_host);
+        assert_eq!(config.capture_host_exclude, vec!["*.internal".to_string(), "metadata".to_string()]);
+        assert!(config.validate(br#"{"captureHostExclude": "*.internal"}"#).is_err());
+    }
+
+    #[test]
+    fn test_config_parse_span_links() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"linkHeaders": ["X-SP-Links", ""], "maxSpanLinks": 4}"#));
+        assert_eq!(config.link_headers, vec!["x-sp-links".to_string()]);
+        assert_eq!(config.max_span_links, 4);
+        assert!(config.validate(br#"{"maxSpanLinks": -1}"#).is_err());
+    }
+
+    #[test]
+    fn test_config_parse_flush_endpoint() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"enableFlushEndpoint": true, "flushEndpointPath": " /_flush "}"#));
+        assert!(config.enable_flush_endpoint);
+        assert_eq!(config.flush_endpoint_path, "/_flush");
+
+        let config_json = br#"{"enableFlushEndpoint": true, "flushEndpointPath": "flush"}"#;
+        let mut config = Config::default();
+        config.parse_from_json(config_json);
+        let problems = config.validate(config_json).unwrap_err();
+        assert!(problems.iter().any(|p| p.starts_with("flushEndpointPath must start with /")));
+    }
+
+    #[test]
+    fn test_config_parse_capture_response_headers() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"captureResponseHeaders": ["Content-Type", " cache-control ", "", "x-envoy-*"]}"#));
+        assert_eq!(config.capture_response_headers, vec!["content-type", "cache-control", "x-envoy-*"]);
+        assert!(config.validate(br#"{"captureResponseHeaders": "content-type"}"#).is_err());
+    }
+
+    #[test]
+    fn test_config_parse_timestamp_source() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"timestampSource": "monotonic-anchored"}"#));
+        assert_eq!(config.timestamp_source, TimestampSource::MonotonicAnchored);
+        assert!(config.parse_from_json(br#"{"timestampSource": "ntp"}"#));
+        assert_eq!(config.timestamp_source, TimestampSource::MonotonicAnchored);
+        assert!(config.validate(br#"{"timestampSource": "ntp"}"#).is_err());
+    }
+
+    #[test]
+    fn test_config_parse_body_hash() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"captureBodyHash": true, "bodyHashAlgorithm": "XXHash"}"#));
+        assert!(config.capture_body_hash);
+        assert_eq!(config.body_hash_algorithm, BodyHashAlgorithm::XxHash);
+        assert!(config.parse_from_json(br#"{"bodyHashAlgorithm": "md5"}"#));
+        assert_eq!(config.body_hash_algorithm, BodyHashAlgorithm::XxHash);
+        assert!(config.validate(br#"{"bodyHashAlgorithm": "md5"}"#).is_err());
+        assert!(config.validate(br#"{"captureBodyHash": "yes"}"#).is_err());
+    }
+
+    #[test]
+    fn test_config_parse_hop_by_hop_headers() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"hopByHopHeaders": ["Connection", " X-Hop-* ", ""]}"#));
+        assert!(config.strip_hop_by_hop_headers);
+        assert_eq!(config.hop_by_hop_headers, vec!["connection".to_string(), "x-hop-*".to_string()]);
+        assert!(config.parse_from_json(br#"{"stripHopByHopHeaders": false}"#));
+        assert!(!config.strip_hop_by_hop_headers);
+        assert!(config.validate(br#"{"hopByHopHeaders": "connection"}"#).is_err());
+    }
+
+    #[test]
+    fn test_config_parse_capture_tls_info() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"captureTlsInfo": true}"#));
+        assert!(config.capture_tls_info);
+        assert!(config.validate(br#"{"captureTlsInfo": 1}"#).is_err());
+    }
+
+    #[test]
+    fn test_config_parse_span_events() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"captureSpanEvents": true, "maxSpanEvents": 2}"#));
+        assert!(config.capture_span_events);
+        assert_eq!(config.max_span_events, 2);
+        assert!(config.validate(br#"{"maxSpanEvents": -1}"#).is_err());
+    }
+
+    #[test]
+    fn test_config_parse_export_path_template() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"exportPathTemplate": " /ingest/{tenant}/{service}/traces "}"#));
+        assert_eq!(config.export_path_template, "/ingest/{tenant}/{service}/traces");
+        assert_eq!(config.validate(b""), Ok(()));
+
+        for (config_json, problem) in [
+            (&br#"{"exportPathTemplate": "/ingest/{region}/traces"}"#[..], "exportPathTemplate: unknown placeholder {region}"),
+            (&br#"{"exportPathTemplate": "ingest/traces"}"#[..], "exportPathTemplate: must start with /"),
+            (&br#"{"exportPathTemplate": "/ingest/{tenant", "bodyExport": "log"}"#[..], "exportPathTemplate: unclosed {"),
+            (&br#"{"exportPathTemplate": "/ingest/spans", "bodyExport": "log"}"#[..], "exportPathTemplate must end in"),
+        ] {
+            let mut config = Config::default();
+            config.parse_from_json(config_json);
+            let problems = config.validate(config_json).unwrap_err();
+            assert!(problems.iter().any(|p| p.starts_with(problem)), "{:?}", problems);
+        }
+    }
+
+    #[test]
+    fn test_config_validate() {
         let config = Config::default();
-        assert_eq!(config.sp_backend_url, "https://o.softprobe.ai");
-        assert_eq!(config.service_name, "default-service");
-        assert!(config.traffic_direction.is_none());
-        assert!(config.collection_rules.is_empty());
-        assert!(config.public_key.is_empty());
+        assert_eq!(config.validate(b""), Ok(()));
+        assert_eq!(config.validate(br#"{"sampleRate": 0.5, "compression": "GZIP"}"#), Ok(()));
+
+        let bytes = br#"{
+            "sampleRate": 2,
+            "maxRequestBodyBytes": -1,
+            "dryRun": "yes",
+            "compression": "brotli",
+            "batchMaxSpans": 0,
+            "capturePaths": ["api/*"],
+            "backendUrl": "not a url"
+        }"#;
+        let mut config = Config::default();
+        assert!(config.parse_from_json(bytes));
+        let problems = config.validate(bytes).unwrap_err();
+        for expected in [
+            "maxRequestBodyBytes must be a non-negative integer",
+            "dryRun must be true or false",
+            "compression must be one of none, gzip",
+            "batchMaxSpans must be greater than 0",
+            "sampleRate must be between 0 and 1",
+            "capturePaths entry \"api/*\" never matches",
+        ] {
+            assert!(problems.iter().any(|p| p.starts_with(expected)), "missing {:?} in {:?}", expected, problems);
+        }
+        assert_eq!(problems.len(), 7, "{:?}", problems);
+
+        assert!(Config::default().validate(b"[1]").is_err());
+        assert!(Config::default().validate(b"{not json").is_err());
     }
 
     #[test]
-    fn test_exemption_rule_default() {
-        let rule = ExemptionRule::default();
-        assert!(rule.host_patterns.is_empty());
-        assert!(rule.path_patterns.contains(&"/v1/traces".to_string()));
-        assert!(rule.path_patterns.contains(&"/api/traces".to_string()));
+    fn test_config_parse_max_form_fields() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"maxFormFields": 5}"#));
+        assert_eq!(config.max_form_fields, 5);
+
+        assert!(config.parse_from_json(br#"{"maxFormFields": 0}"#));
+        assert_eq!(config.max_form_fields, 0);
     }
 
     #[test]
-    fn test_config_parse_backend_url() {
+    fn test_config_parse_sink() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"sink": {"file": "/tmp/spans.ndjson"}}"#));
+        assert_eq!(
+            config.sink,
+            Some(SinkConfig {
+                file: "/tmp/spans.ndjson".to_string(),
+                also_export: false,
+            })
+        );
+
+        assert!(config.parse_from_json(br#"{"sink": {"file": "/tmp/spans.ndjson", "alsoExport": true}}"#));
+        assert!(config.sink.as_ref().unwrap().also_export);
+
+        // A sink without a file is ignored, null turns it off
+        assert!(config.parse_from_json(br#"{"sink": {"file": " "}}"#));
+        assert!(config.sink.is_some());
+        assert!(config.parse_from_json(br#"{"sink": null}"#));
+        assert!(config.sink.is_none());
+    }
+
+    #[test]
+    fn test_config_parse_body_export() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"bodyExport": "LOG"}"#));
+        assert_eq!(config.body_export, BodyExport::Log);
+
+        assert!(config.parse_from_json(br#"{"bodyExport": "events"}"#));
+        assert_eq!(config.body_export, BodyExport::Log);
+    }
+
+    #[test]
+    fn test_config_parse_span_name_template() {
         let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"spanNameTemplate": {}}"#));
+        let template = config.span_name_template.clone().unwrap();
+        assert!(template.routes.is_empty());
+        assert_eq!(template.segment_patterns.len(), default_segment_patterns().len());
+
         let json_config = json!({
-            "sp_backend_url": "https://custom.backend.com"
+            "spanNameTemplate": {
+                "routes": {"users-get": "GET /users/{id}"},
+                "segmentPatterns": [
+                    {"regex": "^[a-z]{2}-[A-Z]{2}$", "replacement": "{locale}"},
+                    {"regex": "(", "replacement": "{bad}"}
+                ]
+            }
         });
         let config_str = serde_json::to_string(&json_config).unwrap();
-        
         assert!(config.parse_from_json(config_str.as_bytes()));
-        assert_eq!(config.sp_backend_url, "https://custom.backend.com");
+        let template = config.span_name_template.clone().unwrap();
+        assert_eq!(template.routes.get("users-get").map(|s| s.as_str()), Some("GET /users/{id}"));
+        assert_eq!(template.segment_patterns.len(), 1);
+        assert_eq!(template.segment_patterns[0].replacement, "{locale}");
     }
 
     #[test]
-    fn test_config_parse_service_name() {
+    fn test_config_parse_capture_duration() {
         let mut config = Config::default();
         let json_config = json!({
-            "service_name": "test-service"
+            "minDurationMs": 250,
+            "filterCombine": "AND"
         });
         let config_str = serde_json::to_string(&json_config).unwrap();
-        
+
         assert!(config.parse_from_json(config_str.as_bytes()));
-        assert_eq!(config.service_name, "test-service");
+        assert_eq!(config.min_duration_ms, Some(250));
+        assert_eq!(config.filter_combine, FilterCombine::And);
+
+        let json_config = json!({
+            "minDurationMs": 0,
+            "filterCombine": "xor"
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.min_duration_ms, None);
+        assert_eq!(config.filter_combine, FilterCombine::And);
     }
 
     #[test]
-    fn test_config_parse_traffic_direction() {
+    fn test_config_parse_log_format() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"logFormat": "json"}"#));
+        assert_eq!(config.log_format, LogFormat::Json);
+
+        assert!(config.parse_from_json(br#"{"logFormat": "yaml"}"#));
+        assert_eq!(config.log_format, LogFormat::Json);
+    }
+
+    #[test]
+    fn test_config_parse_capture_direction() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"captureDirection": "Inbound"}"#));
+        assert_eq!(config.capture_direction, CaptureDirection::Inbound);
+        assert!(config.capture_direction.allows("inbound"));
+        assert!(!config.capture_direction.allows("outbound"));
+        assert!(!config.capture_direction.allows("auto"));
+
+        assert!(config.parse_from_json(br#"{"captureDirection": "sideways"}"#));
+        assert_eq!(config.capture_direction, CaptureDirection::Inbound);
+        assert!(CaptureDirection::Both.allows("auto"));
+    }
+
+    #[test]
+    fn test_config_parse_xff_trust_hops() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"xffTrustHops": 2}"#));
+        assert_eq!(config.xff_trust_hops, 2);
+    }
+
+    #[test]
+    fn test_config_parse_dedup_window() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"dedupWindowMs": 5000}"#));
+        assert_eq!(config.dedup_window_ms, 5000);
+    }
+
+    #[test]
+    fn test_config_parse_capture_trailers() {
         let mut config = Config::default();
         let json_config = json!({
-            "traffic_direction": "outbound"
+            "captureTrailers": ["Server-Timing", " grpc-status ", ""]
         });
         let config_str = serde_json::to_string(&json_config).unwrap();
-        
+
         assert!(config.parse_from_json(config_str.as_bytes()));
-        assert_eq!(config.traffic_direction, Some("outbound".to_string()));
+        assert_eq!(config.capture_trailers, vec!["server-timing".to_string(), "grpc-status".to_string()]);
     }
 
     #[test]
-    fn test_config_parse_api_key() {
+    fn test_config_parse_capture_header_stats() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"captureHeaderStats": false}"#));
+        assert!(!config.capture_header_stats);
+    }
+
+    #[test]
+    fn test_config_parse_body_preview() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"bodyPreviewBytes": 2048}"#));
+        assert_eq!(config.body_preview_bytes, 2048);
+    }
+
+    #[test]
+    fn test_config_parse_dry_run() {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(br#"{"dryRun": true}"#));
+        assert!(config.dry_run);
+    }
+
+    #[test]
+    fn test_config_parse_query_params() {
         let mut config = Config::default();
         let json_config = json!({
-            "api_key": "test-api-key-123"
+            "redactQueryParams": ["Access_Token", "sig*"],
+            "maxQueryParams": 8
         });
         let config_str = serde_json::to_string(&json_config).unwrap();
-        
+
         assert!(config.parse_from_json(config_str.as_bytes()));
-        assert_eq!(config.public_key, "test-api-key-123");
+        assert_eq!(config.redact_query_params, vec!["access_token".to_string(), "sig*".to_string()]);
+        assert_eq!(config.max_query_params, 8);
     }
 
     #[test]
-    fn test_config_parse_collection_rules() {
+    fn test_config_parse_session_id() {
         let mut config = Config::default();
         let json_config = json!({
-            "collectionRules": {
-                "http": {
-                    "server": [
-                        {"path": "/api/test"}
-                    ],
-                    "client": [
-                        {
-                            "host": "example.com",
-                            "paths": ["/api/endpoint1", "/api/endpoint2"]
-                        }
-                    ]
-                }
-            }
+            "sessionIdHeaders": ["X-Session-ID", "X-Correlation-ID"],
+            "synthesizeSessionId": true
         });
         let config_str = serde_json::to_string(&json_config).unwrap();
-        
+
         assert!(config.parse_from_json(config_str.as_bytes()));
-        assert_eq!(config.collection_rules.len(), 2);
-        
-        // Check server rule
-        assert_eq!(config.collection_rules[0].http.server.path, "/api/test");
-        assert!(config.collection_rules[0].http.client.is_empty());
-        
-        // Check client rule
-        assert!(config.collection_rules[1].http.server.path.is_empty());
-        assert_eq!(config.collection_rules[1].http.client.len(), 1);
-        assert_eq!(config.collection_rules[1].http.client[0].host, "example.com");
-        assert_eq!(config.collection_rules[1].http.client[0].paths.len(), 2);
+        assert_eq!(config.session_id_headers, vec!["x-session-id".to_string(), "x-correlation-id".to_string()]);
+        assert!(config.synthesize_session_id);
+
+        assert!(config.parse_from_json(br#"{"sessionIdHeaders": []}"#));
+        assert_eq!(config.session_id_headers, vec!["x-session-id".to_string(), "x-correlation-id".to_string()]);
+
+        assert!(config.parse_from_json(br#"{"injectSessionId": true, "sessionIdInjectHeader": "X-Session-ID"}"#));
+        assert!(config.inject_session_id);
+        assert_eq!(config.session_id_inject_header, "x-session-id");
+
+        assert!(config.parse_from_json(br#"{"sessionSequence": true, "sessionSeqHeader": "X-SP-Session-Seq", "sessionIdleMs": 60000, "maxSessions": 500}"#));
+        assert!(config.session_sequence);
+        assert_eq!(config.session_seq_header, "x-sp-session-seq");
+        assert_eq!(config.session_idle_ms, 60000);
+        assert_eq!(config.max_sessions, 500);
     }
 
     #[test]
-    fn test_config_parse_exemption_rules() {
+    fn test_config_parse_resource_attributes() {
         let mut config = Config::default();
-        let json_config = json!({
-            "exemptionRules": [
-                {
-                    "hostPatterns": ["internal.com", "localhost"],
-                    "pathPatterns": ["/health", "/metrics"]
-                }
-            ]
+        let json_config = serde_json::json!({
+            "resourceAttributes": {
+                "deployment.environment": "staging",
+                "service.version": 3,
+                "sp.resource.type": "other",
+                "nested": {"a": 1}
+            }
         });
         let config_str = serde_json::to_string(&json_config).unwrap();
-        
+
         assert!(config.parse_from_json(config_str.as_bytes()));
-        assert_eq!(config.exemption_rules.len(), 1);
-        assert_eq!(config.exemption_rules[0].host_patterns.len(), 2);
-        assert_eq!(config.exemption_rules[0].path_patterns.len(), 2);
-        assert!(config.exemption_rules[0].host_patterns.contains(&"internal.com".to_string()));
-        assert!(config.exemption_rules[0].path_patterns.contains(&"/health".to_string()));
+        assert_eq!(
+            config.resource_attributes,
+            vec![
+                ("deployment.environment".to_string(), "staging".to_string()),
+                ("service.version".to_string(), "3".to_string()),
+            ]
+        );
     }
 
     #[test]
-    fn test_config_parse_invalid_json() {
+    fn test_config_parse_sample_rate() {
         let mut config = Config::default();
-        let original_backend = config.sp_backend_url.clone();
-        
-        // Test with invalid JSON
-        assert!(!config.parse_from_json(b"invalid json"));
-        assert_eq!(config.sp_backend_url, original_backend);
-        
-        // Test with invalid UTF-8
-        assert!(!config.parse_from_json(&[0xFF, 0xFE]));
-        assert_eq!(config.sp_backend_url, original_backend);
+        let json_config = json!({
+            "sampleRate": 0.25
+        });
+        let config_str = serde_json::to_string(&json_config).unwrap();
+
+        assert!(config.parse_from_json(config_str.as_bytes()));
+        assert_eq!(config.sample_rate, 0.25);
     }
 
     #[test]
-    fn test_config_parse_empty_exemption_rules() {
+    fn test_config_parse_response_body_content_types() {
         let mut config = Config::default();
-        let json_config = json!({});
+        let json_config = json!({
+            "responseBodyContentTypes": ["application/json", " Application/X-WWW-Form-Urlencoded ", ""]
+        });
         let config_str = serde_json::to_string(&json_config).unwrap();
-        
+
         assert!(config.parse_from_json(config_str.as_bytes()));
-        // Should add default exemption rule
-        assert_eq!(config.exemption_rules.len(), 1);
-        assert!(config.exemption_rules[0].path_patterns.contains(&"/v1/traces".to_string()));
+        assert_eq!(
+            config.response_body_content_types,
+            vec!["application/json".to_string(), "application/x-www-form-urlencoded".to_string()]
+        );
     }
 }
\ No newline at end of file
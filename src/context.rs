@@ -1,11 +1,19 @@
 use proxy_wasm::traits::*;
 use proxy_wasm::types::*;
+use std::borrow::Cow;
 use std::collections::HashMap;
 
-use crate::config::Config;
-use crate::otel::{SpanBuilder, serialize_traces_data};
-use crate::headers::{detect_service_name, build_new_tracestate};
-use crate::http_helpers::{get_backend_authority, get_backend_cluster_name};
+use crate::config::{BodyExport, Config, FilterCombine, TimestampSource};
+use crate::otel::{SpanBuilder, KeyValue};
+use crate::headers::{client_address, detect_service_name, build_new_tracestate, header_stats, redact_headers, strip_hop_by_hop};
+use crate::http_helpers::{
+    content_type_allowed, grpc_method_from_path, is_grpc_content_type, is_websocket_upgrade, method_capture_allowed, path_capture_allowed,
+    capture_filters_pass, capture_forced, count_lines, glob_match, host_excluded, is_text_media_type, local_reply_reason, query_params, redact_query, request_id_mismatch, resolve_tenant, status_capture_allowed, truncate_utf8,
+};
+use crate::decompression::{decompress, is_encoded, DecompressError};
+use crate::multipart::MultipartScanner;
+use crate::body_hash::BodyHasher;
+use crate::redaction::redact_json_body;
 use crate::trace_context::extract_and_propagate_trace_context;
 use crate::traffic::TrafficAnalyzer;
 
@@ -17,13 +25,28 @@ pub struct SpHttpContext {
     pub(crate) response_body: Vec<u8>,
     pub(crate) span_builder: SpanBuilder,
     pub(crate) pending_inject_call_token: Option<u32>,
-    pub(crate) pending_save_call_token: Option<u32>,
     pub(crate) injected: bool,
     pub(crate) config: Config,
     pub(crate) url_host: Option<String>,
     pub(crate) url_path: Option<String>,
     pub(crate) is_from_ingressgateway: bool,  // Cache to avoid calling get_request_header during response phase
     pub(crate) request_start_time: Option<u64>,  // Store request start time in nanoseconds
+    pub(crate) timer: Option<crate::timing::ExchangeTimer>,  // sp.timing.* timestamps, anchored at request start
+    pub(crate) request_body_truncated: bool,
+    pub(crate) response_body_truncated: bool,
+    pub(crate) skip_request_body: bool,  // Set when content-length exceeds captureBodyMaxContentLength
+    pub(crate) skip_response_body: bool,  // Set when the response content-type is not in the allowlist
+    pub(crate) capture_enabled: bool,  // False when this exchange should not be recorded (e.g. sampled out)
+    pub(crate) span_attributes: Vec<KeyValue>,  // Extra attributes collected during the exchange
+    pub(crate) tenant: Option<String>,  // Backend tenant resolved from the tenant header or default
+    pub(crate) is_grpc: bool,  // Response is native gRPC; status comes from grpc-status
+    pub(crate) grpc_web_framed: bool,  // A captured body had its gRPC-Web framing stripped
+    pub(crate) status_matched: Option<bool>,  // captureStatusCodes result, None when not configured
+    pub(crate) span_finalized: bool,  // The exchange's single span was built (or dropped); later callbacks must not add another
+    pub(crate) multipart: Option<MultipartScanner>,  // Streams a multipart request body instead of buffering it
+    pub(crate) request_body_as_fields: bool,  // The request body was recorded as form fields or multipart parts
+    pub(crate) sampled_out: bool,  // Dropped by sampleRate alone; the keep header can still revive it
+    pub(crate) request_body_hasher: Option<BodyHasher>,  // captureBodyHash: fed every request body chunk, uncapped
 }
 
 impl SpHttpContext {
@@ -46,12 +69,27 @@ impl SpHttpContext {
             response_body: Vec::new(),
             span_builder,
             pending_inject_call_token: None,
-            pending_save_call_token: None,
             injected: false,
             url_host: None,
             url_path: None,
             is_from_ingressgateway: false,  // Initialize to false, will be set during request processing
             request_start_time: None,  // Initialize to None, will be set when request starts
+            timer: None,
+            request_body_truncated: false,
+            response_body_truncated: false,
+            skip_request_body: false,
+            skip_response_body: false,
+            capture_enabled: true,
+            span_attributes: Vec::new(),
+            tenant: None,
+            is_grpc: false,
+            grpc_web_framed: false,
+            status_matched: None,
+            span_finalized: false,
+            multipart: None,
+            request_body_as_fields: false,
+            sampled_out: false,
+            request_body_hasher: None,
         }
     }
     // Dispatch injection HTTP call (disabled)
@@ -92,6 +130,31 @@ impl SpHttpContext {
     fn dispatch_async_extraction_save(&mut self) {
         crate::sp_debug!("Starting async extraction save (host={:?}, path={:?})", self.url_host, self.url_path);
 
+        // One span per exchange, whichever callback ends it
+        if self.span_finalized {
+            crate::sp_debug!("Span already finalized for this exchange, skipping");
+            return;
+        }
+        self.span_finalized = true;
+        self.capture_stream_reset();
+        if let Some(timer) = &mut self.timer {
+            let (wall_now, mono_now) = (crate::otel::get_current_timestamp_nanos(), crate::timing::monotonic_nanos());
+            timer.mark_response_end(wall_now, mono_now);
+            if self.config.timestamp_source == TimestampSource::MonotonicAnchored {
+                let (unanchored_start, _) = timer.span_times();
+                timer.anchor_to_batch(wall_now, mono_now);
+                self.span_builder.rebase_events(unanchored_start, timer.span_times().0);
+            }
+            self.span_attributes.extend(timer.attributes());
+        }
+
+        // Final status/duration filter decision, now that the exchange is complete
+        if !self.end_of_response_filters_pass() {
+            crate::sp_debug!("Exchange excluded by captureStatusCodes/minDurationMs, discarding capture");
+            self.discard_capture();
+            return;
+        }
+
         // Early skip: Next.js RSC / prefetch requests
         if self.is_rsc_or_prefetch() {
             crate::sp_debug!("RSC/prefetch request detected, skipping trace upload");
@@ -118,65 +181,246 @@ impl SpHttpContext {
             }
         }
 
+        if self.is_duplicate_hop() {
+            crate::sp_debug!("Span for this hop was already exported within dedupWindowMs, skipping");
+            return;
+        }
+
         crate::sp_debug!("Storing agent data asynchronously (backend={})", self.config.sp_backend_url);
 
-        // Create extract span using references to avoid cloning
-        let traces_data = self.span_builder.create_extract_span(
-            &self.request_headers,
-            &self.request_body,
-            &self.response_headers,
-            &self.response_body,
-            self.url_host.as_deref(),
-            self.url_path.as_deref(),
-            self.request_start_time,  // Pass the stored request start time
-        );
+        // Strict backends drop spans with malformed ids; never hand them one
+        self.span_builder.ensure_valid_ids();
 
-        // Serialize to protobuf
-        let otel_data = match serialize_traces_data(&traces_data) {
-            Ok(bytes) => bytes,
-            Err(e) => {
-                crate::sp_error!("Serialization error: {}", e);
-                return;
-            }
+        // Drop hop-by-hop headers and redact sensitive values before anything is serialized
+        let (request_headers, response_headers) = if self.config.strip_hop_by_hop_headers {
+            (
+                strip_hop_by_hop(&self.request_headers, &self.config.hop_by_hop_headers),
+                strip_hop_by_hop(&self.response_headers, &self.config.hop_by_hop_headers),
+            )
+        } else {
+            (self.request_headers.clone(), self.response_headers.clone())
         };
+        let mut request_headers = redact_headers(&request_headers, &self.config.redact_headers);
+        let response_headers = redact_headers(&response_headers, &self.config.redact_headers);
+
+        // Query values matching redactQueryParams are redacted wherever the path is recorded:
+        // url attributes, the default span name, the :path header and the tee
+        let url_path = self.url_path.as_deref().map(|path| redact_query(path, &self.config.redact_query_params));
+        if let Some(path) = request_headers.get(":path") {
+            let path = redact_query(path, &self.config.redact_query_params);
+            request_headers.insert(":path".to_string(), path);
+        }
 
-        // Get backend authority from configured URL
-        let authority = get_backend_authority(&self.config.sp_backend_url);
-
-        // Prepare HTTP headers for the async save call
-        let content_length = otel_data.len().to_string();
-        let http_headers = vec![
-            (":method", "POST"),
-            (":path", "/v1/traces"),
-            (":authority", &authority),
-            ("content-type", "application/x-protobuf"),
-            ("content-length", &content_length),
-            ("x-public-key", &self.config.public_key),
-        ];
+        let mut request_body = Cow::Borrowed(self.request_body.as_slice());
+        let mut response_body = Cow::Borrowed(self.response_body.as_slice());
+
+        // Undo Content-Encoding on the captured copies before anything inspects them.
+        // Bodies that fail to decompress are kept as captured and annotated.
+        let mut decompressed_any = false;
+        let mut still_encoded = [false, false];  // request, response
+        for (is_request, body) in [(true, &mut request_body), (false, &mut response_body)] {
+            match self.decompress_body(is_request, body) {
+                Ok(Some(decompressed)) => {
+                    *body = Cow::Owned(decompressed);
+                    decompressed_any = true;
+                }
+                Ok(None) => {}
+                Err(e) => {
+                    crate::sp_debug!("Could not decompress {} body: {:?}", if is_request { "request" } else { "response" }, e);
+                    self.span_attributes.push(crate::otel::string_attribute("sp.body.decompression_error", e.reason()));
+                    still_encoded[usize::from(!is_request)] = true;
+                }
+            }
+        }
+        if decompressed_any {
+            self.span_attributes.push(crate::otel::bool_attribute("sp.body.decompressed", true));
+        }
 
-        // Fire and forget async call to /v1/traces endpoint for storage
-        let cluster_name = get_backend_cluster_name(&self.config.sp_backend_url);
-        let timeout = std::time::Duration::from_secs(5);
+        // A response without a content-type is classified from its first bytes
+        let mut response_sniffed_text = false;
+        if !response_body.is_empty() && !self.response_headers.contains_key("content-type") {
+            let sniffed = crate::sniff::sniff(&response_body);
+            crate::sp_debug!("Response has no content-type, sniffed {}", sniffed);
+            self.span_attributes.push(crate::otel::string_attribute("sp.body.content_type_sniffed", sniffed.to_string()));
+            if content_type_allowed(Some(sniffed), &self.config.response_body_content_types) {
+                response_sniffed_text = crate::sniff::is_text(sniffed);
+            } else {
+                crate::sp_debug!("Sniffed content-type {} not in allowlist, dropping response body", sniffed);
+                self.span_attributes.push(crate::otel::string_attribute("sp.response.body.skipped", "content-type".to_string()));
+                response_body = Cow::Borrowed(&[]);
+            }
+        }
 
-        match self.dispatch_http_call(
-            &cluster_name,
-            http_headers,
-            Some(&otel_data),
-            vec![],
-            timeout,
-        ) {
-            Ok(call_id) => {
-                crate::sp_info!("Extraction: HTTP call dispatched successfully (call_id={})", call_id);
-                self.pending_save_call_token = Some(call_id);
+        // Line counts of captured text bodies, decompressed but before redaction or previews.
+        // A body cut at maxRequestBodyBytes or maxResponseBodyBytes is counted as far as it
+        // was captured. Bodies still encoded because decompression failed are not counted.
+        for (key, body, headers, truncated, encoded) in [
+            ("sp.request.body.line_count", &request_body, &self.request_headers, self.request_body_truncated, still_encoded[0]),
+            ("sp.body.line_count", &response_body, &self.response_headers, self.response_body_truncated, still_encoded[1]),
+        ] {
+            if body.is_empty() || encoded || !is_text_media_type(headers.get("content-type").map(|v| v.as_str())) {
+                continue;
+            }
+            self.span_attributes.push(crate::otel::int_attribute(key, count_lines(body) as i64));
+            if truncated {
+                self.span_attributes.push(crate::otel::bool_attribute(&format!("{}_truncated", key), true));
+            }
+        }
+
+        // Protobuf bodies with a registered schema become JSON first, so redaction covers them
+        let mut decoded_request = None;
+        let mut decoded_response = None;
+        if self.config.decode_protobuf {
+            decoded_request = self.decode_protobuf_body(true, &request_body);
+            decoded_response = self.decode_protobuf_body(false, &response_body);
+            if let Some(json) = &decoded_request {
+                request_body = Cow::Owned(json.clone().into_bytes());
+            }
+            if let Some(json) = &decoded_response {
+                response_body = Cow::Owned(json.clone().into_bytes());
+            }
+
+            let binary_bodies = [
+                (&request_body, &self.request_headers, decoded_request.is_some()),
+                (&response_body, &self.response_headers, decoded_response.is_some() || response_sniffed_text),
+            ];
+            let fell_back = binary_bodies
+                .iter()
+                .any(|(body, headers, decoded)| !body.is_empty() && !decoded && !crate::otel::is_text_content(headers));
+            if fell_back {
+                let encoding = self.config.binary_body_encoding.as_str();
+                self.span_attributes.push(crate::otel::string_attribute("sp.body.encoding", encoding.to_string()));
+            } else if decoded_request.is_some() || decoded_response.is_some() {
+                self.span_attributes.push(crate::otel::string_attribute("sp.body.encoding", "json".to_string()));
             }
-            Err(status) => {
-                let error_msg = format!(
-                    "SP Extraction: Failed to dispatch HTTP call, status: {:?}",
-                    status
-                );
-                crate::sp_error!("{}", error_msg);
+        }
+        // Redact JSON body fields on the captured copies only; forwarded bodies are untouched
+        if !self.config.redact_json_paths.is_empty() {
+            let mut skipped_nonjson = false;
+            for body in [&mut request_body, &mut response_body] {
+                if body.is_empty() {
+                    continue;
+                }
+                match redact_json_body(body, &self.config.redact_json_paths) {
+                    Some(redacted) => *body = Cow::Owned(redacted),
+                    None => skipped_nonjson = true,
+                }
+            }
+            if skipped_nonjson {
+                crate::sp_debug!("Body is not valid JSON, skipping JSON redaction");
+                self.span_attributes.push(crate::otel::string_attribute("sp.body.redaction", "skipped-nonjson".to_string()));
             }
         }
+
+        // Large response bodies are reduced to a preview, taken after redaction
+        let preview_bytes = self.config.body_preview_bytes;
+        if preview_bytes > 0 && response_body.len() > preview_bytes {
+            let preview = truncate_utf8(&response_body, preview_bytes);
+            let preview_value = if response_sniffed_text || crate::otel::is_text_content(&response_headers) {
+                String::from_utf8_lossy(preview).to_string()
+            } else {
+                self.config.binary_body_encoding.encode(preview)
+            };
+            self.span_attributes.push(crate::otel::string_attribute("sp.body.preview", preview_value));
+            self.span_attributes.push(crate::otel::int_attribute("sp.body.length", response_body.len() as i64));
+            self.span_attributes.push(crate::otel::bool_attribute("sp.body.preview_only", true));
+            response_body = Cow::Borrowed(&[]);
+        }
+
+        // The tee sees every captured request, before and regardless of span rate limiting.
+        // Form and multipart bodies are no longer held as raw bytes, so they are not mirrored.
+        let now_ms = crate::otel::get_current_timestamp_nanos() / 1_000_000;
+        if let Some(tee) = self.config.tee.as_ref().filter(|_| !self.request_body_as_fields) {
+            let trace_id = self.span_builder.get_trace_id_hex();
+            let mirror = crate::tee::Mirror {
+                method: self.request_headers.get(":method").map_or("", |v| v.as_str()),
+                path: url_path.as_deref().unwrap_or("/"),
+                host: self.url_host.as_deref().unwrap_or(""),
+                content_type: request_headers.get("content-type").map(|v| v.as_str()),
+                session_id: self.span_builder.get_session_id(),
+                trace_id: &trace_id,
+                body: &request_body,
+                truncated: self.request_body_truncated,
+            };
+            crate::tee::send(self, tee, self.config.dry_run, now_ms, &mirror);
+        } else if self.config.tee.is_some() {
+            crate::sp_debug!("Request body was recorded as fields, not mirroring it to the tee");
+        }
+
+        match crate::trace_limit::check(self, &self.span_builder.get_trace_id_hex(), now_ms, self.config.max_spans_per_trace) {
+            crate::trace_limit::Verdict::Export => {}
+            crate::trace_limit::Verdict::Truncate => {
+                crate::sp_info!("Trace reached maxSpansPerTrace ({}), dropping its further spans", self.config.max_spans_per_trace);
+                self.span_attributes.push(crate::otel::bool_attribute("sp.trace.truncated", true));
+            }
+            crate::trace_limit::Verdict::Drop => {
+                crate::sp_debug!("Trace is over maxSpansPerTrace, dropping span");
+                crate::metrics::increment_counter(crate::metrics::TRACE_SPANS_DROPPED_TOTAL, 1);
+                return;
+            }
+        }
+        if !crate::ratelimit::allow_span(self, self.tenant.as_deref(), now_ms, &self.config) {
+            return;
+        }
+
+        // bodyExport=log: bodies leave the span and go out as linked log records.
+        // Decoded protobuf bodies are JSON text despite their content-type.
+        if self.config.body_export == BodyExport::Log {
+            let bodies = [
+                ("request", &*request_body, decoded_request.is_some() || crate::otel::is_text_content(&request_headers)),
+                ("response", &*response_body, decoded_response.is_some() || response_sniffed_text || crate::otel::is_text_content(&response_headers)),
+            ];
+            let request_id = self.request_headers.get("x-request-id").map(|v| v.as_str());
+            if let Some(logs_data) = self.span_builder.create_body_logs(&bodies, request_id) {
+                crate::export::enqueue_logs(self, &self.config.plugin_name, self.tenant.as_deref(), logs_data);
+            }
+            request_body = Cow::Borrowed(&[]);
+            response_body = Cow::Borrowed(&[]);
+        }
+
+        // Decoded bodies keep their protobuf content-type, and sniffed ones have none, so
+        // they are recorded here as text rather than left to the span builder, which would
+        // base64 them
+        if decoded_request.is_some() && !request_body.is_empty() {
+            self.span_attributes.push(crate::otel::string_attribute(
+                "http.request.body",
+                String::from_utf8_lossy(&request_body).to_string(),
+            ));
+            request_body = Cow::Borrowed(&[]);
+        }
+        if (decoded_response.is_some() || response_sniffed_text) && !response_body.is_empty() {
+            self.span_attributes.push(crate::otel::string_attribute(
+                "http.response.body",
+                String::from_utf8_lossy(&response_body).to_string(),
+            ));
+            response_body = Cow::Borrowed(&[]);
+        }
+
+        // Span times come from the timer only when anchored; wall mode keeps the
+        // per-exchange wall clock readings
+        let (span_start, span_end) = match &self.timer {
+            Some(timer) if self.config.timestamp_source == TimestampSource::MonotonicAnchored => {
+                let (start, end) = timer.span_times();
+                (Some(start), end)
+            }
+            _ => (self.request_start_time, None),
+        };
+
+        // Create extract span
+        let traces_data = self.span_builder.create_extract_span(
+            &request_headers,
+            &request_body,
+            &response_headers,
+            &response_body,
+            self.url_host.as_deref(),
+            url_path.as_deref(),
+            span_start,
+            span_end,
+            &self.span_attributes,
+        );
+
+        // Hand off to the batch exporter
+        crate::export::enqueue(self, &self.config.plugin_name, self.tenant.as_deref(), traces_data);
     }
 
     fn inject_trace_context_headers(&mut self) {
@@ -264,6 +508,7 @@ impl Context for SpHttpContext {
         body_size: usize,
         _num_trailers: usize,
     ) {
+        self.enter_log_context();
         crate::sp_debug!("HTTP call response received: token={}, body_size={}", token_id, body_size);
 
         // Get response status
@@ -280,19 +525,9 @@ impl Context for SpHttpContext {
             Vec::new()
         };
 
-        // Check if this is the response to our async save call
-        if let Some(pending_save_token) = self.pending_save_call_token {
-            if pending_save_token == token_id {
-                crate::sp_debug!("Processing async save response (status_code={})", status_code);
-                self.pending_save_call_token = None;
-
-                if status_code >= 200 && status_code < 300 {
-                    crate::sp_info!("Async save completed (status: {})", status_code);
-                } else {
-                    crate::sp_error!("Async save failed with status: {}", status_code);
-                }
-                return;
-            }
+        // Check if this is the response to a batch export dispatched from this context
+        if crate::export::on_export_response(self, token_id, status_code) {
+            return;
         }
 
         // Check if this is the response to our injection lookup call
@@ -335,27 +570,51 @@ impl Context for SpHttpContext {
             }
         }
     }
+
+    fn on_grpc_call_response(&mut self, token_id: u32, status_code: u32, _response_size: usize) {
+        self.enter_log_context();
+        // Only batch exports use gRPC; forward them like HTTP export responses
+        if !crate::export::on_export_grpc_response(self, token_id, status_code) {
+            crate::sp_debug!("Ignoring unknown gRPC call response: token={}", token_id);
+        }
+    }
 }
 
 impl HttpContext for SpHttpContext {
     fn on_http_request_headers(&mut self, _num_headers: usize, end_of_stream: bool) -> Action {
+        self.enter_log_context();
         // Record request start time as early as possible
         if self.request_start_time.is_none() {
-            self.request_start_time = Some(crate::otel::get_current_timestamp_nanos());
+            let now = crate::otel::get_current_timestamp_nanos();
+            self.request_start_time = Some(now);
+            self.timer = Some(crate::timing::ExchangeTimer::start(now, crate::timing::monotonic_nanos()));
+        }
+
+        // Route overrides replace this stream's copy of the config before anything reads it
+        self.apply_route_overrides();
+
+        if self.handle_flush_endpoint() {
+            return Action::Pause;
         }
         
         let traffic_direction = crate::traffic::TrafficAnalyzer::detect_traffic_direction(self, &self.config);
         crate::sp_debug!("{} request headers callback invoked", traffic_direction);
         
         // Get initial request headers
+        let raw_headers = self.get_http_request_headers();
+        crate::metrics::increment_counter(crate::metrics::REQUEST_BYTES_TOTAL, header_stats(&raw_headers).1 as i64);
+        self.record_header_stats("request", &raw_headers);
         let mut initial_headers = HashMap::new();
-        for (key, value) in self.get_http_request_headers() {
+        for (key, value) in raw_headers {
             crate::sp_debug!("on_http_request_headers request header: {}: {}", key, value);
             initial_headers.insert(key, value);
         }
 
         // Copy to request_headers cache
         self.request_headers = initial_headers.clone();
+
+        // The capture kill switch is stripped even when the request is not captured
+        let capture_disabled = self.strip_disable_capture_header();
         
         // Cache the ingressgateway check result to avoid calling get_request_header during response phase
         self.is_from_ingressgateway = crate::traffic::TrafficAnalyzer::is_from_istio_ingressgateway(self);
@@ -367,8 +626,14 @@ impl HttpContext for SpHttpContext {
         }
 
         // Detect service name
-        let detected_service_name = detect_service_name(&self.request_headers, &self.config.service_name);
+        let detected_service_name = detect_service_name(
+            &self.request_headers,
+            &self.config.service_name,
+            self.config.workload_name.as_deref(),
+        );
         let public_key = self.config.public_key.clone();
+        let (links, dropped_links) =
+            crate::span_links::parse(&initial_headers, &self.config.link_headers, self.config.max_span_links);
 
         // Update url info
         self.update_url_info();
@@ -378,58 +643,116 @@ impl HttpContext for SpHttpContext {
             .span_builder
             .clone()
             .with_service_name(detected_service_name)
-            .with_traffic_direction(traffic_direction)
+            .with_traffic_direction(traffic_direction.clone())
             .with_public_key(public_key)
+            .with_resource_attributes(self.config.resource_attributes.clone())
+            .with_propagators(self.config.propagators.clone())
+            .with_session_id_headers(self.config.session_id_headers.clone())
+            .with_synthesized_session_id(self.config.synthesize_session_id)
+            .with_binary_body_encoding(self.config.binary_body_encoding)
+            .with_links(links, dropped_links)
+            .with_captured_response_headers(self.config.capture_response_headers.clone())
             .with_context(&initial_headers);
+        // The session and trace ids are known from here on
+        self.enter_log_context();
+
+        // Decide whether to capture this exchange; propagation below happens either way
+        if capture_disabled {
+            crate::sp_debug!("Request opted out of capture via {}", self.config.disable_capture_header);
+            self.capture_enabled = false;
+        }
+        self.apply_capture_filters(&traffic_direction);
+        if self.capture_enabled {
+            self.resolve_tenant();
+        }
+        if self.capture_enabled {
+            self.apply_sampling_decision();
+        }
+        self.capture_baggage();
+        if self.capture_enabled {
+            self.capture_request_attributes();
+            self.check_request_content_length();
+            self.record_session_sequence();
+            if self.config.capture_body_hash && !self.skip_request_body && !end_of_stream {
+                self.request_body_hasher = Some(BodyHasher::new(self.config.body_hash_algorithm));
+            }
+        }
 
         // Inject trace context headers
         self.inject_trace_context_headers();
+        self.inject_session_id_header();
 
         // If no body, perform injection lookup now
         if end_of_stream {
-            match self.dispatch_injection_lookup() {
-                Ok(call_id) => {
-                    self.pending_inject_call_token = Some(call_id);
-                    return Action::Pause;
-                }
-                Err(e) => {
-                    crate::sp_error!("Injection lookup error: {}, continuing", e);
-                }
-            }
+            return self.finish_request();
         }
 
         Action::Continue
     }
 
     fn on_http_request_body(&mut self, body_size: usize, end_of_stream: bool) -> Action {
+        self.enter_log_context();
+        // Each callback sees only the new chunk, so counting needs no buffering
+        crate::metrics::increment_counter(crate::metrics::REQUEST_BYTES_TOTAL, body_size as i64);
         if self.is_from_ingressgateway {
             return Action::Continue;
         }
+        if self.capture_enabled {
+            self.hash_request_body(body_size, end_of_stream);
+        }
 
-        // Buffer request body
-        if let Some(body) = self.get_http_request_body(0, body_size) {
-            self.request_body.extend_from_slice(&body);
+        // Buffer request body up to the configured cap; the upstream still receives the full body.
+        // Multipart bodies are scanned chunk by chunk instead.
+        if self.capture_enabled && !self.skip_request_body {
+            if self.multipart.is_none() && self.config.max_form_fields > 0 && self.config.max_request_body_bytes > 0 {
+                let boundary = crate::http_helpers::multipart_boundary(self.request_headers.get("content-type").map(|v| v.as_str()));
+                self.multipart = boundary.map(|b| MultipartScanner::new(&b, self.config.max_form_fields));
+            }
+            if self.multipart.is_some() {
+                self.scan_multipart_body(body_size);
+            } else {
+                self.buffer_request_body(body_size);
+            }
         }
 
         if end_of_stream {
-            match self.dispatch_injection_lookup() {
-                Ok(call_id) => {
-                    self.pending_inject_call_token = Some(call_id);
-                    return Action::Pause;
-                }
-                Err(e) => {
-                    crate::sp_error!("Injection lookup error: {}, continuing", e);
-                }
+            let content_type = self.request_headers.get("content-type").cloned();
+            if self.capture_enabled && !self.skip_request_body && !self.request_body_truncated {
+                let mut body = std::mem::take(&mut self.request_body);
+                self.unframe_grpc_web_body(content_type.as_deref(), &mut body);
+                self.request_body = body;
+            }
+            if self.capture_enabled && !self.skip_request_body {
+                self.capture_form_body(content_type.as_deref());
             }
+
+            return self.finish_request();
         }
 
         Action::Continue
     }
 
     fn on_http_response_headers(&mut self, num_headers: usize, end_of_stream: bool) -> Action {
+        self.enter_log_context();
         crate::sp_debug!("proxied response headers - num_headers: {}, end_of_stream: {}", num_headers, end_of_stream);
-        
-        if self.is_from_ingressgateway || self.injected {
+        if let Some(timer) = &mut self.timer {
+            timer.mark_ttfb(crate::otel::get_current_timestamp_nanos(), crate::timing::monotonic_nanos());
+        }
+
+        // The keep hint is stripped even when the exchange is not captured
+        if self.strip_keep_header() && self.sampled_out {
+            crate::sp_debug!("Upstream asked to keep this exchange via {}, overriding sampling", self.config.keep_header);
+            self.sampled_out = false;
+            self.capture_enabled = true;
+            self.capture_request_attributes();
+            self.span_attributes.push(crate::otel::bool_attribute("sp.capture.kept", true));
+        }
+
+        // Read once, after the keep hint is gone: counted for every exchange, captured below
+        let raw_headers = self.get_http_response_headers();
+        crate::metrics::increment_counter(crate::metrics::RESPONSE_BYTES_TOTAL, header_stats(&raw_headers).1 as i64);
+
+        if self.is_from_ingressgateway || self.injected || !self.capture_enabled {
             return Action::Continue;
         }
 
@@ -440,9 +763,53 @@ impl HttpContext for SpHttpContext {
         }
 
         // Capture response headers
-        for (key, value) in self.get_http_response_headers() {
+        self.record_header_stats("response", &raw_headers);
+        self.capture_server_timing(&raw_headers);
+        for (key, value) in raw_headers {
             self.response_headers.insert(key, value);
         }
+        self.check_response_request_id();
+        self.capture_response_source();
+        self.capture_span_events();
+
+        // Status filter: the request was buffered before the status was known, so a
+        // failing response drops that buffer here instead of building a span. With
+        // filterCombine=or a slow request can still qualify, so that case is left to
+        // the duration check at the end of the response.
+        if !self.config.capture_status_codes.is_empty() {
+            let status_code = self.response_headers.get(":status").and_then(|s| s.parse::<u32>().ok());
+            let matched = status_capture_allowed(status_code, &self.config.capture_status_codes);
+            self.status_matched = Some(matched);
+            if !matched && (self.config.min_duration_ms.is_none() || self.config.filter_combine == FilterCombine::And) {
+                crate::sp_debug!("Status {:?} excluded by captureStatusCodes, discarding capture", status_code);
+                self.discard_capture();
+                return Action::Continue;
+            }
+        }
+
+        // WebSocket: record the upgrade now; frames that follow are not HTTP bodies
+        let upgraded = self.response_headers.get(":status").map(|s| s.as_str()) == Some("101");
+        if upgraded && is_websocket_upgrade(self.request_headers.get("upgrade").map(|v| v.as_str())) {
+            self.finish_websocket_upgrade();
+            return Action::Continue;
+        }
+
+        // gRPC: name the span after the method and take the status from grpc-status
+        let content_type = self.response_headers.get("content-type").map(|v| v.as_str());
+        if is_grpc_content_type(content_type) {
+            self.start_grpc_capture();
+        }
+
+        self.capture_upstream_info();
+
+        // Decide up front whether the response body is worth buffering. Without a
+        // content-type the body is buffered and the allowlist applied to its sniffed type.
+        let content_type = self.response_headers.get("content-type").map(|v| v.as_str());
+        if content_type.is_some() && !content_type_allowed(content_type, &self.config.response_body_content_types) {
+            crate::sp_debug!("Response content-type {:?} not in allowlist, skipping body capture", content_type);
+            self.skip_response_body = true;
+            self.span_attributes.push(crate::otel::string_attribute("sp.response.body.skipped", "content-type".to_string()));
+        }
 
         // Extract and propagate trace context
         self.extract_and_propagate_trace_context_impl();
@@ -456,18 +823,25 @@ impl HttpContext for SpHttpContext {
     }
 
     fn on_http_response_body(&mut self, body_size: usize, end_of_stream: bool) -> Action {
+        self.enter_log_context();
+        crate::metrics::increment_counter(crate::metrics::RESPONSE_BYTES_TOTAL, body_size as i64);
         crate::sp_debug!("proxied response body - body_size: {}, end_of_stream: {}", body_size, end_of_stream);
 
-        if self.is_from_ingressgateway || self.injected {
+        if self.is_from_ingressgateway || self.injected || !self.capture_enabled {
             return Action::Continue;
         }
 
         // Buffer response body
-        if let Some(body) = self.get_http_response_body(0, body_size) {
-            self.response_body.extend_from_slice(&body);
+        if !self.skip_response_body {
+            self.buffer_response_body(body_size);
         }
 
         if end_of_stream {
+            let content_type = self.response_headers.get("content-type").cloned();
+            let mut body = std::mem::take(&mut self.response_body);
+            self.unframe_grpc_web_body(content_type.as_deref(), &mut body);
+            self.response_body = body;
+
             if let Some(status) = self.response_headers.get(":status") {
                 crate::sp_debug!("Processing response (status: {})", status);
                 self.dispatch_async_extraction_save();
@@ -476,9 +850,920 @@ impl HttpContext for SpHttpContext {
 
         Action::Continue
     }
+
+    fn on_http_response_trailers(&mut self, num_trailers: usize) -> Action {
+        self.enter_log_context();
+        crate::sp_debug!("proxied response trailers - num_trailers: {}", num_trailers);
+
+        if self.is_from_ingressgateway || self.injected || !self.capture_enabled {
+            return Action::Continue;
+        }
+
+        // Trailers end the stream, so the body callback never saw end_of_stream and the
+        // span is only built here, after the allowlisted trailers are recorded
+        self.capture_trailers();
+        if self.is_grpc {
+            if let Some(grpc_status) = self.get_http_response_trailer("grpc-status") {
+                let grpc_message = self.get_http_response_trailer("grpc-message");
+                self.record_grpc_status(&grpc_status, grpc_message);
+            }
+        }
+        self.dispatch_async_extraction_save();
+
+        Action::Continue
+    }
+
+    fn on_log(&mut self) {
+        self.enter_log_context();
+        if self.is_from_ingressgateway || self.injected || !self.capture_enabled || self.span_finalized {
+            return;
+        }
+
+        // The stream ended without a final response callback (e.g. a downstream reset
+        // mid-body); close the span here so the exchange is still recorded once. A stream
+        // reset before any response is recorded too, without response attributes.
+        if !self.response_headers.is_empty() || self.stream_reset_details().is_some() {
+            crate::sp_debug!("Stream closed before the response completed, finalizing span");
+            self.span_attributes.push(crate::otel::bool_attribute("sp.body.partial", true));
+            self.dispatch_async_extraction_save();
+        }
+    }
 }
 
 impl SpHttpContext {
+    /// Apply sampleRate. Sessions are sampled deterministically by session id so a
+    /// session is either fully captured or fully dropped; requests that arrived
+    /// without a session id get an independent per-request roll. A captureIfHeader
+    /// match skips the roll entirely.
+    fn apply_sampling_decision(&mut self) {
+        if capture_forced(&self.request_headers, &self.config.capture_if_header) {
+            crate::sp_debug!("Request matches captureIfHeader, capturing regardless of sampleRate");
+            self.span_attributes.push(crate::otel::bool_attribute("sp.capture.forced", true));
+            return;
+        }
+
+        let sample_rate = self.config.sample_rate;
+        if sample_rate >= 1.0 {
+            return;
+        }
+
+        let sampled = if self.span_builder.is_session_id_generated() {
+            crate::sampling::should_sample_request(self._context_id, sample_rate)
+        } else {
+            crate::sampling::should_sample_session(self.span_builder.get_session_id(), sample_rate)
+        };
+
+        crate::sp_debug!("Sampling decision (rate={}): sampled={}", sample_rate, sampled);
+        if sampled {
+            self.span_attributes.push(crate::otel::bool_attribute("sp.sampled", true));
+        } else {
+            self.capture_enabled = false;
+            self.sampled_out = true;
+        }
+    }
+
+    /// Record a complete form-urlencoded request body as sp.form.<key> attributes instead
+    /// of one opaque body; values of keys matching redactHeaders are redacted. A truncated
+    /// form body is left as captured. Multipart bodies were never buffered; their part
+    /// metadata is recorded instead.
+    fn capture_form_body(&mut self, content_type: Option<&str>) {
+        if let Some(scanner) = self.multipart.take() {
+            let boundary = crate::http_helpers::multipart_boundary(content_type).unwrap_or_default();
+            let (parts, truncated, size) = scanner.finish();
+            crate::sp_debug!("Scanned {} multipart parts (truncated={})", parts.len(), truncated);
+            self.span_attributes.push(crate::otel::string_attribute("sp.multipart.boundary", boundary));
+            self.span_attributes.push(crate::otel::int_attribute("sp.multipart.size", size as i64));
+            for (i, part) in parts.into_iter().enumerate() {
+                if let Some(name) = part.name {
+                    self.span_attributes.push(crate::otel::string_attribute(&format!("sp.multipart.part[{}].name", i), name));
+                }
+                if let Some(content_type) = part.content_type {
+                    self.span_attributes
+                        .push(crate::otel::string_attribute(&format!("sp.multipart.part[{}].content-type", i), content_type));
+                }
+                self.span_attributes.push(crate::otel::int_attribute(&format!("sp.multipart.part[{}].size", i), part.size as i64));
+            }
+            if truncated {
+                self.span_attributes.push(crate::otel::bool_attribute("sp.multipart.truncated", true));
+            }
+            self.request_body_as_fields = true;
+            return;
+        }
+        if self.config.max_form_fields == 0
+            || self.request_body.is_empty()
+            || self.request_body_truncated
+            || !crate::http_helpers::is_form_urlencoded(content_type)
+        {
+            return;
+        }
+
+        let (fields, truncated) = crate::http_helpers::form_fields(&self.request_body, &self.config.redact_headers, self.config.max_form_fields);
+        crate::sp_debug!("Captured {} form fields (truncated={})", fields.len(), truncated);
+        for (key, value) in fields {
+            self.span_attributes.push(crate::otel::string_attribute(&format!("sp.form.{}", key), value));
+        }
+        if truncated {
+            self.span_attributes.push(crate::otel::bool_attribute("sp.form.truncated", true));
+        }
+        // The raw body would repeat the fields, redacted ones included
+        self.request_body.clear();
+        self.request_body_as_fields = true;
+    }
+
+    /// Replace a complete gRPC-Web body with its message payload when captureGrpcWeb is on.
+    /// The span exporter then records the payload base64-encoded.
+    fn unframe_grpc_web_body(&mut self, content_type: Option<&str>, body: &mut Vec<u8>) {
+        if !self.config.capture_grpc_web || body.is_empty() {
+            return;
+        }
+        let encoding = match crate::grpc_web::grpc_web_encoding(content_type) {
+            Some(encoding) => encoding,
+            None => return,
+        };
+
+        match crate::grpc_web::unframe(body, encoding) {
+            Some(payload) => {
+                *body = payload;
+                if !self.grpc_web_framed {
+                    self.grpc_web_framed = true;
+                    self.span_attributes.push(crate::otel::bool_attribute("sp.grpc.framed", true));
+                }
+            }
+            None => {
+                crate::sp_debug!("Malformed gRPC-Web body, capturing raw bytes");
+            }
+        }
+    }
+
+    /// Decompress a captured body per its Content-Encoding, bounded by that side's body
+    /// limit. Ok(None) when the body is empty or not encoded. A body cut at its size limit
+    /// is not attempted: a compressed prefix never decodes cleanly.
+    fn decompress_body(&self, is_request: bool, body: &[u8]) -> Result<Option<Vec<u8>>, DecompressError> {
+        let (headers, max_len, truncated) = if is_request {
+            (&self.request_headers, self.config.max_request_body_bytes, self.request_body_truncated)
+        } else {
+            (&self.response_headers, self.config.max_response_body_bytes, self.response_body_truncated)
+        };
+        match headers.get("content-encoding") {
+            Some(content_encoding) if truncated && is_encoded(content_encoding) => {
+                Err(DecompressError::Truncated)
+            }
+            Some(content_encoding) if !body.is_empty() => decompress(body, content_encoding, max_len),
+            _ => Ok(None),
+        }
+    }
+
+    /// Decode a captured protobuf body to JSON using the first protoSchemas entry whose glob
+    /// matches the path. None when no schema applies or decoding fails; the caller then
+    /// keeps the raw bytes.
+    fn decode_protobuf_body(&self, is_request: bool, body: &[u8]) -> Option<String> {
+        if body.is_empty() {
+            return None;
+        }
+        let headers = if is_request { &self.request_headers } else { &self.response_headers };
+        if crate::otel::is_text_content(headers) {
+            return None;
+        }
+
+        let path = self.request_headers.get(":path").map(|p| p.as_str()).unwrap_or("");
+        let path_only = path.split('?').next().unwrap_or("");
+        let schema = self
+            .config
+            .proto_schemas
+            .iter()
+            .find(|schema| glob_match(&schema.path_pattern, path_only))?;
+        let pool = crate::protobuf::cached_pool(&schema.descriptor_set, self.config.proto_descriptor_cache_size)?;
+
+        let configured_type = if is_request { &schema.request_type } else { &schema.response_type };
+        let message_type = match configured_type {
+            Some(message_type) => message_type.as_str(),
+            None => {
+                let (input, output) = pool.method_types(path)?;
+                if is_request { input } else { output }
+            }
+        };
+
+        // Native gRPC bodies are length-prefixed; gRPC-Web bodies were unframed on capture
+        let content_type = headers.get("content-type").map(|v| v.as_str());
+        let unframed;
+        let message: &[u8] = if is_grpc_content_type(content_type) {
+            unframed = crate::grpc_web::unframe(body, crate::grpc_web::GrpcWebEncoding::Binary)?;
+            &unframed
+        } else {
+            body
+        };
+
+        let json = pool.decode_to_json(message_type, message);
+        if json.is_none() {
+            crate::sp_debug!("Could not decode {} body as {}, keeping raw bytes", if is_request { "request" } else { "response" }, message_type);
+        }
+        json
+    }
+
+    /// Set up a gRPC capture. A trailers-only response carries grpc-status in the headers;
+    /// otherwise it arrives in the trailers.
+    fn start_grpc_capture(&mut self) {
+        self.is_grpc = true;
+        if let Some(method) = self.request_headers.get(":path").and_then(|p| grpc_method_from_path(p)) {
+            self.span_builder.set_span_name(method);
+        }
+        if let Some(grpc_status) = self.response_headers.get("grpc-status").cloned() {
+            let grpc_message = self.response_headers.get("grpc-message").cloned();
+            self.record_grpc_status(&grpc_status, grpc_message);
+        }
+    }
+
+    fn record_grpc_status(&mut self, grpc_status: &str, grpc_message: Option<String>) {
+        let code = match grpc_status.trim().parse::<i64>() {
+            Ok(code) => code,
+            Err(_) => {
+                crate::sp_debug!("Ignoring unparseable grpc-status: {}", grpc_status);
+                return;
+            }
+        };
+        self.span_attributes.push(crate::otel::int_attribute(crate::semconv::RPC_GRPC_STATUS_CODE, code));
+        if code != 0 {
+            let message = match grpc_message {
+                Some(message) if !message.is_empty() => format!("grpc-status {}: {}", code, message),
+                _ => format!("grpc-status {}", code),
+            };
+            self.span_builder.set_error(message);
+        }
+    }
+
+    /// Overlay the route's sp.overrides metadata, if any, for the rest of the stream
+    fn apply_route_overrides(&mut self) {
+        let overrides = self
+            .get_property(crate::route_config::ROUTE_OVERRIDES_PROPERTY.to_vec())
+            .and_then(|bytes| String::from_utf8(bytes).ok())
+            .filter(|json| !json.trim().is_empty());
+        if let Some(overrides) = overrides {
+            crate::sp_debug!("Applying route config overrides");
+            self.config = crate::route_config::effective_config(&self.config, &overrides);
+        }
+    }
+
+    /// Attach this request's ids to log lines emitted during the current callback
+    fn enter_log_context(&self) {
+        crate::logging::set_context(
+            self._context_id,
+            self.span_builder.get_session_id(),
+            self.span_builder.get_trace_id_hex(),
+        );
+    }
+
+    /// Apply minDurationMs, combined with the status filter result per filterCombine
+    fn end_of_response_filters_pass(&self) -> bool {
+        let duration_ok = self.config.min_duration_ms.map(|min_duration_ms| {
+            let elapsed_nanos = self
+                .request_start_time
+                .map(|start| crate::otel::get_current_timestamp_nanos().saturating_sub(start))
+                .unwrap_or(0);
+            elapsed_nanos / 1_000_000 >= min_duration_ms
+        });
+        capture_filters_pass(self.status_matched, duration_ok, self.config.filter_combine)
+    }
+
+    /// Check-and-claim the (trace, inbound span, direction) dedup key. Requests without
+    /// an inbound trace context get fresh ids, so they can never be duplicates.
+    fn is_duplicate_hop(&self) -> bool {
+        if self.config.dedup_window_ms == 0 {
+            return false;
+        }
+        let parent_span_id = match self.span_builder.get_parent_span_id_hex() {
+            Some(span_id) => span_id,
+            None => return false,
+        };
+        let key = crate::dedup::dedup_key(
+            &self.span_builder.get_trace_id_hex(),
+            &parent_span_id,
+            self.span_builder.get_traffic_direction(),
+        );
+        let now_ms = crate::otel::get_current_timestamp_nanos() / 1_000_000;
+        !crate::dedup::claim(self, &key, now_ms, self.config.dedup_window_ms)
+    }
+
+    /// Record sp.<side>.header_count and sp.<side>.headers_bytes unless captureHeaderStats is off
+    fn record_header_stats(&mut self, side: &str, headers: &[(String, String)]) {
+        if !self.config.capture_header_stats {
+            return;
+        }
+        let (count, bytes) = header_stats(headers);
+        self.span_attributes.push(crate::otel::int_attribute(&format!("sp.{}.header_count", side), count as i64));
+        self.span_attributes.push(crate::otel::int_attribute(&format!("sp.{}.headers_bytes", side), bytes as i64));
+    }
+
+    /// Record the matched Envoy route and virtual host as sp.route.*, and the route name
+    /// as http.route. With spanNameTemplate the templated route is recorded as http.route
+    /// instead and also names the span.
+    fn capture_route(&mut self) {
+        let read_property = |ctx: &Self, path: Vec<&str>| {
+            ctx.get_property(path)
+                .and_then(|bytes| String::from_utf8(bytes).ok())
+                .filter(|value| !value.is_empty())
+        };
+        let route_name = read_property(self, vec!["xds", "route_name"]).or_else(|| read_property(self, vec!["route_name"]));
+        let virtual_host = read_property(self, vec!["xds", "virtual_host_name"]);
+        self.span_attributes
+            .extend(crate::semconv::route_attributes(route_name.as_deref(), virtual_host.as_deref()));
+        if let Some(template) = &self.config.span_name_template {
+            let method = self.request_headers.get(":method").map(|m| m.as_str());
+            let path = self.url_path.as_deref().unwrap_or("");
+            let (name, route) = template.resolve(method, route_name.as_deref(), path);
+            self.span_builder.set_span_name(name);
+            self.span_attributes.push(crate::otel::string_attribute(crate::semconv::HTTP_ROUTE, route));
+            return;
+        }
+        if let Some(route_name) = route_name {
+            self.span_attributes.push(crate::otel::string_attribute(crate::semconv::HTTP_ROUTE, route_name));
+        }
+    }
+
+    /// Record each Server-Timing duration as sp.server_timing.<name>_ms. An upstream may
+    /// send several Server-Timing headers; they read as one comma-separated list.
+    fn capture_server_timing(&mut self, raw_headers: &[(String, String)]) {
+        if !self.config.capture_server_timing {
+            return;
+        }
+        let value = raw_headers
+            .iter()
+            .filter(|(name, _)| name.eq_ignore_ascii_case("server-timing"))
+            .map(|(_, value)| value.as_str())
+            .collect::<Vec<_>>()
+            .join(",");
+        if value.is_empty() {
+            return;
+        }
+        for metric in crate::server_timing::parse(&value) {
+            if let Some(dur_ms) = metric.dur_ms {
+                let key = crate::server_timing::attribute_key(&metric.name);
+                self.span_attributes.push(crate::otel::double_attribute(&key, dur_ms));
+            }
+        }
+    }
+
+    /// Record which upstream served the request, the attempts Envoy made and the upstream
+    /// service time. Local replies have no upstream, so missing values are simply skipped.
+    fn capture_upstream_info(&mut self) {
+        let read_property = |ctx: &Self, path: Vec<&str>| {
+            ctx.get_property(path)
+                .and_then(|bytes| String::from_utf8(bytes).ok())
+                .filter(|value| !value.is_empty())
+        };
+
+        let upstream_host = read_property(self, vec!["upstream", "address"])
+            .or_else(|| read_property(self, vec!["upstream_host"]));
+        if let Some(upstream_host) = upstream_host {
+            self.span_attributes.push(crate::otel::string_attribute(crate::semconv::NET_PEER_NAME, upstream_host));
+        }
+
+        let upstream_cluster = read_property(self, vec!["xds", "cluster_name"])
+            .or_else(|| read_property(self, vec!["cluster_name"]));
+        if let Some(upstream_cluster) = upstream_cluster {
+            self.span_attributes.push(crate::otel::string_attribute("sp.upstream.cluster", upstream_cluster));
+        }
+        self.capture_upstream_authority();
+
+        // Retries: the router reports attempts only when the virtual host sets
+        // include_attempt_count_in_response; the attribute works without it on newer Envoys
+        let header_number = |ctx: &Self, name: &str| {
+            ctx.response_headers.get(name).and_then(|v| v.trim().parse::<i64>().ok())
+        };
+        let attempts = header_number(self, "x-envoy-attempt-count").or_else(|| {
+            self.get_property(vec!["upstream", "request_attempt_count"])
+                .and_then(|bytes| <[u8; 8]>::try_from(bytes.as_slice()).ok())
+                .map(|bytes| u64::from_le_bytes(bytes) as i64)
+                .filter(|attempts| *attempts > 0)
+        });
+        if let Some(attempts) = attempts {
+            self.span_attributes.push(crate::otel::int_attribute("sp.upstream.attempts", attempts));
+        }
+        if let Some(service_time_ms) = header_number(self, "x-envoy-upstream-service-time") {
+            self.span_attributes.push(crate::otel::int_attribute("sp.upstream.service_time_ms", service_time_ms));
+        }
+    }
+
+    /// Envoy's response.code_details, when they say the stream was reset
+    fn stream_reset_details(&self) -> Option<String> {
+        self.get_property(vec!["response", "code_details"])
+            .and_then(|bytes| String::from_utf8(bytes).ok())
+            .filter(|details| crate::http_helpers::stream_reset(details).is_some())
+    }
+
+    /// Record a stream reset (an HTTP/2 RST_STREAM, or a connection lost mid-exchange) as
+    /// sp.http2.reset_code and sp.http2.reset_by, and mark the span as errored. Envoy also
+    /// answers some upstream resets with a local 503, which is recorded the same way.
+    fn capture_stream_reset(&mut self) {
+        let details = match self.stream_reset_details() {
+            Some(details) => details,
+            None => return,
+        };
+        if let Some((reset_by, reason)) = crate::http_helpers::stream_reset(&details) {
+            crate::sp_debug!("Stream reset by {}: {}", reset_by, details);
+            self.span_attributes.push(crate::otel::string_attribute("sp.http2.reset_code", reason));
+            self.span_attributes.push(crate::otel::string_attribute("sp.http2.reset_by", reset_by.to_string()));
+            self.span_builder.set_error(format!("stream reset: {}", details));
+        }
+    }
+
+    /// Record captureTrailers values as sp.trailer.<name>, redacted like headers
+    fn capture_trailers(&mut self) {
+        if self.config.capture_trailers.is_empty() {
+            return;
+        }
+        let mut trailers = HashMap::new();
+        for name in &self.config.capture_trailers {
+            if let Some(value) = self.get_http_response_trailer(name) {
+                trailers.insert(name.clone(), value);
+            }
+        }
+        let mut trailers: Vec<(String, String)> = redact_headers(&trailers, &self.config.redact_headers).into_iter().collect();
+        trailers.sort();
+        for (name, value) in trailers {
+            self.span_attributes.push(crate::otel::string_attribute(&format!("sp.trailer.{}", name), value));
+        }
+    }
+
+    /// Export the span for a WebSocket upgrade immediately and stop buffering; the
+    /// connection may stay open long after the exchange that matters has finished
+    fn finish_websocket_upgrade(&mut self) {
+        crate::sp_debug!("WebSocket upgrade, finalizing span at 101");
+        self.span_attributes.push(crate::otel::string_attribute("sp.protocol", "websocket".to_string()));
+        if let Some(subprotocol) = self.response_headers.get("sec-websocket-protocol") {
+            self.span_attributes.push(crate::otel::string_attribute("sp.websocket.subprotocol", subprotocol.clone()));
+        }
+        self.capture_upstream_info();
+        self.skip_response_body = true;
+        self.response_body = Vec::new();
+        self.dispatch_async_extraction_save();
+        self.discard_capture();
+    }
+
+    /// Stop capturing this exchange and release anything buffered so far
+    fn discard_capture(&mut self) {
+        self.capture_enabled = false;
+        self.multipart = None;
+        self.request_body = Vec::new();
+        self.response_body = Vec::new();
+        self.span_attributes = Vec::new();
+    }
+
+    /// Request-time capture filters (direction, method, path); excluded requests skip buffering and span creation
+    fn apply_capture_filters(&mut self, traffic_direction: &str) {
+        if !self.config.capture_direction.allows(traffic_direction) {
+            crate::sp_debug!("Direction {} excluded by captureDirection, skipping capture", traffic_direction);
+            self.capture_enabled = false;
+            return;
+        }
+
+        let method = self.request_headers.get(":method").map(|m| m.as_str());
+        if !method_capture_allowed(method, &self.config.capture_methods) {
+            crate::sp_debug!("Method {:?} excluded by captureMethods, skipping capture", method);
+            self.capture_enabled = false;
+            return;
+        }
+
+        let path = self.request_headers.get(":path").map(|p| p.as_str()).unwrap_or("");
+        if !path_capture_allowed(path, &self.config.capture_paths, &self.config.ignore_paths) {
+            crate::sp_debug!("Path {} excluded by capturePaths/ignorePaths, skipping capture", path);
+            self.capture_enabled = false;
+        }
+    }
+
+    /// Answer a request to flushEndpointPath (with enableFlushEndpoint) locally: flush the
+    /// export batch and reply 204. The request never reaches the upstream and is not
+    /// captured. The query string is ignored.
+    fn handle_flush_endpoint(&mut self) -> bool {
+        if !self.config.enable_flush_endpoint {
+            return false;
+        }
+        let path = self.get_http_request_header(":path").unwrap_or_default();
+        if path.split('?').next() != Some(self.config.flush_endpoint_path.as_str()) {
+            return false;
+        }
+        crate::sp_info!("Flush endpoint {} requested, flushing export batches", self.config.flush_endpoint_path);
+        crate::export::request_flush(self);
+        self.capture_enabled = false;
+        self.send_http_response(204, vec![], None);
+        true
+    }
+
+    /// Remove the disableCaptureHeader kill switch so it is not forwarded upstream.
+    /// Returns whether the request carried it.
+    fn strip_disable_capture_header(&mut self) -> bool {
+        let header = self.config.disable_capture_header.clone();
+        if header.is_empty() || self.request_headers.remove(&header).is_none() {
+            return false;
+        }
+        self.set_http_request_header(&header, None);
+        true
+    }
+
+    /// Remove the keep header from the response; true when it asked to keep the exchange
+    fn strip_keep_header(&mut self) -> bool {
+        let header = self.config.keep_header.clone();
+        if header.is_empty() {
+            return false;
+        }
+        let value = match self.get_http_response_header(&header) {
+            Some(value) => value,
+            None => return false,
+        };
+        self.set_http_response_header(&header, None);
+        matches!(value.trim().to_ascii_lowercase().as_str(), "true" | "1")
+    }
+
+    /// Resolve the backend tenant; captures with an unsafe tenant value are skipped
+    fn resolve_tenant(&mut self) {
+        match resolve_tenant(&self.request_headers, &self.config.tenant_header, &self.config.default_tenant) {
+            Ok(tenant) => self.tenant = tenant,
+            Err(tenant) => {
+                crate::sp_warn!("Skipping capture: tenant '{}' is not safe for the export path", tenant);
+                self.capture_enabled = false;
+            }
+        }
+    }
+
+    /// Forward a locally generated session id so downstream hops join the same session.
+    /// A header already on the request is never overwritten.
+    fn inject_session_id_header(&mut self) {
+        if !self.config.inject_session_id || !self.span_builder.is_session_id_generated() {
+            return;
+        }
+        let header = self.config.session_id_inject_header.clone();
+        if self.request_headers.contains_key(&header) {
+            return;
+        }
+        let session_id = self.span_builder.get_session_id().to_string();
+        crate::sp_debug!("Injecting generated session id into {}", header);
+        self.add_http_request_header(&header, &session_id);
+        self.request_headers.insert(header, session_id);
+    }
+
+    /// Number this exchange within its session as sp.session.seq, and forward the number
+    /// in sessionSeqHeader when one is configured
+    fn record_session_sequence(&mut self) {
+        if !self.config.session_sequence || !self.span_builder.has_session_id() {
+            return;
+        }
+        let now_ms = crate::otel::get_current_timestamp_nanos() / 1_000_000;
+        let session_id = self.span_builder.get_session_id().to_string();
+        let seq = match crate::session::next_sequence(
+            self,
+            &session_id,
+            now_ms,
+            self.config.session_idle_ms,
+            self.config.max_sessions,
+        ) {
+            Some(seq) => seq,
+            None => return,
+        };
+        self.span_attributes.push(crate::otel::int_attribute("sp.session.seq", seq as i64));
+        if !self.config.session_seq_header.is_empty() {
+            let header = self.config.session_seq_header.clone();
+            self.set_http_request_header(&header, Some(&seq.to_string()));
+        }
+    }
+
+    /// Record the request authority (:authority, else host) as server.address and
+    /// sp.http.host, unless the host is in captureHostExclude
+    fn capture_host(&mut self) {
+        if !self.config.capture_host {
+            return;
+        }
+        let authority = match self.url_host.as_deref() {
+            Some(authority) if !host_excluded(authority, &self.config.capture_host_exclude) => authority,
+            _ => return,
+        };
+        let attributes = crate::semconv::host_attributes(authority);
+        self.span_attributes.extend(attributes);
+    }
+
+    /// Record sp.upstream.authority when a route's host rewrite changed the authority
+    /// after this filter saw it. The request.host property reads the live header map,
+    /// so by response time it holds what the upstream was sent.
+    fn capture_upstream_authority(&mut self) {
+        if !self.config.capture_host {
+            return;
+        }
+        let downstream = match self.url_host.as_deref() {
+            Some(downstream) => downstream,
+            None => return,
+        };
+        let upstream = self
+            .get_property(vec!["request", "host"])
+            .and_then(|bytes| String::from_utf8(bytes).ok())
+            .filter(|upstream| !upstream.is_empty() && !upstream.eq_ignore_ascii_case(downstream));
+        if let Some(upstream) = upstream {
+            if !host_excluded(&upstream, &self.config.capture_host_exclude) {
+                self.span_attributes.push(crate::otel::string_attribute(crate::semconv::SP_UPSTREAM_AUTHORITY, upstream));
+            }
+        }
+    }
+
+    /// Record client.address from x-forwarded-for, trusting only xffTrustHops entries,
+    /// or from the downstream remote address
+    fn capture_client_address(&mut self) {
+        let remote_address = self
+            .get_property(vec!["source", "address"])
+            .and_then(|bytes| String::from_utf8(bytes).ok());
+        let xff = self.request_headers.get("x-forwarded-for").map(|v| v.as_str());
+        if let Some(address) = client_address(xff, self.config.xff_trust_hops, remote_address.as_deref()) {
+            self.span_attributes.push(crate::otel::string_attribute(crate::semconv::CLIENT_ADDRESS, address.to_string()));
+        }
+    }
+
+    /// Request-side attributes that only need the cached request headers, so they can also
+    /// be recorded late when the keep header revives a sampled-out exchange
+    fn capture_request_attributes(&mut self) {
+        self.capture_route();
+        self.capture_host();
+        self.capture_request_id();
+        self.capture_query_params();
+        self.capture_client_address();
+        self.capture_peer_identity();
+        self.capture_tls_info();
+    }
+
+    /// Record Envoy's x-request-id as sp.request.id, a correlation key that is present
+    /// even without a session or test header
+    fn capture_request_id(&mut self) {
+        let request_id = self.request_headers.get("x-request-id").map(|v| v.trim()).filter(|v| !v.is_empty());
+        if let Some(request_id) = request_id {
+            self.span_attributes.push(crate::otel::string_attribute("sp.request.id", request_id.to_string()));
+        }
+    }
+
+    /// Flag a response x-request-id that differs from the request's, usually an id
+    /// regenerated by another hop
+    fn check_response_request_id(&mut self) {
+        let request_id = self.request_headers.get("x-request-id").map(|v| v.as_str());
+        let response_id = self.response_headers.get("x-request-id").map(|v| v.as_str());
+        if request_id_mismatch(request_id, response_id) {
+            crate::sp_debug!("Response x-request-id {:?} differs from request's {:?}", response_id, request_id);
+            self.span_attributes.push(crate::otel::bool_attribute("sp.request.id_mismatch", true));
+        }
+    }
+
+    /// Tag responses Envoy generated itself (no healthy upstream, an RBAC denial, a direct
+    /// response route) as sp.response.source=local_reply, with the code details as the
+    /// reason. Envoy sets the details before the reply reaches the encoder filters.
+    fn capture_response_source(&mut self) {
+        let details = match self.get_property(vec!["response", "code_details"]).and_then(|bytes| String::from_utf8(bytes).ok()) {
+            Some(details) => details,
+            None => return,
+        };
+        if let Some(reason) = local_reply_reason(&details) {
+            crate::sp_debug!("Local reply from Envoy: {}", reason);
+            self.span_attributes.push(crate::otel::string_attribute("sp.response.source", "local_reply".to_string()));
+            self.span_attributes.push(crate::otel::string_attribute("sp.response.local_reply_reason", reason.to_string()));
+        }
+    }
+
+    /// captureSpanEvents: redirects and auth challenges, stamped with this response's
+    /// first byte so they sit on the same clock as the span
+    fn capture_span_events(&mut self) {
+        if !self.config.capture_span_events {
+            return;
+        }
+        let time = self
+            .timer
+            .and_then(|timer| timer.ttfb())
+            .unwrap_or_else(crate::otel::get_current_timestamp_nanos);
+        for event in crate::span_events::from_response_headers(&self.response_headers, &self.config.redact_headers, time) {
+            crate::sp_debug!("Recording span event {}", event.name);
+            self.span_builder.add_event(event, self.config.max_span_events);
+        }
+    }
+
+    /// Record the downstream peer's certificate URI SAN (the SPIFFE ID in an Istio mesh)
+    /// as sp.peer.spiffe_id and enduser.id. Plaintext connections have no peer
+    /// certificate, so nothing is recorded.
+    fn capture_peer_identity(&mut self) {
+        if !self.config.capture_mtls_identity {
+            return;
+        }
+        let identity = self
+            .get_property(vec!["connection", "uri_san_peer_certificate"])
+            .and_then(|bytes| String::from_utf8(bytes).ok())
+            .map(|identity| identity.trim().to_string())
+            .filter(|identity| !identity.is_empty());
+        if let Some(identity) = identity {
+            self.span_attributes.push(crate::otel::string_attribute("sp.peer.spiffe_id", identity.clone()));
+            self.span_attributes.push(crate::otel::string_attribute(crate::semconv::ENDUSER_ID, identity));
+        }
+    }
+
+    /// Record the SNI the client asked for as sp.tls.sni and the negotiated ALPN protocol as
+    /// sp.tls.alpn. Envoy only sets connection.tls_version on TLS connections, so plaintext
+    /// ones record neither.
+    fn capture_tls_info(&mut self) {
+        if !self.config.capture_tls_info {
+            return;
+        }
+        let read_property = |ctx: &Self, name: &str| {
+            ctx.get_property(vec!["connection", name])
+                .and_then(|bytes| String::from_utf8(bytes).ok())
+                .map(|value| value.trim().to_string())
+                .filter(|value| !value.is_empty())
+        };
+        if read_property(self, "tls_version").is_none() {
+            return;
+        }
+        if let Some(sni) = read_property(self, "requested_server_name") {
+            self.span_attributes.push(crate::otel::string_attribute("sp.tls.sni", sni));
+        }
+        if let Some(alpn) = read_property(self, "negotiated_protocol") {
+            self.span_attributes.push(crate::otel::string_attribute("sp.tls.alpn", alpn));
+        }
+    }
+
+    /// Record query string parameters as sp.query.<key>, redacted per redactQueryParams
+    fn capture_query_params(&mut self) {
+        if self.config.max_query_params == 0 {
+            return;
+        }
+        let path = match self.request_headers.get(":path") {
+            Some(path) => path.clone(),
+            None => return,
+        };
+        let (params, truncated) = query_params(&path, &self.config.redact_query_params, self.config.max_query_params);
+        for (key, value) in params {
+            self.span_attributes.push(crate::otel::string_attribute(&format!("sp.query.{}", key), value));
+        }
+        if truncated {
+            self.span_attributes.push(crate::otel::bool_attribute("sp.query.truncated", true));
+        }
+    }
+
+    /// Record allowlisted W3C baggage entries as sp.baggage.<key> attributes
+    fn capture_baggage(&mut self) {
+        if self.config.capture_baggage_keys.is_empty() {
+            return;
+        }
+        let baggage = match self.request_headers.get("baggage") {
+            Some(baggage) => baggage.clone(),
+            None => return,
+        };
+
+        for (key, mut value) in crate::trace_context::parse_baggage(&baggage) {
+            if !self.config.capture_baggage_keys.contains(&key) {
+                continue;
+            }
+            let max_bytes = self.config.max_baggage_value_bytes;
+            if value.len() > max_bytes {
+                let mut end = max_bytes;
+                while !value.is_char_boundary(end) {
+                    end -= 1;
+                }
+                value.truncate(end);
+            }
+            self.span_attributes.push(crate::otel::string_attribute(&format!("sp.baggage.{}", key), value));
+        }
+    }
+
+    /// End of the request stream: run the injection lookup, holding the request for its
+    /// answer
+    fn finish_request(&mut self) -> Action {
+        match self.dispatch_injection_lookup() {
+            Ok(call_id) => {
+                self.pending_inject_call_token = Some(call_id);
+                Action::Pause
+            }
+            Err(e) => {
+                crate::sp_error!("Injection lookup error: {}, continuing", e);
+                Action::Continue
+            }
+        }
+    }
+
+    /// Feed the whole chunk to the captureBodyHash hasher, past maxRequestBodyBytes too, and
+    /// record sp.request.body_hash once the body is complete. A body cut short by a reset
+    /// never gets a hash.
+    fn hash_request_body(&mut self, body_size: usize, end_of_stream: bool) {
+        if self.request_body_hasher.is_none() {
+            return;
+        }
+        if body_size > 0 {
+            if let Some(chunk) = self.get_http_request_body(0, body_size) {
+                if let Some(hasher) = self.request_body_hasher.as_mut() {
+                    hasher.update(&chunk);
+                }
+            }
+        }
+        if end_of_stream {
+            if let Some(hasher) = self.request_body_hasher.take() {
+                self.span_attributes.push(crate::otel::string_attribute("sp.request.body_hash", hasher.finish()));
+                self.span_attributes.push(crate::otel::string_attribute(
+                    "sp.request.body_hash_algorithm",
+                    self.config.body_hash_algorithm.as_str().to_string(),
+                ));
+            }
+        }
+    }
+
+    /// Feed the current multipart body chunk to the scanner without keeping it.
+    /// maxRequestBodyBytes bounds how much is scanned; later bytes are only counted.
+    fn scan_multipart_body(&mut self, body_size: usize) {
+        let (seen, done) = match self.multipart.as_ref() {
+            Some(scanner) => (scanner.bytes_seen(), scanner.is_done()),
+            None => return,
+        };
+        let remaining = (self.config.max_request_body_bytes as u64).saturating_sub(seen) as usize;
+        let chunk = if !done && remaining > 0 && body_size > 0 {
+            self.get_http_request_body(0, body_size.min(remaining))
+        } else {
+            None
+        };
+
+        let fetched = chunk.as_ref().map_or(0, |c| c.len());
+        if let Some(scanner) = self.multipart.as_mut() {
+            if let Some(chunk) = chunk {
+                scanner.feed(&chunk);
+            }
+            if body_size > fetched {
+                if !scanner.is_done() {
+                    crate::sp_debug!("Multipart body exceeds {} bytes, stopping scan", self.config.max_request_body_bytes);
+                }
+                scanner.stop();
+                scanner.skip(body_size - fetched);
+            }
+        }
+    }
+
+    /// Skip request body capture up front when content-length is over
+    /// captureBodyMaxContentLength, so no chunk is ever copied. Chunked requests have no
+    /// content-length and are left to the maxRequestBodyBytes cap.
+    fn check_request_content_length(&mut self) {
+        let max_len = self.config.capture_body_max_content_length;
+        if max_len == 0 {
+            return;
+        }
+        let content_length = match self.request_headers.get("content-length").and_then(|v| v.trim().parse::<u64>().ok()) {
+            Some(content_length) => content_length,
+            None => return,
+        };
+        if content_length > max_len {
+            crate::sp_debug!("Request content-length {} exceeds {}, skipping body capture", content_length, max_len);
+            self.skip_request_body = true;
+            self.span_attributes.push(crate::otel::string_attribute("sp.body.skipped", "too-large".to_string()));
+            self.span_attributes.push(crate::otel::int_attribute("sp.request.content_length", content_length as i64));
+        }
+    }
+
+    /// Append the current request body chunk to the capture buffer, honoring max_request_body_bytes.
+    /// Works for chunked requests too since the cap is applied per accumulated byte, not Content-Length.
+    fn buffer_request_body(&mut self, body_size: usize) {
+        let max_bytes = self.config.max_request_body_bytes;
+        let remaining = max_bytes.saturating_sub(self.request_body.len());
+
+        if remaining > 0 && body_size > 0 {
+            if let Some(body) = self.get_http_request_body(0, body_size.min(remaining)) {
+                self.request_body.extend_from_slice(&body);
+            }
+        }
+
+        // A zero cap means headers only, which is not reported as truncation
+        if max_bytes > 0 && body_size > remaining && !self.request_body_truncated {
+            crate::sp_debug!("Request body exceeds {} bytes, truncating capture", max_bytes);
+            self.request_body_truncated = true;
+            self.span_attributes.push(crate::otel::bool_attribute("sp.body.truncated", true));
+            crate::metrics::increment_counter(crate::metrics::BODY_TRUNCATED_TOTAL, 1);
+
+            // Record the original length so the backend knows how much was dropped
+            if let Some(content_length) = self
+                .request_headers
+                .get("content-length")
+                .and_then(|v| v.parse::<i64>().ok())
+            {
+                self.span_attributes.push(crate::otel::int_attribute("sp.request.content_length", content_length));
+            }
+        }
+    }
+
+    /// Buffer a response body chunk up to maxResponseBodyBytes, marking the span
+    /// `sp.body.truncated` once the cap is hit. The response itself is not modified.
+    fn buffer_response_body(&mut self, body_size: usize) {
+        let max_bytes = self.config.max_response_body_bytes;
+        let remaining = max_bytes.saturating_sub(self.response_body.len());
+
+        if remaining > 0 && body_size > 0 {
+            if let Some(body) = self.get_http_response_body(0, body_size.min(remaining)) {
+                self.response_body.extend_from_slice(&body);
+            }
+        }
+
+        if max_bytes > 0 && body_size > remaining && !self.response_body_truncated {
+            crate::sp_debug!("Response body exceeds {} bytes, truncating capture", max_bytes);
+            self.response_body_truncated = true;
+            // The request side may have set it already
+            if !self.request_body_truncated {
+                self.span_attributes.push(crate::otel::bool_attribute("sp.body.truncated", true));
+            }
+            crate::metrics::increment_counter(crate::metrics::BODY_TRUNCATED_TOTAL, 1);
+        }
+    }
+
     /// Check if the current request is for static resources based on URL path and Content-Type
     fn is_static_resource(&self) -> bool {
         is_static_resource(self.url_path.as_deref(), &self.response_headers)
@@ -576,4 +1861,417 @@ fn is_static_resource(url_path: Option<&str>, response_headers: &HashMap<String,
     }
     
     false
-}
\ No newline at end of file
+}
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::headers::REDACTED_VALUE;
+    use crate::otel::Span;
+    use crate::test_host::{self, span_attribute};
+
+    const REQUEST_HEADERS: &[(&str, &str)] = &[
+        (":method", "POST"),
+        (":path", "/orders"),
+        (":authority", "shop.example"),
+        ("content-type", "application/json"),
+        ("authorization", "Bearer s3cret"),
+        ("x-api-key", "k-123"),
+    ];
+    const RESPONSE_HEADERS: &[(&str, &str)] = &[(":status", "201"), ("content-type", "application/json")];
+
+    fn config(json: &str) -> Config {
+        let mut config = Config::default();
+        assert!(config.parse_from_json(json.as_bytes()));
+        config
+    }
+
+    /// Drive one exchange through the callbacks in the order Envoy makes them, with each
+    /// body chunk exposed as the current buffer, then flush the export batch
+    fn run_exchange(
+        config: Config,
+        request_headers: &[(&str, &str)],
+        request_chunks: &[&[u8]],
+        response_chunks: &[&[u8]],
+    ) -> SpHttpContext {
+        run_exchange_with_response(config, request_headers, request_chunks, RESPONSE_HEADERS, response_chunks)
+    }
+
+    fn run_exchange_with_response(
+        config: Config,
+        request_headers: &[(&str, &str)],
+        request_chunks: &[&[u8]],
+        response_headers: &[(&str, &str)],
+        response_chunks: &[&[u8]],
+    ) -> SpHttpContext {
+        crate::export::configure(&config);
+        let mut ctx = SpHttpContext::new(1, config);
+
+        test_host::set_request_headers(request_headers);
+        ctx.on_http_request_headers(request_headers.len(), request_chunks.is_empty());
+        for (i, chunk) in request_chunks.iter().enumerate() {
+            test_host::set_request_body(chunk);
+            ctx.on_http_request_body(chunk.len(), i + 1 == request_chunks.len());
+        }
+
+        test_host::advance_time(std::time::Duration::from_millis(25));
+        test_host::set_response_headers(response_headers);
+        ctx.on_http_response_headers(response_headers.len(), response_chunks.is_empty());
+        for (i, chunk) in response_chunks.iter().enumerate() {
+            test_host::set_response_body(chunk);
+            ctx.on_http_response_body(chunk.len(), i + 1 == response_chunks.len());
+        }
+        ctx.on_log();
+
+        crate::export::flush(&ctx, &ctx.config.plugin_name);
+        ctx
+    }
+
+    fn only_span() -> Span {
+        let mut spans = test_host::exported_spans();
+        assert_eq!(spans.len(), 1, "expected exactly one exported span");
+        spans.remove(0)
+    }
+
+    #[test]
+    fn test_plugins_sharing_a_vm_keep_their_own_export_settings() {
+        let mut inbound = config(r#"{"public_key": "pk-inbound", "backendUrl": "http://inbound.example"}"#);
+        inbound.plugin_name = "inbound".to_string();
+        let mut outbound = config(r#"{"public_key": "pk-outbound", "backendUrl": "http://outbound.example"}"#);
+        outbound.plugin_name = "outbound".to_string();
+
+        // Both plugins configure before either exports, as when the VM starts
+        crate::export::configure(&inbound);
+        crate::export::configure(&outbound);
+        let ctx = SpHttpContext::new(1, inbound);
+        for plugin_name in ["inbound", "outbound"] {
+            crate::export::enqueue(&ctx, plugin_name, None, crate::otel::SpanBuilder::new().create_heartbeat_span(1000));
+            crate::export::flush(&ctx, plugin_name);
+        }
+
+        let calls = test_host::http_calls();
+        assert_eq!(calls.len(), 2);
+        for (call, plugin_name) in calls.iter().zip(["inbound", "outbound"]) {
+            assert_eq!(call.header("x-public-key"), Some(format!("pk-{}", plugin_name).as_str()));
+            let backend_url = format!("http://{}.example", plugin_name);
+            assert_eq!(call.upstream, crate::http_helpers::get_backend_cluster_name(&backend_url));
+        }
+    }
+
+    #[test]
+    fn test_exchange_is_exported_as_one_span() {
+        let config = config(r#"{"public_key": "pk-test", "serviceName": "shop"}"#);
+        run_exchange(config, REQUEST_HEADERS, &[b"{\"item\": ", b"42}"], &[b"{\"id\": 7}"]);
+
+        let calls = test_host::http_calls();
+        assert_eq!(calls.len(), 1);
+        assert_eq!(calls[0].header(":path"), Some("/v1/traces"));
+        assert_eq!(calls[0].header("x-public-key"), Some("pk-test"));
+
+        let span = only_span();
+        assert_eq!(span.name, "/orders");
+        assert_eq!(span.end_time_unix_nano - span.start_time_unix_nano, 25_000_000);
+        assert_eq!(span_attribute(&span, "http.request.body").as_deref(), Some("{\"item\": 42}"));
+        assert_eq!(span_attribute(&span, "http.response.body").as_deref(), Some("{\"id\": 7}"));
+        assert_eq!(span_attribute(&span, crate::semconv::HTTP_STATUS_CODE).as_deref(), Some("201"));
+
+        // The upstream request carries the span's trace context
+        let traceparent = test_host::request_header("traceparent").expect("traceparent injected");
+        let trace_id: String = span.trace_id.iter().map(|b| format!("{:02x}", b)).collect();
+        assert!(traceparent.contains(&trace_id), "{} does not carry trace {}", traceparent, trace_id);
+        assert_eq!(test_host::metric(crate::metrics::SPANS_CAPTURED_TOTAL), Some(1));
+    }
+
+    #[test]
+    fn test_malformed_traceparents_never_reach_the_exported_span() {
+        let malformed = [
+            ("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01"),
+            ("traceparent", "00-00000000000000000000000000000000-00f067aa0ba902b7-01"),
+            ("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01"),
+            ("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01"),
+            ("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902-01"),
+            ("traceparent", "garbage"),
+            ("tracestate", "x-sp-traceparent=00-00000000000000000000000000000000-0000000000000000-01"),
+        ];
+        for (name, value) in malformed {
+            let mut headers = REQUEST_HEADERS.to_vec();
+            headers.push((name, value));
+            run_exchange(config("{}"), &headers, &[], &[b"{}"]);
+
+            let spans = test_host::exported_spans();
+            let span = spans.last().expect("span exported");
+            assert!(crate::trace_context::is_valid_trace_id(&span.trace_id), "{}: {}", name, value);
+            assert!(crate::trace_context::is_valid_span_id(&span.span_id), "{}: {}", name, value);
+            assert!(
+                span.parent_span_id.is_empty() || crate::trace_context::is_valid_span_id(&span.parent_span_id),
+                "{}: {}",
+                name,
+                value
+            );
+
+            // The upstream gets a well-formed traceparent for the same trace
+            let traceparent = test_host::request_header("traceparent").expect("traceparent injected");
+            let (trace_id, _) = crate::trace_context::parse_traceparent_value(&traceparent).expect("valid traceparent");
+            assert_eq!(trace_id, span.trace_id, "{}: {}", name, value);
+        }
+    }
+
+    #[test]
+    fn test_sampled_out_exchange_is_propagated_but_not_exported() {
+        run_exchange(config(r#"{"sampleRate": 0.0}"#), REQUEST_HEADERS, &[b"{}"], &[b"{}"]);
+
+        assert!(test_host::http_calls().is_empty());
+        assert!(test_host::request_header("traceparent").is_some());
+        // Traffic is counted whether or not it is captured
+        assert!(test_host::metric(crate::metrics::REQUEST_BYTES_TOTAL).unwrap() > 2);
+        assert_eq!(test_host::metric(crate::metrics::SPANS_CAPTURED_TOTAL), None);
+    }
+
+    #[test]
+    fn test_sampled_out_exchange_kept_by_upstream_is_exported() {
+        let config = config(r#"{"sampleRate": 0.0}"#);
+        let keep_header = config.keep_header.clone();
+        crate::export::configure(&config);
+        let mut ctx = SpHttpContext::new(1, config);
+        test_host::set_request_headers(REQUEST_HEADERS);
+        ctx.on_http_request_headers(REQUEST_HEADERS.len(), true);
+
+        test_host::set_response_headers(&[(":status", "500"), (keep_header.as_str(), "1")]);
+        ctx.on_http_response_headers(2, true);
+        crate::export::flush(&ctx, &ctx.config.plugin_name);
+
+        let span = only_span();
+        assert_eq!(span_attribute(&span, "sp.capture.kept").as_deref(), Some("true"));
+        assert_eq!(span_attribute(&span, crate::semconv::HTTP_STATUS_CODE).as_deref(), Some("500"));
+        // The hint is for the filter only and never reaches the client
+        assert_eq!(test_host::response_header(&keep_header), None);
+        assert!(test_host::response_headers().iter().any(|(k, _)| k == ":status"));
+    }
+
+    #[test]
+    fn test_headers_and_json_fields_are_redacted_in_the_span_only() {
+        let config = config(r#"{"redactHeaders": ["x-api-key"], "redactJsonPaths": ["$.card.number"]}"#);
+        let body: &[u8] = b"{\"card\": {\"number\": \"4111111111111111\", \"exp\": \"12/30\"}}";
+        run_exchange(config, REQUEST_HEADERS, &[body], &[b"{\"ok\": true}"]);
+
+        let span = only_span();
+        assert_eq!(span_attribute(&span, "http.request.header.x-api-key").as_deref(), Some(REDACTED_VALUE));
+        assert_eq!(span_attribute(&span, "http.request.header.authorization"), None);
+        let captured: serde_json::Value = serde_json::from_str(&span_attribute(&span, "http.request.body").unwrap()).unwrap();
+        assert_eq!(captured["card"]["number"], REDACTED_VALUE);
+        assert_eq!(captured["card"]["exp"], "12/30");
+
+        // What goes upstream is untouched
+        assert_eq!(test_host::request_header("x-api-key").as_deref(), Some("k-123"));
+    }
+
+    #[test]
+    fn test_redacted_query_param_never_leaves_the_filter() {
+        let config = config(r#"{"redactQueryParams": ["token"], "tee": {"url": "http://tee.example/capture"}}"#);
+        let mut headers = REQUEST_HEADERS.to_vec();
+        headers[1] = (":path", "/orders?token=s3cret-token&id=7");
+        headers.push((":scheme", "https"));
+        run_exchange(config, &headers, &[b"{}"], &[]);
+
+        let redacted_path = format!("/orders?token={}&id=7", REDACTED_VALUE);
+        let span = only_span();
+        assert_eq!(span.name, redacted_path);
+        assert_eq!(span_attribute(&span, crate::semconv::HTTP_TARGET), Some(redacted_path.clone()));
+        assert_eq!(span_attribute(&span, crate::semconv::HTTP_URL), Some(format!("https://shop.example{}", redacted_path)));
+        assert_eq!(span_attribute(&span, "http.request.header.:path"), Some(redacted_path.clone()));
+        assert_eq!(span_attribute(&span, "sp.query.token").as_deref(), Some(REDACTED_VALUE));
+        for attribute in &span.attributes {
+            let value = span_attribute(&span, &attribute.key).unwrap_or_default();
+            assert!(!value.contains("s3cret-token"), "{} leaks the token", attribute.key);
+        }
+
+        let tee_call = test_host::http_calls().into_iter().find(|call| call.header("x-sp-tee-path").is_some()).expect("no tee mirror");
+        assert_eq!(tee_call.header("x-sp-tee-path"), Some(redacted_path.as_str()));
+    }
+
+    #[test]
+    fn test_tee_marks_truncated_bodies_and_skips_form_bodies() {
+        let tee_calls = || {
+            test_host::http_calls()
+                .into_iter()
+                .filter(|call| call.header("x-sp-tee-path").is_some())
+                .collect::<Vec<_>>()
+        };
+
+        let config_json = r#"{"maxRequestBodyBytes": 4, "tee": {"url": "http://tee.example/capture"}}"#;
+        run_exchange(config(config_json), REQUEST_HEADERS, &[b"{\"item\": 42}"], &[]);
+        let calls = tee_calls();
+        assert_eq!(calls.len(), 1);
+        assert_eq!(calls[0].body, b"{\"it");
+        assert_eq!(calls[0].header("x-sp-tee-truncated"), Some("true"));
+
+        let mut headers = REQUEST_HEADERS.to_vec();
+        headers[3] = ("content-type", "application/x-www-form-urlencoded");
+        run_exchange(config(r#"{"tee": {"url": "http://tee.example/capture"}}"#), &headers, &[b"item=42"], &[]);
+        assert_eq!(tee_calls().len(), 1, "form bodies are not mirrored");
+    }
+
+    #[test]
+    fn test_request_body_over_the_cap_is_truncated() {
+        let mut headers = REQUEST_HEADERS.to_vec();
+        headers.push(("content-length", "24"));
+        run_exchange(config(r#"{"maxRequestBodyBytes": 10}"#), &headers, &[b"0123456789ab", b"cdefghijklmn"], &[]);
+
+        let span = only_span();
+        assert_eq!(span_attribute(&span, "http.request.body").as_deref(), Some("0123456789"));
+        assert_eq!(span_attribute(&span, "sp.body.truncated").as_deref(), Some("true"));
+        assert_eq!(span_attribute(&span, "sp.request.content_length").as_deref(), Some("24"));
+        assert_eq!(test_host::metric(crate::metrics::BODY_TRUNCATED_TOTAL), Some(1));
+    }
+
+    #[test]
+    fn test_response_body_over_the_cap_is_truncated() {
+        run_exchange(config(r#"{"maxResponseBodyBytes": 10}"#), REQUEST_HEADERS, &[], &[b"0123456789ab", b"cdefghijklmn"]);
+
+        let span = only_span();
+        assert_eq!(span_attribute(&span, "http.response.body").as_deref(), Some("0123456789"));
+        assert_eq!(span_attribute(&span, "sp.body.truncated").as_deref(), Some("true"));
+        assert_eq!(test_host::metric(crate::metrics::BODY_TRUNCATED_TOTAL), Some(1));
+    }
+
+    #[test]
+    fn test_truncated_compressed_request_body_is_not_decompressed() {
+        use std::io::Write;
+
+        let mut encoder = flate2::write::GzEncoder::new(Vec::new(), flate2::Compression::fast());
+        encoder.write_all(&[b'a'; 256]).unwrap();
+        let gzipped = encoder.finish().unwrap();
+        let mut headers = REQUEST_HEADERS.to_vec();
+        headers.push(("content-encoding", "gzip"));
+        run_exchange(config(r#"{"maxRequestBodyBytes": 10}"#), &headers, &[gzipped.as_slice()], &[]);
+
+        let span = only_span();
+        assert_eq!(span_attribute(&span, "sp.body.truncated").as_deref(), Some("true"));
+        assert_eq!(span_attribute(&span, "sp.body.decompression_error").as_deref(), Some("truncated before decompression"));
+        assert_eq!(span_attribute(&span, "sp.body.decompressed"), None);
+    }
+
+    #[test]
+    fn test_large_response_body_is_reduced_to_a_preview() {
+        let body = format!("{{\"items\": [{}]}}", vec!["1"; 100].join(","));
+        run_exchange(config(r#"{"bodyPreviewBytes": 16}"#), REQUEST_HEADERS, &[], &[body.as_bytes()]);
+
+        let span = only_span();
+        assert_eq!(span_attribute(&span, "http.response.body"), None);
+        assert_eq!(span_attribute(&span, "sp.body.preview").as_deref(), Some(&body[..16]));
+        assert_eq!(span_attribute(&span, "sp.body.length"), Some(body.len().to_string()));
+        assert_eq!(span_attribute(&span, "sp.body.preview_only").as_deref(), Some("true"));
+    }
+
+    const REDIRECT_HEADERS: &[(&str, &str)] = &[(":status", "302"), ("location", "/login?next=%2Forders")];
+
+    #[test]
+    fn test_redirect_is_recorded_as_a_span_event() {
+        run_exchange_with_response(config(r#"{"captureSpanEvents": true}"#), REQUEST_HEADERS, &[], REDIRECT_HEADERS, &[]);
+
+        let span = only_span();
+        assert_eq!(span.events.len(), 1);
+        let event = &span.events[0];
+        assert_eq!(event.name, crate::span_events::REDIRECT);
+        assert!(span.start_time_unix_nano <= event.time_unix_nano && event.time_unix_nano <= span.end_time_unix_nano);
+        assert_eq!(event.attributes[1].key, "http.response.header.location");
+    }
+
+    #[test]
+    fn test_span_events_are_off_by_default() {
+        run_exchange_with_response(config("{}"), REQUEST_HEADERS, &[], REDIRECT_HEADERS, &[]);
+        assert!(only_span().events.is_empty());
+    }
+
+    #[test]
+    fn test_span_events_past_the_cap_are_counted_as_dropped() {
+        let config = config(r#"{"captureSpanEvents": true, "maxSpanEvents": 0}"#);
+        run_exchange_with_response(config, REQUEST_HEADERS, &[], REDIRECT_HEADERS, &[]);
+
+        let span = only_span();
+        assert!(span.events.is_empty());
+        assert_eq!(span.dropped_events_count, 1);
+    }
+
+    #[test]
+    fn test_stream_closed_mid_body_is_marked_partial() {
+        let config = config("{}");
+        crate::export::configure(&config);
+        let mut ctx = SpHttpContext::new(1, config);
+        test_host::set_request_headers(REQUEST_HEADERS);
+        ctx.on_http_request_headers(REQUEST_HEADERS.len(), true);
+        test_host::set_response_headers(RESPONSE_HEADERS);
+        ctx.on_http_response_headers(RESPONSE_HEADERS.len(), false);
+        let chunk: &[u8] = b"{\"id\": ";
+        test_host::set_response_body(chunk);
+        ctx.on_http_response_body(chunk.len(), false);
+        ctx.on_log();
+        crate::export::flush(&ctx, &ctx.config.plugin_name);
+
+        let span = only_span();
+        assert_eq!(span_attribute(&span, "sp.body.partial").as_deref(), Some("true"));
+    }
+
+    #[test]
+    fn test_export_path_template_is_expanded_per_batch() {
+        let config = config(r#"{"service_name": "shop", "exportPathTemplate": "/ingest/{service}/traces"}"#);
+        run_exchange(config, REQUEST_HEADERS, &[], &[b"{}"]);
+
+        let calls = test_host::http_calls();
+        assert_eq!(calls.len(), 1);
+        assert_eq!(calls[0].header(":path"), Some("/ingest/shop/traces"));
+    }
+
+    #[test]
+    fn test_unresolved_export_path_template_falls_back_and_is_counted() {
+        let config = config(r#"{"exportPathTemplate": "/ingest/{tenant}/traces"}"#);
+        run_exchange(config, REQUEST_HEADERS, &[], &[b"{}"]);
+
+        let calls = test_host::http_calls();
+        assert_eq!(calls.len(), 1);
+        assert_eq!(calls[0].header(":path"), Some("/v1/traces"));
+        assert_eq!(test_host::metric(crate::metrics::EXPORT_PATH_FALLBACK_TOTAL), Some(1));
+    }
+
+    #[test]
+    fn test_line_counts_of_text_bodies() {
+        let request_headers = [(":method", "POST"), (":path", "/logs"), ("content-type", "text/plain")];
+        let config = config(r#"{"maxRequestBodyBytes": 10}"#);
+        run_exchange_with_response(
+            config,
+            &request_headers,
+            &[b"a\nb\nc\nd\ne\nf\n"],
+            &[(":status", "200"), ("content-type", "text/plain; charset=utf-8")],
+            &[b"line 1\nline 2\nline 3"],
+        );
+
+        let span = only_span();
+        assert_eq!(span_attribute(&span, "sp.request.body.line_count").as_deref(), Some("5"));
+        assert_eq!(span_attribute(&span, "sp.request.body.line_count_truncated").as_deref(), Some("true"));
+        assert_eq!(span_attribute(&span, "sp.body.line_count").as_deref(), Some("3"));
+        assert_eq!(span_attribute(&span, "sp.body.line_count_truncated"), None);
+    }
+
+    #[test]
+    fn test_no_line_count_for_bodies_that_fail_to_decompress() {
+        run_exchange_with_response(
+            config("{}"),
+            REQUEST_HEADERS,
+            &[],
+            &[(":status", "200"), ("content-type", "text/plain"), ("content-encoding", "gzip")],
+            &[b"not gzip\nat all\n"],
+        );
+
+        let span = only_span();
+        assert!(span_attribute(&span, "sp.body.decompression_error").is_some());
+        assert_eq!(span_attribute(&span, "sp.body.line_count"), None);
+    }
+
+    #[test]
+    fn test_no_line_count_for_non_text_bodies() {
+        run_exchange(config("{}"), REQUEST_HEADERS, &[b"{\n}"], &[b"{\n}"]);
+
+        let span = only_span();
+        assert_eq!(span_attribute(&span, "sp.request.body.line_count"), None);
+        assert_eq!(span_attribute(&span, "sp.body.line_count"), None);
+    }
+}
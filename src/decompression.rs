@@ -0,0 +1,145 @@
+// Content-Encoding decompression of captured bodies
+//
+// Only the captured copy is decompressed; forwarded bytes are never touched. gzip and
+// deflate are always available. Brotli needs the `brotli` cargo feature, which is off by
+// default to keep the module small.
+
+use std::io::Read;
+
+use flate2::read::{DeflateDecoder, GzDecoder, ZlibDecoder};
+
+#[derive(Debug, PartialEq)]
+pub enum DecompressError {
+    Unsupported(String),
+    TooLarge,
+    Corrupt,
+    Truncated,  // The captured body was cut short, so it cannot be decoded
+}
+
+impl DecompressError {
+    /// Short reason recorded on the span
+    pub fn reason(&self) -> String {
+        match self {
+            DecompressError::Unsupported(encoding) => format!("unsupported encoding {}", encoding),
+            DecompressError::TooLarge => "exceeds size limit".to_string(),
+            DecompressError::Corrupt => "corrupt body".to_string(),
+            DecompressError::Truncated => "truncated before decompression".to_string(),
+        }
+    }
+}
+
+/// Undo a Content-Encoding header, applying the codings in reverse order. Returns
+/// Ok(None) when the body is not encoded. Output past `max_len` bytes is an error, so
+/// a small compressed body cannot expand without bound.
+pub fn decompress(body: &[u8], content_encoding: &str, max_len: usize) -> Result<Option<Vec<u8>>, DecompressError> {
+    let codings = codings(content_encoding);
+    if codings.is_empty() {
+        return Ok(None);
+    }
+
+    let mut data = body.to_vec();
+    for coding in codings.iter().rev() {
+        data = match coding.as_str() {
+            "gzip" | "x-gzip" => read_bounded(GzDecoder::new(data.as_slice()), max_len)?,
+            // "deflate" is meant to be zlib-wrapped, but raw deflate is common in practice
+            "deflate" => read_bounded(ZlibDecoder::new(data.as_slice()), max_len)
+                .or_else(|_| read_bounded(DeflateDecoder::new(data.as_slice()), max_len))?,
+            #[cfg(feature = "brotli")]
+            "br" => read_bounded(brotli_decompressor::Decompressor::new(data.as_slice(), 4096), max_len)?,
+            other => return Err(DecompressError::Unsupported(other.to_string())),
+        };
+    }
+    Ok(Some(data))
+}
+
+/// Whether a Content-Encoding header names any coding other than identity
+pub fn is_encoded(content_encoding: &str) -> bool {
+    !codings(content_encoding).is_empty()
+}
+
+fn codings(content_encoding: &str) -> Vec<String> {
+    content_encoding
+        .split(',')
+        .map(|coding| coding.trim().to_ascii_lowercase())
+        .filter(|coding| !coding.is_empty() && coding != "identity")
+        .collect()
+}
+
+fn read_bounded<R: Read>(reader: R, max_len: usize) -> Result<Vec<u8>, DecompressError> {
+    let mut output = Vec::new();
+    reader
+        .take(max_len as u64 + 1)
+        .read_to_end(&mut output)
+        .map_err(|_| DecompressError::Corrupt)?;
+    if output.len() > max_len {
+        return Err(DecompressError::TooLarge);
+    }
+    Ok(output)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use flate2::write::{DeflateEncoder, GzEncoder, ZlibEncoder};
+    use flate2::Compression;
+    use std::io::Write;
+
+    fn gzip(data: &[u8]) -> Vec<u8> {
+        let mut encoder = GzEncoder::new(Vec::new(), Compression::default());
+        encoder.write_all(data).unwrap();
+        encoder.finish().unwrap()
+    }
+
+    #[test]
+    fn test_decompress_gzip() {
+        let body = br#"{"ok":true}"#;
+        assert_eq!(decompress(&gzip(body), "gzip", 1024), Ok(Some(body.to_vec())));
+        assert_eq!(decompress(&gzip(body), "GZIP", 1024), Ok(Some(body.to_vec())));
+    }
+
+    #[test]
+    fn test_decompress_deflate_zlib_and_raw() {
+        let body = b"hello deflate";
+        let mut zlib = ZlibEncoder::new(Vec::new(), Compression::default());
+        zlib.write_all(body).unwrap();
+        assert_eq!(decompress(&zlib.finish().unwrap(), "deflate", 1024), Ok(Some(body.to_vec())));
+
+        let mut raw = DeflateEncoder::new(Vec::new(), Compression::default());
+        raw.write_all(body).unwrap();
+        assert_eq!(decompress(&raw.finish().unwrap(), "deflate", 1024), Ok(Some(body.to_vec())));
+    }
+
+    #[test]
+    fn test_decompress_identity_is_untouched() {
+        assert_eq!(decompress(b"plain", "", 1024), Ok(None));
+        assert_eq!(decompress(b"plain", "identity", 1024), Ok(None));
+    }
+
+    #[test]
+    fn test_decompress_bounds_output() {
+        let bomb = gzip(&vec![0u8; 1 << 20]);
+        assert_eq!(decompress(&bomb, "gzip", 4096), Err(DecompressError::TooLarge));
+        assert!(decompress(&bomb, "gzip", 1 << 20).is_ok());
+    }
+
+    #[test]
+    fn test_decompress_errors() {
+        assert_eq!(decompress(b"not gzip", "gzip", 1024), Err(DecompressError::Corrupt));
+        assert_eq!(decompress(b"data", "zstd", 1024), Err(DecompressError::Unsupported("zstd".to_string())));
+    }
+
+    #[test]
+    fn test_is_encoded() {
+        assert!(is_encoded("gzip"));
+        assert!(is_encoded("identity, br"));
+        assert!(!is_encoded("identity"));
+        assert!(!is_encoded(" , "));
+    }
+
+    #[test]
+    fn test_decompress_stacked_codings() {
+        let body = b"twice";
+        let twice = gzip(&gzip(body));
+        assert_eq!(decompress(&twice, "gzip, gzip", 1024), Ok(Some(body.to_vec())));
+    }
+}
@@ -0,0 +1,80 @@
+// Span deduplication across worker VMs, through VM-level shared data
+//
+// Shared data has no delete, so keys are hashed into a fixed set of slots; each slot
+// holds the full key of its latest claim and when that claim expires. A collision just
+// evicts the older claim, which at worst lets a duplicate through.
+
+use proxy_wasm::traits::Context;
+use proxy_wasm::types::Status;
+
+use crate::sampling::fnv1a_hash;
+use crate::shared_data::{self, Feature};
+
+const DEDUP_SLOTS: u64 = 4096;
+const SLOT_KEY_PREFIX: &str = "sp.dedup.";
+/// Slot value: 8-byte little-endian expiry (ms) followed by the claim key
+const EXPIRY_LEN: usize = 8;
+
+/// Dedup key for one side of a hop
+pub fn dedup_key(trace_id: &str, span_id: &str, direction: &str) -> String {
+    format!("{}-{}-{}", trace_id, span_id, direction)
+}
+
+/// Claim a key for `window_ms`. Returns false if the same key was claimed, on any
+/// worker, within the window. Host errors fail open so spans are never lost to dedup.
+pub fn claim(ctx: &dyn Context, key: &str, now_ms: u64, window_ms: u64) -> bool {
+    let slot = format!("{}{}", SLOT_KEY_PREFIX, fnv1a_hash(key.as_bytes()) % DEDUP_SLOTS);
+    let value = encode_slot(key, now_ms.saturating_add(window_ms));
+
+    // One retry: a CAS mismatch means another worker wrote the slot in between
+    for _ in 0..2 {
+        let (current, cas) = shared_data::get(ctx, Feature::Dedup, &slot);
+        if current.as_deref().map_or(false, |current| slot_holds_claim(current, key, now_ms)) {
+            return false;
+        }
+        match shared_data::set(ctx, Feature::Dedup, &slot, &value, cas) {
+            Ok(()) => return true,
+            Err(Status::CasMismatch) => continue,
+            Err(_) => return true,
+        }
+    }
+    true
+}
+
+fn encode_slot(key: &str, expires_at_ms: u64) -> Vec<u8> {
+    let mut value = expires_at_ms.to_le_bytes().to_vec();
+    value.extend_from_slice(key.as_bytes());
+    value
+}
+
+/// Whether a slot value is an unexpired claim of this key
+fn slot_holds_claim(value: &[u8], key: &str, now_ms: u64) -> bool {
+    if value.len() < EXPIRY_LEN {
+        return false;
+    }
+    let (expiry, claimed_key) = value.split_at(EXPIRY_LEN);
+    let expires_at_ms = u64::from_le_bytes(expiry.try_into().unwrap_or_default());
+    claimed_key == key.as_bytes() && now_ms < expires_at_ms
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_slot_holds_claim() {
+        let key = dedup_key("0af7651916cd43dd8448eb211c80319c", "b7ad6b7169203331", "inbound");
+        let value = encode_slot(&key, 2_000);
+
+        assert!(slot_holds_claim(&value, &key, 1_000));
+        assert!(!slot_holds_claim(&value, &key, 2_000));
+        assert!(!slot_holds_claim(&value, "other-key", 1_000));
+        assert!(!slot_holds_claim(b"short", &key, 1_000));
+        assert!(!slot_holds_claim(b"", &key, 1_000));
+    }
+
+    #[test]
+    fn test_dedup_key_includes_direction() {
+        assert_ne!(dedup_key("t", "s", "inbound"), dedup_key("t", "s", "outbound"));
+    }
+}
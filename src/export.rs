@@ -0,0 +1,1201 @@
+//! Batched export of captured spans to the Softprobe backend.
+//!
+//! HTTP contexts hand finished spans to their plugin's exporter instead of POSTing each
+//! one. Each plugin in the VM (by plugin name) has its own exporter, with its own config,
+//! backends, batches and retry queue, so plugins sharing a `vm_id` never send each
+//! other's spans with the wrong key or to the wrong backend. Spans are batched per export path (one per tenant, see `tenantHeader`); within a batch
+//! spans sharing a Resource are merged into a single OTLP `resourceSpans` payload, which
+//! is sent once `batchMaxSpans` or `batchMaxBytes` is reached, on the root context tick
+//! (`batchFlushIntervalMs`), or when the VM shuts down.
+//!
+//! A flush is dispatched from whichever context triggered it, so the export response can
+//! arrive at the root context or at an HTTP context; both forward tokens they do not own
+//! to `on_export_response`. If the dispatching stream is torn down first the callback is
+//! never delivered, so in-flight entries that outlive the call timeout are expired on tick.
+//!
+//! Failed exports (dispatch errors, 5xx, 429, timeouts and lost callbacks) are held in a
+//! retry queue and re-sent from the tick with exponential backoff (`retryBackoffMs`
+//! doubling up to `retryMaxBackoffMs`) until `maxExportRetries` is exhausted, at which
+//! point the batch is dropped and `sp_export_failed_total` is incremented.
+//!
+//! The retry queue holds at most `maxQueuedBatches`; on overflow `overflowPolicy` drops
+//! either the oldest queued batch or the incoming one, counted in `sp_export_dropped_total`.
+//! The queue length is published as the `sp_export_queue_depth` gauge.
+//!
+//! When an `auth` block is configured its header is added to every export request; a
+//! credential taken from node metadata (`auth.metadataKey`) is re-read per request so it
+//! can be rotated without redeploying the module.
+//!
+//! With `compression: gzip` each batch is compressed once at flush time (fastest level;
+//! roughly 6x smaller for typical span payloads) and sent with `Content-Encoding: gzip`.
+//!
+//! With `exportProtocol: grpc` batches go out through the host gRPC call API as an OTLP
+//! `TraceService/Export` request instead of an HTTP POST. Envoy does the gRPC framing;
+//! tenants travel in `x-sp-tenant` metadata rather than the path, and payloads are never
+//! gzipped since the call API cannot set the compressed flag. The gRPC status decides
+//! success, retry or rejection just as the HTTP status does for `http/protobuf`.
+//!
+//! A circuit breaker (see `circuit`) sits in front of every dispatch. While it is open,
+//! batches are dropped without a dispatch and counted in `sp_export_circuit_dropped_total`,
+//! so a backend outage does not cost every flush a doomed call.
+//!
+//! With `bodyExport: log` captured bodies leave the span and are sent as OTLP log records
+//! (linked by trace and span id) to the matching `/v1/logs` path. Log batches go through
+//! the same batching, retry queue and circuit breaker as span batches.
+//!
+//! With a `sink` every span and body log batch is also written as NDJSON lines (see
+//! `sink`); unless `sink.alsoExport` is set, batches then stop there and nothing reaches
+//! the backend.
+//!
+//! With a `backends` list every batch is serialized once and sent to each backend as a
+//! separate export, with that backend's auth and compression. Retries, the circuit
+//! breaker and per-backend stats then work per backend, so a slow or failing backend
+//! does not hold back the others. Without the list the top-level `backendUrl`, `auth`
+//! and `compression` form the only backend.
+//!
+//! With `maxAttributeValueBytes` every string attribute (span, event, link and log record)
+//! and log record body is capped when its batch is flushed, so no single oversized value
+//! gets a whole batch rejected by the backend.
+//!
+//! With `dryRun` batches are built, serialized and compressed as usual, then logged and
+//! discarded instead of dispatched, so `sp_spans_exported_total` stays at zero.
+//!
+//! The HTTP export path comes from `exportPathTemplate`, with `{tenant}` and `{service}`
+//! expanded per batch, so spans of different services are batched separately when the
+//! template uses `{service}`.
+
+use std::cell::RefCell;
+use std::collections::{HashMap, VecDeque};
+use std::io::Write;
+use std::time::Duration;
+
+use flate2::write::GzEncoder;
+
+use prost::Message;
+use proxy_wasm::traits::Context;
+use proxy_wasm::types::Status;
+
+use crate::config::{AuthConfig, BackendConfig, Compression, Config, ExportProtocol, OverflowPolicy};
+use crate::http_helpers::{get_backend_authority, get_backend_cluster_name, truncate_utf8};
+use crate::shared_data::{self, Feature};
+use crate::otel::{
+    any_value, bool_attribute, get_current_timestamp_nanos, serialize_logs_data, serialize_traces_data, KeyValue, LogsData,
+    Resource, ResourceLogs, ResourceSpans, TracesData,
+};
+
+const EXPORT_TIMEOUT: Duration = Duration::from_secs(5);
+// Extra time past the call timeout before an unanswered export is treated as lost
+const LOST_CALLBACK_GRACE: Duration = Duration::from_secs(5);
+// Overflow drops are logged on the first drop and then once per this many
+const DROP_LOG_EVERY: u64 = 100;
+const OTLP_TRACE_SERVICE: &str = "opentelemetry.proto.collector.trace.v1.TraceService";
+const OTLP_LOGS_SERVICE: &str = "opentelemetry.proto.collector.logs.v1.LogsService";
+const OTLP_EXPORT_METHOD: &str = "Export";
+const TENANT_METADATA: &str = "x-sp-tenant";
+// Appended to values cut at maxAttributeValueBytes
+const TRUNCATED_SUFFIX: &str = "...(truncated)";
+// Shared-data counter of flush endpoint requests; a worker that sees it move flushes
+const FLUSH_GENERATION_KEY: &str = "sp.flush.generation";
+// Placeholders exportPathTemplate may use
+const PATH_PLACEHOLDERS: [&str; 2] = ["tenant", "service"];
+
+/// Which OTLP signal a batch carries
+#[derive(Debug, Clone, Copy, PartialEq, Default)]
+enum Signal {
+    #[default]
+    Traces,
+    Logs,
+}
+
+impl Signal {
+    /// What the batch counts, for log lines
+    fn unit(&self) -> &'static str {
+        match self {
+            Signal::Traces => "spans",
+            Signal::Logs => "log records",
+        }
+    }
+}
+
+/// Spans (or body log records) accumulated for one export path
+#[derive(Default)]
+struct PendingBatch {
+    tenant: Option<String>,
+    signal: Signal,
+    resource_spans: Vec<ResourceSpans>,
+    resource_logs: Vec<ResourceLogs>,
+    span_count: usize,  // Log records for a Logs batch
+    bytes: usize,
+}
+
+/// A serialized batch for one backend, kept until it accepts it or retries run out
+struct ExportBatch {
+    backend: usize,  // Index into SpanExporter::backends
+    path: String,
+    tenant: Option<String>,
+    signal: Signal,
+    payload: Vec<u8>,
+    gzipped: bool,
+    span_count: usize,
+    attempts: u32,
+}
+
+struct InFlightExport {
+    batch: ExportBatch,
+    dispatched_at: u64,
+}
+
+struct QueuedRetry {
+    batch: ExportBatch,
+    next_attempt_at: u64,
+}
+
+#[derive(Default)]
+struct SpanExporter {
+    config: Config,
+    backends: Vec<BackendConfig>,
+    pending: HashMap<String, PendingBatch>,
+    in_flight: HashMap<u32, InFlightExport>,
+    retry_queue: VecDeque<QueuedRetry>,
+    last_flush_at: u64,
+    dropped_batches: u64,
+    path_fallbacks: u64,  // Batches sent to the plain OTLP path under a custom exportPathTemplate
+    flush_generation: u64,  // Last FLUSH_GENERATION_KEY value this worker acted on
+}
+
+thread_local! {
+    // Exporter of each plugin in this VM, by plugin name
+    static EXPORTERS: RefCell<HashMap<String, SpanExporter>> = RefCell::new(HashMap::new());
+}
+
+/// Run `f` on the named plugin's exporter, creating it on first use
+fn with_exporter<T>(plugin_name: &str, f: impl FnOnce(&mut SpanExporter) -> T) -> T {
+    EXPORTERS.with(|exporters| f(exporters.borrow_mut().entry(plugin_name.to_string()).or_default()))
+}
+
+/// Apply the plugin configuration to that plugin's exporter; called from the root
+/// context on configure
+pub fn configure(config: &Config) {
+    with_exporter(&config.plugin_name, |exporter| {
+        exporter.config = config.clone();
+        exporter.backends = config.export_backends();
+    });
+}
+
+/// Add a captured span to the plugin's batch for its tenant, flushing if a size limit is
+/// reached
+pub fn enqueue(ctx: &dyn Context, plugin_name: &str, tenant: Option<&str>, traces_data: TracesData) {
+    with_exporter(plugin_name, |exporter| {
+        let max_spans = exporter.config.batch_max_spans;
+        let max_bytes = exporter.config.batch_max_bytes;
+
+        let mut paths = Vec::new();
+        for resource_spans in traces_data.resource_spans {
+            let span_count = count_spans(&resource_spans);
+            let path = exporter.export_path(tenant, resource_spans.resource.as_ref(), Signal::Traces, span_count);
+            if !paths.contains(&path) {
+                paths.push(path.clone());
+            }
+            let bytes = resource_spans.encoded_len();
+            crate::metrics::increment_counter(crate::metrics::SPANS_CAPTURED_TOTAL, span_count as i64);
+            let pending = exporter.pending.entry(path.clone()).or_default();
+            if pending.span_count > 0 && pending.bytes + bytes > max_bytes {
+                exporter.flush_path(ctx, &path);
+            }
+
+            let pending = exporter.pending.entry(path.clone()).or_default();
+            pending.tenant = tenant.map(|t| t.to_string());
+            pending.span_count += span_count;
+            pending.bytes += bytes;
+            merge_resource_spans(&mut pending.resource_spans, resource_spans);
+        }
+
+        exporter.flush_full(ctx, &paths, max_spans, max_bytes);
+    });
+}
+
+/// Add captured body log records to the plugin's logs batch for their tenant
+/// (bodyExport=log)
+pub fn enqueue_logs(ctx: &dyn Context, plugin_name: &str, tenant: Option<&str>, logs_data: LogsData) {
+    with_exporter(plugin_name, |exporter| {
+        let max_spans = exporter.config.batch_max_spans;
+        let max_bytes = exporter.config.batch_max_bytes;
+
+        let mut paths = Vec::new();
+        for resource_logs in logs_data.resource_logs {
+            let record_count: usize = resource_logs.scope_logs.iter().map(|s| s.log_records.len()).sum();
+            let path = exporter.export_path(tenant, resource_logs.resource.as_ref(), Signal::Logs, record_count);
+            if !paths.contains(&path) {
+                paths.push(path.clone());
+            }
+            let bytes = resource_logs.encoded_len();
+            let pending = exporter.pending.entry(path.clone()).or_default();
+            if pending.span_count > 0 && pending.bytes + bytes > max_bytes {
+                exporter.flush_path(ctx, &path);
+            }
+
+            let pending = exporter.pending.entry(path.clone()).or_default();
+            pending.tenant = tenant.map(|t| t.to_string());
+            pending.signal = Signal::Logs;
+            pending.span_count += record_count;
+            pending.bytes += bytes;
+            merge_resource_logs(&mut pending.resource_logs, resource_logs);
+        }
+
+        exporter.flush_full(ctx, &paths, max_spans, max_bytes);
+    });
+}
+
+/// Record how long a dispatch took, from dispatch to response (or to being declared lost)
+fn record_export_duration(dispatched_at: u64, success: bool) {
+    let elapsed_ms = get_current_timestamp_nanos().saturating_sub(dispatched_at) / 1_000_000;
+    crate::metrics::record_histogram(crate::metrics::EXPORT_DURATION_MS, elapsed_ms);
+    let outcome_metric = if success {
+        crate::metrics::EXPORT_DURATION_MS_SUCCESS
+    } else {
+        crate::metrics::EXPORT_DURATION_MS_FAILURE
+    };
+    crate::metrics::record_histogram(outcome_metric, elapsed_ms);
+}
+
+/// A piece of an exportPathTemplate
+#[derive(Debug, PartialEq)]
+enum PathPart<'a> {
+    Literal(&'a str),
+    Placeholder(&'a str),
+}
+
+fn path_template_parts(template: &str) -> Result<Vec<PathPart<'_>>, String> {
+    let mut parts = Vec::new();
+    let mut rest = template;
+    while let Some(open) = rest.find('{') {
+        if open > 0 {
+            parts.push(PathPart::Literal(&rest[..open]));
+        }
+        let close = rest[open..].find('}').ok_or_else(|| "unclosed {".to_string())? + open;
+        let name = &rest[open + 1..close];
+        if !PATH_PLACEHOLDERS.contains(&name) {
+            return Err(format!("unknown placeholder {{{}}}, expected one of {{tenant}}, {{service}}", name));
+        }
+        parts.push(PathPart::Placeholder(name));
+        rest = &rest[close + 1..];
+    }
+    if !rest.is_empty() {
+        parts.push(PathPart::Literal(rest));
+    }
+    Ok(parts)
+}
+
+/// Check an exportPathTemplate: an absolute path using only the known placeholders
+pub fn validate_path_template(template: &str) -> Result<(), String> {
+    if !template.starts_with('/') {
+        return Err(format!("must start with /, got \"{}\"", template));
+    }
+    path_template_parts(template).map(|_| ())
+}
+
+/// Backend path for a batch: the template with its placeholders expanded. Log batches
+/// swap the trailing `traces` for `logs`. Fails, naming the placeholder, when the batch
+/// has no value for one the template uses (no tenant, say) or the value is not safe as a
+/// path segment.
+fn export_path(template: &str, tenant: Option<&str>, service: Option<&str>, signal: Signal) -> Result<String, String> {
+    let parts = path_template_parts(template)?;
+    let mut path = String::with_capacity(template.len());
+    for part in parts {
+        let (name, value) = match part {
+            PathPart::Literal(text) => {
+                path.push_str(text);
+                continue;
+            }
+            PathPart::Placeholder("tenant") => ("tenant", tenant),
+            PathPart::Placeholder(_) => ("service", service),
+        };
+        match value.filter(|v| !v.is_empty()) {
+            Some(value) if crate::http_helpers::is_safe_path_segment(value) => path.push_str(value),
+            Some(value) => return Err(format!("{{{}}} value \"{}\" is not a safe path segment", name, value)),
+            None => return Err(format!("no value for {{{}}}", name)),
+        }
+    }
+    match signal {
+        Signal::Traces => Ok(path),
+        Signal::Logs => match path.strip_suffix("traces") {
+            Some(prefix) => Ok(format!("{}logs", prefix)),
+            None => Err("template does not end in \"traces\"".to_string()),
+        },
+    }
+}
+
+/// The plain OTLP path a batch goes to when its template cannot be expanded
+fn plain_export_path(signal: Signal) -> &'static str {
+    match signal {
+        Signal::Traces => "/v1/traces",
+        Signal::Logs => "/v1/logs",
+    }
+}
+
+/// The service.name resource attribute, for the {service} placeholder
+fn resource_service_name(resource: Option<&Resource>) -> Option<&str> {
+    resource?
+        .attributes
+        .iter()
+        .find(|kv| kv.key == crate::semconv::SERVICE_NAME)
+        .and_then(|kv| match kv.value.as_ref()?.value.as_ref()? {
+            any_value::Value::StringValue(service) => Some(service.as_str()),
+            _ => None,
+        })
+}
+
+/// Periodic work driven by the plugin's root context tick: expire lost callbacks, re-send
+/// due retries and flush the batch once the flush interval has elapsed
+pub fn on_tick(ctx: &dyn Context, plugin_name: &str) {
+    with_exporter(plugin_name, |exporter| {
+        let now = get_current_timestamp_nanos();
+        exporter.expire_lost_exports(ctx, now);
+        exporter.dispatch_due_retries(ctx, now);
+
+        let generation = flush_generation(ctx);
+        let flush_requested = generation != exporter.flush_generation;
+        exporter.flush_generation = generation;
+
+        let interval = Duration::from_millis(exporter.config.batch_flush_interval_ms).as_nanos() as u64;
+        if flush_requested || now.saturating_sub(exporter.last_flush_at) >= interval {
+            exporter.flush(ctx);
+        }
+    });
+}
+
+fn flush_generation(ctx: &dyn Context) -> u64 {
+    decode_generation(shared_data::get(ctx, Feature::Flush, FLUSH_GENERATION_KEY).0)
+}
+
+fn decode_generation(value: Option<Vec<u8>>) -> u64 {
+    value
+        .and_then(|value| <[u8; 8]>::try_from(value.as_slice()).ok())
+        .map(u64::from_le_bytes)
+        .unwrap_or(0)
+}
+
+/// Tick period for the root context: fine enough for both flushing and retry backoff
+pub fn tick_period(config: &Config) -> Duration {
+    Duration::from_millis(config.batch_flush_interval_ms.min(config.retry_backoff_ms.max(1)))
+}
+
+/// Send whatever the plugin has batched right now
+pub fn flush(ctx: &dyn Context, plugin_name: &str) {
+    with_exporter(plugin_name, |exporter| exporter.flush(ctx));
+}
+
+/// Flush for the flush endpoint. Batches are per worker, so this worker flushes every
+/// plugin's batches now and bumps the shared flush generation, which makes every other
+/// worker flush on its next tick. Losing the CAS race means another request bumped it,
+/// which does the same.
+pub fn request_flush(ctx: &dyn Context) {
+    let (value, cas) = shared_data::get(ctx, Feature::Flush, FLUSH_GENERATION_KEY);
+    let generation = decode_generation(value).wrapping_add(1);
+    if shared_data::set(ctx, Feature::Flush, FLUSH_GENERATION_KEY, &generation.to_le_bytes(), cas).is_err() {
+        crate::sp_debug!("Flush generation moved concurrently, other workers flush anyway");
+    }
+    EXPORTERS.with(|exporters| {
+        for exporter in exporters.borrow_mut().values_mut() {
+            exporter.flush_generation = generation;
+            exporter.flush(ctx);
+        }
+    });
+}
+
+/// What a backend response means for the batch
+#[derive(Debug, PartialEq)]
+enum ExportOutcome {
+    Success,
+    Retry,
+    Reject,
+}
+
+/// Handle an HTTP dispatch response. Returns false if the token is not an export call.
+pub fn on_export_response(ctx: &dyn Context, token_id: u32, status_code: u32) -> bool {
+    complete_export(ctx, token_id, http_outcome(status_code), &status_code.to_string())
+}
+
+/// Handle a gRPC dispatch response. Returns false if the token is not an export call.
+pub fn on_export_grpc_response(ctx: &dyn Context, token_id: u32, grpc_status: u32) -> bool {
+    complete_export(ctx, token_id, grpc_outcome(grpc_status), &format!("grpc-status {}", grpc_status))
+}
+
+fn complete_export(ctx: &dyn Context, token_id: u32, outcome: ExportOutcome, status: &str) -> bool {
+    EXPORTERS.with(|exporters| {
+        // Call tokens are unique across the VM, so at most one plugin's exporter owns it
+        let mut exporters = exporters.borrow_mut();
+        let (exporter, export) = match exporters
+            .values_mut()
+            .find_map(|exporter| exporter.in_flight.remove(&token_id).map(|export| (exporter, export)))
+        {
+            Some(found) => found,
+            None => return false,
+        };
+
+        record_export_duration(export.dispatched_at, outcome == ExportOutcome::Success);
+        let backend = exporter.backend_name(&export.batch);
+        // A rejection still means the backend is up, so only retryable failures trip the circuit
+        if outcome == ExportOutcome::Retry {
+            exporter.record_circuit_failure(ctx, &backend);
+        } else {
+            crate::circuit::record_success(ctx, &backend);
+        }
+        let unit = export.batch.signal.unit();
+        match outcome {
+            ExportOutcome::Success => {
+                crate::sp_info!("Exported {} {} to '{}' (status: {})", export.batch.span_count, unit, backend, status);
+                let exported_metric = match export.batch.signal {
+                    Signal::Traces => crate::metrics::SPANS_EXPORTED_TOTAL,
+                    Signal::Logs => crate::metrics::LOG_RECORDS_EXPORTED_TOTAL,
+                };
+                crate::metrics::increment_backend_counter(exported_metric, &backend, export.batch.span_count as i64);
+            }
+            ExportOutcome::Retry => {
+                crate::sp_warn!("Export of {} {} to '{}' failed with status: {}", export.batch.span_count, unit, backend, status);
+                exporter.schedule_retry(export.batch);
+            }
+            ExportOutcome::Reject => {
+                crate::sp_error!("Export of {} {} to '{}' rejected with status: {}", export.batch.span_count, unit, backend, status);
+                exporter.give_up(export.batch);
+            }
+        }
+        true
+    })
+}
+
+/// Whether any of the plugin's export calls is still awaiting a response
+pub fn has_in_flight(plugin_name: &str) -> bool {
+    EXPORTERS.with(|exporters| exporters.borrow().get(plugin_name).map_or(false, |exporter| !exporter.in_flight.is_empty()))
+}
+
+impl SpanExporter {
+    /// Export path for a batch, falling back to the plain OTLP path when the template
+    /// cannot be expanded. Under the default template that is how tenant-less requests
+    /// reach `/v1/traces`; with a custom template (over http/protobuf, where the path is
+    /// used) each fallback is counted in sp_export_path_fallback_total and logged.
+    fn export_path(&mut self, tenant: Option<&str>, resource: Option<&Resource>, signal: Signal, count: usize) -> String {
+        let template = &self.config.export_path_template;
+        match export_path(template, tenant, resource_service_name(resource), signal) {
+            Ok(path) => path,
+            Err(e) => {
+                if template != crate::config::DEFAULT_EXPORT_PATH_TEMPLATE
+                    && self.config.export_protocol == ExportProtocol::HttpProtobuf
+                {
+                    self.path_fallbacks += 1;
+                    crate::metrics::increment_counter(crate::metrics::EXPORT_PATH_FALLBACK_TOTAL, count as i64);
+                    if self.path_fallbacks % DROP_LOG_EVERY == 1 {
+                        crate::sp_warn!(
+                            "exportPathTemplate {}: {}, sending {} {} to {} ({} fallbacks so far)",
+                            template,
+                            e,
+                            count,
+                            signal.unit(),
+                            plain_export_path(signal),
+                            self.path_fallbacks
+                        );
+                    }
+                }
+                plain_export_path(signal).to_string()
+            }
+        }
+    }
+
+    /// Flush the given paths whose batch reached a size limit
+    fn flush_full(&mut self, ctx: &dyn Context, paths: &[String], max_spans: usize, max_bytes: usize) {
+        for path in paths {
+            let full = self
+                .pending
+                .get(path)
+                .map_or(false, |p| p.span_count >= max_spans || p.bytes >= max_bytes);
+            if full {
+                self.flush_path(ctx, path);
+            }
+        }
+    }
+
+    fn flush(&mut self, ctx: &dyn Context) {
+        self.last_flush_at = get_current_timestamp_nanos();
+        let paths: Vec<String> = self.pending.keys().cloned().collect();
+        for path in paths {
+            self.flush_path(ctx, &path);
+        }
+    }
+
+    fn flush_path(&mut self, ctx: &dyn Context, path: &str) {
+        let mut pending = match self.pending.remove(path) {
+            Some(pending) if pending.span_count > 0 => pending,
+            _ => return,
+        };
+        crate::timing::reset_batch_anchor();
+
+        let span_count = pending.span_count;
+        let signal = pending.signal;
+        let max_value_bytes = self.config.max_attribute_value_bytes;
+        if max_value_bytes > 0 {
+            cap_span_values(&mut pending.resource_spans, max_value_bytes);
+            cap_log_values(&mut pending.resource_logs, max_value_bytes);
+        }
+        if let Some(sink) = &self.config.sink {
+            match signal {
+                Signal::Traces => crate::sink::write(sink, &pending.resource_spans),
+                Signal::Logs => crate::sink::write_logs(sink, &pending.resource_logs),
+            }
+            if !sink.also_export {
+                crate::sp_debug!("Sink only: not exporting {} {} to {}", span_count, signal.unit(), path);
+                return;
+            }
+        }
+        let serialized = match signal {
+            Signal::Traces => serialize_traces_data(&TracesData {
+                resource_spans: pending.resource_spans,
+            }),
+            Signal::Logs => serialize_logs_data(&LogsData {
+                resource_logs: pending.resource_logs,
+            }),
+        };
+        let payload = match serialized {
+            Ok(bytes) => bytes,
+            Err(e) => {
+                crate::sp_error!("Serialization error, dropping {} {}: {}", span_count, signal.unit(), e);
+                return;
+            }
+        };
+
+        // Compressed at most once, however many backends want gzip
+        let mut compressed: Option<Option<Vec<u8>>> = None;
+        for backend in 0..self.backends.len() {
+            let compression = match self.config.export_protocol {
+                ExportProtocol::Grpc => Compression::None,
+                ExportProtocol::HttpProtobuf => self.backends[backend].compression,
+            };
+            let gzipped_payload = match compression {
+                Compression::Gzip => compressed
+                    .get_or_insert_with(|| match gzip(&payload) {
+                        Ok(compressed) => Some(compressed),
+                        Err(e) => {
+                            crate::sp_warn!("Gzip compression failed, sending uncompressed: {}", e);
+                            None
+                        }
+                    })
+                    .clone(),
+                Compression::None => None,
+            };
+            let gzipped = gzipped_payload.is_some();
+            let payload = gzipped_payload.unwrap_or_else(|| payload.clone());
+
+            // dryRun: all the work up to the wire, then report instead of sending
+            if self.config.dry_run {
+                crate::sp_info!(
+                    "Dry run: would export {} {} ({} bytes, gzip={}) to {} on '{}'",
+                    span_count,
+                    signal.unit(),
+                    payload.len(),
+                    gzipped,
+                    path,
+                    self.backends[backend].name
+                );
+                continue;
+            }
+
+            self.dispatch(
+                ctx,
+                ExportBatch {
+                    backend,
+                    path: path.to_string(),
+                    tenant: pending.tenant.clone(),
+                    signal,
+                    payload,
+                    gzipped,
+                    span_count,
+                    attempts: 0,
+                },
+            );
+        }
+    }
+
+    /// Name of the backend a batch is for, for stats, logs and its circuit
+    fn backend_name(&self, batch: &ExportBatch) -> String {
+        self.backends
+            .get(batch.backend)
+            .map_or_else(|| crate::config::DEFAULT_BACKEND_NAME.to_string(), |b| b.name.clone())
+    }
+
+    fn dispatch(&mut self, ctx: &dyn Context, batch: ExportBatch) {
+        let span_count = batch.span_count;
+        let unit = batch.signal.unit();
+        // A reload may have shrunk the backends list while this batch waited for a retry
+        let backend = match self.backends.get(batch.backend) {
+            Some(backend) => backend.clone(),
+            None => {
+                crate::sp_warn!("Export backend {} is no longer configured, dropping {} {}", batch.backend, span_count, unit);
+                return;
+            }
+        };
+        let now_ms = get_current_timestamp_nanos() / 1_000_000;
+        let circuit_open = !crate::circuit::allow_dispatch(
+            ctx,
+            &backend.name,
+            now_ms,
+            self.config.circuit_failure_threshold,
+            self.config.circuit_open_ms,
+        );
+        if circuit_open {
+            crate::sp_debug!("Export circuit of backend '{}' open, dropping {} {}", backend.name, span_count, unit);
+            crate::metrics::increment_backend_counter(crate::metrics::EXPORT_CIRCUIT_DROPPED_TOTAL, &backend.name, 1);
+            return;
+        }
+
+        let dispatched = match self.config.export_protocol {
+            ExportProtocol::HttpProtobuf => self.dispatch_http(ctx, &backend, &batch),
+            ExportProtocol::Grpc => self.dispatch_grpc(ctx, &backend, &batch),
+        };
+
+        match dispatched {
+            Ok(call_id) => {
+                crate::sp_debug!(
+                    "Export dispatched to '{}' (call_id={}, {}={}, bytes={})",
+                    backend.name,
+                    call_id,
+                    unit,
+                    span_count,
+                    batch.payload.len()
+                );
+                self.in_flight.insert(
+                    call_id,
+                    InFlightExport {
+                        batch,
+                        dispatched_at: get_current_timestamp_nanos(),
+                    },
+                );
+            }
+            Err(status) => {
+                crate::sp_warn!("Failed to dispatch export of {} {} to '{}', status: {:?}", span_count, unit, backend.name, status);
+                self.record_circuit_failure(ctx, &backend.name);
+                self.schedule_retry(batch);
+            }
+        }
+    }
+
+    fn dispatch_http(&self, ctx: &dyn Context, backend: &BackendConfig, batch: &ExportBatch) -> Result<u32, Status> {
+        let payload = &batch.payload;
+        let authority = get_backend_authority(&backend.url);
+        let content_length = payload.len().to_string();
+        let mut http_headers = vec![
+            (":method", "POST"),
+            (":path", batch.path.as_str()),
+            (":authority", authority.as_str()),
+            ("content-type", "application/x-protobuf"),
+            ("content-length", content_length.as_str()),
+            ("x-public-key", self.config.public_key.as_str()),
+        ];
+        if batch.gzipped {
+            http_headers.push(("content-encoding", "gzip"));
+        }
+        let auth_header = backend.auth.header(read_auth_metadata(ctx, &backend.auth).as_deref());
+        if let Some((name, value)) = &auth_header {
+            http_headers.push((name.as_str(), value.as_str()));
+        }
+
+        let cluster_name = get_backend_cluster_name(&backend.url);
+        ctx.dispatch_http_call(&cluster_name, http_headers, Some(payload.as_slice()), vec![], EXPORT_TIMEOUT)
+    }
+
+    /// OTLP/gRPC: the batch bytes are already a valid ExportTraceServiceRequest (or
+    /// ExportLogsServiceRequest), which has the same wire layout as TracesData (LogsData)
+    fn dispatch_grpc(&self, ctx: &dyn Context, backend: &BackendConfig, batch: &ExportBatch) -> Result<u32, Status> {
+        let mut metadata: Vec<(&str, &[u8])> = vec![("x-public-key", self.config.public_key.as_bytes())];
+        if let Some(tenant) = &batch.tenant {
+            metadata.push((TENANT_METADATA, tenant.as_bytes()));
+        }
+        let auth_header = backend.auth.header(read_auth_metadata(ctx, &backend.auth).as_deref());
+        if let Some((name, value)) = &auth_header {
+            metadata.push((name.as_str(), value.as_bytes()));
+        }
+
+        let cluster_name = get_backend_cluster_name(&backend.url);
+        ctx.dispatch_grpc_call(
+            &cluster_name,
+            match batch.signal {
+                Signal::Traces => OTLP_TRACE_SERVICE,
+                Signal::Logs => OTLP_LOGS_SERVICE,
+            },
+            OTLP_EXPORT_METHOD,
+            metadata,
+            Some(batch.payload.as_slice()),
+            EXPORT_TIMEOUT,
+        )
+    }
+
+    fn schedule_retry(&mut self, mut batch: ExportBatch) {
+        if batch.attempts >= self.config.max_export_retries {
+            self.give_up(batch);
+            return;
+        }
+
+        let delay_ms = retry_backoff_ms(batch.attempts, self.config.retry_backoff_ms, self.config.retry_max_backoff_ms);
+        batch.attempts += 1;
+        let retry = QueuedRetry {
+            batch,
+            next_attempt_at: get_current_timestamp_nanos() + Duration::from_millis(delay_ms).as_nanos() as u64,
+        };
+
+        if self.retry_queue.len() >= self.config.max_queued_batches {
+            let dropped = match self.config.overflow_policy {
+                OverflowPolicy::DropOldest if !self.retry_queue.is_empty() => {
+                    let oldest = self.retry_queue.pop_front();
+                    self.retry_queue.push_back(retry);
+                    oldest.map(|r| r.batch)
+                }
+                _ => Some(retry.batch),
+            };
+            if let Some(dropped) = dropped {
+                self.record_overflow_drop(dropped);
+            }
+        } else {
+            crate::sp_debug!(
+                "Retrying export of {} {} in {}ms (attempt {})",
+                retry.batch.span_count,
+                retry.batch.signal.unit(),
+                delay_ms,
+                retry.batch.attempts
+            );
+            self.retry_queue.push_back(retry);
+        }
+        self.update_queue_depth();
+    }
+
+    fn record_overflow_drop(&mut self, batch: ExportBatch) {
+        self.dropped_batches += 1;
+        crate::metrics::increment_backend_counter(crate::metrics::EXPORT_DROPPED_TOTAL, &self.backend_name(&batch), 1);
+        if self.dropped_batches % DROP_LOG_EVERY == 1 {
+            crate::sp_warn!(
+                "Export queue full ({} batches), dropped a batch of {} spans ({:?}, {} dropped so far)",
+                self.config.max_queued_batches,
+                batch.span_count,
+                self.config.overflow_policy,
+                self.dropped_batches
+            );
+        }
+    }
+
+    fn update_queue_depth(&self) {
+        crate::metrics::set_gauge(crate::metrics::EXPORT_QUEUE_DEPTH, self.retry_queue.len() as u64);
+    }
+
+    fn give_up(&mut self, batch: ExportBatch) {
+        let backend = self.backend_name(&batch);
+        crate::sp_error!("Dropping {} {} for '{}' after {} export retries", batch.span_count, batch.signal.unit(), backend, batch.attempts);
+        crate::metrics::increment_backend_counter(crate::metrics::EXPORT_FAILED_TOTAL, &backend, 1);
+    }
+
+    fn dispatch_due_retries(&mut self, ctx: &dyn Context, now: u64) {
+        let mut waiting = VecDeque::with_capacity(self.retry_queue.len());
+        while let Some(retry) = self.retry_queue.pop_front() {
+            if retry.next_attempt_at <= now {
+                self.dispatch(ctx, retry.batch);
+            } else {
+                waiting.push_back(retry);
+            }
+        }
+        // dispatch() may have re-queued immediate failures; keep them behind the waiting ones
+        waiting.append(&mut self.retry_queue);
+        self.retry_queue = waiting;
+        self.update_queue_depth();
+    }
+
+    fn record_circuit_failure(&self, ctx: &dyn Context, backend: &str) {
+        let now_ms = get_current_timestamp_nanos() / 1_000_000;
+        crate::circuit::record_failure(ctx, backend, now_ms, self.config.circuit_failure_threshold, self.config.circuit_open_ms);
+    }
+
+    fn expire_lost_exports(&mut self, ctx: &dyn Context, now: u64) {
+        let deadline = (EXPORT_TIMEOUT + LOST_CALLBACK_GRACE).as_nanos() as u64;
+        let lost: Vec<u32> = self
+            .in_flight
+            .iter()
+            .filter(|(_, export)| now.saturating_sub(export.dispatched_at) > deadline)
+            .map(|(call_id, _)| *call_id)
+            .collect();
+
+        for call_id in lost {
+            if let Some(export) = self.in_flight.remove(&call_id) {
+                crate::sp_warn!("No response for export call {} ({} {})", call_id, export.batch.span_count, export.batch.signal.unit());
+                record_export_duration(export.dispatched_at, false);
+                self.record_circuit_failure(ctx, &self.backend_name(&export.batch));
+                self.schedule_retry(export.batch);
+            }
+        }
+    }
+}
+
+/// Read the auth credential from Envoy node metadata, if auth.metadataKey is configured
+pub fn read_auth_metadata(ctx: &dyn Context, auth: &AuthConfig) -> Option<String> {
+    if !auth.enabled || auth.metadata_key.is_empty() {
+        return None;
+    }
+    ctx.get_property(vec!["node", "metadata", auth.metadata_key.as_str()])
+        .and_then(|bytes| String::from_utf8(bytes).ok())
+        .map(|value| value.trim().to_string())
+}
+
+fn gzip(payload: &[u8]) -> std::io::Result<Vec<u8>> {
+    let mut encoder = GzEncoder::new(Vec::with_capacity(payload.len() / 4), flate2::Compression::fast());
+    encoder.write_all(payload)?;
+    encoder.finish()
+}
+
+/// Transient failures worth retrying; status 0 means the call timed out or was reset
+fn is_retryable_status(status_code: u32) -> bool {
+    status_code == 0 || status_code == 429 || status_code >= 500
+}
+
+fn http_outcome(status_code: u32) -> ExportOutcome {
+    if (200..300).contains(&status_code) {
+        ExportOutcome::Success
+    } else if is_retryable_status(status_code) {
+        ExportOutcome::Retry
+    } else {
+        ExportOutcome::Reject
+    }
+}
+
+/// gRPC status handling per the OTLP spec's retryable codes, plus RESOURCE_EXHAUSTED
+/// to match HTTP 429
+fn grpc_outcome(grpc_status: u32) -> ExportOutcome {
+    match grpc_status {
+        0 => ExportOutcome::Success,
+        // CANCELLED, DEADLINE_EXCEEDED, RESOURCE_EXHAUSTED, ABORTED, OUT_OF_RANGE, UNAVAILABLE, DATA_LOSS
+        1 | 4 | 8 | 10 | 11 | 14 | 15 => ExportOutcome::Retry,
+        _ => ExportOutcome::Reject,
+    }
+}
+
+/// Exponential backoff for the given (zero-based) retry attempt, capped at max_ms
+fn retry_backoff_ms(attempt: u32, base_ms: u64, max_ms: u64) -> u64 {
+    base_ms.saturating_mul(1u64 << attempt.min(32)).min(max_ms)
+}
+
+/// Cut a string longer than `max_bytes` (suffix included) on a UTF-8 boundary; true when
+/// it was cut
+fn cap_string(value: &mut String, max_bytes: usize) -> bool {
+    if value.len() <= max_bytes {
+        return false;
+    }
+    let keep = max_bytes.saturating_sub(TRUNCATED_SUFFIX.len());
+    let kept_len = truncate_utf8(value.as_bytes(), keep).len();
+    value.truncate(kept_len);
+    if max_bytes > TRUNCATED_SUFFIX.len() {
+        value.push_str(TRUNCATED_SUFFIX);
+    }
+    true
+}
+
+/// Cap the string values in an attribute list, adding `sp.<attr>.truncated = true` to the
+/// same list for each one cut. Returns how many were cut.
+fn cap_key_values(attributes: &mut Vec<KeyValue>, max_bytes: usize) -> usize {
+    let mut markers = Vec::new();
+    for attribute in attributes.iter_mut() {
+        if let Some(any_value::Value::StringValue(value)) = attribute.value.as_mut().and_then(|v| v.value.as_mut()) {
+            if cap_string(value, max_bytes) {
+                let name = attribute.key.strip_prefix("sp.").unwrap_or(&attribute.key);
+                markers.push(bool_attribute(&format!("sp.{}.truncated", name), true));
+            }
+        }
+    }
+    let cut = markers.len();
+    attributes.extend(markers);
+    cut
+}
+
+/// Cap string span, event and link attributes at `max_bytes`
+fn cap_span_values(resource_spans: &mut [ResourceSpans], max_bytes: usize) {
+    for scope_spans in resource_spans.iter_mut().flat_map(|r| r.scope_spans.iter_mut()) {
+        for span in &mut scope_spans.spans {
+            let mut cut = cap_key_values(&mut span.attributes, max_bytes);
+            for event in &mut span.events {
+                cut += cap_key_values(&mut event.attributes, max_bytes);
+            }
+            for link in &mut span.links {
+                cut += cap_key_values(&mut link.attributes, max_bytes);
+            }
+            if cut > 0 {
+                crate::sp_debug!("Truncated {} attribute values of span '{}' to {} bytes", cut, span.name, max_bytes);
+            }
+        }
+    }
+}
+
+/// Cap string log record bodies and attributes at `max_bytes`; a cut body is marked
+/// `sp.body.truncated` on the record
+fn cap_log_values(resource_logs: &mut [ResourceLogs], max_bytes: usize) {
+    for scope_logs in resource_logs.iter_mut().flat_map(|r| r.scope_logs.iter_mut()) {
+        for record in &mut scope_logs.log_records {
+            let mut cut = cap_key_values(&mut record.attributes, max_bytes);
+            if let Some(any_value::Value::StringValue(body)) = record.body.as_mut().and_then(|v| v.value.as_mut()) {
+                if cap_string(body, max_bytes) {
+                    record.attributes.push(bool_attribute("sp.body.truncated", true));
+                    cut += 1;
+                }
+            }
+            if cut > 0 {
+                crate::sp_debug!("Truncated {} values of log record '{}' to {} bytes", cut, record.event_name, max_bytes);
+            }
+        }
+    }
+}
+
+fn count_spans(resource_spans: &ResourceSpans) -> usize {
+    resource_spans.scope_spans.iter().map(|s| s.spans.len()).sum()
+}
+
+/// Merge log records into the batch, reusing an entry with the same Resource and scope
+fn merge_resource_logs(batch: &mut Vec<ResourceLogs>, incoming: ResourceLogs) {
+    let existing = match batch
+        .iter_mut()
+        .find(|r| r.resource == incoming.resource && r.schema_url == incoming.schema_url)
+    {
+        Some(existing) => existing,
+        None => {
+            batch.push(incoming);
+            return;
+        }
+    };
+
+    for scope_logs in incoming.scope_logs {
+        match existing
+            .scope_logs
+            .iter_mut()
+            .find(|s| s.scope == scope_logs.scope && s.schema_url == scope_logs.schema_url)
+        {
+            Some(scope) => scope.log_records.extend(scope_logs.log_records),
+            None => existing.scope_logs.push(scope_logs),
+        }
+    }
+}
+
+/// Merge spans into the batch, reusing an entry with the same Resource and scope
+fn merge_resource_spans(batch: &mut Vec<ResourceSpans>, incoming: ResourceSpans) {
+    let existing = batch
+        .iter_mut()
+        .find(|r| r.resource == incoming.resource && r.schema_url == incoming.schema_url);
+
+    let existing = match existing {
+        Some(existing) => existing,
+        None => {
+            batch.push(incoming);
+            return;
+        }
+    };
+
+    for scope_spans in incoming.scope_spans {
+        match existing
+            .scope_spans
+            .iter_mut()
+            .find(|s| s.scope == scope_spans.scope && s.schema_url == scope_spans.schema_url)
+        {
+            Some(scope) => scope.spans.extend(scope_spans.spans),
+            None => existing.scope_spans.push(scope_spans),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::otel::{Resource, ScopeSpans, Span};
+
+    fn resource_spans(service: &str, span_name: &str) -> ResourceSpans {
+        ResourceSpans {
+            resource: Some(Resource {
+                attributes: vec![crate::otel::string_attribute("service.name", service.to_string())],
+                ..Default::default()
+            }),
+            scope_spans: vec![ScopeSpans {
+                spans: vec![Span {
+                    name: span_name.to_string(),
+                    ..Default::default()
+                }],
+                ..Default::default()
+            }],
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn test_cap_attribute_values() {
+        let mut batch = resource_spans("svc", "GET /");
+        batch.scope_spans[0].spans[0].attributes = vec![
+            crate::otel::string_attribute("http.request.body", "é".repeat(20)),
+            crate::otel::string_attribute("sp.query.q", "short".to_string()),
+            crate::otel::int_attribute("sp.body.length", 123_456),
+        ];
+        let long_location = crate::otel::string_attribute("http.response.header.location", "/".repeat(40));
+        batch.scope_spans[0].spans[0].events = vec![crate::otel::span::Event {
+            name: "http.redirect".to_string(),
+            attributes: vec![long_location.clone()],
+            ..Default::default()
+        }];
+        batch.scope_spans[0].spans[0].links = vec![crate::otel::span::Link {
+            attributes: vec![long_location],
+            ..Default::default()
+        }];
+        let mut batches = vec![batch];
+        cap_span_values(&mut batches, 25);
+        let batch = &batches[0];
+
+        let attributes = &batch.scope_spans[0].spans[0].attributes;
+        let value = |i: usize| match attributes[i].value.as_ref().and_then(|v| v.value.as_ref()) {
+            Some(any_value::Value::StringValue(s)) => s.clone(),
+            other => panic!("unexpected value {:?}", other),
+        };
+        // 11 bytes left for content: 5 two-byte characters, never half of one
+        assert_eq!(value(0), format!("{}{}", "é".repeat(5), TRUNCATED_SUFFIX));
+        assert!(value(0).len() <= 25);
+        assert_eq!(value(1), "short");
+        assert_eq!(attributes.len(), 4);
+        assert_eq!(attributes[3].key, "sp.http.request.body.truncated");
+
+        // Event and link attributes are capped too, with the marker next to the value
+        let span = &batch.scope_spans[0].spans[0];
+        for attributes in [&span.events[0].attributes, &span.links[0].attributes] {
+            assert_eq!(attributes.len(), 2);
+            let capped = format!("{}{}", "/".repeat(11), TRUNCATED_SUFFIX);
+            assert_eq!(attributes[0].value.as_ref().and_then(|v| v.value.clone()), Some(any_value::Value::StringValue(capped)));
+            assert_eq!(attributes[1].key, "sp.http.response.header.location.truncated");
+        }
+    }
+
+    #[test]
+    fn test_cap_log_values() {
+        let mut batches = vec![ResourceLogs {
+            scope_logs: vec![crate::otel::ScopeLogs {
+                log_records: vec![crate::otel::LogRecord {
+                    event_name: "http.request.body".to_string(),
+                    body: Some(crate::otel::AnyValue {
+                        value: Some(any_value::Value::StringValue("x".repeat(100))),
+                    }),
+                    attributes: vec![crate::otel::string_attribute("sp.request.id", "r".repeat(30))],
+                    ..Default::default()
+                }],
+                ..Default::default()
+            }],
+            ..Default::default()
+        }];
+        cap_log_values(&mut batches, 25);
+
+        let record = &batches[0].scope_logs[0].log_records[0];
+        match record.body.as_ref().and_then(|v| v.value.as_ref()) {
+            Some(any_value::Value::StringValue(body)) => assert_eq!(body, &format!("{}{}", "x".repeat(11), TRUNCATED_SUFFIX)),
+            other => panic!("unexpected body {:?}", other),
+        }
+        let keys: Vec<&str> = record.attributes.iter().map(|kv| kv.key.as_str()).collect();
+        assert_eq!(keys, vec!["sp.request.id", "sp.request.id.truncated", "sp.body.truncated"]);
+    }
+
+    #[test]
+    fn test_export_path() {
+        let template = crate::config::DEFAULT_EXPORT_PATH_TEMPLATE;
+        assert_eq!(export_path(template, None, Some("svc"), Signal::Traces), Err("no value for {tenant}".to_string()));
+        assert_eq!(export_path(template, Some("acme"), Some("svc"), Signal::Traces).unwrap(), "/api/tenants/acme/v1/traces");
+        assert!(export_path(template, None, Some("svc"), Signal::Logs).is_err());
+        assert_eq!(export_path(template, Some("acme"), None, Signal::Logs).unwrap(), "/api/tenants/acme/v1/logs");
+    }
+
+    #[test]
+    fn test_export_path_template() {
+        let template = "/ingest/{tenant}/services/{service}/traces";
+        assert_eq!(export_path(template, Some("acme"), Some("cart"), Signal::Traces).unwrap(), "/ingest/acme/services/cart/traces");
+        assert_eq!(export_path(template, Some("acme"), Some("cart"), Signal::Logs).unwrap(), "/ingest/acme/services/cart/logs");
+        // A placeholder without a value, or with one unsafe in a path, does not resolve
+        assert_eq!(export_path(template, Some("acme"), None, Signal::Traces), Err("no value for {service}".to_string()));
+        assert_eq!(export_path(template, Some(""), Some("cart"), Signal::Traces), Err("no value for {tenant}".to_string()));
+        assert!(export_path(template, Some("acme"), Some("cart/../admin"), Signal::Traces).unwrap_err().contains("{service}"));
+        assert!(export_path(template, Some("acme"), Some("cart svc"), Signal::Traces).is_err());
+        assert_eq!(export_path("/collect", Some("acme"), Some("cart"), Signal::Traces).unwrap(), "/collect");
+        assert!(export_path("/collect", None, None, Signal::Logs).is_err());
+
+        assert_eq!(validate_path_template(template), Ok(()));
+        assert!(validate_path_template("/ingest/{tenant}/{svc}").unwrap_err().starts_with("unknown placeholder {svc}"));
+        assert_eq!(validate_path_template("/ingest/{tenant"), Err("unclosed {".to_string()));
+        assert!(validate_path_template("ingest/{tenant}").is_err());
+    }
+
+    #[test]
+    fn test_resource_service_name() {
+        let batch = resource_spans("cart", "GET /");
+        assert_eq!(resource_service_name(batch.resource.as_ref()), Some("cart"));
+        assert_eq!(resource_service_name(None), None);
+    }
+
+    #[test]
+    fn test_gzip_round_trip() {
+        use std::io::Read;
+
+        let payload = b"resourceSpans resourceSpans resourceSpans".repeat(100);
+        let compressed = gzip(&payload).unwrap();
+        assert!(compressed.len() < payload.len());
+
+        let mut decoded = Vec::new();
+        flate2::read::GzDecoder::new(compressed.as_slice()).read_to_end(&mut decoded).unwrap();
+        assert_eq!(decoded, payload);
+    }
+
+    #[test]
+    fn test_retry_backoff_ms() {
+        assert_eq!(retry_backoff_ms(0, 500, 30_000), 500);
+        assert_eq!(retry_backoff_ms(1, 500, 30_000), 1_000);
+        assert_eq!(retry_backoff_ms(3, 500, 30_000), 4_000);
+        assert_eq!(retry_backoff_ms(10, 500, 30_000), 30_000);
+        assert_eq!(retry_backoff_ms(40, 500, 30_000), 30_000);
+    }
+
+    #[test]
+    fn test_grpc_outcome() {
+        assert_eq!(grpc_outcome(0), ExportOutcome::Success);
+        assert_eq!(grpc_outcome(14), ExportOutcome::Retry);
+        assert_eq!(grpc_outcome(4), ExportOutcome::Retry);
+        assert_eq!(grpc_outcome(8), ExportOutcome::Retry);
+        assert_eq!(grpc_outcome(3), ExportOutcome::Reject);
+        assert_eq!(grpc_outcome(16), ExportOutcome::Reject);
+    }
+
+    #[test]
+    fn test_http_outcome() {
+        assert_eq!(http_outcome(200), ExportOutcome::Success);
+        assert_eq!(http_outcome(503), ExportOutcome::Retry);
+        assert_eq!(http_outcome(400), ExportOutcome::Reject);
+    }
+
+    #[test]
+    fn test_is_retryable_status() {
+        assert!(is_retryable_status(0));
+        assert!(is_retryable_status(429));
+        assert!(is_retryable_status(503));
+        assert!(!is_retryable_status(400));
+        assert!(!is_retryable_status(401));
+    }
+
+    #[test]
+    fn test_merge_resource_spans_same_resource() {
+        let mut batch = Vec::new();
+        merge_resource_spans(&mut batch, resource_spans("checkout", "a"));
+        merge_resource_spans(&mut batch, resource_spans("checkout", "b"));
+
+        assert_eq!(batch.len(), 1);
+        assert_eq!(batch[0].scope_spans.len(), 1);
+        assert_eq!(count_spans(&batch[0]), 2);
+    }
+
+    #[test]
+    fn test_merge_resource_spans_distinct_resources() {
+        let mut batch = Vec::new();
+        merge_resource_spans(&mut batch, resource_spans("checkout", "a"));
+        merge_resource_spans(&mut batch, resource_spans("payments", "b"));
+        merge_resource_spans(&mut batch, resource_spans("checkout", "c"));
+
+        assert_eq!(batch.len(), 2);
+        assert_eq!(count_spans(&batch[0]), 2);
+        assert_eq!(count_spans(&batch[1]), 1);
+    }
+}
@@ -0,0 +1,124 @@
+// gRPC-Web body unframing for capture
+
+use base64::{engine::general_purpose, Engine as _};
+
+/// Flag bit marking a gRPC-Web trailer frame
+const TRAILER_FRAME_FLAG: u8 = 0x80;
+/// Frame header: 1 flag byte followed by a 4-byte big-endian length
+const FRAME_HEADER_LEN: usize = 5;
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum GrpcWebEncoding {
+    Binary,  // application/grpc-web, application/grpc-web+proto
+    Text,    // application/grpc-web-text, application/grpc-web-text+proto (base64)
+}
+
+/// Detect a gRPC-Web content-type
+pub fn grpc_web_encoding(content_type: Option<&str>) -> Option<GrpcWebEncoding> {
+    let media_type = content_type?.split(';').next()?.trim().to_ascii_lowercase();
+    if media_type == "application/grpc-web-text" || media_type.starts_with("application/grpc-web-text+") {
+        Some(GrpcWebEncoding::Text)
+    } else if media_type == "application/grpc-web" || media_type.starts_with("application/grpc-web+") {
+        Some(GrpcWebEncoding::Binary)
+    } else {
+        None
+    }
+}
+
+/// Strip gRPC-Web framing and return the concatenated message payloads.
+/// Trailer frames are dropped. Returns None if the body is not well-formed
+/// (e.g. a truncated capture), in which case the caller keeps the raw bytes.
+pub fn unframe(body: &[u8], encoding: GrpcWebEncoding) -> Option<Vec<u8>> {
+    let decoded;
+    let mut framed: &[u8] = body;
+    if encoding == GrpcWebEncoding::Text {
+        decoded = decode_text_body(body)?;
+        framed = &decoded;
+    }
+
+    let mut messages = Vec::new();
+    while !framed.is_empty() {
+        if framed.len() < FRAME_HEADER_LEN {
+            return None;
+        }
+        let flag = framed[0];
+        let len = u32::from_be_bytes([framed[1], framed[2], framed[3], framed[4]]) as usize;
+        let end = FRAME_HEADER_LEN.checked_add(len)?;
+        if framed.len() < end {
+            return None;
+        }
+        if flag & TRAILER_FRAME_FLAG == 0 {
+            messages.extend_from_slice(&framed[FRAME_HEADER_LEN..end]);
+        }
+        framed = &framed[end..];
+    }
+    Some(messages)
+}
+
+/// Decode a grpc-web-text body. Each stream chunk is base64-encoded separately, so the
+/// body may be several padded base64 segments back to back.
+fn decode_text_body(body: &[u8]) -> Option<Vec<u8>> {
+    let text: Vec<u8> = body.iter().copied().filter(|b| !b.is_ascii_whitespace()).collect();
+    let mut decoded = Vec::new();
+    let mut start = 0;
+    let mut i = 0;
+    while i < text.len() {
+        // A segment ends after its padding
+        if text[i] == b'=' {
+            while i < text.len() && text[i] == b'=' {
+                i += 1;
+            }
+            decoded.extend(general_purpose::STANDARD.decode(&text[start..i]).ok()?);
+            start = i;
+        } else {
+            i += 1;
+        }
+    }
+    if start < text.len() {
+        decoded.extend(general_purpose::STANDARD.decode(&text[start..]).ok()?);
+    }
+    Some(decoded)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn frame(flag: u8, payload: &[u8]) -> Vec<u8> {
+        let mut framed = vec![flag];
+        framed.extend_from_slice(&(payload.len() as u32).to_be_bytes());
+        framed.extend_from_slice(payload);
+        framed
+    }
+
+    #[test]
+    fn test_grpc_web_encoding() {
+        assert_eq!(grpc_web_encoding(Some("application/grpc-web+proto")), Some(GrpcWebEncoding::Binary));
+        assert_eq!(grpc_web_encoding(Some("application/grpc-web")), Some(GrpcWebEncoding::Binary));
+        assert_eq!(grpc_web_encoding(Some("application/grpc-web-text")), Some(GrpcWebEncoding::Text));
+        assert_eq!(grpc_web_encoding(Some("application/grpc-web-text+proto")), Some(GrpcWebEncoding::Text));
+        assert_eq!(grpc_web_encoding(Some("application/grpc")), None);
+        assert_eq!(grpc_web_encoding(None), None);
+    }
+
+    #[test]
+    fn test_unframe_binary_drops_trailers() {
+        let mut body = frame(0x00, b"hello");
+        body.extend(frame(0x80, b"grpc-status: 0\r\n"));
+        assert_eq!(unframe(&body, GrpcWebEncoding::Binary), Some(b"hello".to_vec()));
+    }
+
+    #[test]
+    fn test_unframe_text_with_concatenated_segments() {
+        let mut body = general_purpose::STANDARD.encode(frame(0x00, b"hi")).into_bytes();
+        body.extend(general_purpose::STANDARD.encode(frame(0x80, b"grpc-status: 0")).into_bytes());
+        assert_eq!(unframe(&body, GrpcWebEncoding::Text), Some(b"hi".to_vec()));
+    }
+
+    #[test]
+    fn test_unframe_truncated_body() {
+        let body = frame(0x00, b"hello");
+        assert_eq!(unframe(&body[..6], GrpcWebEncoding::Binary), None);
+        assert_eq!(unframe(b"not base64!", GrpcWebEncoding::Text), None);
+    }
+}
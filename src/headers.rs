@@ -1,9 +1,11 @@
 use std::collections::HashMap;
+use std::net::{IpAddr, SocketAddr};
 
-/// Detect service name from headers or configuration
+/// Detect service name from configuration, headers or the Istio workload name, in that order
 pub fn detect_service_name(
     request_headers: &HashMap<String, String>,
     config_service_name: &str,
+    workload_name: Option<&str>,
 ) -> String {
     // Use configured service_name if it's not default
     if !config_service_name.is_empty() && config_service_name != "default-service" {
@@ -20,9 +22,61 @@ pub fn detect_service_name(
             }
         }
     }
+    if let Some(workload_name) = workload_name.filter(|name| !name.is_empty()) {
+        crate::sp_debug!("Using Istio workload name as service_name: {}", workload_name);
+        return workload_name.to_string();
+    }
     config_service_name.to_string()
 }
 
+/// Placeholder written in place of redacted values
+pub const REDACTED_VALUE: &str = "***REDACTED***";
+
+/// Case-insensitive name match; a trailing `*` matches any suffix (e.g. `x-internal-*`)
+pub fn matches_name_pattern(name: &str, pattern: &str) -> bool {
+    let name = name.to_ascii_lowercase();
+    let pattern = pattern.to_ascii_lowercase();
+    match pattern.strip_suffix('*') {
+        Some(prefix) => name.starts_with(prefix),
+        None => name == pattern,
+    }
+}
+
+/// Return a copy of the headers with values of matching names replaced by REDACTED_VALUE.
+/// Only the captured copy is touched; the proxied request keeps its original headers.
+pub fn redact_headers(
+    headers: &HashMap<String, String>,
+    patterns: &[String],
+) -> HashMap<String, String> {
+    headers
+        .iter()
+        .map(|(name, value)| {
+            if patterns.iter().any(|pattern| matches_name_pattern(name, pattern)) {
+                (name.clone(), REDACTED_VALUE.to_string())
+            } else {
+                (name.clone(), value.clone())
+            }
+        })
+        .collect()
+}
+
+/// Return a copy of the headers without the hop-by-hop ones: names matching `patterns`, and
+/// any header the Connection header lists as connection-specific (RFC 9110 section 7.6.1)
+pub fn strip_hop_by_hop(headers: &HashMap<String, String>, patterns: &[String]) -> HashMap<String, String> {
+    let connection_options: Vec<String> = headers
+        .get("connection")
+        .map(|value| value.split(',').map(|name| name.trim().to_ascii_lowercase()).filter(|name| !name.is_empty()).collect())
+        .unwrap_or_default();
+    headers
+        .iter()
+        .filter(|(name, _)| {
+            !patterns.iter().any(|pattern| matches_name_pattern(name, pattern))
+                && !connection_options.iter().any(|option| name.eq_ignore_ascii_case(option))
+        })
+        .map(|(name, value)| (name.clone(), value.clone()))
+        .collect()
+}
+
 /// Build new tracestate with x-sp-traceparent entry
 pub fn build_new_tracestate(
     request_headers: &HashMap<String, String>,
@@ -59,6 +113,41 @@ pub fn build_new_tracestate(
     new_tracestate
 }
 
+/// Header count and total size (names plus values), for capacity planning
+pub fn header_stats(headers: &[(String, String)]) -> (usize, usize) {
+    let bytes = headers.iter().map(|(name, value)| name.len() + value.len()).sum();
+    (headers.len(), bytes)
+}
+
+/// Client IP for an exchange. Each of the `trust_hops` proxies in front of this one
+/// appends the address it received the request from to x-forwarded-for, so the client
+/// is the `trust_hops`-th entry from the right; anything further left was sent by the
+/// client and can be spoofed. With 0 trusted hops the header is ignored and the
+/// downstream remote address is used.
+pub fn client_address(xff: Option<&str>, trust_hops: usize, remote_address: Option<&str>) -> Option<IpAddr> {
+    if trust_hops > 0 {
+        if let Some(xff) = xff {
+            let entries: Vec<&str> = xff.split(',').map(str::trim).filter(|e| !e.is_empty()).collect();
+            // Fewer entries than trusted hops: every entry was added by a trusted proxy
+            let index = entries.len().saturating_sub(trust_hops);
+            if let Some(address) = entries.get(index).and_then(|entry| parse_ip(entry)) {
+                return Some(address);
+            }
+        }
+    }
+    remote_address.and_then(parse_ip)
+}
+
+/// Parse an address with or without a port: `10.0.0.1`, `10.0.0.1:443`, `2001:db8::1`, `[2001:db8::1]:443`
+fn parse_ip(value: &str) -> Option<IpAddr> {
+    let value = value.trim();
+    value
+        .parse::<IpAddr>()
+        .ok()
+        .or_else(|| value.parse::<SocketAddr>().ok().map(|addr| addr.ip()))
+        .or_else(|| value.strip_prefix('[')?.strip_suffix(']')?.parse::<IpAddr>().ok())
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -69,7 +158,7 @@ mod tests {
         let headers = HashMap::new();
         let config_name = "my-service";
         
-        let result = detect_service_name(&headers, config_name);
+        let result = detect_service_name(&headers, config_name, None);
         assert_eq!(result, "my-service");
     }
 
@@ -78,7 +167,7 @@ mod tests {
         let headers = HashMap::new();
         let config_name = "default-service";
         
-        let result = detect_service_name(&headers, config_name);
+        let result = detect_service_name(&headers, config_name, None);
         assert_eq!(result, "default-service");
     }
 
@@ -88,7 +177,7 @@ mod tests {
         headers.insert("x-sp-service-name".to_string(), "header-service".to_string());
         let config_name = "default-service";
         
-        let result = detect_service_name(&headers, config_name);
+        let result = detect_service_name(&headers, config_name, None);
         assert_eq!(result, "header-service");
     }
 
@@ -98,7 +187,7 @@ mod tests {
         headers.insert("x-sp-service-name".to_string(), "header-service".to_string());
         let config_name = "my-service";
         
-        let result = detect_service_name(&headers, config_name);
+        let result = detect_service_name(&headers, config_name, None);
         assert_eq!(result, "my-service"); // Config takes precedence if not default
     }
 
@@ -108,10 +197,65 @@ mod tests {
         headers.insert("x-sp-service-name".to_string(), "".to_string());
         let config_name = "default-service";
         
-        let result = detect_service_name(&headers, config_name);
+        let result = detect_service_name(&headers, config_name, None);
         assert_eq!(result, "default-service");
     }
 
+    #[test]
+    fn test_detect_service_name_from_workload() {
+        let mut headers = HashMap::new();
+        assert_eq!(detect_service_name(&headers, "default-service", Some("reviews-v1")), "reviews-v1");
+        assert_eq!(detect_service_name(&headers, "my-service", Some("reviews-v1")), "my-service");
+        assert_eq!(detect_service_name(&headers, "default-service", Some("")), "default-service");
+
+        headers.insert("x-sp-service-name".to_string(), "header-service".to_string());
+        assert_eq!(detect_service_name(&headers, "default-service", Some("reviews-v1")), "header-service");
+    }
+
+    #[test]
+    fn test_matches_name_pattern() {
+        assert!(matches_name_pattern("Authorization", "authorization"));
+        assert!(matches_name_pattern("X-Internal-Token", "x-internal-*"));
+        assert!(!matches_name_pattern("x-internal", "x-internal-*"));
+        assert!(!matches_name_pattern("authorization-extra", "authorization"));
+    }
+
+    #[test]
+    fn test_strip_hop_by_hop() {
+        let mut headers = HashMap::new();
+        headers.insert("connection".to_string(), "keep-alive, X-Conn-Token".to_string());
+        headers.insert("keep-alive".to_string(), "timeout=5".to_string());
+        headers.insert("transfer-encoding".to_string(), "chunked".to_string());
+        headers.insert("x-conn-token".to_string(), "abc".to_string());
+        headers.insert("content-type".to_string(), "application/json".to_string());
+
+        let stripped = strip_hop_by_hop(&headers, &crate::config::default_hop_by_hop_headers());
+        let mut names: Vec<&String> = stripped.keys().collect();
+        names.sort();
+        assert_eq!(names, vec!["content-type"]);
+
+        // Headers named by Connection go even when the configured set leaves them out
+        let stripped = strip_hop_by_hop(&headers, &[]);
+        assert!(!stripped.contains_key("x-conn-token") && !stripped.contains_key("keep-alive"));
+        assert!(stripped.contains_key("connection") && stripped.contains_key("transfer-encoding"));
+    }
+
+    #[test]
+    fn test_redact_headers() {
+        let mut headers = HashMap::new();
+        headers.insert("cookie".to_string(), "session=abc".to_string());
+        headers.insert("x-internal-user".to_string(), "alice".to_string());
+        headers.insert("content-type".to_string(), "application/json".to_string());
+        let patterns = vec!["Cookie".to_string(), "x-internal-*".to_string()];
+
+        let redacted = redact_headers(&headers, &patterns);
+        assert_eq!(redacted.get("cookie").unwrap(), REDACTED_VALUE);
+        assert_eq!(redacted.get("x-internal-user").unwrap(), REDACTED_VALUE);
+        assert_eq!(redacted.get("content-type").unwrap(), "application/json");
+        // Original map is left untouched
+        assert_eq!(headers.get("cookie").unwrap(), "session=abc");
+    }
+
     #[test]
     fn test_build_new_tracestate_with_no_existing() {
         let mut headers = HashMap::new();
@@ -160,4 +304,58 @@ mod tests {
         let result = build_new_tracestate(&headers, traceparent, "");
         assert!(result.starts_with("x-sp-traceparent="));
     }
-}
\ No newline at end of file
+
+    #[test]
+    fn test_header_stats() {
+        let headers = vec![
+            (":method".to_string(), "GET".to_string()),
+            ("accept".to_string(), "*/*".to_string()),
+            ("accept".to_string(), "text/html".to_string()),
+        ];
+        assert_eq!(header_stats(&headers), (3, 10 + 9 + 15));
+        assert_eq!(header_stats(&[]), (0, 0));
+    }
+
+    #[test]
+    fn test_client_address_single_ip() {
+        assert_eq!(
+            client_address(Some("203.0.113.7"), 1, Some("10.0.0.2:51234")),
+            Some("203.0.113.7".parse().unwrap())
+        );
+    }
+
+    #[test]
+    fn test_client_address_list_honors_trust_hops() {
+        let xff = "198.51.100.1, 203.0.113.7, 10.0.0.9";
+        assert_eq!(client_address(Some(xff), 1, None), Some("10.0.0.9".parse().unwrap()));
+        assert_eq!(client_address(Some(xff), 2, None), Some("203.0.113.7".parse().unwrap()));
+        // More trusted hops than entries: the leftmost entry was still added by a trusted proxy
+        assert_eq!(client_address(Some(xff), 5, None), Some("198.51.100.1".parse().unwrap()));
+    }
+
+    #[test]
+    fn test_client_address_zero_hops_ignores_xff() {
+        assert_eq!(
+            client_address(Some("198.51.100.1"), 0, Some("10.0.0.2:51234")),
+            Some("10.0.0.2".parse().unwrap())
+        );
+        assert_eq!(client_address(Some("198.51.100.1"), 0, None), None);
+    }
+
+    #[test]
+    fn test_client_address_missing_header_falls_back() {
+        assert_eq!(client_address(None, 1, Some("10.0.0.2:51234")), Some("10.0.0.2".parse().unwrap()));
+        assert_eq!(client_address(Some("not-an-ip"), 1, Some("10.0.0.2")), Some("10.0.0.2".parse().unwrap()));
+        assert_eq!(client_address(None, 1, None), None);
+    }
+
+    #[test]
+    fn test_client_address_ipv6() {
+        assert_eq!(
+            client_address(Some("2001:db8::1, [2001:db8::2]:443"), 1, None),
+            Some("2001:db8::2".parse().unwrap())
+        );
+        assert_eq!(client_address(Some("2001:db8::1"), 1, None), Some("2001:db8::1".parse().unwrap()));
+        assert_eq!(client_address(None, 0, Some("[::1]:8080")), Some("::1".parse().unwrap()));
+    }
+}
@@ -0,0 +1,80 @@
+// Heartbeat spans, so an idle sidecar stays visible to the backend
+//
+// With heartbeatIntervalMs set, the root context tick enqueues a small internal span
+// carrying the service name and filter version. It goes through the regular exporter,
+// so it is batched, authenticated and retried like captured spans. Every worker VM
+// sends its own heartbeat.
+
+use std::cell::RefCell;
+use std::collections::HashMap;
+use std::time::Duration;
+
+use proxy_wasm::traits::Context;
+
+use crate::config::Config;
+use crate::otel::{get_current_timestamp_nanos, SpanBuilder};
+
+thread_local! {
+    static LAST_HEARTBEAT_AT: RefCell<u64> = RefCell::new(0);
+}
+
+/// Tick period that also honours the heartbeat interval
+pub fn tick_period(config: &Config, export_period: Duration) -> Duration {
+    if config.heartbeat_interval_ms == 0 {
+        return export_period;
+    }
+    export_period.min(Duration::from_millis(config.heartbeat_interval_ms))
+}
+
+/// Enqueue a heartbeat span if heartbeatIntervalMs has elapsed since the last one.
+/// The first heartbeat goes out on the first tick after configure.
+pub fn on_tick(ctx: &dyn Context, config: &Config) {
+    if config.heartbeat_interval_ms == 0 {
+        return;
+    }
+    let now = get_current_timestamp_nanos();
+    let interval = Duration::from_millis(config.heartbeat_interval_ms).as_nanos() as u64;
+    let due = LAST_HEARTBEAT_AT.with(|last| {
+        let mut last = last.borrow_mut();
+        if *last != 0 && now.saturating_sub(*last) < interval {
+            return false;
+        }
+        *last = now;
+        true
+    });
+    if !due {
+        return;
+    }
+
+    let service_name =
+        crate::headers::detect_service_name(&HashMap::new(), &config.service_name, config.workload_name.as_deref());
+    let tenant = crate::http_helpers::resolve_tenant(&HashMap::new(), &config.tenant_header, &config.default_tenant)
+        .ok()
+        .flatten();
+    let traces_data = SpanBuilder::new()
+        .with_service_name(service_name)
+        .with_traffic_direction(config.traffic_direction.clone().unwrap_or_else(|| "auto".to_string()))
+        .with_public_key(config.public_key.clone())
+        .with_resource_attributes(config.resource_attributes.clone())
+        .create_heartbeat_span(config.heartbeat_interval_ms);
+    crate::sp_debug!("Enqueueing heartbeat span");
+    crate::export::enqueue(ctx, &config.plugin_name, tenant.as_deref(), traces_data);
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_tick_period() {
+        let mut config = Config::default();
+        let export_period = Duration::from_millis(1000);
+        assert_eq!(tick_period(&config, export_period), export_period);
+
+        config.heartbeat_interval_ms = 250;
+        assert_eq!(tick_period(&config, export_period), Duration::from_millis(250));
+
+        config.heartbeat_interval_ms = 30_000;
+        assert_eq!(tick_period(&config, export_period), export_period);
+    }
+}
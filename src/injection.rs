@@ -80,7 +80,7 @@ fn extract_agent_response_from_span(span: &crate::otel::Span) -> Option<AgentRes
 
     for attr in &span.attributes {
         match attr.key.as_str() {
-            "http.response.status_code" => {
+            crate::semconv::HTTP_STATUS_CODE | crate::semconv::LEGACY_HTTP_STATUS_CODE => {
                 if let Some(value) = &attr.value {
                     if let Some(crate::otel::any_value::Value::IntValue(code)) = &value.value {
                         status_code = *code as u32;
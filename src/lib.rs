@@ -1,3 +1,6 @@
+use std::cell::RefCell;
+use std::collections::HashMap;
+
 use proxy_wasm::traits::*;
 use proxy_wasm::types::*;
 
@@ -10,32 +13,118 @@ mod context;
 mod http_helpers;
 mod trace_context;
 mod logging;
+mod redaction;
+mod sampling;
+mod export;
+mod metrics;
+mod grpc_web;
+mod dedup;
+mod route_config;
+mod semconv;
+mod protobuf;
+mod decompression;
+mod circuit;
+mod session;
+mod span_name;
+mod sink;
+mod multipart;
+mod heartbeat;
+mod ratelimit;
+mod tee;
+mod shared_data;
+mod server_timing;
+mod trace_limit;
+mod timing;
+mod span_links;
+mod sniff;
+mod body_hash;
+mod span_events;
+#[cfg(test)]
+mod test_host;
 
-use crate::config::Config;
+use crate::config::{Compression, Config, ExportProtocol};
 use crate::context::SpHttpContext;
+
+/// Version of this filter build (set by build.rs), reported as sp.filter.version
+pub const FILTER_VERSION: &str = env!("SP_FILTER_VERSION");
+
 // Main entry point for the WASM module
 proxy_wasm::main! {{
     // It's required to set the log level explicitly for the WASM module log to work correctly
     proxy_wasm::set_log_level(LogLevel::Debug);
-    sp_info!("SP-Istio Agent WASM module loaded.");
+    sp_info!("SP-Istio Agent WASM module loaded (version {}).", FILTER_VERSION);
     proxy_wasm::set_root_context(|_| -> Box<dyn RootContext> {
         Box::new(SpRootContext::new())
     });
 }}
 
+thread_local! {
+    // Last valid config of each plugin in this VM, by plugin name
+    static LAST_VALID_CONFIGS: RefCell<HashMap<String, Config>> = RefCell::new(HashMap::new());
+}
+
 struct SpRootContext {
     config: Config,
+    shutting_down: bool,  // Set in on_done while waiting for the final export responses
+    config_invalid: bool,  // Failed validation: streams pass through uncaptured
+    configured: bool,  // A valid config has been applied; a bad reload keeps it
 }
 
 impl SpRootContext {
     fn new() -> Self {
         Self {
             config: Config::default(),
+            shutting_down: false,
+            config_invalid: false,
+            configured: false,
         }
     }
 }
 
-impl Context for SpRootContext {}
+/// Stream handler used while the plugin configuration is invalid: traffic flows,
+/// nothing is captured
+struct PassthroughContext;
+
+impl Context for PassthroughContext {}
+
+impl HttpContext for PassthroughContext {}
+
+impl Context for SpRootContext {
+    fn on_http_call_response(&mut self, token_id: u32, _num_headers: usize, _body_size: usize, _num_trailers: usize) {
+        logging::clear_context();
+        let status_code = self
+            .get_http_call_response_header(":status")
+            .and_then(|s| s.parse::<u32>().ok())
+            .unwrap_or(0);
+        if !export::on_export_response(self, token_id, status_code) {
+            sp_debug!("Ignoring unknown HTTP call response: token={}", token_id);
+        }
+
+        if self.shutting_down && !export::has_in_flight(&self.config.plugin_name) {
+            self.done();
+        }
+    }
+
+    fn on_grpc_call_response(&mut self, token_id: u32, status_code: u32, _response_size: usize) {
+        logging::clear_context();
+        if !export::on_export_grpc_response(self, token_id, status_code) {
+            sp_debug!("Ignoring unknown gRPC call response: token={}", token_id);
+        }
+
+        if self.shutting_down && !export::has_in_flight(&self.config.plugin_name) {
+            self.done();
+        }
+    }
+
+    fn on_done(&mut self) -> bool {
+        logging::clear_context();
+        // Flush the last partial batch; stay alive until its response arrives
+        sp_info!("Plugin shutting down, flushing pending spans");
+        self.shutting_down = true;
+        export::flush(self, &self.config.plugin_name);
+        !export::has_in_flight(&self.config.plugin_name)
+    }
+}
 
 impl RootContext for SpRootContext {
     fn get_type(&self) -> Option<ContextType> {
@@ -43,6 +132,9 @@ impl RootContext for SpRootContext {
     }
 
     fn create_http_context(&self, context_id: u32) -> Option<Box<dyn HttpContext>> {
+        if self.config_invalid {
+            return Some(Box::new(PassthroughContext));
+        }
         Some(Box::new(SpHttpContext::new(
             context_id,
             self.config.clone(),
@@ -50,11 +142,113 @@ impl RootContext for SpRootContext {
     }
 
     fn on_configure(&mut self, _plugin_configuration_size: usize) -> bool {
-        if let Some(config_bytes) = self.get_plugin_configuration() {
-            self.config.parse_from_json(&config_bytes);
+        logging::clear_context();
+        // Called again whenever the plugin config is pushed. The new config is parsed from
+        // scratch and only swapped in once valid; streams already running keep their copy.
+        let config_bytes = self.get_plugin_configuration().unwrap_or_default();
+        let mut config = Config::default();
+        if !config_bytes.is_empty() {
+            config.parse_from_json(&config_bytes);
         }
+
+        // Istio copies ISTIO_META_WORKLOAD_NAME into node metadata; it names the service
+        // when service_name is not configured
+        config.workload_name = self
+            .get_property(vec!["node", "metadata", "WORKLOAD_NAME"])
+            .and_then(|bytes| String::from_utf8(bytes).ok())
+            .filter(|name| !name.is_empty());
+
+        let mut problems = config.validate(&config_bytes).err().unwrap_or_default();
+        for backend in config.export_backends() {
+            let auth_metadata = export::read_auth_metadata(self, &backend.auth);
+            if let Err(e) = backend.auth.validate(auth_metadata.as_deref()) {
+                if config.backends.is_empty() {
+                    problems.push(e);
+                } else {
+                    problems.push(format!("backend '{}': {}", backend.name, e));
+                }
+            }
+        }
+        // Envoy usually hands an updated config to a new root context in the same VM, so
+        // the last valid config is also kept per plugin name for that case
+        let plugin_name = self
+            .get_property(vec!["plugin_name"])
+            .and_then(|bytes| String::from_utf8(bytes).ok())
+            .unwrap_or_default();
+        config.plugin_name = plugin_name.clone();
+        let config = if problems.is_empty() {
+            if self.configured || LAST_VALID_CONFIGS.with(|configs| configs.borrow().contains_key(&plugin_name)) {
+                sp_info!("Plugin configuration reloaded; new streams use it");
+                metrics::increment_counter(metrics::CONFIG_RELOADS_TOTAL, 1);
+            }
+            LAST_VALID_CONFIGS.with(|configs| configs.borrow_mut().insert(plugin_name.clone(), config.clone()));
+            config
+        } else {
+            let previous = if self.configured {
+                Some(self.config.clone())
+            } else {
+                LAST_VALID_CONFIGS.with(|configs| configs.borrow().get(&plugin_name).cloned())
+            };
+            if previous.is_some() {
+                sp_error!("Invalid plugin configuration, keeping the previous one ({} problems):", problems.len());
+                metrics::increment_counter(metrics::CONFIG_REJECTED_TOTAL, 1);
+            } else {
+                // Fail closed on a bad config: keep the listener serving, capture nothing
+                sp_error!("Invalid plugin configuration, capture disabled until it is fixed ({} problems):", problems.len());
+                self.config_invalid = true;
+            }
+            for problem in &problems {
+                sp_error!("  - {}", problem);
+            }
+            match previous {
+                Some(previous) if !self.configured => previous,
+                _ => return true,
+            }
+        };
+
+        self.config = config;
+        self.config_invalid = false;
+        self.configured = true;
+        sp_info!("Plugin started, filter version {}", FILTER_VERSION);
+        metrics::set_gauge(metrics::BUILD_INFO, 1);
+        logging::set_format(self.config.log_format);
+        route_config::clear_cache(&plugin_name);
+
+        if let Some(workload_name) = &self.config.workload_name {
+            sp_info!("Detected Istio workload name: {}", workload_name);
+        }
+        for backend in self.config.export_backends() {
+            if let Ok(backend_endpoint) = http_helpers::validate_backend_url(&backend.url) {
+                sp_info!(
+                    "Exporting spans to {} (cluster {}, backend '{}')",
+                    backend_endpoint,
+                    http_helpers::get_backend_cluster_name(&backend.url),
+                    backend.name
+                );
+            }
+        }
+        let any_gzip = self.config.export_backends().iter().any(|backend| backend.compression == Compression::Gzip);
+        if self.config.export_protocol == ExportProtocol::Grpc && any_gzip {
+            sp_warn!("compression: gzip is ignored with exportProtocol: grpc; batches are sent uncompressed");
+        }
+
+        export::configure(&self.config);
+        if self.config.heartbeat_interval_ms > 0 {
+            sp_info!("Sending heartbeat spans every {}ms", self.config.heartbeat_interval_ms);
+        }
+        self.set_tick_period(heartbeat::tick_period(&self.config, export::tick_period(&self.config)));
         true
     }
+
+    fn on_tick(&mut self) {
+        logging::clear_context();
+        heartbeat::on_tick(self, &self.config);
+        export::on_tick(self, &self.config.plugin_name);
+        if self.config.session_sequence {
+            let now_ms = otel::get_current_timestamp_nanos() / 1_000_000;
+            session::sweep(self, now_ms, self.config.session_idle_ms, self.config.max_sessions);
+        }
+    }
 }
 
 #[cfg(test)]
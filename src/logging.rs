@@ -1,53 +1,148 @@
-// Logging macros that enforce the "SP: " prefix consistently
+// Logging macros that enforce the "SP: " prefix consistently, or emit one JSON object
+// per line when logFormat is json. Never pass request/response body content to these.
+
+use std::cell::{Cell, RefCell};
+use std::fmt;
+
+use crate::config::LogFormat;
+
+/// Request the current callback is running for, attached to JSON log lines
+#[derive(Default)]
+struct LogContext {
+    context_id: Option<u32>,
+    session_id: Option<String>,
+    trace_id: Option<String>,
+}
+
+thread_local! {
+    static LOG_FORMAT: Cell<LogFormat> = Cell::new(LogFormat::Text);
+    static LOG_CONTEXT: RefCell<LogContext> = RefCell::new(LogContext::default());
+}
+
+/// Apply the configured logFormat; called from the root context on configure
+pub fn set_format(format: LogFormat) {
+    LOG_FORMAT.with(|f| f.set(format));
+}
+
+/// Tag following log lines with a request's ids. Callbacks for different requests
+/// interleave on the VM thread, so each http callback sets this on entry.
+pub fn set_context(context_id: u32, session_id: &str, trace_id: String) {
+    if LOG_FORMAT.with(|f| f.get()) == LogFormat::Text {
+        return;
+    }
+    LOG_CONTEXT.with(|c| {
+        *c.borrow_mut() = LogContext {
+            context_id: Some(context_id),
+            session_id: Some(session_id.to_string()).filter(|s| !s.is_empty()),
+            trace_id: Some(trace_id),
+        }
+    });
+}
+
+/// Drop the request ids, for root context callbacks
+pub fn clear_context() {
+    LOG_CONTEXT.with(|c| *c.borrow_mut() = LogContext::default());
+}
+
+#[doc(hidden)]
+pub fn format_message(level: &str, args: fmt::Arguments) -> String {
+    match LOG_FORMAT.with(|f| f.get()) {
+        LogFormat::Text => format!("SP: {}", args),
+        LogFormat::Json => LOG_CONTEXT.with(|c| {
+            let c = c.borrow();
+            let mut line = serde_json::json!({
+                "level": level,
+                "msg": args.to_string(),
+                "session_id": c.session_id,
+                "trace_id": c.trace_id,
+            });
+            if let Some(context_id) = c.context_id {
+                line["context_id"] = serde_json::json!(context_id);
+            }
+            line.to_string()
+        }),
+    }
+}
 
 #[macro_export]
 macro_rules! sp_trace {
     ($fmt:expr) => {
-        log::trace!(concat!("SP: ", $fmt));
+        log::trace!("{}", $crate::logging::format_message("trace", format_args!($fmt)));
     };
     ($fmt:expr, $($arg:tt)*) => {
-        log::trace!(concat!("SP: ", $fmt), $($arg)*);
+        log::trace!("{}", $crate::logging::format_message("trace", format_args!($fmt, $($arg)*)));
     };
 }
 
 #[macro_export]
 macro_rules! sp_debug {
     ($fmt:expr) => {
-        log::debug!(concat!("SP: ", $fmt));
+        log::debug!("{}", $crate::logging::format_message("debug", format_args!($fmt)));
     };
     ($fmt:expr, $($arg:tt)*) => {
-        log::debug!(concat!("SP: ", $fmt), $($arg)*);
+        log::debug!("{}", $crate::logging::format_message("debug", format_args!($fmt, $($arg)*)));
     };
 }
 
 #[macro_export]
 macro_rules! sp_info {
     ($fmt:expr) => {
-        log::info!(concat!("SP: ", $fmt));
+        log::info!("{}", $crate::logging::format_message("info", format_args!($fmt)));
     };
     ($fmt:expr, $($arg:tt)*) => {
-        log::info!(concat!("SP: ", $fmt), $($arg)*);
+        log::info!("{}", $crate::logging::format_message("info", format_args!($fmt, $($arg)*)));
     };
 }
 
 #[macro_export]
 macro_rules! sp_warn {
     ($fmt:expr) => {
-        log::warn!(concat!("SP: ", $fmt));
+        log::warn!("{}", $crate::logging::format_message("warn", format_args!($fmt)));
     };
     ($fmt:expr, $($arg:tt)*) => {
-        log::warn!(concat!("SP: ", $fmt), $($arg)*);
+        log::warn!("{}", $crate::logging::format_message("warn", format_args!($fmt, $($arg)*)));
     };
 }
 
 #[macro_export]
 macro_rules! sp_error {
     ($fmt:expr) => {
-        log::error!(concat!("SP: ", $fmt));
+        log::error!("{}", $crate::logging::format_message("error", format_args!($fmt)));
     };
     ($fmt:expr, $($arg:tt)*) => {
-        log::error!(concat!("SP: ", $fmt), $($arg)*);
+        log::error!("{}", $crate::logging::format_message("error", format_args!($fmt, $($arg)*)));
     };
 }
 
 
+
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_format_message_text() {
+        set_format(LogFormat::Text);
+        assert_eq!(format_message("info", format_args!("hello {}", 1)), "SP: hello 1");
+    }
+
+    #[test]
+    fn test_format_message_json() {
+        set_format(LogFormat::Json);
+        set_context(7, "session-1", "0af7651916cd43dd8448eb211c80319c".to_string());
+        let line: serde_json::Value =
+            serde_json::from_str(&format_message("warn", format_args!("quoted \"{}\"", "value"))).unwrap();
+        assert_eq!(line["level"], "warn");
+        assert_eq!(line["msg"], "quoted \"value\"");
+        assert_eq!(line["session_id"], "session-1");
+        assert_eq!(line["trace_id"], "0af7651916cd43dd8448eb211c80319c");
+        assert_eq!(line["context_id"], 7);
+
+        clear_context();
+        let line: serde_json::Value = serde_json::from_str(&format_message("info", format_args!("root"))).unwrap();
+        assert!(line["session_id"].is_null());
+        assert!(line.get("context_id").is_none());
+        set_format(LogFormat::Text);
+    }
+}
\ No newline at end of file
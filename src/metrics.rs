@@ -0,0 +1,123 @@
+// Plugin self-metrics, reported through Envoy stats (/stats/prometheus)
+
+use std::cell::RefCell;
+use std::collections::HashMap;
+
+use proxy_wasm::types::MetricType;
+
+pub const SPANS_CAPTURED_TOTAL: &str = "sp_spans_captured_total";
+pub const SPANS_EXPORTED_TOTAL: &str = "sp_spans_exported_total";
+pub const BODY_TRUNCATED_TOTAL: &str = "sp_body_truncated_total";
+pub const EXPORT_FAILED_TOTAL: &str = "sp_export_failed_total";
+pub const EXPORT_DROPPED_TOTAL: &str = "sp_export_dropped_total";
+pub const EXPORT_QUEUE_DEPTH: &str = "sp_export_queue_depth";
+pub const EXPORT_CIRCUIT_DROPPED_TOTAL: &str = "sp_export_circuit_dropped_total";
+pub const EXPORT_CIRCUIT_STATE: &str = "sp_export_circuit_state";
+pub const ACTIVE_SESSIONS: &str = "sp_active_sessions";
+pub const LOG_RECORDS_EXPORTED_TOTAL: &str = "sp_log_records_exported_total";
+pub const CONFIG_RELOADS_TOTAL: &str = "sp_config_reloads_total";
+pub const CONFIG_REJECTED_TOTAL: &str = "sp_config_rejected_total";
+pub const EXPORT_RATELIMITED_TOTAL: &str = "sp_export_ratelimited_total";
+pub const TEE_SENT_TOTAL: &str = "sp_tee_sent_total";
+pub const TEE_FAILED_TOTAL: &str = "sp_tee_failed_total";
+pub const TEE_RATELIMITED_TOTAL: &str = "sp_tee_ratelimited_total";
+pub const SHARED_DATA_ERRORS_TOTAL: &str = "sp_shared_data_errors_total";
+pub const TRACE_SPANS_DROPPED_TOTAL: &str = "sp_trace_spans_dropped_total";
+// Spans and log records sent to the plain OTLP path because exportPathTemplate did not resolve
+pub const EXPORT_PATH_FALLBACK_TOTAL: &str = "sp_export_path_fallback_total";
+// All traffic through the filter, captured or not: header (names plus values) and body bytes
+pub const REQUEST_BYTES_TOTAL: &str = "sp_request_bytes_total";
+pub const RESPONSE_BYTES_TOTAL: &str = "sp_response_bytes_total";
+// Always 1; the filter version is the last name segment, e.g. sp_build_info.0_0_21_g1a2b3c4d5e6f
+pub const BUILD_INFO: &str = concat!("sp_build_info.", env!("SP_FILTER_VERSION_STAT"));
+// proxy-wasm metrics carry no tags, so the outcome is part of the name
+pub const EXPORT_DURATION_MS: &str = "sp_export_duration_ms";
+pub const EXPORT_DURATION_MS_SUCCESS: &str = "sp_export_duration_ms.success";
+pub const EXPORT_DURATION_MS_FAILURE: &str = "sp_export_duration_ms.failure";
+
+thread_local! {
+    static METRIC_IDS: RefCell<HashMap<String, u32>> = RefCell::new(HashMap::new());
+}
+
+/// Look up a metric id, defining the metric with the host on first use
+fn metric_id(metric_type: MetricType, name: &str) -> Option<u32> {
+    METRIC_IDS.with(|ids| {
+        let mut ids = ids.borrow_mut();
+        if let Some(id) = ids.get(name) {
+            return Some(*id);
+        }
+        match proxy_wasm::hostcalls::define_metric(metric_type, name) {
+            Ok(id) => {
+                ids.insert(name.to_string(), id);
+                Some(id)
+            }
+            Err(status) => {
+                crate::sp_warn!("Failed to define metric {}: {:?}", name, status);
+                None
+            }
+        }
+    })
+}
+
+/// Add to a counter
+pub fn increment_counter(name: &'static str, offset: i64) {
+    if let Some(id) = metric_id(MetricType::Counter, name) {
+        if let Err(status) = proxy_wasm::hostcalls::increment_metric(id, offset) {
+            crate::sp_warn!("Failed to increment metric {}: {:?}", name, status);
+        }
+    }
+}
+
+/// Add to a counter broken down by a tag value, which becomes the last name segment
+/// (`sp_export_ratelimited_total.acme`). Dots in the value are replaced so it stays
+/// one segment.
+pub fn increment_tagged_counter(name: &'static str, tag: &str, offset: i64) {
+    let tagged_name = format!("{}.{}", name, tag.replace('.', "_"));
+    if let Some(id) = metric_id(MetricType::Counter, &tagged_name) {
+        if let Err(status) = proxy_wasm::hostcalls::increment_metric(id, offset) {
+            crate::sp_warn!("Failed to increment metric {}: {:?}", tagged_name, status);
+        }
+    }
+}
+
+/// Add to a counter for one export backend. The plain stat always counts; backends from
+/// a `backends` list are also counted under their own name.
+pub fn increment_backend_counter(name: &'static str, backend: &str, offset: i64) {
+    increment_counter(name, offset);
+    if backend != crate::config::DEFAULT_BACKEND_NAME {
+        increment_tagged_counter(name, backend, offset);
+    }
+}
+
+/// Set a gauge for one export backend: the plain stat for the single default backend,
+/// `<name>.<backend>` for backends from a `backends` list
+pub fn set_backend_gauge(name: &'static str, backend: &str, value: u64) {
+    if backend == crate::config::DEFAULT_BACKEND_NAME {
+        set_gauge(name, value);
+        return;
+    }
+    let tagged_name = format!("{}.{}", name, backend.replace('.', "_"));
+    if let Some(id) = metric_id(MetricType::Gauge, &tagged_name) {
+        if let Err(status) = proxy_wasm::hostcalls::record_metric(id, value) {
+            crate::sp_warn!("Failed to record metric {}: {:?}", tagged_name, status);
+        }
+    }
+}
+
+/// Record a histogram sample. Bucket boundaries are set on the Envoy side.
+pub fn record_histogram(name: &'static str, value: u64) {
+    if let Some(id) = metric_id(MetricType::Histogram, name) {
+        if let Err(status) = proxy_wasm::hostcalls::record_metric(id, value) {
+            crate::sp_warn!("Failed to record metric {}: {:?}", name, status);
+        }
+    }
+}
+
+/// Set a gauge to an absolute value
+pub fn set_gauge(name: &'static str, value: u64) {
+    if let Some(id) = metric_id(MetricType::Gauge, name) {
+        if let Err(status) = proxy_wasm::hostcalls::record_metric(id, value) {
+            crate::sp_warn!("Failed to record metric {}: {:?}", name, status);
+        }
+    }
+}
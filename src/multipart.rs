@@ -0,0 +1,259 @@
+// Streaming multipart/form-data scanner
+//
+// Uploads can be large, so multipart bodies are never buffered. Each chunk is fed through
+// the scanner as it arrives. Part headers are parsed and part contents only counted, so
+// memory stays at one chunk plus a delimiter's worth of carried-over bytes.
+
+/// Longest header block accepted for one part; anything larger is treated as malformed
+const MAX_PART_HEADER_BYTES: usize = 8 * 1024;
+
+/// Metadata of one part; the content itself is never kept
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct PartInfo {
+    pub name: Option<String>,
+    pub content_type: Option<String>,
+    pub size: u64,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+enum State {
+    Preamble,
+    AfterDelimiter,  // Either "--" (closing delimiter) or the end of the delimiter line follows
+    Headers,
+    Body,
+    Done,
+}
+
+#[derive(Debug)]
+pub struct MultipartScanner {
+    delimiter: Vec<u8>,  // CRLF "--" boundary
+    carry: Vec<u8>,  // Bytes that may still start a delimiter or header terminator
+    state: State,
+    parts: Vec<PartInfo>,
+    max_parts: usize,
+    bytes_seen: u64,
+    truncated: bool,
+}
+
+impl MultipartScanner {
+    pub fn new(boundary: &str, max_parts: usize) -> Self {
+        let mut delimiter = b"\r\n--".to_vec();
+        delimiter.extend_from_slice(boundary.as_bytes());
+        Self {
+            delimiter,
+            // The first delimiter may open the body without a preceding CRLF
+            carry: b"\r\n".to_vec(),
+            state: State::Preamble,
+            parts: Vec::new(),
+            max_parts,
+            bytes_seen: 0,
+            truncated: false,
+        }
+    }
+
+    /// Feed the next body chunk
+    pub fn feed(&mut self, chunk: &[u8]) {
+        self.bytes_seen += chunk.len() as u64;
+        if self.state == State::Done {
+            return;
+        }
+        self.carry.extend_from_slice(chunk);
+
+        loop {
+            match self.state {
+                State::Preamble | State::Body => match find(&self.carry, &self.delimiter) {
+                    Some(at) => {
+                        if self.state == State::Body {
+                            self.current_part().size += at as u64;
+                        }
+                        self.carry.drain(..at + self.delimiter.len());
+                        self.state = State::AfterDelimiter;
+                    }
+                    None => {
+                        // Keep just enough to recognise a delimiter split across chunks
+                        let keep = (self.delimiter.len() - 1).min(self.carry.len());
+                        let consumed = self.carry.len() - keep;
+                        if self.state == State::Body {
+                            self.current_part().size += consumed as u64;
+                        }
+                        self.carry.drain(..consumed);
+                        return;
+                    }
+                },
+                State::AfterDelimiter => {
+                    if self.carry.len() < 2 {
+                        return;
+                    }
+                    if self.carry.starts_with(b"--") {
+                        self.state = State::Done;
+                        self.carry = Vec::new();
+                        return;
+                    }
+                    // Transport padding may precede the CRLF ending the delimiter line
+                    match find(&self.carry, b"\r\n") {
+                        Some(at) => {
+                            self.carry.drain(..at + 2);
+                            self.state = State::Headers;
+                        }
+                        None => return,
+                    }
+                }
+                State::Headers => {
+                    // An empty header block ends right after the delimiter line
+                    let (part, header_len) = if self.carry.starts_with(b"\r\n") {
+                        (PartInfo::default(), 2)
+                    } else {
+                        match find(&self.carry, b"\r\n\r\n") {
+                            Some(at) => (parse_part_headers(&self.carry[..at]), at + 4),
+                            None => {
+                                if self.carry.len() > MAX_PART_HEADER_BYTES {
+                                    crate::sp_debug!("Multipart part headers exceed {} bytes, stopping", MAX_PART_HEADER_BYTES);
+                                    self.stop();
+                                }
+                                return;
+                            }
+                        }
+                    };
+                    if self.parts.len() >= self.max_parts {
+                        self.stop();
+                        return;
+                    }
+                    self.carry.drain(..header_len);
+                    self.parts.push(part);
+                    self.state = State::Body;
+                }
+                State::Done => return,
+            }
+        }
+    }
+
+    /// Stop scanning early (the body limit was reached); the last part's size is partial
+    pub fn stop(&mut self) {
+        if self.state != State::Done {
+            self.truncated = true;
+            self.state = State::Done;
+            self.carry = Vec::new();
+        }
+    }
+
+    /// Body bytes fed or skipped so far
+    pub fn bytes_seen(&self) -> u64 {
+        self.bytes_seen
+    }
+
+    /// True once the closing delimiter was seen or scanning stopped; later chunks need
+    /// not be fetched
+    pub fn is_done(&self) -> bool {
+        self.state == State::Done
+    }
+
+    /// Count body bytes that were not fetched, once scanning has stopped
+    pub fn skip(&mut self, len: usize) {
+        self.bytes_seen += len as u64;
+    }
+
+    /// Parts seen so far, and whether scanning ended before the closing delimiter
+    /// (body limit, part limit, oversized headers or a body that ended early)
+    pub fn finish(self) -> (Vec<PartInfo>, bool, u64) {
+        let truncated = self.truncated || self.state != State::Done;
+        (self.parts, truncated, self.bytes_seen)
+    }
+
+    fn current_part(&mut self) -> &mut PartInfo {
+        self.parts.last_mut().expect("body state always follows a part")
+    }
+}
+
+fn find(haystack: &[u8], needle: &[u8]) -> Option<usize> {
+    haystack.windows(needle.len()).position(|window| window == needle)
+}
+
+fn parse_part_headers(block: &[u8]) -> PartInfo {
+    let mut part = PartInfo::default();
+    for line in String::from_utf8_lossy(block).split("\r\n") {
+        let (name, value) = match line.split_once(':') {
+            Some((name, value)) => (name.trim(), value.trim()),
+            None => continue,
+        };
+        if name.eq_ignore_ascii_case("content-type") {
+            part.content_type = Some(value.to_string());
+        } else if name.eq_ignore_ascii_case("content-disposition") {
+            part.name = disposition_param(value, "name");
+        }
+    }
+    part
+}
+
+/// A parameter of a Content-Disposition value, unquoted (`form-data; name="file"`)
+fn disposition_param(value: &str, param: &str) -> Option<String> {
+    value.split(';').skip(1).find_map(|p| {
+        let (name, value) = p.split_once('=')?;
+        if !name.trim().eq_ignore_ascii_case(param) {
+            return None;
+        }
+        Some(value.trim().trim_matches('"').to_string())
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const BODY: &[u8] = b"--xyz\r\n\
+Content-Disposition: form-data; name=\"title\"\r\n\
+\r\n\
+hello\r\n\
+--xyz\r\n\
+Content-Disposition: form-data; name=\"upload\"; filename=\"a.bin\"\r\n\
+Content-Type: application/octet-stream\r\n\
+\r\n\
+0123456789\r\n\
+--xyz--\r\n";
+
+    fn expected() -> Vec<PartInfo> {
+        vec![
+            PartInfo { name: Some("title".to_string()), content_type: None, size: 5 },
+            PartInfo {
+                name: Some("upload".to_string()),
+                content_type: Some("application/octet-stream".to_string()),
+                size: 10,
+            },
+        ]
+    }
+
+    #[test]
+    fn test_scan_whole_body() {
+        let mut scanner = MultipartScanner::new("xyz", 10);
+        scanner.feed(BODY);
+        assert_eq!(scanner.finish(), (expected(), false, BODY.len() as u64));
+    }
+
+    #[test]
+    fn test_scan_any_chunking() {
+        for chunk_size in 1..BODY.len() {
+            let mut scanner = MultipartScanner::new("xyz", 10);
+            for chunk in BODY.chunks(chunk_size) {
+                scanner.feed(chunk);
+            }
+            assert_eq!(scanner.finish(), (expected(), false, BODY.len() as u64), "chunk size {}", chunk_size);
+        }
+    }
+
+    #[test]
+    fn test_scan_limits() {
+        let mut scanner = MultipartScanner::new("xyz", 1);
+        scanner.feed(BODY);
+        let (parts, truncated, _) = scanner.finish();
+        assert_eq!(parts, expected()[..1].to_vec());
+        assert!(truncated);
+
+        // Stopped inside the second part: its size so far is reported
+        let mut scanner = MultipartScanner::new("xyz", 10);
+        scanner.feed(&BODY[..BODY.len() - 20]);
+        scanner.stop();
+        let (parts, truncated, _) = scanner.finish();
+        assert_eq!(parts.len(), 2);
+        assert!(parts[1].size < 10);
+        assert!(truncated);
+    }
+}
@@ -22,6 +22,11 @@ pub mod opentelemetry {
                 include!(concat!(env!("OUT_DIR"), "/opentelemetry.proto.trace.v1.rs"));
             }
         }
+        pub mod logs {
+            pub mod v1 {
+                include!(concat!(env!("OUT_DIR"), "/opentelemetry.proto.logs.v1.rs"));
+            }
+        }
     }
 }
 
@@ -29,6 +34,11 @@ pub mod opentelemetry {
 pub use opentelemetry::proto::common::v1::{AnyValue, KeyValue, any_value};
 pub use opentelemetry::proto::resource::v1::Resource;
 pub use opentelemetry::proto::trace::v1::{TracesData, ResourceSpans, ScopeSpans, Span, Status, span};
+pub use opentelemetry::proto::logs::v1::{LogsData, ResourceLogs, ScopeLogs, LogRecord, SeverityNumber};
+
+use crate::config::BinaryBodyEncoding;
+use crate::headers::matches_name_pattern;
+use crate::trace_context::{id_from_seed, parse_b3_headers, parse_traceparent_value, repair_ids, SPAN_ID_LEN, TRACE_ID_LEN};
 
 #[derive(Clone)]
 pub struct SpanBuilder {
@@ -38,7 +48,20 @@ pub struct SpanBuilder {
     service_name: String,
     traffic_direction: String,  // 添加traffic_direction字段
     public_key: String,
-    session_id: String
+    session_id: String,
+    session_id_generated: bool,  // True when no session id arrived with the request
+    propagators: Vec<String>,  // Inbound trace context formats, in priority order
+    session_id_headers: Vec<String>,  // Headers carrying the session id, in priority order
+    synthesize_session_id: bool,  // Derive a missing session id from the trace id
+    span_name: Option<String>,  // Overrides the url path as the extract span name
+    error_message: Option<String>,  // When set, the extract span status is ERROR
+    resource_attributes: Vec<(String, String)>,  // User resource attributes; override the built-in ones
+    binary_body_encoding: BinaryBodyEncoding,  // Base64 alphabet for non-text bodies
+    links: Vec<span::Link>,  // Links to other traces, exported on the extract span
+    dropped_links_count: u32,
+    events: Vec<span::Event>,  // captureSpanEvents: redirects and auth challenges
+    dropped_events_count: u32,
+    captured_response_headers: Vec<String>,  // Name patterns of exported response headers; empty: all
 }
 
 impl SpanBuilder {
@@ -50,7 +73,20 @@ impl SpanBuilder {
             service_name: "default-service".to_string(),
             traffic_direction: "outbound".to_string(),  // 默认值
             public_key: String::new(),
-            session_id: String::new()
+            session_id: String::new(),
+            session_id_generated: false,
+            propagators: vec!["tracecontext".to_string()],
+            session_id_headers: crate::config::default_session_id_headers(),
+            synthesize_session_id: false,
+            span_name: None,
+            error_message: None,
+            resource_attributes: Vec::new(),
+            binary_body_encoding: BinaryBodyEncoding::Std,
+            links: Vec::new(),
+            dropped_links_count: 0,
+            events: Vec::new(),
+            dropped_events_count: 0,
+            captured_response_headers: Vec::new(),
         }
     }
     // 添加设置service_name的方法
@@ -71,11 +107,84 @@ impl SpanBuilder {
         self
     }
 
+    /// Set the inbound trace context propagators ("tracecontext", "b3"), in priority order
+    pub fn with_propagators(mut self, propagators: Vec<String>) -> Self {
+        self.propagators = propagators;
+        self
+    }
+
+    /// Set the session id headers (lowercase), in priority order
+    pub fn with_session_id_headers(mut self, session_id_headers: Vec<String>) -> Self {
+        self.session_id_headers = session_id_headers;
+        self
+    }
+
+    /// Use the trace id as the session id when the request carries none
+    pub fn with_synthesized_session_id(mut self, synthesize_session_id: bool) -> Self {
+        self.synthesize_session_id = synthesize_session_id;
+        self
+    }
+
+    pub fn with_binary_body_encoding(mut self, binary_body_encoding: BinaryBodyEncoding) -> Self {
+        self.binary_body_encoding = binary_body_encoding;
+        self
+    }
+
+    /// Set the extract span's links; `dropped` counts the links over maxSpanLinks
+    pub fn with_links(mut self, links: Vec<span::Link>, dropped: u32) -> Self {
+        self.links = links;
+        self.dropped_links_count = dropped;
+        self
+    }
+
+    /// Limit exported response headers to those matching captureResponseHeaders
+    pub fn with_captured_response_headers(mut self, patterns: Vec<String>) -> Self {
+        self.captured_response_headers = patterns;
+        self
+    }
+
+    /// Set user resource attributes, merged into every exported resource
+    pub fn with_resource_attributes(mut self, resource_attributes: Vec<(String, String)>) -> Self {
+        self.resource_attributes = resource_attributes;
+        self
+    }
+
+    /// Use a custom name for the extract span instead of the url path
+    pub fn set_span_name(&mut self, name: String) {
+        self.span_name = Some(name);
+    }
+
+    /// Add an event to the extract span; events past `max_events` are only counted
+    pub fn add_event(&mut self, event: span::Event, max_events: usize) {
+        if self.events.len() < max_events {
+            self.events.push(event);
+        } else {
+            self.dropped_events_count = self.dropped_events_count.saturating_add(1);
+        }
+    }
+
+    /// Keep event times in step with the span when its start moves from `from` to `to`
+    pub fn rebase_events(&mut self, from: u64, to: u64) {
+        for event in &mut self.events {
+            event.time_unix_nano = to.saturating_add(event.time_unix_nano.saturating_sub(from));
+        }
+    }
+
+    /// Mark the extract span as failed
+    pub fn set_error(&mut self, message: String) {
+        self.error_message = Some(message);
+    }
+
     /// Check if session_id is present and not empty
     pub fn has_session_id(&self) -> bool {
         !self.session_id.is_empty()
     }
 
+    /// Check if the session_id was generated locally rather than received
+    pub fn is_session_id_generated(&self) -> bool {
+        self.session_id_generated
+    }
+
     /// Get current session_id string (may be empty if not set)
     pub fn get_session_id(&self) -> &str {
         &self.session_id
@@ -86,11 +195,24 @@ impl SpanBuilder {
         self.current_span_id.iter().map(|b| format!("{:02x}", b)).collect::<String>()
     }
 
+    /// Span id received in the inbound trace context, if any
+    pub fn get_parent_span_id_hex(&self) -> Option<String> {
+        self.parent_span_id
+            .as_ref()
+            .map(|id| id.iter().map(|b| format!("{:02x}", b)).collect::<String>())
+    }
+
+    pub fn get_traffic_direction(&self) -> &str {
+        &self.traffic_direction
+    }
+
     pub fn get_trace_id_hex(&self) -> String {
         self.trace_id.iter().map(|b| format!("{:02x}", b)).collect::<String>()
     }
 
     pub fn with_context(mut self, headers: &HashMap<String, String>) -> Self {
+        let mut trace_context_found = false;
+
         // Extract trace context from tracestate x-sp-traceparent if present
         if let Some(tracestate) = headers.get("tracestate") {
             crate::sp_info!("with_context Found tracestate header {}", tracestate);
@@ -101,9 +223,10 @@ impl SpanBuilder {
                 if let Some(value) = entry.strip_prefix("x-sp-traceparent=") {
                     crate::sp_debug!("Found x-sp-traceparent entry in tracestate {}", value);
                     // 解析完整的 traceparent 格式: 00-trace_id-span_id-01
-                    if let Some((trace_id, span_id)) = parse_traceparent(value) {
+                    if let Some((trace_id, span_id)) = parse_traceparent_value(value) {
                         self.trace_id = trace_id;
                         self.parent_span_id = Some(span_id);
+                        trace_context_found = true;
                         crate::sp_debug!("Parsed trace context from x-sp-traceparent");
                         break;
                     }
@@ -118,24 +241,42 @@ impl SpanBuilder {
             }
         }
 
-        // 如果没有从 tracestate 中解析到 trace context，尝试从标准的 traceparent 头部解析
-        if self.trace_id.is_empty() {
-            if let Some(traceparent) = headers.get("traceparent") {
-                crate::sp_debug!("Found traceparent header {}", traceparent);
-                // 解析标准的 traceparent 格式: 00-trace_id-span_id-01
-                if let Some((trace_id, span_id)) = parse_traceparent(traceparent) {
+        // 如果没有从 tracestate 中解析到 trace context，按配置的 propagators 顺序尝试，第一个匹配的生效
+        if !trace_context_found {
+            for propagator in &self.propagators {
+                let parsed = match propagator.as_str() {
+                    "tracecontext" => headers.get("traceparent").and_then(|traceparent| {
+                        crate::sp_debug!("Found traceparent header {}", traceparent);
+                        // 解析标准的 traceparent 格式: 00-trace_id-span_id-01
+                        parse_traceparent_value(traceparent)
+                    }),
+                    "b3" => parse_b3_headers(headers),
+                    _ => None,
+                };
+                if let Some((trace_id, span_id)) = parsed {
                     self.trace_id = trace_id;
                     self.parent_span_id = Some(span_id);
-                    crate::sp_debug!("Parsed trace context from traceparent");
+                    trace_context_found = true;
+                    crate::sp_debug!("Parsed trace context using {} propagator", propagator);
+                    break;
                 }
             }
         }
 
-        // Get session ID from headers directly
+        // If no valid trace context found, start a new trace
+        if !trace_context_found {
+            self.trace_id = generate_trace_id();
+            self.parent_span_id = None;
+        }
+        self.ensure_valid_ids();
+
+        // Get session ID from headers directly; the first configured header present wins
         crate::sp_debug!("Looking for session_id in headers");
-        let session_id_found = headers.get("x-sp-session-id")
-            .or_else(|| headers.get("sp_session_id"))
-            .or_else(|| headers.get("x-session-id"));
+        let session_id_found = self
+            .session_id_headers
+            .iter()
+            .filter_map(|name| headers.get(name))
+            .find(|value| !value.is_empty());
 
         if let Some(session_id) = session_id_found {
             let masked = if session_id.len() > 4 { "****" } else { "" };
@@ -154,18 +295,18 @@ impl SpanBuilder {
                 }
             }
             // 如果依然没有，则生成新的，并在后续注入阶段补充到 tracestate 中
-            if self.session_id.is_empty() {
+            if self.session_id.is_empty() && self.synthesize_session_id {
+                crate::sp_debug!("No session_id found in headers or tracestate, using the trace id");
+                self.session_id = self.get_trace_id_hex();
+                self.session_id_generated = true;
+            } else if self.session_id.is_empty() {
                 crate::sp_debug!("No session_id found in headers or tracestate, generating new one");
                 self.session_id = generate_session_id();
+                self.session_id_generated = true;
                 crate::sp_debug!("Generated session_id: sp-session-**** (will be added into tracestate during injection)");
             }
         }
 
-        // If no valid trace context found, generate new one
-        if self.trace_id.is_empty() {
-            self.trace_id = generate_trace_id();
-        }
-        
         self
     }
 
@@ -246,32 +387,12 @@ impl SpanBuilder {
             }
         }
 
-        // Add url attributes if available
-        if let Some(path) = url_path {
-            attributes.push(KeyValue {
-                key: "url.path".to_string(),
-                value: Some(AnyValue {
-                    value: Some(any_value::Value::StringValue(path.to_string())),
-                }),
-            });
-        }
-        if let Some(host) = url_host {
-            attributes.push(KeyValue {
-                key: "url.host".to_string(),
-                value: Some(AnyValue {
-                    value: Some(any_value::Value::StringValue(host.to_string())),
-                }),
-            });
-        }
+        // Add method and url attributes (semconv names)
+        attributes.extend(crate::semconv::request_attributes(request_headers, url_host, url_path));
 
         // Add request body if present and text-based
         if !request_body.is_empty() {
-            let body_value = if is_text_content(request_headers) {
-                String::from_utf8_lossy(request_body).to_string()
-            } else {
-                use base64::{Engine as _, engine::general_purpose};
-                general_purpose::STANDARD.encode(request_body)
-            };
+            let body_value = encode_body(request_headers, request_body, self.binary_body_encoding);
 
             attributes.push(KeyValue {
                 key: "http.request.body".to_string(),
@@ -297,6 +418,11 @@ impl SpanBuilder {
         self.create_traces_data(span)
     }
 
+    fn response_header_captured(&self, name: &str) -> bool {
+        self.captured_response_headers.is_empty()
+            || self.captured_response_headers.iter().any(|pattern| matches_name_pattern(name, pattern))
+    }
+
     pub fn create_extract_span(
         &self,
         request_headers: &HashMap<String, String>,
@@ -306,6 +432,8 @@ impl SpanBuilder {
         url_host: Option<&str>,
         url_path: Option<&str>,
         request_start_time: Option<u64>,  // Add request start time parameter
+        request_end_time: Option<u64>,  // None: now
+        extra_attributes: &[KeyValue],
     ) -> TracesData {
         let span_id = self.current_span_id.clone();
         let mut attributes = Vec::new();
@@ -360,44 +488,17 @@ impl SpanBuilder {
             }
         }
 
-        // Add url attributes if available
-        if let Some(path) = url_path {
-            attributes.push(KeyValue {
-                key: "url.path".to_string(),
-                value: Some(AnyValue {
-                    value: Some(any_value::Value::StringValue(path.to_string())),
-                }),
-            });
-        }
-        if let Some(host) = url_host {
-            attributes.push(KeyValue {
-                key: "url.host".to_string(),
-                value: Some(AnyValue {
-                    value: Some(any_value::Value::StringValue(host.to_string())),
-                }),
-            });
-        }
+        // Add method and url attributes (semconv names)
+        attributes.extend(crate::semconv::request_attributes(request_headers, url_host, url_path));
 
         // Add request body
         if !request_body.is_empty() {
-            let body_value = if is_text_content(request_headers) {
-                String::from_utf8_lossy(request_body).to_string()
-            } else {
-                use base64::{Engine as _, engine::general_purpose};
-                general_purpose::STANDARD.encode(request_body)
-            };
-
-            attributes.push(KeyValue {
-                key: "http.request.body".to_string(),
-                value: Some(AnyValue {
-                    value: Some(any_value::Value::StringValue(body_value)),
-                }),
-            });
+            attributes.push(string_attribute("http.request.body", encode_body(request_headers, request_body, self.binary_body_encoding)));
         }
 
         // Add response headers
         for (key, value) in response_headers {
-            if !should_skip_header(key) {
+            if !should_skip_header(key) && self.response_header_captured(key) {
                 attributes.push(KeyValue {
                     key: format!("http.response.header.{}", key.to_lowercase()),
                     value: Some(AnyValue {
@@ -408,46 +509,41 @@ impl SpanBuilder {
         }
 
         // Add response status code
-        if let Some(status) = response_headers.get(":status") {
-            if let Ok(status_code) = status.parse::<i64>() {
-                attributes.push(KeyValue {
-                    key: "http.response.status_code".to_string(),
-                    value: Some(AnyValue {
-                        value: Some(any_value::Value::IntValue(status_code)),
-                    }),
-                });
-            }
-        }
+        attributes.extend(crate::semconv::response_attributes(response_headers));
 
         // Add response body
         if !response_body.is_empty() {
-            let body_value = if is_text_content(response_headers) {
-                String::from_utf8_lossy(response_body).to_string()
-            } else {
-                use base64::{Engine as _, engine::general_purpose};
-                general_purpose::STANDARD.encode(response_body)
-            };
-
-            attributes.push(KeyValue {
-                key: "http.response.body".to_string(),
-                value: Some(AnyValue {
-                    value: Some(any_value::Value::StringValue(body_value)),
-                }),
-            });
+            attributes.push(string_attribute("http.response.body", encode_body(response_headers, response_body, self.binary_body_encoding)));
         }
 
+        // Add attributes collected by the http context during the exchange
+        attributes.extend_from_slice(extra_attributes);
+
         let span = Span {
             trace_id: self.trace_id.clone(),
             span_id,
             parent_span_id: self.parent_span_id.clone().unwrap_or_default(),
-            name: url_path.unwrap_or("unknown_path").to_string(),
+            name: self
+                .span_name
+                .clone()
+                .unwrap_or_else(|| url_path.unwrap_or("unknown_path").to_string()),
             kind: span::SpanKind::Server as i32,
             start_time_unix_nano: request_start_time.unwrap_or_else(|| get_current_timestamp_nanos()),
-            end_time_unix_nano: get_current_timestamp_nanos(),
+            end_time_unix_nano: request_end_time.unwrap_or_else(get_current_timestamp_nanos),
             attributes,
-            status: Some(Status {
-                code: 1, // STATUS_CODE_OK
-                message: String::new(),
+            links: self.links.clone(),
+            dropped_links_count: self.dropped_links_count,
+            events: self.events.clone(),
+            dropped_events_count: self.dropped_events_count,
+            status: Some(match &self.error_message {
+                Some(message) => Status {
+                    code: 2, // STATUS_CODE_ERROR
+                    message: message.clone(),
+                },
+                None => Status {
+                    code: 1, // STATUS_CODE_OK
+                    message: String::new(),
+                },
             }),
             flags: 0,
             ..Default::default()
@@ -456,7 +552,94 @@ impl SpanBuilder {
         self.create_traces_data(span)
     }
 
+    /// Internal span announcing that the filter is alive, sent on heartbeatIntervalMs
+    pub fn create_heartbeat_span(&self, interval_ms: u64) -> TracesData {
+        let now = get_current_timestamp_nanos();
+        let span = Span {
+            trace_id: self.trace_id.clone(),
+            span_id: self.current_span_id.clone(),
+            name: "sp.heartbeat".to_string(),
+            kind: span::SpanKind::Internal as i32,
+            start_time_unix_nano: now,
+            end_time_unix_nano: now,
+            attributes: vec![
+                string_attribute("sp.service.name", self.service_name.clone()),
+                string_attribute("sp.traffic.direction", self.traffic_direction.clone()),
+                string_attribute("sp.span.type", "heartbeat".to_string()),
+                int_attribute("sp.heartbeat.interval_ms", interval_ms as i64),
+            ],
+            ..Default::default()
+        };
+
+        self.create_traces_data(span)
+    }
+
+    /// Captured bodies as OTLP log records for bodyExport=log, one per non-empty
+    /// (side, body, is_text) entry, linked to the extract span by trace and span id.
+    /// Non-text bodies are base64-encoded. None when every body is empty.
+    pub fn create_body_logs(&self, bodies: &[(&str, &[u8], bool)], request_id: Option<&str>) -> Option<LogsData> {
+        let now = get_current_timestamp_nanos();
+        let mut log_records = Vec::new();
+        for (side, body, is_text) in bodies {
+            if body.is_empty() {
+                continue;
+            }
+            let body_value = if *is_text {
+                String::from_utf8_lossy(body).to_string()
+            } else {
+                self.binary_body_encoding.encode(body)
+            };
+            let mut attributes = vec![string_attribute("sp.body.side", side.to_string())];
+            if !self.session_id.is_empty() {
+                attributes.push(string_attribute("sp.session.id", self.session_id.clone()));
+            }
+            if let Some(request_id) = request_id {
+                attributes.push(string_attribute("sp.request.id", request_id.to_string()));
+            }
+            log_records.push(LogRecord {
+                time_unix_nano: now,
+                observed_time_unix_nano: now,
+                severity_number: SeverityNumber::Info as i32,
+                event_name: format!("http.{}.body", side),
+                body: Some(AnyValue {
+                    value: Some(any_value::Value::StringValue(body_value)),
+                }),
+                attributes,
+                trace_id: self.trace_id.clone(),
+                span_id: self.current_span_id.clone(),
+                ..Default::default()
+            });
+        }
+        if log_records.is_empty() {
+            return None;
+        }
+
+        Some(LogsData {
+            resource_logs: vec![ResourceLogs {
+                resource: Some(self.create_resource()),
+                scope_logs: vec![ScopeLogs {
+                    log_records,
+                    ..Default::default()
+                }],
+                schema_url: crate::semconv::SCHEMA_URL.to_string(),
+            }],
+        })
+    }
+
     fn create_traces_data(&self, span: Span) -> TracesData {
+        TracesData {
+            resource_spans: vec![ResourceSpans {
+                resource: Some(self.create_resource()),
+                scope_spans: vec![ScopeSpans {
+                    spans: vec![span],
+                    ..Default::default()
+                }],
+                schema_url: crate::semconv::SCHEMA_URL.to_string(),
+            }],
+        }
+    }
+
+    fn create_resource(&self) -> Resource {
         // Create resource with service.name attribute
         let service_name = if self.service_name.is_empty() {
             "default-service".to_string()
@@ -479,7 +662,7 @@ impl SpanBuilder {
         }
 
         attributes.push(KeyValue {
-            key: "service.name".to_string(),
+            key: crate::semconv::SERVICE_NAME.to_string(),
             value: Some(AnyValue {
                 value: Some(any_value::Value::StringValue(service_name)),
             }),
@@ -493,24 +676,27 @@ impl SpanBuilder {
             }),
         });
 
-        let resource = Resource {
+        attributes.push(string_attribute("sp.filter.version", crate::FILTER_VERSION.to_string()));
+
+        // User-provided attributes win over detected ones, service.name included
+        for (key, value) in &self.resource_attributes {
+            attributes.retain(|kv| &kv.key != key);
+            attributes.push(string_attribute(key, value.clone()));
+        }
+
+        Resource {
             attributes,
             dropped_attributes_count: 0,
             entity_refs: vec![],
-        };
-
-        TracesData {
-            resource_spans: vec![ResourceSpans {
-                resource: Some(resource),
-                scope_spans: vec![ScopeSpans {
-                    spans: vec![span],
-                    ..Default::default()
-                }],
-                ..Default::default()
-            }],
         }
     }
 
+    /// Replace any id OTLP would reject, with a warning. The parsers and generators only
+    /// produce valid ids, so this is the last line of defence before propagation and export.
+    pub fn ensure_valid_ids(&mut self) {
+        repair_ids(&mut self.trace_id, &mut self.current_span_id, &mut self.parent_span_id, next_id_seed());
+    }
+
     /// Generate W3C traceparent header value
     /// Format: 00-{trace_id}-{span_id}-{trace_flags}
     pub fn generate_traceparent(&self, span_id: &[u8]) -> String {
@@ -525,6 +711,46 @@ impl SpanBuilder {
     }
 
 
+/// Build a string-valued span attribute
+pub fn string_attribute(key: &str, value: String) -> KeyValue {
+    KeyValue {
+        key: key.to_string(),
+        value: Some(AnyValue {
+            value: Some(any_value::Value::StringValue(value)),
+        }),
+    }
+}
+
+/// Build a bool-valued span attribute
+pub fn bool_attribute(key: &str, value: bool) -> KeyValue {
+    KeyValue {
+        key: key.to_string(),
+        value: Some(AnyValue {
+            value: Some(any_value::Value::BoolValue(value)),
+        }),
+    }
+}
+
+/// Build an int-valued span attribute
+pub fn int_attribute(key: &str, value: i64) -> KeyValue {
+    KeyValue {
+        key: key.to_string(),
+        value: Some(AnyValue {
+            value: Some(any_value::Value::IntValue(value)),
+        }),
+    }
+}
+
+/// Build a double-valued span attribute
+pub fn double_attribute(key: &str, value: f64) -> KeyValue {
+    KeyValue {
+        key: key.to_string(),
+        value: Some(AnyValue {
+            value: Some(any_value::Value::DoubleValue(value)),
+        }),
+    }
+}
+
 // 保留原有的protobuf序列化函数
 pub fn serialize_traces_data(traces_data: &TracesData) -> Result<Vec<u8>, prost::EncodeError> {
     let mut buf = Vec::new();
@@ -532,62 +758,42 @@ pub fn serialize_traces_data(traces_data: &TracesData) -> Result<Vec<u8>, prost:
     Ok(buf)
 }
 
-fn generate_trace_id() -> Vec<u8> {
-    let mut trace_id = vec![0u8; 16];
-    
-    // Use current timestamp as source of randomness
-    let now_nanos = get_current_timestamp_nanos();
-    let secs = (now_nanos / 1_000_000_000) as u64;
-    let nanos = (now_nanos % 1_000_000_000) as u64;
-    
-    // Fill first 8 bytes with seconds
-    trace_id[0..8].copy_from_slice(&secs.to_be_bytes());
-    // Fill last 8 bytes with nanoseconds
-    trace_id[8..16].copy_from_slice(&nanos.to_be_bytes());
-    
-    trace_id
+pub fn serialize_logs_data(logs_data: &LogsData) -> Result<Vec<u8>, prost::EncodeError> {
+    let mut buf = Vec::new();
+    logs_data.encode(&mut buf)?;
+    Ok(buf)
 }
 
-pub fn generate_span_id() -> Vec<u8> {
-    let mut span_id = vec![0u8; 8];
-    
-    // Use current timestamp as source of randomness
-    let now_nanos = get_current_timestamp_nanos();
-    
-    // Add some variation to make it different from trace ID
-    let varied_nanos = now_nanos ^ 0xCAFEBABE;
-    span_id.copy_from_slice(&varied_nanos.to_be_bytes());
-    
-    span_id
+/// Body as captured text, or base64 in the configured alphabet when the content type is not text
+fn encode_body(headers: &HashMap<String, String>, body: &[u8], encoding: BinaryBodyEncoding) -> String {
+    if is_text_content(headers) {
+        String::from_utf8_lossy(body).to_string()
+    } else {
+        encoding.encode(body)
+    }
 }
 
-fn parse_traceparent(traceparent: &str) -> Option<(Vec<u8>, Vec<u8>)> {
-    let parts: Vec<&str> = traceparent.split('-').collect();
-    if parts.len() != 4 {
-        return None;
-    }
-    
-    let trace_id = hex_decode(parts[1])?;
-    let span_id = hex_decode(parts[2])?;
-    
-    Some((trace_id, span_id))
+thread_local! {
+    static ID_SEQUENCE: std::cell::Cell<u64> = std::cell::Cell::new(0);
 }
 
-fn hex_decode(hex: &str) -> Option<Vec<u8>> {
-    if hex.len() % 2 != 0 {
-        return None;
-    }
-    
-    let mut result = Vec::new();
-    for i in (0..hex.len()).step_by(2) {
-        if let Ok(byte) = u8::from_str_radix(&hex[i..i+2], 16) {
-            result.push(byte);
-        } else {
-            return None;
-        }
-    }
-    
-    Some(result)
+/// Seed for a new id: the current time plus a per-worker sequence, so ids generated in
+/// the same clock tick (or with a stuck clock) still differ
+fn next_id_seed() -> u64 {
+    let sequence = ID_SEQUENCE.with(|sequence| {
+        let next = sequence.get().wrapping_add(1);
+        sequence.set(next);
+        next
+    });
+    get_current_timestamp_nanos() ^ sequence.rotate_left(40)
+}
+
+fn generate_trace_id() -> Vec<u8> {
+    id_from_seed(next_id_seed(), TRACE_ID_LEN)
+}
+
+pub fn generate_span_id() -> Vec<u8> {
+    id_from_seed(next_id_seed(), SPAN_ID_LEN)
 }
 
 pub fn get_current_timestamp_nanos() -> u64 {
@@ -620,7 +826,7 @@ fn should_skip_header(key: &str) -> bool {
     )
 }
 
-fn is_text_content(headers: &HashMap<String, String>) -> bool {
+pub fn is_text_content(headers: &HashMap<String, String>) -> bool {
     if let Some(content_type) = headers.get("content-type") {
         content_type.starts_with("text/") || 
         content_type.starts_with("application/json") ||
@@ -0,0 +1,648 @@
+//! Schema-driven decoding of protobuf bodies into JSON for capture.
+//!
+//! Schemas are FileDescriptorSets as produced by
+//! `protoc --include_imports --descriptor_set_out=...`. Only the descriptor fields needed
+//! to walk a message are read (names, numbers, types, labels, enums, map entries and
+//! service methods), so no reflection library is linked into the module.
+//!
+//! Output follows the proto3 JSON mapping: fields use their `json_name`, 64-bit integers
+//! are strings, bytes are base64, enums are value names (numbers when unknown), and map
+//! fields are objects. Unknown fields are skipped. Groups are not supported.
+//!
+//! Parsed descriptor sets are cached per worker, keyed by the hash of the raw set and
+//! bounded by `protoDescriptorCacheSize`; the least recently inserted set is evicted.
+
+use std::cell::RefCell;
+use std::collections::{HashMap, VecDeque};
+use std::rc::Rc;
+
+use base64::{engine::general_purpose, Engine as _};
+use serde_json::{Map, Value};
+
+use crate::sampling::fnv1a_hash;
+
+/// Nesting limit for decoded messages; recursive schemas can otherwise recurse on hostile input
+const MAX_DEPTH: usize = 64;
+
+// FieldDescriptorProto.Type values
+const TYPE_DOUBLE: i32 = 1;
+const TYPE_FLOAT: i32 = 2;
+const TYPE_INT64: i32 = 3;
+const TYPE_UINT64: i32 = 4;
+const TYPE_INT32: i32 = 5;
+const TYPE_FIXED64: i32 = 6;
+const TYPE_FIXED32: i32 = 7;
+const TYPE_BOOL: i32 = 8;
+const TYPE_STRING: i32 = 9;
+const TYPE_MESSAGE: i32 = 11;
+const TYPE_BYTES: i32 = 12;
+const TYPE_UINT32: i32 = 13;
+const TYPE_ENUM: i32 = 14;
+const TYPE_SFIXED32: i32 = 15;
+const TYPE_SFIXED64: i32 = 16;
+const TYPE_SINT32: i32 = 17;
+const TYPE_SINT64: i32 = 18;
+const LABEL_REPEATED: i32 = 3;
+
+// Wire types
+const WIRE_VARINT: u8 = 0;
+const WIRE_FIXED64: u8 = 1;
+const WIRE_LEN: u8 = 2;
+const WIRE_FIXED32: u8 = 5;
+
+#[derive(Debug, Default)]
+struct FieldDescriptor {
+    json_name: String,
+    field_type: i32,
+    type_name: String,
+    repeated: bool,
+}
+
+#[derive(Debug, Default)]
+struct MessageDescriptor {
+    fields: HashMap<u32, FieldDescriptor>,
+    map_entry: bool,
+}
+
+/// Message, enum and method descriptors from one FileDescriptorSet. Type names are fully
+/// qualified with a leading dot (`.pkg.Message`), as descriptors reference them.
+#[derive(Debug, Default)]
+pub struct DescriptorPool {
+    messages: HashMap<String, MessageDescriptor>,
+    enums: HashMap<String, HashMap<i32, String>>,
+    methods: HashMap<String, (String, String)>,  // "/pkg.Service/Method" -> (input, output)
+}
+
+thread_local! {
+    static POOL_CACHE: RefCell<VecDeque<(u64, Option<Rc<DescriptorPool>>)>> = RefCell::new(VecDeque::new());
+}
+
+/// Parsed pool for a descriptor set, from the cache when possible. Parse failures are
+/// cached too (as None) so a bad schema is not re-parsed on every request.
+pub fn cached_pool(descriptor_set: &[u8], cache_size: usize) -> Option<Rc<DescriptorPool>> {
+    let key = fnv1a_hash(descriptor_set);
+    POOL_CACHE.with(|cache| {
+        let mut cache = cache.borrow_mut();
+        if let Some((_, pool)) = cache.iter().find(|(k, _)| *k == key) {
+            return pool.clone();
+        }
+
+        let pool = match DescriptorPool::parse(descriptor_set) {
+            Ok(pool) => Some(Rc::new(pool)),
+            Err(e) => {
+                crate::sp_warn!("Invalid protobuf descriptor set: {}", e);
+                None
+            }
+        };
+        if cache_size > 0 {
+            while cache.len() >= cache_size {
+                cache.pop_front();
+            }
+            cache.push_back((key, pool.clone()));
+        }
+        pool
+    })
+}
+
+impl DescriptorPool {
+    /// Parse a serialized FileDescriptorSet
+    pub fn parse(descriptor_set: &[u8]) -> Result<Self, String> {
+        let mut pool = DescriptorPool::default();
+        for (number, value) in read_fields(descriptor_set).ok_or("malformed FileDescriptorSet")? {
+            if number == 1 {
+                pool.add_file(value.bytes().ok_or("malformed file")?)?;
+            }
+        }
+        if pool.messages.is_empty() {
+            return Err("no message types".to_string());
+        }
+        Ok(pool)
+    }
+
+    /// Request and response types of a gRPC method, from a `:path` like `/pkg.Service/Method`
+    pub fn method_types(&self, path: &str) -> Option<(&str, &str)> {
+        let path = path.split('?').next().unwrap_or("");
+        self.methods.get(path).map(|(input, output)| (input.as_str(), output.as_str()))
+    }
+
+    /// Decode `bytes` as message `type_name` (leading dot optional) into a JSON document
+    pub fn decode_to_json(&self, type_name: &str, bytes: &[u8]) -> Option<String> {
+        let type_name = qualify(type_name);
+        let value = self.decode_message(&type_name, bytes, 0)?;
+        serde_json::to_string(&value).ok()
+    }
+
+    fn add_file(&mut self, file: &[u8]) -> Result<(), String> {
+        let fields = read_fields(file).ok_or("malformed FileDescriptorProto")?;
+        let package = fields
+            .iter()
+            .find(|(number, _)| *number == 2)
+            .and_then(|(_, value)| value.string())
+            .unwrap_or_default();
+        let scope = if package.is_empty() { String::new() } else { format!(".{}", package) };
+
+        for (number, value) in &fields {
+            let bytes = match value.bytes() {
+                Some(bytes) => bytes,
+                None => continue,
+            };
+            match number {
+                4 => self.add_message(&scope, bytes)?,
+                5 => self.add_enum(&scope, bytes)?,
+                6 => self.add_service(&package, bytes)?,
+                _ => {}
+            }
+        }
+        Ok(())
+    }
+
+    fn add_message(&mut self, scope: &str, message: &[u8]) -> Result<(), String> {
+        let fields = read_fields(message).ok_or("malformed DescriptorProto")?;
+        let name = find_string(&fields, 1).ok_or("message without a name")?;
+        let full_name = format!("{}.{}", scope, name);
+
+        let mut descriptor = MessageDescriptor::default();
+        for (number, value) in &fields {
+            let bytes = match value.bytes() {
+                Some(bytes) => bytes,
+                None => continue,
+            };
+            match number {
+                2 => {
+                    let (field_number, field) = parse_field(bytes)?;
+                    descriptor.fields.insert(field_number, field);
+                }
+                3 => self.add_message(&full_name, bytes)?,
+                4 => self.add_enum(&full_name, bytes)?,
+                7 => {
+                    // MessageOptions.map_entry
+                    let options = read_fields(bytes).ok_or("malformed MessageOptions")?;
+                    descriptor.map_entry = find_varint(&options, 7).unwrap_or(0) != 0;
+                }
+                _ => {}
+            }
+        }
+        self.messages.insert(full_name, descriptor);
+        Ok(())
+    }
+
+    fn add_enum(&mut self, scope: &str, enum_type: &[u8]) -> Result<(), String> {
+        let fields = read_fields(enum_type).ok_or("malformed EnumDescriptorProto")?;
+        let name = find_string(&fields, 1).ok_or("enum without a name")?;
+
+        let mut values = HashMap::new();
+        for (number, value) in &fields {
+            if *number != 2 {
+                continue;
+            }
+            let value_fields = read_fields(value.bytes().ok_or("malformed enum value")?).ok_or("malformed enum value")?;
+            if let Some(value_name) = find_string(&value_fields, 1) {
+                let value_number = find_varint(&value_fields, 2).unwrap_or(0) as i32;
+                values.insert(value_number, value_name);
+            }
+        }
+        self.enums.insert(format!("{}.{}", scope, name), values);
+        Ok(())
+    }
+
+    fn add_service(&mut self, package: &str, service: &[u8]) -> Result<(), String> {
+        let fields = read_fields(service).ok_or("malformed ServiceDescriptorProto")?;
+        let name = find_string(&fields, 1).ok_or("service without a name")?;
+        let service_name = if package.is_empty() { name } else { format!("{}.{}", package, name) };
+
+        for (number, value) in &fields {
+            if *number != 2 {
+                continue;
+            }
+            let method = read_fields(value.bytes().ok_or("malformed method")?).ok_or("malformed method")?;
+            if let (Some(method_name), Some(input), Some(output)) =
+                (find_string(&method, 1), find_string(&method, 2), find_string(&method, 3))
+            {
+                self.methods.insert(format!("/{}/{}", service_name, method_name), (input, output));
+            }
+        }
+        Ok(())
+    }
+
+    fn decode_message(&self, type_name: &str, bytes: &[u8], depth: usize) -> Option<Value> {
+        if depth > MAX_DEPTH {
+            return None;
+        }
+        let descriptor = self.messages.get(type_name)?;
+        let mut object = Map::new();
+
+        let mut reader = WireReader::new(bytes);
+        while !reader.is_empty() {
+            let tag = reader.varint()?;
+            let (number, wire_type) = ((tag >> 3) as u32, (tag & 7) as u8);
+            let field = match descriptor.fields.get(&number) {
+                Some(field) => field,
+                None => {
+                    reader.skip(wire_type)?;
+                    continue;
+                }
+            };
+
+            // Packed repeated scalars arrive as one length-delimited run
+            if field.repeated && wire_type == WIRE_LEN && is_packable(field.field_type) {
+                let mut packed = WireReader::new(reader.length_delimited()?);
+                let wire_type = packed_wire_type(field.field_type);
+                while !packed.is_empty() {
+                    let value = self.decode_value(field, wire_type, &mut packed, depth)?;
+                    push_repeated(&mut object, &field.json_name, value);
+                }
+                continue;
+            }
+
+            let value = self.decode_value(field, wire_type, &mut reader, depth)?;
+            if self.is_map_field(field) {
+                let entry = object
+                    .entry(field.json_name.clone())
+                    .or_insert_with(|| Value::Object(Map::new()));
+                if let (Value::Object(entry), Value::Object(pair)) = (entry, value) {
+                    let key = match pair.get("key") {
+                        Some(Value::String(key)) => key.clone(),
+                        Some(other) => other.to_string(),
+                        None => String::new(),
+                    };
+                    entry.insert(key, pair.get("value").cloned().unwrap_or(Value::Null));
+                }
+            } else if field.repeated {
+                push_repeated(&mut object, &field.json_name, value);
+            } else {
+                object.insert(field.json_name.clone(), value);
+            }
+        }
+        Some(Value::Object(object))
+    }
+
+    fn decode_value(&self, field: &FieldDescriptor, wire_type: u8, reader: &mut WireReader, depth: usize) -> Option<Value> {
+        let value = match (field.field_type, wire_type) {
+            (TYPE_DOUBLE, WIRE_FIXED64) => json_float(f64::from_bits(reader.fixed64()?)),
+            (TYPE_FLOAT, WIRE_FIXED32) => json_float(f32::from_bits(reader.fixed32()?) as f64),
+            (TYPE_INT64, WIRE_VARINT) => Value::String((reader.varint()? as i64).to_string()),
+            (TYPE_UINT64, WIRE_VARINT) => Value::String(reader.varint()?.to_string()),
+            (TYPE_INT32, WIRE_VARINT) => Value::from(reader.varint()? as i32),
+            (TYPE_UINT32, WIRE_VARINT) => Value::from(reader.varint()? as u32),
+            (TYPE_SINT32, WIRE_VARINT) => Value::from(zigzag(reader.varint()?) as i32),
+            (TYPE_SINT64, WIRE_VARINT) => Value::String(zigzag(reader.varint()?).to_string()),
+            (TYPE_FIXED64, WIRE_FIXED64) => Value::String(reader.fixed64()?.to_string()),
+            (TYPE_SFIXED64, WIRE_FIXED64) => Value::String((reader.fixed64()? as i64).to_string()),
+            (TYPE_FIXED32, WIRE_FIXED32) => Value::from(reader.fixed32()?),
+            (TYPE_SFIXED32, WIRE_FIXED32) => Value::from(reader.fixed32()? as i32),
+            (TYPE_BOOL, WIRE_VARINT) => Value::Bool(reader.varint()? != 0),
+            (TYPE_ENUM, WIRE_VARINT) => {
+                let number = reader.varint()? as i32;
+                match self.enums.get(&field.type_name).and_then(|values| values.get(&number)) {
+                    Some(name) => Value::String(name.clone()),
+                    None => Value::from(number),
+                }
+            }
+            (TYPE_STRING, WIRE_LEN) => Value::String(String::from_utf8(reader.length_delimited()?.to_vec()).ok()?),
+            (TYPE_BYTES, WIRE_LEN) => Value::String(general_purpose::STANDARD.encode(reader.length_delimited()?)),
+            (TYPE_MESSAGE, WIRE_LEN) => self.decode_message(&field.type_name, reader.length_delimited()?, depth + 1)?,
+            _ => return None,
+        };
+        Some(value)
+    }
+
+    fn is_map_field(&self, field: &FieldDescriptor) -> bool {
+        field.repeated
+            && field.field_type == TYPE_MESSAGE
+            && self.messages.get(&field.type_name).map_or(false, |m| m.map_entry)
+    }
+}
+
+fn parse_field(field: &[u8]) -> Result<(u32, FieldDescriptor), String> {
+    let fields = read_fields(field).ok_or("malformed FieldDescriptorProto")?;
+    let name = find_string(&fields, 1).ok_or("field without a name")?;
+    let number = find_varint(&fields, 3).ok_or("field without a number")? as u32;
+    let descriptor = FieldDescriptor {
+        json_name: find_string(&fields, 10).unwrap_or(name),
+        field_type: find_varint(&fields, 5).unwrap_or(0) as i32,
+        type_name: find_string(&fields, 6).unwrap_or_default(),
+        repeated: find_varint(&fields, 4) == Some(LABEL_REPEATED as u64),
+    };
+    Ok((number, descriptor))
+}
+
+fn qualify(type_name: &str) -> String {
+    if type_name.starts_with('.') {
+        type_name.to_string()
+    } else {
+        format!(".{}", type_name)
+    }
+}
+
+fn push_repeated(object: &mut Map<String, Value>, name: &str, value: Value) {
+    match object.entry(name.to_string()).or_insert_with(|| Value::Array(Vec::new())) {
+        Value::Array(values) => values.push(value),
+        other => *other = Value::Array(vec![value]),
+    }
+}
+
+/// NaN and infinities have no JSON number form; proto3 JSON writes them as strings
+fn json_float(value: f64) -> Value {
+    serde_json::Number::from_f64(value)
+        .map(Value::Number)
+        .unwrap_or_else(|| Value::String(value.to_string()))
+}
+
+fn zigzag(value: u64) -> i64 {
+    ((value >> 1) as i64) ^ -((value & 1) as i64)
+}
+
+fn is_packable(field_type: i32) -> bool {
+    !matches!(field_type, TYPE_STRING | TYPE_BYTES | TYPE_MESSAGE)
+}
+
+fn packed_wire_type(field_type: i32) -> u8 {
+    match field_type {
+        TYPE_DOUBLE | TYPE_FIXED64 | TYPE_SFIXED64 => WIRE_FIXED64,
+        TYPE_FLOAT | TYPE_FIXED32 | TYPE_SFIXED32 => WIRE_FIXED32,
+        _ => WIRE_VARINT,
+    }
+}
+
+/// A raw field value, used while reading descriptors
+enum WireValue<'a> {
+    Varint(u64),
+    Bytes(&'a [u8]),
+    Fixed,
+}
+
+impl<'a> WireValue<'a> {
+    fn bytes(&self) -> Option<&'a [u8]> {
+        match self {
+            WireValue::Bytes(bytes) => Some(bytes),
+            _ => None,
+        }
+    }
+
+    fn string(&self) -> Option<String> {
+        self.bytes().and_then(|bytes| String::from_utf8(bytes.to_vec()).ok())
+    }
+}
+
+fn read_fields(bytes: &[u8]) -> Option<Vec<(u32, WireValue<'_>)>> {
+    let mut reader = WireReader::new(bytes);
+    let mut fields = Vec::new();
+    while !reader.is_empty() {
+        let tag = reader.varint()?;
+        let number = (tag >> 3) as u32;
+        let value = match (tag & 7) as u8 {
+            WIRE_VARINT => WireValue::Varint(reader.varint()?),
+            WIRE_LEN => WireValue::Bytes(reader.length_delimited()?),
+            WIRE_FIXED64 => {
+                reader.fixed64()?;
+                WireValue::Fixed
+            }
+            WIRE_FIXED32 => {
+                reader.fixed32()?;
+                WireValue::Fixed
+            }
+            _ => return None,
+        };
+        fields.push((number, value));
+    }
+    Some(fields)
+}
+
+fn find_string(fields: &[(u32, WireValue)], number: u32) -> Option<String> {
+    fields.iter().find(|(n, _)| *n == number).and_then(|(_, value)| value.string())
+}
+
+fn find_varint(fields: &[(u32, WireValue)], number: u32) -> Option<u64> {
+    fields.iter().find_map(|(n, value)| match value {
+        WireValue::Varint(v) if *n == number => Some(*v),
+        _ => None,
+    })
+}
+
+struct WireReader<'a> {
+    bytes: &'a [u8],
+    pos: usize,
+}
+
+impl<'a> WireReader<'a> {
+    fn new(bytes: &'a [u8]) -> Self {
+        Self { bytes, pos: 0 }
+    }
+
+    fn is_empty(&self) -> bool {
+        self.pos >= self.bytes.len()
+    }
+
+    fn varint(&mut self) -> Option<u64> {
+        let mut value = 0u64;
+        for shift in (0..64).step_by(7) {
+            let byte = *self.bytes.get(self.pos)?;
+            self.pos += 1;
+            value |= ((byte & 0x7f) as u64) << shift;
+            if byte & 0x80 == 0 {
+                return Some(value);
+            }
+        }
+        None
+    }
+
+    fn take(&mut self, len: usize) -> Option<&'a [u8]> {
+        let end = self.pos.checked_add(len)?;
+        let slice = self.bytes.get(self.pos..end)?;
+        self.pos = end;
+        Some(slice)
+    }
+
+    fn fixed32(&mut self) -> Option<u32> {
+        self.take(4).map(|b| u32::from_le_bytes([b[0], b[1], b[2], b[3]]))
+    }
+
+    fn fixed64(&mut self) -> Option<u64> {
+        self.take(8).map(|b| u64::from_le_bytes(b.try_into().unwrap_or_default()))
+    }
+
+    fn length_delimited(&mut self) -> Option<&'a [u8]> {
+        let len = usize::try_from(self.varint()?).ok()?;
+        self.take(len)
+    }
+
+    fn skip(&mut self, wire_type: u8) -> Option<()> {
+        match wire_type {
+            WIRE_VARINT => self.varint().map(|_| ()),
+            WIRE_FIXED64 => self.fixed64().map(|_| ()),
+            WIRE_LEN => self.length_delimited().map(|_| ()),
+            WIRE_FIXED32 => self.fixed32().map(|_| ()),
+            _ => None,
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    // Minimal protobuf writer for building descriptors and messages in tests
+    fn varint(mut value: u64, out: &mut Vec<u8>) {
+        while value >= 0x80 {
+            out.push((value as u8) | 0x80);
+            value >>= 7;
+        }
+        out.push(value as u8);
+    }
+
+    fn tag(number: u32, wire_type: u8, out: &mut Vec<u8>) {
+        varint(((number as u64) << 3) | wire_type as u64, out);
+    }
+
+    fn len_field(number: u32, bytes: &[u8], out: &mut Vec<u8>) {
+        tag(number, WIRE_LEN, out);
+        varint(bytes.len() as u64, out);
+        out.extend_from_slice(bytes);
+    }
+
+    fn varint_field(number: u32, value: u64, out: &mut Vec<u8>) {
+        tag(number, WIRE_VARINT, out);
+        varint(value, out);
+    }
+
+    fn field_descriptor(name: &str, json_name: &str, number: u64, label: u64, field_type: u64, type_name: &str) -> Vec<u8> {
+        let mut out = Vec::new();
+        len_field(1, name.as_bytes(), &mut out);
+        varint_field(3, number, &mut out);
+        varint_field(4, label, &mut out);
+        varint_field(5, field_type, &mut out);
+        if !type_name.is_empty() {
+            len_field(6, type_name.as_bytes(), &mut out);
+        }
+        len_field(10, json_name.as_bytes(), &mut out);
+        out
+    }
+
+    /// package shop; enum Status { UNKNOWN = 0; PAID = 1; }
+    /// message Order { int64 order_id = 1; string customer = 2; repeated int32 qty = 3;
+    ///   Status status = 4; map<string, string> tags = 5; Item item = 6;
+    ///   message Item { bytes sku = 1; } }
+    /// service Orders { rpc Get(Order) returns (Order); }
+    fn descriptor_set() -> Vec<u8> {
+        let mut item = Vec::new();
+        len_field(1, b"Item", &mut item);
+        len_field(2, &field_descriptor("sku", "sku", 1, 1, TYPE_BYTES as u64, ""), &mut item);
+
+        let mut tags_entry = Vec::new();
+        len_field(1, b"TagsEntry", &mut tags_entry);
+        len_field(2, &field_descriptor("key", "key", 1, 1, TYPE_STRING as u64, ""), &mut tags_entry);
+        len_field(2, &field_descriptor("value", "value", 2, 1, TYPE_STRING as u64, ""), &mut tags_entry);
+        let mut map_options = Vec::new();
+        varint_field(7, 1, &mut map_options);
+        len_field(7, &map_options, &mut tags_entry);
+
+        let mut order = Vec::new();
+        len_field(1, b"Order", &mut order);
+        len_field(2, &field_descriptor("order_id", "orderId", 1, 1, TYPE_INT64 as u64, ""), &mut order);
+        len_field(2, &field_descriptor("customer", "customer", 2, 1, TYPE_STRING as u64, ""), &mut order);
+        len_field(2, &field_descriptor("qty", "qty", 3, 3, TYPE_INT32 as u64, ""), &mut order);
+        len_field(2, &field_descriptor("status", "status", 4, 1, TYPE_ENUM as u64, ".shop.Status"), &mut order);
+        len_field(2, &field_descriptor("tags", "tags", 5, 3, TYPE_MESSAGE as u64, ".shop.Order.TagsEntry"), &mut order);
+        len_field(2, &field_descriptor("item", "item", 6, 1, TYPE_MESSAGE as u64, ".shop.Order.Item"), &mut order);
+        len_field(3, &item, &mut order);
+        len_field(3, &tags_entry, &mut order);
+
+        let mut status = Vec::new();
+        len_field(1, b"Status", &mut status);
+        for (name, number) in [("UNKNOWN", 0u64), ("PAID", 1)] {
+            let mut value = Vec::new();
+            len_field(1, name.as_bytes(), &mut value);
+            varint_field(2, number, &mut value);
+            len_field(2, &value, &mut status);
+        }
+
+        let mut method = Vec::new();
+        len_field(1, b"Get", &mut method);
+        len_field(2, b".shop.Order", &mut method);
+        len_field(3, b".shop.Order", &mut method);
+        let mut service = Vec::new();
+        len_field(1, b"Orders", &mut service);
+        len_field(2, &method, &mut service);
+
+        let mut file = Vec::new();
+        len_field(2, b"shop", &mut file);
+        len_field(4, &order, &mut file);
+        len_field(5, &status, &mut file);
+        len_field(6, &service, &mut file);
+
+        let mut set = Vec::new();
+        len_field(1, &file, &mut set);
+        set
+    }
+
+    fn order_message() -> Vec<u8> {
+        let mut out = Vec::new();
+        varint_field(1, 9_007_199_254_740_993, &mut out);
+        len_field(2, b"ada", &mut out);
+        let mut packed = Vec::new();
+        varint(2, &mut packed);
+        varint(5, &mut packed);
+        len_field(3, &packed, &mut out);
+        varint_field(4, 1, &mut out);
+        let mut entry = Vec::new();
+        len_field(1, b"channel", &mut entry);
+        len_field(2, b"web", &mut entry);
+        len_field(5, &entry, &mut out);
+        let mut item = Vec::new();
+        len_field(1, &[0xde, 0xad], &mut item);
+        len_field(6, &item, &mut out);
+        varint_field(99, 7, &mut out);  // unknown field, skipped
+        out
+    }
+
+    #[test]
+    fn test_decode_to_json() {
+        let pool = DescriptorPool::parse(&descriptor_set()).unwrap();
+        let json = pool.decode_to_json("shop.Order", &order_message()).unwrap();
+        let value: Value = serde_json::from_str(&json).unwrap();
+        assert_eq!(
+            value,
+            serde_json::json!({
+                "orderId": "9007199254740993",
+                "customer": "ada",
+                "qty": [2, 5],
+                "status": "PAID",
+                "tags": {"channel": "web"},
+                "item": {"sku": "3q0="}
+            })
+        );
+    }
+
+    #[test]
+    fn test_method_types() {
+        let pool = DescriptorPool::parse(&descriptor_set()).unwrap();
+        assert_eq!(pool.method_types("/shop.Orders/Get"), Some((".shop.Order", ".shop.Order")));
+        assert_eq!(pool.method_types("/shop.Orders/List"), None);
+    }
+
+    #[test]
+    fn test_decode_rejects_malformed_input() {
+        let pool = DescriptorPool::parse(&descriptor_set()).unwrap();
+        let message = order_message();
+        // Cut inside the nested item
+        assert!(pool.decode_to_json(".shop.Order", &message[..message.len() - 4]).is_none());
+        assert!(pool.decode_to_json(".shop.Missing", &message).is_none());
+        assert!(DescriptorPool::parse(b"not a descriptor").is_err());
+    }
+
+    #[test]
+    fn test_zigzag() {
+        assert_eq!(zigzag(0), 0);
+        assert_eq!(zigzag(1), -1);
+        assert_eq!(zigzag(2), 1);
+        assert_eq!(zigzag(3), -2);
+    }
+
+    #[test]
+    fn test_cached_pool_is_bounded() {
+        let set = descriptor_set();
+        assert!(cached_pool(&set, 1).is_some());
+        assert!(cached_pool(b"bad", 1).is_none());
+        POOL_CACHE.with(|cache| assert_eq!(cache.borrow().len(), 1));
+    }
+}
@@ -0,0 +1,220 @@
+// Per-tenant export rate limit: a token bucket per resolved tenant, shared by all
+// worker VMs through shared data
+//
+// Buckets live in a fixed table of maxTenantBuckets slots, placed like session counters
+// (see `session`): a tenant hashes to a short run of slots and takes its own slot, else
+// a free or idle one, else evicts the least recently used slot of the run. A bucket that
+// has refilled to its burst is idle; reusing its slot loses nothing, since a new bucket
+// starts full. An evicted tenant likewise starts over with a full bucket. Updates go
+// through CAS so workers never spend the same token twice.
+//
+// `allow_keyed` is the same bucket under one fixed key, for limits that are not per
+// tenant (the tee mirror).
+
+use proxy_wasm::traits::Context;
+use proxy_wasm::types::Status;
+
+use crate::config::Config;
+use crate::sampling::fnv1a_hash;
+use crate::session::probe_indexes;
+use crate::shared_data::{self, Feature};
+
+const SLOT_KEY_PREFIX: &str = "sp.ratelimit.";
+/// Slot value: tenant hash (u64), tokens (f64 bits), last refill (ms); all LE
+const SLOT_VALUE_LEN: usize = 24;
+/// CAS attempts before giving up; the span is then let through
+const MAX_CAS_ATTEMPTS: usize = 8;
+/// Bucket key for spans without a tenant
+const NO_TENANT: &str = "none";
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+struct Bucket {
+    tenant_hash: u64,
+    tokens: f64,
+    last_refill_ms: u64,
+}
+
+impl Bucket {
+    fn encode(&self) -> Vec<u8> {
+        let mut value = Vec::with_capacity(SLOT_VALUE_LEN);
+        value.extend_from_slice(&self.tenant_hash.to_le_bytes());
+        value.extend_from_slice(&self.tokens.to_bits().to_le_bytes());
+        value.extend_from_slice(&self.last_refill_ms.to_le_bytes());
+        value
+    }
+
+    /// None for a free slot
+    fn decode(value: &[u8]) -> Option<Self> {
+        if value.len() != SLOT_VALUE_LEN {
+            return None;
+        }
+        let word = |i: usize| u64::from_le_bytes(value[i * 8..(i + 1) * 8].try_into().unwrap_or_default());
+        Some(Self {
+            tenant_hash: word(0),
+            tokens: f64::from_bits(word(1)),
+            last_refill_ms: word(2),
+        })
+    }
+
+    /// Tokens available at `now_ms`, capped at the burst
+    fn refilled(&self, now_ms: u64, rate: f64, burst: f64) -> f64 {
+        let elapsed_secs = now_ms.saturating_sub(self.last_refill_ms) as f64 / 1000.0;
+        (self.tokens + elapsed_secs * rate).min(burst)
+    }
+}
+
+fn slot_key(index: u64) -> String {
+    format!("{}{}", SLOT_KEY_PREFIX, index)
+}
+
+/// Tokens a full bucket holds; perTenantExportBurst, or one second's worth when unset
+pub fn burst(config: &Config) -> f64 {
+    if config.per_tenant_export_burst > 0 {
+        config.per_tenant_export_burst as f64
+    } else {
+        config.per_tenant_export_rate.ceil().max(1.0)
+    }
+}
+
+/// Pick the slot for a tenant among its probe run and the tokens it holds before this
+/// span: the tenant's own bucket refilled, a fresh full bucket anywhere else.
+fn choose_slot(slots: &[Option<Bucket>], tenant_hash: u64, now_ms: u64, rate: f64, burst: f64) -> (usize, f64) {
+    if let Some((i, bucket)) = slots
+        .iter()
+        .enumerate()
+        .find_map(|(i, slot)| slot.filter(|b| b.tenant_hash == tenant_hash).map(|b| (i, b)))
+    {
+        return (i, bucket.refilled(now_ms, rate, burst));
+    }
+    if let Some(i) = slots.iter().position(|slot| slot.map_or(true, |b| b.refilled(now_ms, rate, burst) >= burst)) {
+        return (i, burst);
+    }
+    // Every slot holds a draining bucket: evict the least recently used
+    let lru = slots
+        .iter()
+        .enumerate()
+        .min_by_key(|(_, slot)| slot.map_or(0, |b| b.last_refill_ms))
+        .map_or(0, |(i, _)| i);
+    (lru, burst)
+}
+
+/// Take a token for one span of `tenant`. False when the tenant is over
+/// perTenantExportRate; the drop is counted in sp_export_ratelimited_total.
+pub fn allow_span(ctx: &dyn Context, tenant: Option<&str>, now_ms: u64, config: &Config) -> bool {
+    let rate = config.per_tenant_export_rate;
+    if rate <= 0.0 || config.max_tenant_buckets == 0 {
+        return true;
+    }
+    let burst = burst(config);
+    let tenant = tenant.unwrap_or(NO_TENANT);
+    let tenant_hash = fnv1a_hash(tenant.as_bytes());
+    let indexes = probe_indexes(tenant_hash, config.max_tenant_buckets);
+
+    for _ in 0..MAX_CAS_ATTEMPTS {
+        let mut slots = Vec::with_capacity(indexes.len());
+        let mut cas_values = Vec::with_capacity(indexes.len());
+        for index in &indexes {
+            let (value, cas) = shared_data::get(ctx, Feature::RateLimit, &slot_key(*index));
+            slots.push(value.as_deref().and_then(Bucket::decode));
+            cas_values.push(cas);
+        }
+
+        let (chosen, tokens) = choose_slot(&slots, tenant_hash, now_ms, rate, burst);
+        let allowed = tokens >= 1.0;
+        let bucket = Bucket {
+            tenant_hash,
+            tokens: if allowed { tokens - 1.0 } else { tokens },
+            last_refill_ms: now_ms,
+        };
+        match shared_data::set(ctx, Feature::RateLimit, &slot_key(indexes[chosen]), &bucket.encode(), cas_values[chosen]) {
+            Ok(()) => {
+                if !allowed {
+                    crate::sp_debug!("Tenant {} is over perTenantExportRate, dropping span", tenant);
+                    crate::metrics::increment_counter(crate::metrics::EXPORT_RATELIMITED_TOTAL, 1);
+                    crate::metrics::increment_tagged_counter(crate::metrics::EXPORT_RATELIMITED_TOTAL, tenant, 1);
+                }
+                return allowed;
+            }
+            Err(Status::CasMismatch) => continue,
+            Err(_) => return true,
+        }
+    }
+    crate::sp_debug!("Export rate limit bucket contended for tenant {}, letting the span through", tenant);
+    true
+}
+
+/// Take a token from the single bucket stored under `key`. Host errors and contention
+/// let the caller through, like the tenant buckets.
+pub fn allow_keyed(ctx: &dyn Context, key: &str, now_ms: u64, rate: f64, burst: f64) -> bool {
+    if rate <= 0.0 {
+        return true;
+    }
+    for _ in 0..MAX_CAS_ATTEMPTS {
+        let (value, cas) = shared_data::get(ctx, Feature::RateLimit, key);
+        let (_, tokens) = choose_slot(&[value.as_deref().and_then(Bucket::decode)], 0, now_ms, rate, burst);
+        let allowed = tokens >= 1.0;
+        let bucket = Bucket {
+            tenant_hash: 0,
+            tokens: if allowed { tokens - 1.0 } else { tokens },
+            last_refill_ms: now_ms,
+        };
+        match shared_data::set(ctx, Feature::RateLimit, key, &bucket.encode(), cas) {
+            Ok(()) => return allowed,
+            Err(Status::CasMismatch) => continue,
+            Err(_) => return true,
+        }
+    }
+    true
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn bucket(tenant_hash: u64, tokens: f64, last_refill_ms: u64) -> Option<Bucket> {
+        Some(Bucket { tenant_hash, tokens, last_refill_ms })
+    }
+
+    #[test]
+    fn test_bucket_round_trip() {
+        let value = Bucket { tenant_hash: 0xabcdef, tokens: 2.5, last_refill_ms: 1_700_000_000_000 };
+        assert_eq!(Bucket::decode(&value.encode()), Some(value));
+        assert_eq!(Bucket::decode(b""), None);
+    }
+
+    #[test]
+    fn test_burst_defaults_to_one_second() {
+        let mut config = Config::default();
+        config.per_tenant_export_rate = 2.5;
+        assert_eq!(burst(&config), 3.0);
+        config.per_tenant_export_rate = 0.1;
+        assert_eq!(burst(&config), 1.0);
+        config.per_tenant_export_burst = 50;
+        assert_eq!(burst(&config), 50.0);
+    }
+
+    #[test]
+    fn test_choose_slot_refills_own_bucket() {
+        let slots = [bucket(1, 0.0, 0), bucket(7, 0.0, 1_000)];
+        // 10 spans/sec: 250ms after the last span the bucket holds 2.5 tokens
+        assert_eq!(choose_slot(&slots, 7, 1_250, 10.0, 20.0), (1, 2.5));
+        // Never above the burst
+        assert_eq!(choose_slot(&slots, 7, 60_000, 10.0, 20.0), (1, 20.0));
+    }
+
+    #[test]
+    fn test_choose_slot_takes_free_or_idle_slot() {
+        let slots = [bucket(1, 0.0, 59_900), None];
+        assert_eq!(choose_slot(&slots, 9, 60_000, 10.0, 20.0), (1, 20.0));
+
+        // Bucket 2 refilled to its burst long ago, so its slot is free to reuse
+        let slots = [bucket(1, 0.0, 59_900), bucket(2, 5.0, 0)];
+        assert_eq!(choose_slot(&slots, 9, 60_000, 10.0, 20.0), (1, 20.0));
+    }
+
+    #[test]
+    fn test_choose_slot_evicts_least_recently_used() {
+        let slots = [bucket(1, 0.0, 59_900), bucket(2, 0.0, 59_500), bucket(3, 0.0, 59_950)];
+        assert_eq!(choose_slot(&slots, 9, 60_000, 10.0, 20.0), (1, 20.0));
+    }
+}
@@ -0,0 +1,190 @@
+//! JSON body field redaction for captured request/response bodies.
+//!
+//! Supported path syntax is a small JSONPath subset:
+//! - `$` the document root (required prefix)
+//! - `.name` or `['name']` an object member
+//! - `[0]` an array element by index
+//! - `[*]` or `.*` every element of an array (or every member of an object)
+//!
+//! Each `[*]` descends exactly one array level, so nested arrays need one wildcard per
+//! level: `$.matrix[*][*].secret` redacts `secret` inside arrays of arrays, while
+//! `$.matrix[*].secret` only looks at the outer array's elements. A member segment never
+//! implicitly iterates an array (`$.cards.number` does not match `{"cards": [...]}`).
+//! Paths that do not resolve are ignored.
+
+use serde_json::Value;
+
+use crate::headers::REDACTED_VALUE;
+
+#[derive(Debug, Clone, PartialEq)]
+enum PathSegment {
+    Key(String),
+    Index(usize),
+    Wildcard,
+}
+
+/// Redact the configured paths in a JSON body.
+/// Returns None when the body is not valid JSON so the caller can annotate the span.
+pub fn redact_json_body(body: &[u8], paths: &[String]) -> Option<Vec<u8>> {
+    let mut document: Value = serde_json::from_slice(body).ok()?;
+
+    for path in paths {
+        match parse_json_path(path) {
+            Some(segments) => redact_at(&mut document, &segments),
+            None => {
+                crate::sp_warn!("Ignoring invalid JSON redaction path: {}", path);
+            }
+        }
+    }
+
+    serde_json::to_vec(&document).ok()
+}
+
+fn parse_json_path(path: &str) -> Option<Vec<PathSegment>> {
+    let mut rest = path.trim().strip_prefix('$')?;
+    let mut segments = Vec::new();
+
+    while !rest.is_empty() {
+        if let Some(after_dot) = rest.strip_prefix('.') {
+            let end = after_dot.find(|c| c == '.' || c == '[').unwrap_or(after_dot.len());
+            let name = &after_dot[..end];
+            if name.is_empty() {
+                return None;
+            }
+            segments.push(if name == "*" {
+                PathSegment::Wildcard
+            } else {
+                PathSegment::Key(name.to_string())
+            });
+            rest = &after_dot[end..];
+        } else if let Some(after_bracket) = rest.strip_prefix('[') {
+            let end = after_bracket.find(']')?;
+            let inner = after_bracket[..end].trim();
+            let segment = if inner == "*" {
+                PathSegment::Wildcard
+            } else if let Ok(index) = inner.parse::<usize>() {
+                PathSegment::Index(index)
+            } else {
+                let quoted = inner
+                    .strip_prefix('\'')
+                    .and_then(|v| v.strip_suffix('\''))
+                    .or_else(|| inner.strip_prefix('"').and_then(|v| v.strip_suffix('"')))?;
+                PathSegment::Key(quoted.to_string())
+            };
+            segments.push(segment);
+            rest = &after_bracket[end + 1..];
+        } else {
+            return None;
+        }
+    }
+
+    Some(segments)
+}
+
+fn redact_at(value: &mut Value, segments: &[PathSegment]) {
+    let (segment, remaining) = match segments.split_first() {
+        Some(split) => split,
+        None => {
+            *value = Value::String(REDACTED_VALUE.to_string());
+            return;
+        }
+    };
+
+    match (segment, value) {
+        (PathSegment::Key(key), Value::Object(map)) => {
+            if let Some(child) = map.get_mut(key) {
+                redact_at(child, remaining);
+            }
+        }
+        (PathSegment::Index(index), Value::Array(items)) => {
+            if let Some(child) = items.get_mut(*index) {
+                redact_at(child, remaining);
+            }
+        }
+        (PathSegment::Wildcard, Value::Array(items)) => {
+            for child in items.iter_mut() {
+                redact_at(child, remaining);
+            }
+        }
+        (PathSegment::Wildcard, Value::Object(map)) => {
+            for child in map.values_mut() {
+                redact_at(child, remaining);
+            }
+        }
+        _ => {}
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    fn redact(body: Value, paths: &[&str]) -> Value {
+        let paths: Vec<String> = paths.iter().map(|p| p.to_string()).collect();
+        let bytes = serde_json::to_vec(&body).unwrap();
+        serde_json::from_slice(&redact_json_body(&bytes, &paths).unwrap()).unwrap()
+    }
+
+    #[test]
+    fn test_parse_json_path() {
+        assert_eq!(
+            parse_json_path("$.cards[*].number"),
+            Some(vec![
+                PathSegment::Key("cards".to_string()),
+                PathSegment::Wildcard,
+                PathSegment::Key("number".to_string()),
+            ])
+        );
+        assert_eq!(
+            parse_json_path("$['user'][0]"),
+            Some(vec![PathSegment::Key("user".to_string()), PathSegment::Index(0)])
+        );
+        assert_eq!(parse_json_path("user.password"), None);
+        assert_eq!(parse_json_path("$..password"), None);
+        assert_eq!(parse_json_path("$.cards[*"), None);
+    }
+
+    #[test]
+    fn test_redact_nested_member() {
+        let result = redact(
+            json!({"user": {"name": "alice", "password": "hunter2"}}),
+            &["$.user.password"],
+        );
+        assert_eq!(result, json!({"user": {"name": "alice", "password": REDACTED_VALUE}}));
+    }
+
+    #[test]
+    fn test_redact_array_wildcard() {
+        let result = redact(
+            json!({"cards": [{"number": "4111"}, {"number": "5500"}, {"brand": "visa"}]}),
+            &["$.cards[*].number"],
+        );
+        assert_eq!(
+            result,
+            json!({"cards": [{"number": REDACTED_VALUE}, {"number": REDACTED_VALUE}, {"brand": "visa"}]})
+        );
+    }
+
+    #[test]
+    fn test_redact_nested_arrays_need_one_wildcard_per_level() {
+        let body = json!({"matrix": [[{"secret": 1}], [{"secret": 2}]]});
+        assert_eq!(redact(body.clone(), &["$.matrix[*].secret"]), body);
+        assert_eq!(
+            redact(body, &["$.matrix[*][*].secret"]),
+            json!({"matrix": [[{"secret": REDACTED_VALUE}], [{"secret": REDACTED_VALUE}]]})
+        );
+    }
+
+    #[test]
+    fn test_redact_missing_path_is_noop() {
+        let body = json!({"user": {"name": "alice"}});
+        assert_eq!(redact(body.clone(), &["$.user.ssn", "$.missing[0]"]), body);
+    }
+
+    #[test]
+    fn test_redact_non_json_body() {
+        let paths = vec!["$.password".to_string()];
+        assert!(redact_json_body(b"password=hunter2", &paths).is_none());
+    }
+}
@@ -0,0 +1,112 @@
+// Per-route config overrides from Envoy route metadata
+
+use std::cell::RefCell;
+use std::collections::HashMap;
+
+use crate::config::Config;
+
+/// Route metadata holding the overrides, as a JSON string:
+/// `metadata.filter_metadata.sp.overrides`
+pub const ROUTE_OVERRIDES_PROPERTY: [&str; 5] = ["xds", "route_metadata", "filter_metadata", "sp", "overrides"];
+
+thread_local! {
+    // Merged config per plugin name and distinct overrides string, so each route is parsed
+    // (and logged) once. Plugins sharing the VM each merge over their own global config.
+    static ROUTE_CONFIGS: RefCell<HashMap<(String, String), Config>> = RefCell::new(HashMap::new());
+}
+
+/// Forget a plugin's merged configs; called whenever its global config changes
+pub fn clear_cache(plugin_name: &str) {
+    ROUTE_CONFIGS.with(|configs| configs.borrow_mut().retain(|(plugin, _), _| plugin != plugin_name));
+}
+
+/// Overlay a route's overrides on the plugin's global config. Keys use the plugin config
+/// names; anything not set by the route keeps its global value. Invalid JSON, or a merged
+/// config that fails validation, leaves the global config in effect.
+pub fn effective_config(global: &Config, overrides_json: &str) -> Config {
+    ROUTE_CONFIGS.with(|configs| {
+        configs
+            .borrow_mut()
+            .entry((global.plugin_name.clone(), overrides_json.to_string()))
+            .or_insert_with(|| {
+                let mut config = global.clone();
+                if !config.parse_from_json(overrides_json.as_bytes()) {
+                    crate::sp_warn!("Ignoring invalid route sp.overrides: not valid JSON");
+                    return global.clone();
+                }
+                if let Err(problems) = config.validate(overrides_json.as_bytes()) {
+                    crate::sp_warn!("Ignoring invalid route sp.overrides ({} problems):", problems.len());
+                    for problem in &problems {
+                        crate::sp_warn!("  - {}", problem);
+                    }
+                    return global.clone();
+                }
+                config
+            })
+            .clone()
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_effective_config_overlays_global() {
+        clear_cache("inbound");
+        let mut global = Config::default();
+        global.plugin_name = "inbound".to_string();
+        global.sample_rate = 0.5;
+        global.max_request_body_bytes = 4096;
+
+        let config = effective_config(&global, r#"{"maxRequestBodyBytes": 0}"#);
+        assert_eq!(config.max_request_body_bytes, 0);
+        assert_eq!(config.sample_rate, 0.5);
+    }
+
+    #[test]
+    fn test_effective_config_invalid_json_keeps_global() {
+        clear_cache("inbound");
+        let mut global = Config::default();
+        global.plugin_name = "inbound".to_string();
+        let config = effective_config(&global, "not json");
+        assert_eq!(config.max_request_body_bytes, global.max_request_body_bytes);
+    }
+
+    #[test]
+    fn test_effective_config_invalid_override_keeps_global() {
+        clear_cache("inbound");
+        let mut global = Config::default();
+        global.plugin_name = "inbound".to_string();
+        global.sample_rate = 0.5;
+
+        for overrides in [r#"{"sampleRate": 7}"#, r#"{"sampleRate": -1, "maxRequestBodyBytes": 0}"#] {
+            let config = effective_config(&global, overrides);
+            assert_eq!(config.sample_rate, 0.5);
+            assert_eq!(config.max_request_body_bytes, global.max_request_body_bytes);
+        }
+    }
+
+    #[test]
+    fn test_effective_config_is_cached_per_plugin() {
+        clear_cache("inbound");
+        clear_cache("outbound");
+        let mut inbound = Config::default();
+        inbound.plugin_name = "inbound".to_string();
+        inbound.sample_rate = 0.25;
+        let mut outbound = Config::default();
+        outbound.plugin_name = "outbound".to_string();
+        outbound.sample_rate = 0.75;
+
+        let overrides = r#"{"maxRequestBodyBytes": 0}"#;
+        assert_eq!(effective_config(&inbound, overrides).sample_rate, 0.25);
+        assert_eq!(effective_config(&outbound, overrides).sample_rate, 0.75);
+
+        // Clearing one plugin leaves the other's merged configs alone
+        inbound.sample_rate = 0.5;
+        outbound.sample_rate = 1.0;
+        clear_cache("inbound");
+        assert_eq!(effective_config(&inbound, overrides).sample_rate, 0.5);
+        assert_eq!(effective_config(&outbound, overrides).sample_rate, 0.75);
+    }
+}
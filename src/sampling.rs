@@ -0,0 +1,70 @@
+// Capture sampling decisions
+
+/// FNV-1a 64-bit hash, stable across VMs and releases
+pub fn fnv1a_hash(data: &[u8]) -> u64 {
+    let mut hash: u64 = 0xcbf29ce484222325;
+    for byte in data {
+        hash ^= *byte as u64;
+        hash = hash.wrapping_mul(0x100000001b3);
+    }
+    hash
+}
+
+/// Map a hash onto [0, 1) and compare against the sample rate
+fn hash_below_rate(hash: u64, sample_rate: f64) -> bool {
+    if sample_rate >= 1.0 {
+        return true;
+    }
+    if sample_rate <= 0.0 {
+        return false;
+    }
+    ((hash >> 11) as f64 / (1u64 << 53) as f64) < sample_rate
+}
+
+/// Deterministic decision for a session: every request carrying the same
+/// session id gets the same answer, on every sidecar.
+pub fn should_sample_session(session_id: &str, sample_rate: f64) -> bool {
+    hash_below_rate(fnv1a_hash(session_id.as_bytes()), sample_rate)
+}
+
+/// Per-request roll for requests without a session id
+pub fn should_sample_request(context_id: u32, sample_rate: f64) -> bool {
+    let seed = crate::otel::get_current_timestamp_nanos() ^ ((context_id as u64) << 32);
+    hash_below_rate(fnv1a_hash(&seed.to_le_bytes()), sample_rate)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_fnv1a_hash_known_values() {
+        assert_eq!(fnv1a_hash(b""), 0xcbf29ce484222325);
+        assert_eq!(fnv1a_hash(b"a"), 0xaf63dc4c8601ec8c);
+    }
+
+    #[test]
+    fn test_should_sample_session_bounds() {
+        assert!(should_sample_session("session-1", 1.0));
+        assert!(should_sample_session("session-1", 1.5));
+        assert!(!should_sample_session("session-1", 0.0));
+        assert!(!should_sample_session("session-1", -0.5));
+    }
+
+    #[test]
+    fn test_should_sample_session_is_deterministic() {
+        for i in 0..100 {
+            let session_id = format!("session-{}", i);
+            let first = should_sample_session(&session_id, 0.5);
+            assert_eq!(first, should_sample_session(&session_id, 0.5));
+        }
+    }
+
+    #[test]
+    fn test_should_sample_session_rate_is_roughly_honored() {
+        let sampled = (0..10_000)
+            .filter(|i| should_sample_session(&format!("session-{}", i), 0.25))
+            .count();
+        assert!(sampled > 2_000 && sampled < 3_000, "sampled {} of 10000", sampled);
+    }
+}
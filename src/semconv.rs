@@ -0,0 +1,217 @@
+// OpenTelemetry semantic convention attribute names, pinned to v1.4.0 to match the
+// instrumented applications. Moving to a newer semconv version only touches this file.
+
+use std::collections::HashMap;
+
+use crate::otel::{int_attribute, string_attribute, KeyValue};
+
+/// Schema URL stamped on exported resource spans
+pub const SCHEMA_URL: &str = "https://opentelemetry.io/schemas/1.4.0";
+
+pub const SERVICE_NAME: &str = "service.name";
+pub const HTTP_METHOD: &str = "http.method";
+pub const HTTP_URL: &str = "http.url";
+pub const HTTP_TARGET: &str = "http.target";
+pub const HTTP_HOST: &str = "http.host";
+pub const HTTP_SCHEME: &str = "http.scheme";
+pub const HTTP_STATUS_CODE: &str = "http.status_code";
+pub const HTTP_ROUTE: &str = "http.route";
+pub const HTTP_USER_AGENT: &str = "http.user_agent";
+pub const NET_HOST_NAME: &str = "net.host.name";
+pub const NET_PEER_NAME: &str = "net.peer.name";
+pub const RPC_GRPC_STATUS_CODE: &str = "rpc.grpc.status_code";
+pub const ENDUSER_ID: &str = "enduser.id";
+/// Later-convention name (v1.4.0 has http.client_ip); the backend indexes this one
+pub const CLIENT_ADDRESS: &str = "client.address";
+/// Later-convention name for the host the client addressed, without the port
+pub const SERVER_ADDRESS: &str = "server.address";
+/// Request authority as sent, port kept, and the one the upstream saw when a rewrite
+/// changed it; no semconv equivalent, so Softprobe names
+pub const SP_HTTP_HOST: &str = "sp.http.host";
+pub const SP_UPSTREAM_AUTHORITY: &str = "sp.upstream.authority";
+/// Envoy route and virtual host; no semconv equivalent, so Softprobe names
+pub const SP_ROUTE_NAME: &str = "sp.route.name";
+pub const SP_ROUTE_VHOST: &str = "sp.route.vhost";
+
+/// Status code key used by spans recorded before the v1.4.0 names were adopted;
+/// still read back from injection responses
+pub const LEGACY_HTTP_STATUS_CODE: &str = "http.response.status_code";
+
+/// Request-side HTTP attributes. `url_host` is the raw authority (port kept) and
+/// `url_path` the request target including any query string.
+pub fn request_attributes(
+    request_headers: &HashMap<String, String>,
+    url_host: Option<&str>,
+    url_path: Option<&str>,
+) -> Vec<KeyValue> {
+    let mut attributes = Vec::new();
+    let scheme = request_headers.get(":scheme").map(|v| v.as_str()).filter(|v| !v.is_empty());
+
+    if let Some(method) = request_headers.get(":method") {
+        attributes.push(string_attribute(HTTP_METHOD, method.clone()));
+    }
+    if let Some(scheme) = scheme {
+        attributes.push(string_attribute(HTTP_SCHEME, scheme.to_string()));
+    }
+    if let Some(path) = url_path {
+        attributes.push(string_attribute(HTTP_TARGET, path.to_string()));
+    }
+    if let Some(host) = url_host {
+        attributes.push(string_attribute(HTTP_HOST, host.to_string()));
+        attributes.push(string_attribute(NET_HOST_NAME, strip_port(host).to_string()));
+    }
+    if let (Some(scheme), Some(host), Some(path)) = (scheme, url_host, url_path) {
+        attributes.push(string_attribute(HTTP_URL, format!("{}://{}{}", scheme, host, path)));
+    }
+    if let Some(user_agent) = request_headers.get("user-agent") {
+        attributes.push(string_attribute(HTTP_USER_AGENT, user_agent.clone()));
+    }
+
+    attributes
+}
+
+/// Response-side HTTP attributes
+pub fn response_attributes(response_headers: &HashMap<String, String>) -> Vec<KeyValue> {
+    let mut attributes = Vec::new();
+    if let Some(status_code) = response_headers.get(":status").and_then(|s| s.parse::<i64>().ok()) {
+        attributes.push(int_attribute(HTTP_STATUS_CODE, status_code));
+    }
+    attributes
+}
+
+/// Routing attributes: the Envoy route that matched and its virtual host. Either may be
+/// missing, e.g. for direct responses.
+pub fn route_attributes(route_name: Option<&str>, virtual_host: Option<&str>) -> Vec<KeyValue> {
+    let mut attributes = Vec::new();
+    if let Some(route_name) = route_name {
+        attributes.push(string_attribute(SP_ROUTE_NAME, route_name.to_string()));
+    }
+    if let Some(virtual_host) = virtual_host {
+        attributes.push(string_attribute(SP_ROUTE_VHOST, virtual_host.to_string()));
+    }
+    attributes
+}
+
+/// Authority attributes of the request: the host as server.address and the raw
+/// authority as sp.http.host
+pub fn host_attributes(authority: &str) -> Vec<KeyValue> {
+    vec![
+        string_attribute(SERVER_ADDRESS, strip_port(authority).to_string()),
+        string_attribute(SP_HTTP_HOST, authority.to_string()),
+    ]
+}
+
+/// Host part of an authority: `example.com:8080` -> `example.com`, `[::1]:80` -> `::1`
+pub fn strip_port(authority: &str) -> &str {
+    if let Some(rest) = authority.strip_prefix('[') {
+        return rest.split(']').next().unwrap_or(rest);
+    }
+    match authority.rsplit_once(':') {
+        Some((host, port)) if !host.contains(':') && port.chars().all(|c| c.is_ascii_digit()) => host,
+        _ => authority,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn keys(attributes: &[KeyValue]) -> Vec<&str> {
+        attributes.iter().map(|kv| kv.key.as_str()).collect()
+    }
+
+    #[test]
+    fn test_request_attribute_keys() {
+        let mut headers = HashMap::new();
+        headers.insert(":method".to_string(), "GET".to_string());
+        headers.insert(":scheme".to_string(), "https".to_string());
+        headers.insert("user-agent".to_string(), "curl/8.0".to_string());
+
+        let attributes = request_attributes(&headers, Some("api.example.com:8443"), Some("/v1/items?page=2"));
+        assert_eq!(
+            keys(&attributes),
+            vec![
+                "http.method",
+                "http.scheme",
+                "http.target",
+                "http.host",
+                "net.host.name",
+                "http.url",
+                "http.user_agent",
+            ]
+        );
+
+        let value = |key: &str| {
+            attributes
+                .iter()
+                .find(|kv| kv.key == key)
+                .and_then(|kv| kv.value.clone())
+                .and_then(|v| v.value)
+        };
+        assert_eq!(
+            value("http.url"),
+            Some(crate::otel::any_value::Value::StringValue(
+                "https://api.example.com:8443/v1/items?page=2".to_string()
+            ))
+        );
+        assert_eq!(
+            value("net.host.name"),
+            Some(crate::otel::any_value::Value::StringValue("api.example.com".to_string()))
+        );
+    }
+
+    #[test]
+    fn test_request_attributes_without_scheme_omit_url() {
+        let mut headers = HashMap::new();
+        headers.insert(":method".to_string(), "POST".to_string());
+
+        let attributes = request_attributes(&headers, Some("svc"), Some("/"));
+        assert_eq!(keys(&attributes), vec!["http.method", "http.target", "http.host", "net.host.name"]);
+    }
+
+    #[test]
+    fn test_response_attribute_keys() {
+        let mut headers = HashMap::new();
+        headers.insert(":status".to_string(), "404".to_string());
+        let attributes = response_attributes(&headers);
+        assert_eq!(keys(&attributes), vec!["http.status_code"]);
+        assert_eq!(
+            attributes[0].value.clone().and_then(|v| v.value),
+            Some(crate::otel::any_value::Value::IntValue(404))
+        );
+
+        assert!(response_attributes(&HashMap::new()).is_empty());
+    }
+
+    #[test]
+    fn test_route_attribute_keys() {
+        let attributes = route_attributes(Some("orders_route"), Some("shop.local"));
+        assert_eq!(keys(&attributes), vec!["sp.route.name", "sp.route.vhost"]);
+        assert_eq!(keys(&route_attributes(None, Some("shop.local"))), vec!["sp.route.vhost"]);
+        assert!(route_attributes(None, None).is_empty());
+    }
+
+    #[test]
+    fn test_strip_port() {
+        assert_eq!(strip_port("example.com:8080"), "example.com");
+        assert_eq!(strip_port("example.com"), "example.com");
+        assert_eq!(strip_port("[::1]:8080"), "::1");
+        assert_eq!(strip_port("10.0.0.1:80"), "10.0.0.1");
+        assert_eq!(strip_port("[2001:db8::1]"), "2001:db8::1");
+        assert_eq!(strip_port("2001:db8::1"), "2001:db8::1");
+    }
+
+    #[test]
+    fn test_host_attributes() {
+        let attributes = host_attributes("[2001:db8::1]:8443");
+        assert_eq!(keys(&attributes), vec!["server.address", "sp.http.host"]);
+        let values: Vec<_> = attributes.into_iter().filter_map(|kv| kv.value.and_then(|v| v.value)).collect();
+        assert_eq!(
+            values,
+            vec![
+                crate::otel::any_value::Value::StringValue("2001:db8::1".to_string()),
+                crate::otel::any_value::Value::StringValue("[2001:db8::1]:8443".to_string()),
+            ]
+        );
+    }
+}
@@ -0,0 +1,171 @@
+// Server-Timing response header (W3C Server Timing), recorded as span attributes
+//
+//   Server-Timing: db;dur=120, cache;desc="Cache Read";dur=5.3, miss
+//
+// Each metric is a token name followed by `;name=value` params, where a value is a
+// token or a quoted string (which may itself hold `,` and `;`). Only `dur` becomes an
+// attribute, `sp.server_timing.<name>_ms`. Entries that do not parse are skipped, as
+// are metrics without a duration.
+
+/// Metrics recorded per response, so a chatty upstream cannot flood the span
+pub const MAX_METRICS: usize = 32;
+
+#[derive(Debug, Clone, PartialEq)]
+pub struct Metric {
+    pub name: String,
+    pub dur_ms: Option<f64>,
+    pub desc: Option<String>,
+}
+
+/// Attribute key of a metric's duration
+pub fn attribute_key(name: &str) -> String {
+    format!("sp.server_timing.{}_ms", name)
+}
+
+/// Parse a Server-Timing header value. A name repeated later in the header is ignored.
+pub fn parse(value: &str) -> Vec<Metric> {
+    let mut metrics: Vec<Metric> = Vec::new();
+    for entry in split_unquoted(value, ',') {
+        let metric = match parse_metric(entry) {
+            Some(metric) => metric,
+            None => {
+                crate::sp_debug!("Skipping malformed Server-Timing entry: {}", entry.trim());
+                continue;
+            }
+        };
+        if metrics.iter().any(|m| m.name == metric.name) {
+            continue;
+        }
+        if metrics.len() == MAX_METRICS {
+            break;
+        }
+        metrics.push(metric);
+    }
+    metrics
+}
+
+fn parse_metric(entry: &str) -> Option<Metric> {
+    let mut parts = split_unquoted(entry, ';').into_iter();
+    let name = parts.next()?.trim();
+    if !is_token(name) {
+        return None;
+    }
+    let mut metric = Metric { name: name.to_string(), dur_ms: None, desc: None };
+    let (mut seen_dur, mut seen_desc) = (false, false);
+    for param in parts {
+        let (param_name, param_value) = match param.split_once('=') {
+            Some((param_name, param_value)) => (param_name.trim(), unquote(param_value.trim())?),
+            None => (param.trim(), String::new()),
+        };
+        if !is_token(param_name) {
+            return None;
+        }
+        // Only the first occurrence of a param counts
+        if param_name.eq_ignore_ascii_case("dur") && !seen_dur {
+            seen_dur = true;
+            let dur_ms = param_value.parse::<f64>().ok().filter(|d| d.is_finite() && *d >= 0.0)?;
+            metric.dur_ms = Some(dur_ms);
+        } else if param_name.eq_ignore_ascii_case("desc") && !seen_desc {
+            seen_desc = true;
+            metric.desc = Some(param_value);
+        }
+    }
+    Some(metric)
+}
+
+/// Split on `sep` outside quoted strings
+fn split_unquoted(value: &str, sep: char) -> Vec<&str> {
+    let mut parts = Vec::new();
+    let (mut start, mut in_quotes, mut escaped) = (0, false, false);
+    for (i, c) in value.char_indices() {
+        if escaped {
+            escaped = false;
+        } else if in_quotes && c == '\\' {
+            escaped = true;
+        } else if c == '"' {
+            in_quotes = !in_quotes;
+        } else if c == sep && !in_quotes {
+            parts.push(&value[start..i]);
+            start = i + 1;
+        }
+    }
+    parts.push(&value[start..]);
+    parts
+}
+
+/// A token as is, or a quoted string with its escapes resolved. None for an unterminated
+/// quote or a bare value that is not a token.
+fn unquote(value: &str) -> Option<String> {
+    let inner = match value.strip_prefix('"') {
+        Some(rest) => rest.strip_suffix('"')?,
+        None => return is_token(value).then(|| value.to_string()),
+    };
+    let mut unquoted = String::with_capacity(inner.len());
+    let mut chars = inner.chars();
+    while let Some(c) = chars.next() {
+        match c {
+            '\\' => unquoted.push(chars.next()?),
+            '"' => return None,
+            _ => unquoted.push(c),
+        }
+    }
+    Some(unquoted)
+}
+
+/// RFC 9110 token
+fn is_token(value: &str) -> bool {
+    !value.is_empty()
+        && value
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || "!#$%&'*+-.^_`|~".contains(c))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn durations(value: &str) -> Vec<(String, Option<f64>)> {
+        parse(value).into_iter().map(|m| (m.name, m.dur_ms)).collect()
+    }
+
+    #[test]
+    fn test_parse_basic() {
+        assert_eq!(
+            durations("db;dur=120, cache;dur=5.3"),
+            vec![("db".to_string(), Some(120.0)), ("cache".to_string(), Some(5.3))]
+        );
+    }
+
+    #[test]
+    fn test_parse_desc_and_quoting() {
+        let metrics = parse(r#"cache;desc="Cache Read, L2; warm";dur=23.2,total;dur="7",miss"#);
+        assert_eq!(metrics.len(), 3);
+        assert_eq!(metrics[0].desc.as_deref(), Some("Cache Read, L2; warm"));
+        assert_eq!(metrics[0].dur_ms, Some(23.2));
+        assert_eq!(metrics[1].dur_ms, Some(7.0));
+        assert_eq!(metrics[2], Metric { name: "miss".to_string(), dur_ms: None, desc: None });
+
+        let metrics = parse(r#"app;desc="say \"hi\"";dur=1"#);
+        assert_eq!(metrics[0].desc.as_deref(), Some(r#"say "hi""#));
+    }
+
+    #[test]
+    fn test_parse_skips_malformed_entries() {
+        assert_eq!(
+            durations("bad name;dur=1, db;dur=abc, ;dur=3, ok ; DUR = 4 , neg;dur=-1, open;desc=\"x"),
+            vec![("ok".to_string(), Some(4.0))]
+        );
+        assert!(parse("").is_empty());
+    }
+
+    #[test]
+    fn test_parse_first_wins() {
+        assert_eq!(durations("db;dur=1;dur=2, db;dur=3"), vec![("db".to_string(), Some(1.0))]);
+    }
+
+    #[test]
+    fn test_parse_caps_metrics() {
+        let header = (0..40).map(|i| format!("m{};dur={}", i, i)).collect::<Vec<_>>().join(",");
+        assert_eq!(parse(&header).len(), MAX_METRICS);
+    }
+}
@@ -0,0 +1,225 @@
+// Per-session sequence numbers, shared by all worker VMs through shared data
+//
+// Shared data has no delete and session ids are unbounded, so sessions live in a fixed
+// table of maxSessions slots. A session id hashes to a short run of slots; it takes the
+// slot already holding it, else a free or idle one, else evicts the least recently used
+// slot of the run (that session's numbering then restarts). Increments go through CAS,
+// so two workers never hand out the same number. The tick timer sweeps the table to
+// clear sessions idle for sessionIdleMs and reports the live count.
+
+use std::cell::RefCell;
+
+use proxy_wasm::traits::Context;
+use proxy_wasm::types::Status;
+
+use crate::sampling::fnv1a_hash;
+use crate::shared_data::{self, Feature};
+
+const SLOT_KEY_PREFIX: &str = "sp.session.";
+/// Slot value: session id hash, last sequence number, last use (ms); all u64 LE
+const SLOT_VALUE_LEN: usize = 24;
+/// Slots a session id may occupy, starting at its hash
+const PROBE_SLOTS: u64 = 4;
+/// CAS attempts before giving up; each failure means another worker got a number
+const MAX_CAS_ATTEMPTS: usize = 8;
+/// Slots checked per tick, so a large table is swept over several ticks
+const SWEEP_SLOTS_PER_TICK: u64 = 256;
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+struct Slot {
+    session_hash: u64,
+    seq: u64,
+    last_seen_ms: u64,
+}
+
+impl Slot {
+    fn encode(&self) -> Vec<u8> {
+        let mut value = Vec::with_capacity(SLOT_VALUE_LEN);
+        value.extend_from_slice(&self.session_hash.to_le_bytes());
+        value.extend_from_slice(&self.seq.to_le_bytes());
+        value.extend_from_slice(&self.last_seen_ms.to_le_bytes());
+        value
+    }
+
+    /// None for a free slot (never written, or cleared by the sweep)
+    fn decode(value: &[u8]) -> Option<Self> {
+        if value.len() != SLOT_VALUE_LEN {
+            return None;
+        }
+        let word = |i: usize| u64::from_le_bytes(value[i * 8..(i + 1) * 8].try_into().unwrap_or_default());
+        Some(Self {
+            session_hash: word(0),
+            seq: word(1),
+            last_seen_ms: word(2),
+        })
+    }
+
+    /// Idle sessions may be cleared or reused; 0 disables the idle timeout
+    fn is_idle(&self, now_ms: u64, idle_ms: u64) -> bool {
+        idle_ms > 0 && now_ms.saturating_sub(self.last_seen_ms) >= idle_ms
+    }
+}
+
+fn slot_key(index: u64) -> String {
+    format!("{}{}", SLOT_KEY_PREFIX, index)
+}
+
+/// The short run of slots a key hash may occupy in a table of `table_size` slots.
+/// Also used by the per-tenant export buckets (see `ratelimit`).
+pub fn probe_indexes(hash: u64, table_size: u64) -> Vec<u64> {
+    let probes = PROBE_SLOTS.min(table_size);
+    (0..probes).map(|i| (hash % table_size + i) % table_size).collect()
+}
+
+/// Pick the slot for a session among its probe run and the sequence number to store
+/// there: the session's own slot continues its numbering, anything else starts at 1.
+fn choose_slot(slots: &[Option<Slot>], session_hash: u64, now_ms: u64, idle_ms: u64) -> (usize, u64) {
+    let own = slots
+        .iter()
+        .enumerate()
+        .find_map(|(i, slot)| slot.filter(|s| s.session_hash == session_hash).map(|s| (i, s)));
+    if let Some((i, slot)) = own {
+        let seq = if slot.is_idle(now_ms, idle_ms) { 1 } else { slot.seq.saturating_add(1) };
+        return (i, seq);
+    }
+    if let Some(i) = slots.iter().position(|slot| slot.map_or(true, |s| s.is_idle(now_ms, idle_ms))) {
+        return (i, 1);
+    }
+    // Every slot holds a live session: evict the least recently used
+    let lru = slots
+        .iter()
+        .enumerate()
+        .min_by_key(|(_, slot)| slot.map_or(0, |s| s.last_seen_ms))
+        .map_or(0, |(i, _)| i);
+    (lru, 1)
+}
+
+/// Hand out the next sequence number for a session. None if shared data could not be
+/// updated; the span is then recorded without a number rather than with a duplicate.
+pub fn next_sequence(ctx: &dyn Context, session_id: &str, now_ms: u64, idle_ms: u64, max_sessions: u64) -> Option<u64> {
+    if max_sessions == 0 || shared_data::is_degraded(Feature::SessionSequence) {
+        return None;
+    }
+    let session_hash = fnv1a_hash(session_id.as_bytes());
+    let indexes = probe_indexes(session_hash, max_sessions);
+
+    for _ in 0..MAX_CAS_ATTEMPTS {
+        let mut slots = Vec::with_capacity(indexes.len());
+        let mut cas_values = Vec::with_capacity(indexes.len());
+        for index in &indexes {
+            let (value, cas) = shared_data::get(ctx, Feature::SessionSequence, &slot_key(*index));
+            slots.push(value.as_deref().and_then(Slot::decode));
+            cas_values.push(cas);
+        }
+
+        let (chosen, seq) = choose_slot(&slots, session_hash, now_ms, idle_ms);
+        if let Some(evicted) = slots[chosen].filter(|s| s.session_hash != session_hash && !s.is_idle(now_ms, idle_ms)) {
+            crate::sp_debug!("Session table full, evicting session {:016x}", evicted.session_hash);
+        }
+        let slot = Slot { session_hash, seq, last_seen_ms: now_ms };
+        match shared_data::set(ctx, Feature::SessionSequence, &slot_key(indexes[chosen]), &slot.encode(), cas_values[chosen]) {
+            Ok(()) => return Some(seq),
+            Err(Status::CasMismatch) => continue,
+            Err(_) => return None,
+        }
+    }
+    crate::sp_debug!("Session sequence contended for {}, skipping", session_id);
+    None
+}
+
+#[derive(Default)]
+struct SweepState {
+    cursor: u64,
+    active: u64,  // Live sessions seen so far in this pass
+}
+
+thread_local! {
+    static SWEEP: RefCell<SweepState> = RefCell::new(SweepState::default());
+}
+
+/// Tick work: clear idle sessions from the next run of slots, and publish
+/// sp_active_sessions each time a full pass over the table completes
+pub fn sweep(ctx: &dyn Context, now_ms: u64, idle_ms: u64, max_sessions: u64) {
+    if max_sessions == 0 || shared_data::is_degraded(Feature::SessionSequence) {
+        return;
+    }
+    SWEEP.with(|sweep| {
+        let mut sweep = sweep.borrow_mut();
+        if sweep.cursor >= max_sessions {
+            sweep.cursor = 0;
+            sweep.active = 0;
+        }
+        let end = (sweep.cursor + SWEEP_SLOTS_PER_TICK).min(max_sessions);
+        for index in sweep.cursor..end {
+            let key = slot_key(index);
+            let (value, cas) = shared_data::get(ctx, Feature::SessionSequence, &key);
+            let slot = match value.as_deref().and_then(Slot::decode) {
+                Some(slot) => slot,
+                None => continue,
+            };
+            if !slot.is_idle(now_ms, idle_ms) {
+                sweep.active += 1;
+                continue;
+            }
+            // A CAS mismatch means the session was just used again, so it stays
+            let _ = shared_data::set(ctx, Feature::SessionSequence, &key, &[], cas);
+        }
+        sweep.cursor = end;
+        if sweep.cursor >= max_sessions {
+            crate::metrics::set_gauge(crate::metrics::ACTIVE_SESSIONS, sweep.active);
+        }
+    });
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn slot(session_hash: u64, seq: u64, last_seen_ms: u64) -> Option<Slot> {
+        Some(Slot { session_hash, seq, last_seen_ms })
+    }
+
+    #[test]
+    fn test_slot_round_trip() {
+        let value = Slot { session_hash: 0xabcdef, seq: 42, last_seen_ms: 1_700_000_000_000 };
+        assert_eq!(Slot::decode(&value.encode()), Some(value));
+        assert_eq!(Slot::decode(b""), None);
+        assert_eq!(Slot::decode(b"short"), None);
+    }
+
+    #[test]
+    fn test_choose_slot_continues_own_session() {
+        let slots = [slot(1, 5, 900), slot(7, 41, 900), None];
+        assert_eq!(choose_slot(&slots, 7, 1_000, 60_000), (1, 42));
+        // No idle timeout: numbering never restarts
+        assert_eq!(choose_slot(&slots, 7, 10_000_000, 0), (1, 42));
+    }
+
+    #[test]
+    fn test_choose_slot_restarts_idle_session() {
+        let slots = [slot(7, 41, 1_000)];
+        assert_eq!(choose_slot(&slots, 7, 61_000, 60_000), (0, 1));
+        assert_eq!(choose_slot(&slots, 7, 60_999, 60_000), (0, 42));
+    }
+
+    #[test]
+    fn test_choose_slot_takes_free_or_idle_slot() {
+        let slots = [slot(1, 5, 50_000), None, slot(2, 3, 50_000)];
+        assert_eq!(choose_slot(&slots, 9, 60_000, 60_000), (1, 1));
+
+        let slots = [slot(1, 5, 50_000), slot(2, 3, 0)];
+        assert_eq!(choose_slot(&slots, 9, 60_000, 60_000), (1, 1));
+    }
+
+    #[test]
+    fn test_probe_indexes_wrap() {
+        assert_eq!(probe_indexes(9, 10), vec![9, 0, 1, 2]);
+        assert_eq!(probe_indexes(5, 2), vec![1, 0]);
+    }
+
+    #[test]
+    fn test_choose_slot_evicts_least_recently_used() {
+        let slots = [slot(1, 5, 50_000), slot(2, 3, 40_000), slot(3, 8, 55_000)];
+        assert_eq!(choose_slot(&slots, 9, 60_000, 60_000), (1, 1));
+    }
+}
@@ -0,0 +1,117 @@
+// Shared data access for the features that keep cross-worker state in it, with graceful
+// degradation when the host refuses a write
+//
+// Shared data is bounded by the host. A write that fails with anything but a CAS
+// mismatch (typically: no room for another key) will keep failing, so the first one
+// switches the feature to degraded for the life of this worker VM: it is counted in
+// sp_shared_data_errors_total, logged once, and later reads and writes never reach the
+// host. Features with a usable per-worker fallback keep running on a worker-local copy
+// of their keys; the rest are switched off (see `Feature::local_fallback`).
+
+use std::cell::RefCell;
+use std::collections::{HashMap, HashSet};
+
+use proxy_wasm::traits::Context;
+use proxy_wasm::types::Status;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub enum Feature {
+    Dedup,
+    SessionSequence,
+    RateLimit,
+    Circuit,
+    TraceLimit,
+    Flush,
+}
+
+impl Feature {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Feature::Dedup => "dedup",
+            Feature::SessionSequence => "session",
+            Feature::RateLimit => "ratelimit",
+            Feature::Circuit => "circuit",
+            Feature::TraceLimit => "trace",
+            Feature::Flush => "flush",
+        }
+    }
+
+    /// Whether worker-local state is an acceptable stand-in. Session numbers kept per
+    /// worker would repeat across workers, so sequencing stops instead.
+    fn local_fallback(&self) -> bool {
+        !matches!(self, Feature::SessionSequence)
+    }
+}
+
+thread_local! {
+    static DEGRADED: RefCell<HashSet<Feature>> = RefCell::new(HashSet::new());
+    // Keys carry a per-feature prefix, so one map serves every feature
+    static LOCAL: RefCell<HashMap<String, Vec<u8>>> = RefCell::new(HashMap::new());
+}
+
+pub fn is_degraded(feature: Feature) -> bool {
+    DEGRADED.with(|degraded| degraded.borrow().contains(&feature))
+}
+
+/// Count a failed write and degrade the feature; only the first failure is logged
+fn degrade(feature: Feature, key: &str, status: Status) {
+    crate::metrics::increment_counter(crate::metrics::SHARED_DATA_ERRORS_TOTAL, 1);
+    crate::metrics::increment_tagged_counter(crate::metrics::SHARED_DATA_ERRORS_TOTAL, feature.as_str(), 1);
+    if DEGRADED.with(|degraded| degraded.borrow_mut().insert(feature)) {
+        let fallback = if feature.local_fallback() { "keeping its state on this worker" } else { "turning it off on this worker" };
+        crate::sp_warn!(
+            "Shared data write for {} failed on {} ({:?}); {} from now on",
+            feature.as_str(),
+            key,
+            status,
+            fallback
+        );
+    }
+}
+
+/// Read a key, from the worker-local copy once the feature is degraded. Local values
+/// carry no CAS, which `set` accepts unconditionally.
+pub fn get(ctx: &dyn Context, feature: Feature, key: &str) -> (Option<Vec<u8>>, Option<u32>) {
+    if is_degraded(feature) {
+        return (LOCAL.with(|local| local.borrow().get(key).cloned()), None);
+    }
+    ctx.get_shared_data(key)
+}
+
+/// Write a key. Err(CasMismatch) means another worker won the race. Any other host
+/// error degrades the feature; the write then lands locally and succeeds, or, for a
+/// feature without a local fallback, the error is returned.
+pub fn set(ctx: &dyn Context, feature: Feature, key: &str, value: &[u8], cas: Option<u32>) -> Result<(), Status> {
+    if !is_degraded(feature) {
+        match ctx.set_shared_data(key, Some(value), cas) {
+            Ok(()) => return Ok(()),
+            Err(Status::CasMismatch) => return Err(Status::CasMismatch),
+            Err(status) => {
+                degrade(feature, key, status);
+                if !feature.local_fallback() {
+                    return Err(status);
+                }
+            }
+        }
+    }
+    if !feature.local_fallback() {
+        return Err(Status::InternalFailure);
+    }
+    LOCAL.with(|local| local.borrow_mut().insert(key.to_string(), value.to_vec()));
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_only_session_sequence_lacks_local_fallback() {
+        assert!(Feature::Dedup.local_fallback());
+        assert!(Feature::RateLimit.local_fallback());
+        assert!(Feature::Circuit.local_fallback());
+        assert!(Feature::TraceLimit.local_fallback());
+        assert!(Feature::Flush.local_fallback());
+        assert!(!Feature::SessionSequence.local_fallback());
+    }
+}
@@ -0,0 +1,212 @@
+// Local span sink: captured spans (and body log records) as NDJSON, for offline debugging
+// and CI assertions
+//
+// The proxy-wasm ABI gives filters no file or fd access, so `sink.file` cannot be opened
+// from the sandbox. Every line goes to the Envoy log instead (stdout by default), prefixed
+// with `sp.sink ` so they can be cut out with `grep -o 'sp.sink .*' | cut -c9-`.
+// The configured path is kept so a host that grows file access can honour it.
+
+use serde_json::{json, Map, Value};
+
+use crate::otel::{any_value, AnyValue, KeyValue, ResourceLogs, ResourceSpans};
+
+/// Prefix marking sink lines in the Envoy log
+pub const LINE_PREFIX: &str = "sp.sink ";
+
+#[derive(Debug, Clone, PartialEq)]
+pub struct SinkConfig {
+    pub file: String,
+    pub also_export: bool,  // Send to the backend as well as the sink
+}
+
+/// Write every span of a batch to the sink, one JSON object per line.
+/// Lines carry captured bodies, so they bypass the sp_* log macros on purpose.
+pub fn write(sink: &SinkConfig, resource_spans: &[ResourceSpans]) {
+    let lines = span_lines(resource_spans);
+    crate::sp_debug!("Writing {} spans to sink (file '{}' unavailable in the sandbox, using log)", lines.len(), sink.file);
+    for line in lines {
+        log::info!("{}{}", LINE_PREFIX, line);
+    }
+}
+
+/// Write every body log record of a batch (bodyExport=log) to the sink, one JSON object
+/// per line
+pub fn write_logs(sink: &SinkConfig, resource_logs: &[ResourceLogs]) {
+    let lines = log_lines(resource_logs);
+    crate::sp_debug!("Writing {} log records to sink (file '{}' unavailable in the sandbox, using log)", lines.len(), sink.file);
+    for line in lines {
+        log::info!("{}{}", LINE_PREFIX, line);
+    }
+}
+
+/// One NDJSON line per span, with its resource attributes inlined
+pub fn span_lines(resource_spans: &[ResourceSpans]) -> Vec<String> {
+    let mut lines = Vec::new();
+    for resource_span in resource_spans {
+        let resource = resource_span
+            .resource
+            .as_ref()
+            .map_or_else(|| Value::Object(Map::new()), |r| attributes_json(&r.attributes));
+        for scope_span in &resource_span.scope_spans {
+            for span in &scope_span.spans {
+                let mut line = json!({
+                    "resource": resource,
+                    "traceId": hex(&span.trace_id),
+                    "spanId": hex(&span.span_id),
+                    "name": span.name,
+                    "kind": span.kind,
+                    "startTimeUnixNano": span.start_time_unix_nano.to_string(),
+                    "endTimeUnixNano": span.end_time_unix_nano.to_string(),
+                    "attributes": attributes_json(&span.attributes),
+                });
+                if !span.parent_span_id.is_empty() {
+                    line["parentSpanId"] = json!(hex(&span.parent_span_id));
+                }
+                if let Some(status) = &span.status {
+                    line["status"] = json!({"code": status.code, "message": status.message});
+                }
+                lines.push(line.to_string());
+            }
+        }
+    }
+    lines
+}
+
+/// One NDJSON line per log record, with its resource attributes inlined. Lines carry
+/// `eventName` where span lines carry `name`, so the two can be told apart.
+pub fn log_lines(resource_logs: &[ResourceLogs]) -> Vec<String> {
+    let mut lines = Vec::new();
+    for resource_log in resource_logs {
+        let resource = resource_log
+            .resource
+            .as_ref()
+            .map_or_else(|| Value::Object(Map::new()), |r| attributes_json(&r.attributes));
+        for scope_log in &resource_log.scope_logs {
+            for record in &scope_log.log_records {
+                let line = json!({
+                    "resource": resource,
+                    "traceId": hex(&record.trace_id),
+                    "spanId": hex(&record.span_id),
+                    "eventName": record.event_name,
+                    "timeUnixNano": record.time_unix_nano.to_string(),
+                    "body": any_value_json(record.body.as_ref()),
+                    "attributes": attributes_json(&record.attributes),
+                });
+                lines.push(line.to_string());
+            }
+        }
+    }
+    lines
+}
+
+fn hex(bytes: &[u8]) -> String {
+    bytes.iter().map(|b| format!("{:02x}", b)).collect()
+}
+
+/// Attributes as a flat `{key: value}` object, which is easier to assert on than OTLP/JSON
+fn attributes_json(attributes: &[KeyValue]) -> Value {
+    let mut map = Map::new();
+    for attribute in attributes {
+        map.insert(attribute.key.clone(), any_value_json(attribute.value.as_ref()));
+    }
+    Value::Object(map)
+}
+
+fn any_value_json(value: Option<&AnyValue>) -> Value {
+    match value.and_then(|v| v.value.as_ref()) {
+        Some(any_value::Value::StringValue(s)) => json!(s),
+        Some(any_value::Value::BoolValue(b)) => json!(b),
+        Some(any_value::Value::IntValue(i)) => json!(i),
+        Some(any_value::Value::DoubleValue(d)) => json!(d),
+        Some(any_value::Value::BytesValue(bytes)) => json!(hex(bytes)),
+        Some(any_value::Value::ArrayValue(array)) => {
+            Value::Array(array.values.iter().map(|v| any_value_json(Some(v))).collect())
+        }
+        Some(any_value::Value::KvlistValue(list)) => attributes_json(&list.values),
+        None => Value::Null,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::otel::{string_attribute, LogRecord, Resource, ScopeLogs, ScopeSpans, Span, Status};
+
+    #[test]
+    fn test_span_lines() {
+        let resource_spans = vec![ResourceSpans {
+            resource: Some(Resource {
+                attributes: vec![string_attribute("service.name", "checkout".to_string())],
+                ..Default::default()
+            }),
+            scope_spans: vec![ScopeSpans {
+                spans: vec![
+                    Span {
+                        trace_id: vec![0xab; 16],
+                        span_id: vec![0x01; 8],
+                        name: "GET /orders".to_string(),
+                        kind: 2,
+                        start_time_unix_nano: 1_000,
+                        end_time_unix_nano: 2_000,
+                        attributes: vec![string_attribute("http.request.body", "{\"id\":1}".to_string())],
+                        status: Some(Status { code: 2, message: "boom".to_string() }),
+                        ..Default::default()
+                    },
+                    Span {
+                        span_id: vec![0x02; 8],
+                        parent_span_id: vec![0x01; 8],
+                        ..Default::default()
+                    },
+                ],
+                ..Default::default()
+            }],
+            ..Default::default()
+        }];
+
+        let lines = span_lines(&resource_spans);
+        assert_eq!(lines.len(), 2);
+        assert!(lines.iter().all(|line| !line.contains('\n')));
+
+        let first: Value = serde_json::from_str(&lines[0]).unwrap();
+        assert_eq!(first["resource"]["service.name"], "checkout");
+        assert_eq!(first["traceId"], "ab".repeat(16));
+        assert_eq!(first["spanId"], "0101010101010101");
+        assert_eq!(first["startTimeUnixNano"], "1000");
+        assert_eq!(first["attributes"]["http.request.body"], "{\"id\":1}");
+        assert_eq!(first["status"]["message"], "boom");
+        assert!(first.get("parentSpanId").is_none());
+
+        let second: Value = serde_json::from_str(&lines[1]).unwrap();
+        assert_eq!(second["parentSpanId"], "0101010101010101");
+    }
+
+    #[test]
+    fn test_log_lines() {
+        let resource_logs = vec![ResourceLogs {
+            scope_logs: vec![ScopeLogs {
+                log_records: vec![LogRecord {
+                    trace_id: vec![0xab; 16],
+                    span_id: vec![0x01; 8],
+                    time_unix_nano: 1_000,
+                    event_name: "http.request.body".to_string(),
+                    body: Some(AnyValue {
+                        value: Some(any_value::Value::StringValue("{\"id\":1}".to_string())),
+                    }),
+                    attributes: vec![string_attribute("sp.request.id", "r-1".to_string())],
+                    ..Default::default()
+                }],
+                ..Default::default()
+            }],
+            ..Default::default()
+        }];
+
+        let lines = log_lines(&resource_logs);
+        assert_eq!(lines.len(), 1);
+        let line: Value = serde_json::from_str(&lines[0]).unwrap();
+        assert_eq!(line["eventName"], "http.request.body");
+        assert_eq!(line["spanId"], "0101010101010101");
+        assert_eq!(line["timeUnixNano"], "1000");
+        assert_eq!(line["body"], "{\"id\":1}");
+        assert_eq!(line["attributes"]["sp.request.id"], "r-1");
+    }
+}
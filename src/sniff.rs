@@ -0,0 +1,112 @@
+// Content-type sniffing for bodies that arrive without a content-type header
+//
+// A cut-down version of the WHATWG MIME sniffing that Go's http.DetectContentType
+// implements: only the first SNIFF_LEN bytes are looked at. Leading whitespace is
+// skipped before matching markup and JSON, then a few binary signatures are checked,
+// and anything left is text unless it holds control bytes that never appear in text.
+
+/// Bytes of the body considered
+pub const SNIFF_LEN: usize = 512;
+
+/// Markup that makes a `<` document HTML rather than XML; matched case-insensitively and
+/// followed by a space or `>`
+const HTML_TAGS: &[&[u8]] = &[
+    b"<!doctype html", b"<html", b"<head", b"<script", b"<iframe", b"<h1", b"<div", b"<font", b"<table", b"<a",
+    b"<style", b"<title", b"<b", b"<body", b"<br", b"<p", b"<!--",
+];
+
+const SIGNATURES: &[(&[u8], &str)] = &[
+    (b"%PDF-", "application/pdf"),
+    (b"\x89PNG\r\n\x1a\n", "image/png"),
+    (b"GIF87a", "image/gif"),
+    (b"GIF89a", "image/gif"),
+    (b"\xff\xd8\xff", "image/jpeg"),
+    (b"\x1f\x8b\x08", "application/x-gzip"),
+    (b"PK\x03\x04", "application/zip"),
+];
+
+/// Media type of a body, judged from its first SNIFF_LEN bytes
+pub fn sniff(body: &[u8]) -> &'static str {
+    let head = &body[..body.len().min(SNIFF_LEN)];
+    let start = head.iter().position(|b| !matches!(b, b'\t' | b'\n' | b'\x0c' | b'\r' | b' ')).unwrap_or(head.len());
+    let trimmed = &head[start..];
+
+    match trimmed.first() {
+        Some(b'{') | Some(b'[') => return "application/json",
+        Some(b'<') if trimmed.starts_with(b"<?xml") => return "text/xml",
+        Some(b'<') if HTML_TAGS.iter().any(|tag| html_tag_at(trimmed, tag)) => return "text/html",
+        Some(b'<') => return "text/xml",
+        _ => {}
+    }
+    if let Some((_, media_type)) = SIGNATURES.iter().find(|(signature, _)| head.starts_with(signature)) {
+        return media_type;
+    }
+    if head.iter().any(|b| is_binary_byte(*b)) {
+        "application/octet-stream"
+    } else {
+        "text/plain"
+    }
+}
+
+/// Whether a sniffed media type is captured as text rather than base64
+pub fn is_text(media_type: &str) -> bool {
+    media_type.starts_with("text/") || media_type == "application/json"
+}
+
+fn html_tag_at(data: &[u8], tag: &[u8]) -> bool {
+    data.len() > tag.len()
+        && data[..tag.len()].eq_ignore_ascii_case(tag)
+        && matches!(data[tag.len()], b' ' | b'>')
+}
+
+/// Control bytes that do not occur in text (WHATWG "binary data byte")
+fn is_binary_byte(b: u8) -> bool {
+    matches!(b, 0x00..=0x08 | 0x0b | 0x0e..=0x1a | 0x1c..=0x1f)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_sniff_structured_text() {
+        assert_eq!(sniff(b"  {\"id\": 1}"), "application/json");
+        assert_eq!(sniff(b"\n[1, 2]"), "application/json");
+        assert_eq!(sniff(b"<?xml version=\"1.0\"?><a/>"), "text/xml");
+        assert_eq!(sniff(b"<order><id>1</id></order>"), "text/xml");
+        assert_eq!(sniff(b"<!DOCTYPE HTML><html>"), "text/html");
+        assert_eq!(sniff(b"\r\n<html lang=\"en\">"), "text/html");
+        // A tag name that merely starts like an HTML one is XML
+        assert_eq!(sniff(b"<brand>x</brand>"), "text/xml");
+    }
+
+    #[test]
+    fn test_sniff_binary_signatures() {
+        assert_eq!(sniff(b"%PDF-1.7\n"), "application/pdf");
+        assert_eq!(sniff(b"\x89PNG\r\n\x1a\n\x00\x00"), "image/png");
+        assert_eq!(sniff(b"\x1f\x8b\x08\x00\x00"), "application/x-gzip");
+        assert_eq!(sniff(b"\x00\x01\x02\x03"), "application/octet-stream");
+    }
+
+    #[test]
+    fn test_sniff_plain_text() {
+        assert_eq!(sniff(b"hello, world\n"), "text/plain");
+        assert_eq!(sniff("héllo".as_bytes()), "text/plain");
+        assert_eq!(sniff(b""), "text/plain");
+    }
+
+    #[test]
+    fn test_sniff_only_reads_prefix() {
+        let mut body = vec![b'a'; SNIFF_LEN];
+        body.push(0x00);
+        assert_eq!(sniff(&body), "text/plain");
+    }
+
+    #[test]
+    fn test_is_text() {
+        assert!(is_text("application/json"));
+        assert!(is_text("text/html"));
+        assert!(!is_text("application/octet-stream"));
+        assert!(!is_text("image/png"));
+    }
+}
@@ -0,0 +1,102 @@
+// OTLP span events for notable response header transitions (captureSpanEvents)
+//
+// A redirect (3xx with Location) and an auth challenge (401 with WWW-Authenticate) are
+// recorded as events on the extract span, stamped with the response headers callback, so
+// the backend shows them on the exchange's timeline with the header that caused them.
+// Header values matching redactHeaders are redacted, as they are in span attributes.
+
+use std::collections::HashMap;
+
+use crate::headers::{matches_name_pattern, REDACTED_VALUE};
+use crate::otel::{int_attribute, span, string_attribute};
+
+pub const REDIRECT: &str = "redirect";
+pub const AUTH_CHALLENGE: &str = "auth_challenge";
+
+/// Events for a response's headers, all at `time_unix_nano`
+pub fn from_response_headers(
+    response_headers: &HashMap<String, String>,
+    redact_patterns: &[String],
+    time_unix_nano: u64,
+) -> Vec<span::Event> {
+    let status = match response_headers.get(":status").and_then(|s| s.parse::<i64>().ok()) {
+        Some(status) => status,
+        None => return Vec::new(),
+    };
+    let trigger = match status {
+        300..=399 => Some((REDIRECT, "location")),
+        401 => Some((AUTH_CHALLENGE, "www-authenticate")),
+        _ => None,
+    };
+
+    trigger
+        .and_then(|(name, header)| {
+            let value = response_headers.get(header)?;
+            let value = if redact_patterns.iter().any(|pattern| matches_name_pattern(header, pattern)) {
+                REDACTED_VALUE.to_string()
+            } else {
+                value.clone()
+            };
+            Some(span::Event {
+                time_unix_nano,
+                name: name.to_string(),
+                attributes: vec![
+                    int_attribute(crate::semconv::HTTP_STATUS_CODE, status),
+                    string_attribute(&format!("http.response.header.{}", header), value),
+                ],
+                ..Default::default()
+            })
+        })
+        .into_iter()
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn headers(pairs: &[(&str, &str)]) -> HashMap<String, String> {
+        pairs.iter().map(|(k, v)| (k.to_string(), v.to_string())).collect()
+    }
+
+    fn attribute_keys(event: &span::Event) -> Vec<&str> {
+        event.attributes.iter().map(|kv| kv.key.as_str()).collect()
+    }
+
+    #[test]
+    fn test_redirect_and_auth_challenge_events() {
+        let events = from_response_headers(&headers(&[(":status", "302"), ("location", "/login")]), &[], 42);
+        assert_eq!(events.len(), 1);
+        assert_eq!((events[0].name.as_str(), events[0].time_unix_nano), (REDIRECT, 42));
+        assert_eq!(attribute_keys(&events[0]), vec![crate::semconv::HTTP_STATUS_CODE, "http.response.header.location"]);
+
+        let challenge = headers(&[(":status", "401"), ("www-authenticate", "Bearer realm=\"api\"")]);
+        let events = from_response_headers(&challenge, &[], 7);
+        assert_eq!(events[0].name, AUTH_CHALLENGE);
+        assert_eq!(attribute_keys(&events[0])[1], "http.response.header.www-authenticate");
+    }
+
+    #[test]
+    fn test_no_event_without_the_header_or_status() {
+        for pairs in [
+            &[(":status", "304")][..],
+            &[(":status", "401")][..],
+            &[(":status", "200"), ("location", "/elsewhere")][..],
+            &[(":status", "403"), ("www-authenticate", "Basic")][..],
+            &[("location", "/elsewhere")][..],
+        ] {
+            assert!(from_response_headers(&headers(pairs), &[], 1).is_empty(), "{:?}", pairs);
+        }
+    }
+
+    #[test]
+    fn test_redacted_header_value() {
+        let events = from_response_headers(
+            &headers(&[(":status", "307"), ("location", "/callback?token=abc")]),
+            &["Location".to_string()],
+            1,
+        );
+        let value = events[0].attributes[1].value.as_ref().and_then(|v| v.value.as_ref());
+        assert_eq!(value, Some(&crate::otel::any_value::Value::StringValue(REDACTED_VALUE.to_string())));
+    }
+}
@@ -0,0 +1,113 @@
+// OTLP span links for fan-in requests (batch and aggregation endpoints), read from the
+// headers listed in linkHeaders
+//
+//   x-sp-links: 00-<trace id>-<span id>-01;batch.index=0, 00-<trace id>-<span id>-00
+//
+// A header holds comma-separated entries. Each is a traceparent value, optionally
+// followed by `;key=value` link attributes. Entries whose traceparent does not validate
+// are skipped; valid entries past maxSpanLinks are counted as dropped links.
+
+use std::collections::HashMap;
+
+use crate::otel::{span, string_attribute};
+use crate::trace_context::parse_traceparent_value;
+
+/// Link flags: the traceparent's trace flags, and the linked context is known remote
+const SPAN_FLAGS_CONTEXT_HAS_IS_REMOTE_MASK: u32 = 0x100;
+const SPAN_FLAGS_CONTEXT_IS_REMOTE_MASK: u32 = 0x200;
+
+/// Links in header order, then entry order, and the number of valid links over the cap
+pub fn parse(request_headers: &HashMap<String, String>, link_headers: &[String], max_links: usize) -> (Vec<span::Link>, u32) {
+    let mut links = Vec::new();
+    let mut dropped = 0u32;
+    for header in link_headers {
+        let value = match request_headers.get(header) {
+            Some(value) => value,
+            None => continue,
+        };
+        for entry in value.split(',').map(str::trim).filter(|entry| !entry.is_empty()) {
+            let link = match parse_entry(entry) {
+                Some(link) => link,
+                None => {
+                    crate::sp_debug!("Skipping malformed span link in {}: {}", header, entry);
+                    continue;
+                }
+            };
+            if links.len() < max_links {
+                links.push(link);
+            } else {
+                dropped = dropped.saturating_add(1);
+            }
+        }
+    }
+    (links, dropped)
+}
+
+fn parse_entry(entry: &str) -> Option<span::Link> {
+    let mut parts = entry.split(';');
+    let traceparent = parts.next()?.trim();
+    let (trace_id, span_id) = parse_traceparent_value(traceparent)?;
+    let trace_flags = u32::from_str_radix(&traceparent[traceparent.len() - 2..], 16).ok()?;
+
+    let mut attributes = Vec::new();
+    for param in parts {
+        let (key, value) = param.split_once('=')?;
+        let key = key.trim();
+        if key.is_empty() {
+            return None;
+        }
+        attributes.push(string_attribute(key, value.trim().to_string()));
+    }
+
+    Some(span::Link {
+        trace_id,
+        span_id,
+        attributes,
+        flags: trace_flags | SPAN_FLAGS_CONTEXT_HAS_IS_REMOTE_MASK | SPAN_FLAGS_CONTEXT_IS_REMOTE_MASK,
+        ..Default::default()
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const FIRST: &str = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01";
+    const SECOND: &str = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00";
+
+    fn headers(pairs: &[(&str, &str)]) -> HashMap<String, String> {
+        pairs.iter().map(|(k, v)| (k.to_string(), v.to_string())).collect()
+    }
+
+    #[test]
+    fn test_parse_links_with_attributes() {
+        let request_headers = headers(&[("x-sp-links", &format!("{};batch.index=0 ; source = queue, {}", FIRST, SECOND))]);
+        let (links, dropped) = parse(&request_headers, &["x-sp-links".to_string()], 8);
+        assert_eq!(dropped, 0);
+        assert_eq!(links.len(), 2);
+        assert_eq!(links[0].span_id, vec![0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7]);
+        assert_eq!(links[0].flags, 0x301);
+        assert_eq!(links[1].flags, 0x300);
+        let keys: Vec<&str> = links[0].attributes.iter().map(|kv| kv.key.as_str()).collect();
+        assert_eq!(keys, vec!["batch.index", "source"]);
+        assert!(links[1].attributes.is_empty());
+    }
+
+    #[test]
+    fn test_parse_skips_malformed_entries() {
+        let bad_id = "00-00000000000000000000000000000000-00f067aa0ba902b7-01";
+        let value = format!("garbage, {}, {};=x, {};noequals, {}", bad_id, FIRST, FIRST, SECOND);
+        let (links, dropped) = parse(&headers(&[("x-sp-links", &value)]), &["x-sp-links".to_string()], 8);
+        assert_eq!((links.len(), dropped), (1, 0));
+    }
+
+    #[test]
+    fn test_parse_caps_links_across_headers() {
+        let request_headers = headers(&[("x-links-a", &format!("{},{}", FIRST, SECOND)), ("x-links-b", FIRST)]);
+        let link_headers = vec!["x-links-a".to_string(), "x-links-b".to_string(), "x-missing".to_string()];
+        let (links, dropped) = parse(&request_headers, &link_headers, 2);
+        assert_eq!((links.len(), dropped), (2, 1));
+        let (links, dropped) = parse(&request_headers, &link_headers, 0);
+        assert_eq!((links.len(), dropped), (0, 3));
+    }
+}
@@ -0,0 +1,121 @@
+// Low-cardinality span names from spanNameTemplate
+//
+// A request whose Envoy route has a configured template is named by it, e.g.
+// `GET /users/{id}`. Otherwise the path (query string dropped) has each segment that
+// fully matches a segment pattern replaced, so `/users/123` becomes `/users/{id}`.
+
+use std::collections::HashMap;
+
+use regex::Regex;
+
+/// Replaces a whole path segment matching `regex` with `replacement`
+#[derive(Debug, Clone)]
+pub struct SegmentPattern {
+    pub regex: Regex,
+    pub replacement: String,
+}
+
+#[derive(Debug, Clone)]
+pub struct SpanNameTemplate {
+    pub routes: HashMap<String, String>,  // Envoy route name -> span name
+    pub segment_patterns: Vec<SegmentPattern>,
+}
+
+/// UUIDs to {uuid}, then all-digit segments to {id}
+pub fn default_segment_patterns() -> Vec<SegmentPattern> {
+    let pattern = |regex: &str, replacement: &str| SegmentPattern {
+        regex: Regex::new(regex).expect("built-in segment pattern"),
+        replacement: replacement.to_string(),
+    };
+    vec![
+        pattern("^(?i)[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$", "{uuid}"),
+        pattern("^[0-9]+$", "{id}"),
+    ]
+}
+
+impl SpanNameTemplate {
+    /// Span name and http.route for a request. The route drops the method prefix of the
+    /// name, so `GET /users/{id}` is recorded as route `/users/{id}`.
+    pub fn resolve(&self, method: Option<&str>, route_name: Option<&str>, path: &str) -> (String, String) {
+        if let Some(template) = route_name.and_then(|name| self.routes.get(name)) {
+            let route = match template.split_once(' ') {
+                Some((_, route)) if route.starts_with('/') => route.to_string(),
+                _ => template.clone(),
+            };
+            return (template.clone(), route);
+        }
+
+        let route = self.collapse_path(path);
+        let name = match method {
+            Some(method) if !method.is_empty() => format!("{} {}", method, route),
+            _ => route.clone(),
+        };
+        (name, route)
+    }
+
+    fn collapse_path(&self, path: &str) -> String {
+        let path = path.split(['?', '#']).next().unwrap_or("");
+        path.split('/')
+            .map(|segment| {
+                self.segment_patterns
+                    .iter()
+                    .find(|pattern| !segment.is_empty() && pattern.regex.is_match(segment))
+                    .map_or(segment, |pattern| pattern.replacement.as_str())
+            })
+            .collect::<Vec<_>>()
+            .join("/")
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn template() -> SpanNameTemplate {
+        let mut routes = HashMap::new();
+        routes.insert("users-get".to_string(), "GET /users/{id}".to_string());
+        routes.insert("health".to_string(), "healthcheck".to_string());
+        SpanNameTemplate {
+            routes,
+            segment_patterns: default_segment_patterns(),
+        }
+    }
+
+    #[test]
+    fn test_resolve_from_route_name() {
+        let template = template();
+        assert_eq!(
+            template.resolve(Some("GET"), Some("users-get"), "/users/123"),
+            ("GET /users/{id}".to_string(), "/users/{id}".to_string())
+        );
+        assert_eq!(
+            template.resolve(Some("GET"), Some("health"), "/healthz"),
+            ("healthcheck".to_string(), "healthcheck".to_string())
+        );
+    }
+
+    #[test]
+    fn test_resolve_collapses_ids() {
+        let template = template();
+        assert_eq!(
+            template.resolve(Some("GET"), Some("unmapped"), "/users/123/orders/550E8400-e29b-41d4-a716-446655440000?expand=1"),
+            ("GET /users/{id}/orders/{uuid}".to_string(), "/users/{id}/orders/{uuid}".to_string())
+        );
+        assert_eq!(
+            template.resolve(None, None, "/v2/items/"),
+            ("/v2/items/".to_string(), "/v2/items/".to_string())
+        );
+    }
+
+    #[test]
+    fn test_resolve_custom_segment_patterns() {
+        let template = SpanNameTemplate {
+            routes: HashMap::new(),
+            segment_patterns: vec![SegmentPattern {
+                regex: Regex::new("^[a-z]{2}-[A-Z]{2}$").unwrap(),
+                replacement: "{locale}".to_string(),
+            }],
+        };
+        assert_eq!(template.resolve(Some("GET"), None, "/en-US/docs/42").0, "GET /{locale}/docs/42");
+    }
+}
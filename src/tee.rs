@@ -0,0 +1,165 @@
+// Tee mirror: a copy of each captured request, body included, POSTed to a capture
+// endpoint for traffic replay pipelines
+//
+// Separate from span export on purpose: its own URL and Envoy cluster, no queue, no
+// retries and no circuit breaker. The call is fire-and-forget; its response is never
+// read and the live request never waits on it. Mirrors go through the same capture
+// caps and redaction as span bodies, and through their own shared token bucket, so a
+// busy tee is throttled without touching span export (perTenantExportRate).
+
+use std::time::Duration;
+
+use proxy_wasm::traits::Context;
+use url::Url;
+
+use crate::http_helpers::{get_backend_authority, get_backend_cluster_name};
+
+/// Shared-data key of the tee's token bucket
+const BUCKET_KEY: &str = "sp.tee.bucket";
+/// Short, since nothing waits on the answer
+const TEE_TIMEOUT: Duration = Duration::from_secs(2);
+
+pub const DEFAULT_RATE_PER_SEC: f64 = 10.0;
+
+#[derive(Debug, Clone, PartialEq)]
+pub struct TeeConfig {
+    pub url: String,
+    pub rate_per_sec: f64,
+    pub burst: u64,  // 0: one second's worth of mirrors
+}
+
+impl TeeConfig {
+    fn burst(&self) -> f64 {
+        if self.burst > 0 {
+            self.burst as f64
+        } else {
+            self.rate_per_sec.ceil().max(1.0)
+        }
+    }
+}
+
+/// The original request as the capture endpoint sees it
+pub struct Mirror<'a> {
+    pub method: &'a str,
+    pub path: &'a str,
+    pub host: &'a str,
+    pub content_type: Option<&'a str>,
+    pub session_id: &'a str,
+    pub trace_id: &'a str,
+    pub body: &'a [u8],
+    pub truncated: bool,  // The body was cut at maxRequestBodyBytes
+}
+
+/// Path and query of the tee URL, "/" when it has none
+fn request_path(tee_url: &str) -> String {
+    match Url::parse(tee_url) {
+        Ok(url) => match url.query() {
+            Some(query) => format!("{}?{}", url.path(), query),
+            None => url.path().to_string(),
+        },
+        Err(_) => "/".to_string(),
+    }
+}
+
+/// Headers of the mirror POST; the original request line travels in x-sp-tee-* headers
+fn mirror_headers<'a>(authority: &'a str, path: &'a str, content_length: &'a str, mirror: &Mirror<'a>) -> Vec<(&'a str, &'a str)> {
+    let mut headers = vec![
+        (":method", "POST"),
+        (":path", path),
+        (":authority", authority),
+        ("content-type", mirror.content_type.unwrap_or("application/octet-stream")),
+        ("content-length", content_length),
+        ("x-sp-tee-method", mirror.method),
+        ("x-sp-tee-path", mirror.path),
+        ("x-sp-tee-host", mirror.host),
+        ("x-sp-trace-id", mirror.trace_id),
+    ];
+    if !mirror.session_id.is_empty() {
+        headers.push(("x-sp-session-id", mirror.session_id));
+    }
+    if mirror.truncated {
+        headers.push(("x-sp-tee-truncated", "true"));
+    }
+    headers
+}
+
+/// Send one mirror unless the tee is over its rate. Failures are counted and logged,
+/// never surfaced to the exchange.
+pub fn send(ctx: &dyn Context, tee: &TeeConfig, dry_run: bool, now_ms: u64, mirror: &Mirror) {
+    if !crate::ratelimit::allow_keyed(ctx, BUCKET_KEY, now_ms, tee.rate_per_sec, tee.burst()) {
+        crate::sp_debug!("Tee is over its rate, not mirroring {} {}", mirror.method, mirror.path);
+        crate::metrics::increment_counter(crate::metrics::TEE_RATELIMITED_TOTAL, 1);
+        return;
+    }
+
+    if dry_run {
+        crate::sp_info!(
+            "Dry run: would mirror {} {} ({} body bytes) to {}",
+            mirror.method,
+            mirror.path,
+            mirror.body.len(),
+            tee.url
+        );
+        return;
+    }
+
+    let authority = get_backend_authority(&tee.url);
+    let path = request_path(&tee.url);
+    let content_length = mirror.body.len().to_string();
+    let headers = mirror_headers(&authority, &path, &content_length, mirror);
+    match ctx.dispatch_http_call(&get_backend_cluster_name(&tee.url), headers, Some(mirror.body), vec![], TEE_TIMEOUT) {
+        Ok(token) => {
+            crate::sp_debug!("Mirrored {} {} to tee (token={})", mirror.method, mirror.path, token);
+            crate::metrics::increment_counter(crate::metrics::TEE_SENT_TOTAL, 1);
+        }
+        Err(status) => {
+            crate::sp_warn!("Failed to mirror request to tee {}: {:?}", tee.url, status);
+            crate::metrics::increment_counter(crate::metrics::TEE_FAILED_TOTAL, 1);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_request_path() {
+        assert_eq!(request_path("http://replay.internal:9000/ingest?src=edge"), "/ingest?src=edge");
+        assert_eq!(request_path("https://replay.internal"), "/");
+        assert_eq!(request_path("not a url"), "/");
+    }
+
+    #[test]
+    fn test_mirror_headers() {
+        let mirror = Mirror {
+            method: "PUT",
+            path: "/orders/7",
+            host: "shop",
+            content_type: Some("application/json"),
+            session_id: "",
+            trace_id: "4bf92f3577b34da6a3ce929d0e0e4736",
+            body: b"{}",
+            truncated: false,
+        };
+        let headers = mirror_headers("replay.internal", "/ingest", "2", &mirror);
+        assert!(headers.contains(&(":method", "POST")));
+        assert!(headers.contains(&("content-type", "application/json")));
+        assert!(headers.contains(&("x-sp-tee-method", "PUT")));
+        assert!(headers.contains(&("x-sp-tee-path", "/orders/7")));
+        assert!(!headers.iter().any(|(name, _)| *name == "x-sp-session-id"));
+        assert!(!headers.iter().any(|(name, _)| *name == "x-sp-tee-truncated"));
+
+        let truncated = Mirror { truncated: true, ..mirror };
+        let headers = mirror_headers("replay.internal", "/ingest", "2", &truncated);
+        assert!(headers.contains(&("x-sp-tee-truncated", "true")));
+    }
+
+    #[test]
+    fn test_burst_defaults_to_one_second() {
+        let mut tee = TeeConfig { url: "http://replay".to_string(), rate_per_sec: 2.5, burst: 0 };
+        assert_eq!(tee.burst(), 3.0);
+        tee.burst = 40;
+        assert_eq!(tee.burst(), 40.0);
+    }
+}
@@ -0,0 +1,698 @@
+// In-process proxy-wasm host for unit tests
+//
+// Defines the proxy_* hostcalls the SDK imports, backed by per-thread state, so a test can
+// drive SpHttpContext callbacks natively: it sets the headers, body chunks and properties
+// Envoy would expose, invokes the callbacks, and then inspects what the filter did (headers
+// it injected, metrics, shared data and the export calls it dispatched). The test harness
+// runs every test on a fresh thread, so each starts with an empty host and exporter.
+//
+// Buffers handed back to the SDK are allocated here as boxed slices, which is what the SDK
+// frees them as. Missing header values and buffers come back as Ok with a null pointer, as
+// from Envoy; missing properties and shared data are NotFound.
+
+// Helpers not every test uses yet are kept for the next one
+#![allow(dead_code, clippy::missing_safety_doc)]
+
+use std::cell::RefCell;
+use std::collections::HashMap;
+use std::ptr::null_mut;
+use std::time::Duration;
+
+use proxy_wasm::types::{BufferType, LogLevel, MapType, MetricType, Status, StreamType};
+
+use crate::otel::{Span, TracesData};
+
+// 2023-11-14T22:13:20Z; any fixed instant works, tests only compare relative times
+const START_TIME_NANOS: u64 = 1_700_000_000_000_000_000;
+
+/// A dispatch_http_call the filter made
+#[derive(Debug, Clone)]
+pub struct HttpCall {
+    pub upstream: String,
+    pub headers: Vec<(String, String)>,
+    pub body: Vec<u8>,
+    pub timeout_ms: u32,
+}
+
+impl HttpCall {
+    pub fn header(&self, name: &str) -> Option<&str> {
+        self.headers.iter().find(|(k, _)| k.eq_ignore_ascii_case(name)).map(|(_, v)| v.as_str())
+    }
+}
+
+/// A send_http_response the filter made
+#[derive(Debug, Clone)]
+pub struct LocalResponse {
+    pub status_code: u32,
+    pub headers: Vec<(String, String)>,
+    pub body: Vec<u8>,
+}
+
+struct Host {
+    time_nanos: u64,
+    maps: HashMap<u32, Vec<(String, String)>>,
+    buffers: HashMap<u32, Vec<u8>>,
+    properties: HashMap<Vec<String>, Vec<u8>>,
+    shared_data: HashMap<String, (Vec<u8>, u32)>,
+    metrics: Vec<(String, i64)>,  // Metric ids are indexes
+    http_calls: Vec<HttpCall>,
+    local_response: Option<LocalResponse>,
+}
+
+impl Default for Host {
+    fn default() -> Self {
+        Self {
+            time_nanos: START_TIME_NANOS,
+            maps: HashMap::new(),
+            buffers: HashMap::new(),
+            properties: HashMap::new(),
+            shared_data: HashMap::new(),
+            metrics: Vec::new(),
+            http_calls: Vec::new(),
+            local_response: None,
+        }
+    }
+}
+
+thread_local! {
+    static HOST: RefCell<Host> = RefCell::new(Host::default());
+}
+
+fn with_host<T>(f: impl FnOnce(&mut Host) -> T) -> T {
+    HOST.with(|host| f(&mut host.borrow_mut()))
+}
+
+fn to_pairs(pairs: &[(&str, &str)]) -> Vec<(String, String)> {
+    pairs.iter().map(|(k, v)| (k.to_string(), v.to_string())).collect()
+}
+
+pub fn set_request_headers(headers: &[(&str, &str)]) {
+    with_host(|host| host.maps.insert(MapType::HttpRequestHeaders as u32, to_pairs(headers)));
+}
+
+/// Request headers as the filter left them, including anything it injected
+pub fn request_headers() -> Vec<(String, String)> {
+    with_host(|host| host.maps.get(&(MapType::HttpRequestHeaders as u32)).cloned().unwrap_or_default())
+}
+
+pub fn request_header(name: &str) -> Option<String> {
+    request_headers().into_iter().find(|(k, _)| k.eq_ignore_ascii_case(name)).map(|(_, v)| v)
+}
+
+pub fn set_response_headers(headers: &[(&str, &str)]) {
+    with_host(|host| host.maps.insert(MapType::HttpResponseHeaders as u32, to_pairs(headers)));
+}
+
+/// Response headers as the filter left them, i.e. what goes downstream to the client
+pub fn response_headers() -> Vec<(String, String)> {
+    with_host(|host| host.maps.get(&(MapType::HttpResponseHeaders as u32)).cloned().unwrap_or_default())
+}
+
+pub fn response_header(name: &str) -> Option<String> {
+    response_headers().into_iter().find(|(k, _)| k.eq_ignore_ascii_case(name)).map(|(_, v)| v)
+}
+
+pub fn set_response_trailers(trailers: &[(&str, &str)]) {
+    with_host(|host| host.maps.insert(MapType::HttpResponseTrailers as u32, to_pairs(trailers)));
+}
+
+/// The request body chunk the next on_http_request_body call sees
+pub fn set_request_body(chunk: &[u8]) {
+    with_host(|host| host.buffers.insert(BufferType::HttpRequestBody as u32, chunk.to_vec()));
+}
+
+/// The response body chunk the next on_http_response_body call sees
+pub fn set_response_body(chunk: &[u8]) {
+    with_host(|host| host.buffers.insert(BufferType::HttpResponseBody as u32, chunk.to_vec()));
+}
+
+pub fn set_plugin_configuration(config: &[u8]) {
+    with_host(|host| host.buffers.insert(BufferType::PluginConfiguration as u32, config.to_vec()));
+}
+
+pub fn set_property(path: &[&str], value: &[u8]) {
+    let path = path.iter().map(|p| p.to_string()).collect();
+    with_host(|host| host.properties.insert(path, value.to_vec()));
+}
+
+pub fn advance_time(by: Duration) {
+    with_host(|host| host.time_nanos += by.as_nanos() as u64);
+}
+
+/// Current value of a metric, None if the filter never defined it
+pub fn metric(name: &str) -> Option<i64> {
+    with_host(|host| host.metrics.iter().find(|(n, _)| n == name).map(|(_, v)| *v))
+}
+
+pub fn shared_data(key: &str) -> Option<Vec<u8>> {
+    with_host(|host| host.shared_data.get(key).map(|(value, _)| value.clone()))
+}
+
+pub fn http_calls() -> Vec<HttpCall> {
+    with_host(|host| host.http_calls.clone())
+}
+
+pub fn local_response() -> Option<LocalResponse> {
+    with_host(|host| host.local_response.clone())
+}
+
+/// Every span in the OTLP trace exports dispatched so far, in order
+pub fn exported_spans() -> Vec<Span> {
+    use prost::Message;
+
+    http_calls()
+        .iter()
+        .filter(|call| call.header(":path").map_or(false, |path| path.ends_with("/v1/traces")))
+        .flat_map(|call| TracesData::decode(call.body.as_slice()).expect("export payload is not TracesData").resource_spans)
+        .flat_map(|resource_spans| resource_spans.scope_spans)
+        .flat_map(|scope_spans| scope_spans.spans)
+        .collect()
+}
+
+/// A span attribute's value as a string, None if the attribute is absent
+pub fn span_attribute(span: &Span, key: &str) -> Option<String> {
+    use crate::otel::any_value::Value;
+
+    let value = span.attributes.iter().find(|kv| kv.key == key)?.value.as_ref()?.value.as_ref()?;
+    Some(match value {
+        Value::StringValue(s) => s.clone(),
+        Value::BoolValue(b) => b.to_string(),
+        Value::IntValue(i) => i.to_string(),
+        Value::DoubleValue(d) => d.to_string(),
+        other => format!("{:?}", other),
+    })
+}
+
+// Wire formats shared with the SDK
+
+fn serialize_map(map: &[(String, String)]) -> Vec<u8> {
+    let mut bytes = Vec::new();
+    bytes.extend_from_slice(&(map.len() as u32).to_le_bytes());
+    for (name, value) in map {
+        bytes.extend_from_slice(&(name.len() as u32).to_le_bytes());
+        bytes.extend_from_slice(&(value.len() as u32).to_le_bytes());
+    }
+    for (name, value) in map {
+        bytes.extend_from_slice(name.as_bytes());
+        bytes.push(0);
+        bytes.extend_from_slice(value.as_bytes());
+        bytes.push(0);
+    }
+    bytes
+}
+
+fn deserialize_map(bytes: &[u8]) -> Vec<(String, String)> {
+    if bytes.len() < 4 {
+        return Vec::new();
+    }
+    let count = u32::from_le_bytes(bytes[0..4].try_into().unwrap()) as usize;
+    let mut sizes = Vec::with_capacity(count);
+    for n in 0..count {
+        let at = 4 + n * 8;
+        let name_len = u32::from_le_bytes(bytes[at..at + 4].try_into().unwrap()) as usize;
+        let value_len = u32::from_le_bytes(bytes[at + 4..at + 8].try_into().unwrap()) as usize;
+        sizes.push((name_len, value_len));
+    }
+    let mut at = 4 + count * 8;
+    let mut map = Vec::with_capacity(count);
+    for (name_len, value_len) in sizes {
+        let name = String::from_utf8_lossy(&bytes[at..at + name_len]).to_string();
+        at += name_len + 1;
+        let value = String::from_utf8_lossy(&bytes[at..at + value_len]).to_string();
+        at += value_len + 1;
+        map.push((name, value));
+    }
+    map
+}
+
+unsafe fn slice<'a>(data: *const u8, size: usize) -> &'a [u8] {
+    if data.is_null() || size == 0 {
+        &[]
+    } else {
+        std::slice::from_raw_parts(data, size)
+    }
+}
+
+unsafe fn string(data: *const u8, size: usize) -> String {
+    String::from_utf8_lossy(slice(data, size)).to_string()
+}
+
+/// Hand bytes to the SDK, which takes ownership and frees them
+unsafe fn give(value: Option<Vec<u8>>, return_data: *mut *mut u8, return_size: *mut usize) {
+    match value {
+        Some(value) => {
+            *return_size = value.len();
+            *return_data = Box::into_raw(value.into_boxed_slice()) as *mut u8;
+        }
+        None => {
+            *return_size = 0;
+            *return_data = null_mut();
+        }
+    }
+}
+
+// Hostcalls
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_log(_level: LogLevel, _message_data: *const u8, _message_size: usize) -> Status {
+    Status::Ok
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_get_log_level(return_level: *mut LogLevel) -> Status {
+    *return_level = LogLevel::Trace;
+    Status::Ok
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_get_current_time_nanoseconds(return_time: *mut u64) -> Status {
+    *return_time = with_host(|host| host.time_nanos);
+    Status::Ok
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_set_tick_period_milliseconds(_period: u32) -> Status {
+    Status::Ok
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_get_buffer_bytes(
+    buffer_type: BufferType,
+    start: usize,
+    max_size: usize,
+    return_buffer_data: *mut *mut u8,
+    return_buffer_size: *mut usize,
+) -> Status {
+    let value = with_host(|host| {
+        let buffer = host.buffers.get(&(buffer_type as u32))?;
+        if start >= buffer.len() {
+            return None;
+        }
+        let end = start.saturating_add(max_size).min(buffer.len());
+        Some(buffer[start..end].to_vec())
+    });
+    give(value, return_buffer_data, return_buffer_size);
+    Status::Ok
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_set_buffer_bytes(
+    buffer_type: BufferType,
+    start: usize,
+    size: usize,
+    buffer_data: *const u8,
+    buffer_size: usize,
+) -> Status {
+    let value = slice(buffer_data, buffer_size).to_vec();
+    with_host(|host| {
+        let buffer = host.buffers.entry(buffer_type as u32).or_default();
+        let start = start.min(buffer.len());
+        let end = start.saturating_add(size).min(buffer.len());
+        buffer.splice(start..end, value);
+    });
+    Status::Ok
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_get_header_map_pairs(
+    map_type: MapType,
+    return_map_data: *mut *mut u8,
+    return_map_size: *mut usize,
+) -> Status {
+    let map = with_host(|host| host.maps.get(&(map_type as u32)).cloned().unwrap_or_default());
+    give(Some(serialize_map(&map)), return_map_data, return_map_size);
+    Status::Ok
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_set_header_map_pairs(map_type: MapType, map_data: *const u8, map_size: usize) -> Status {
+    let map = deserialize_map(slice(map_data, map_size));
+    with_host(|host| host.maps.insert(map_type as u32, map));
+    Status::Ok
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_get_header_map_value(
+    map_type: MapType,
+    key_data: *const u8,
+    key_size: usize,
+    return_value_data: *mut *mut u8,
+    return_value_size: *mut usize,
+) -> Status {
+    let key = string(key_data, key_size);
+    let value = with_host(|host| {
+        host.maps
+            .get(&(map_type as u32))
+            .and_then(|map| map.iter().find(|(k, _)| k.eq_ignore_ascii_case(&key)))
+            .map(|(_, v)| v.clone().into_bytes())
+    });
+    give(value, return_value_data, return_value_size);
+    Status::Ok
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_replace_header_map_value(
+    map_type: MapType,
+    key_data: *const u8,
+    key_size: usize,
+    value_data: *const u8,
+    value_size: usize,
+) -> Status {
+    let (key, value) = (string(key_data, key_size), string(value_data, value_size));
+    with_host(|host| {
+        let map = host.maps.entry(map_type as u32).or_default();
+        map.retain(|(k, _)| !k.eq_ignore_ascii_case(&key));
+        map.push((key, value));
+    });
+    Status::Ok
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_remove_header_map_value(map_type: MapType, key_data: *const u8, key_size: usize) -> Status {
+    let key = string(key_data, key_size);
+    with_host(|host| {
+        if let Some(map) = host.maps.get_mut(&(map_type as u32)) {
+            map.retain(|(k, _)| !k.eq_ignore_ascii_case(&key));
+        }
+    });
+    Status::Ok
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_add_header_map_value(
+    map_type: MapType,
+    key_data: *const u8,
+    key_size: usize,
+    value_data: *const u8,
+    value_size: usize,
+) -> Status {
+    let (key, value) = (string(key_data, key_size), string(value_data, value_size));
+    with_host(|host| host.maps.entry(map_type as u32).or_default().push((key, value)));
+    Status::Ok
+}
+
+fn property_path(bytes: &[u8]) -> Vec<String> {
+    let mut path: Vec<String> = bytes.split(|b| *b == 0).map(|p| String::from_utf8_lossy(p).to_string()).collect();
+    if path.last().map_or(false, |p| p.is_empty()) {
+        path.pop();
+    }
+    path
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_get_property(
+    path_data: *const u8,
+    path_size: usize,
+    return_value_data: *mut *mut u8,
+    return_value_size: *mut usize,
+) -> Status {
+    let path = property_path(slice(path_data, path_size));
+    match with_host(|host| host.properties.get(&path).cloned()) {
+        Some(value) => {
+            give(Some(value), return_value_data, return_value_size);
+            Status::Ok
+        }
+        None => {
+            give(None, return_value_data, return_value_size);
+            Status::NotFound
+        }
+    }
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_set_property(
+    path_data: *const u8,
+    path_size: usize,
+    value_data: *const u8,
+    value_size: usize,
+) -> Status {
+    let path = property_path(slice(path_data, path_size));
+    let value = slice(value_data, value_size).to_vec();
+    with_host(|host| host.properties.insert(path, value));
+    Status::Ok
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_get_shared_data(
+    key_data: *const u8,
+    key_size: usize,
+    return_value_data: *mut *mut u8,
+    return_value_size: *mut usize,
+    return_cas: *mut u32,
+) -> Status {
+    let key = string(key_data, key_size);
+    match with_host(|host| host.shared_data.get(&key).cloned()) {
+        Some((value, cas)) => {
+            give(Some(value), return_value_data, return_value_size);
+            *return_cas = cas;
+            Status::Ok
+        }
+        None => {
+            give(None, return_value_data, return_value_size);
+            Status::NotFound
+        }
+    }
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_set_shared_data(
+    key_data: *const u8,
+    key_size: usize,
+    value_data: *const u8,
+    value_size: usize,
+    cas: u32,
+) -> Status {
+    let key = string(key_data, key_size);
+    let value = slice(value_data, value_size).to_vec();
+    with_host(|host| {
+        let current_cas = host.shared_data.get(&key).map_or(0, |(_, cas)| *cas);
+        if cas != 0 && cas != current_cas {
+            return Status::CasMismatch;
+        }
+        host.shared_data.insert(key, (value, current_cas + 1));
+        Status::Ok
+    })
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_register_shared_queue(_name_data: *const u8, _name_size: usize, return_id: *mut u32) -> Status {
+    *return_id = 1;
+    Status::Ok
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_resolve_shared_queue(
+    _vm_id_data: *const u8,
+    _vm_id_size: usize,
+    _name_data: *const u8,
+    _name_size: usize,
+    _return_id: *mut u32,
+) -> Status {
+    Status::NotFound
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_dequeue_shared_queue(
+    _queue_id: u32,
+    return_value_data: *mut *mut u8,
+    return_value_size: *mut usize,
+) -> Status {
+    give(None, return_value_data, return_value_size);
+    Status::Empty
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_enqueue_shared_queue(_queue_id: u32, _value_data: *const u8, _value_size: usize) -> Status {
+    Status::Ok
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_continue_stream(_stream_type: StreamType) -> Status {
+    Status::Ok
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_close_stream(_stream_type: StreamType) -> Status {
+    Status::Ok
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_send_local_response(
+    status_code: u32,
+    _status_code_details_data: *const u8,
+    _status_code_details_size: usize,
+    body_data: *const u8,
+    body_size: usize,
+    headers_data: *const u8,
+    headers_size: usize,
+    _grpc_status: i32,
+) -> Status {
+    let response = LocalResponse {
+        status_code,
+        headers: deserialize_map(slice(headers_data, headers_size)),
+        body: slice(body_data, body_size).to_vec(),
+    };
+    with_host(|host| host.local_response = Some(response));
+    Status::Ok
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_http_call(
+    upstream_data: *const u8,
+    upstream_size: usize,
+    headers_data: *const u8,
+    headers_size: usize,
+    body_data: *const u8,
+    body_size: usize,
+    _trailers_data: *const u8,
+    _trailers_size: usize,
+    timeout: u32,
+    return_token: *mut u32,
+) -> Status {
+    let call = HttpCall {
+        upstream: string(upstream_data, upstream_size),
+        headers: deserialize_map(slice(headers_data, headers_size)),
+        body: slice(body_data, body_size).to_vec(),
+        timeout_ms: timeout,
+    };
+    *return_token = with_host(|host| {
+        host.http_calls.push(call);
+        host.http_calls.len() as u32
+    });
+    Status::Ok
+}
+
+// gRPC calls are not modelled; the SDK reports the failure to the filter as a dispatch error
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_grpc_call(
+    _upstream_data: *const u8,
+    _upstream_size: usize,
+    _service_name_data: *const u8,
+    _service_name_size: usize,
+    _method_name_data: *const u8,
+    _method_name_size: usize,
+    _initial_metadata_data: *const u8,
+    _initial_metadata_size: usize,
+    _message_data_data: *const u8,
+    _message_data_size: usize,
+    _timeout: u32,
+    _return_callout_id: *mut u32,
+) -> Status {
+    Status::InternalFailure
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_grpc_stream(
+    _upstream_data: *const u8,
+    _upstream_size: usize,
+    _service_name_data: *const u8,
+    _service_name_size: usize,
+    _method_name_data: *const u8,
+    _method_name_size: usize,
+    _initial_metadata_data: *const u8,
+    _initial_metadata_size: usize,
+    _return_stream_id: *mut u32,
+) -> Status {
+    Status::InternalFailure
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_grpc_send(_token: u32, _message_data: *const u8, _message_size: usize, _end_stream: bool) -> Status {
+    Status::NotFound
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_grpc_cancel(_token_id: u32) -> Status {
+    Status::NotFound
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_grpc_close(_token_id: u32) -> Status {
+    Status::NotFound
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_get_status(
+    return_code: *mut u32,
+    return_message_data: *mut *mut u8,
+    return_message_size: *mut usize,
+) -> Status {
+    *return_code = 0;
+    give(None, return_message_data, return_message_size);
+    Status::Ok
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_set_effective_context(_context_id: u32) -> Status {
+    Status::Ok
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_done() -> Status {
+    Status::Ok
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_call_foreign_function(
+    _function_name_data: *const u8,
+    _function_name_size: usize,
+    _arguments_data: *const u8,
+    _arguments_size: usize,
+    return_results_data: *mut *mut u8,
+    return_results_size: *mut usize,
+) -> Status {
+    give(None, return_results_data, return_results_size);
+    Status::NotFound
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_define_metric(
+    _metric_type: MetricType,
+    name_data: *const u8,
+    name_size: usize,
+    return_id: *mut u32,
+) -> Status {
+    let name = string(name_data, name_size);
+    *return_id = with_host(|host| match host.metrics.iter().position(|(n, _)| *n == name) {
+        Some(id) => id as u32,
+        None => {
+            host.metrics.push((name, 0));
+            (host.metrics.len() - 1) as u32
+        }
+    });
+    Status::Ok
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_get_metric(metric_id: u32, return_value: *mut u64) -> Status {
+    match with_host(|host| host.metrics.get(metric_id as usize).map(|(_, v)| *v)) {
+        Some(value) => {
+            *return_value = value as u64;
+            Status::Ok
+        }
+        None => Status::NotFound,
+    }
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_record_metric(metric_id: u32, value: u64) -> Status {
+    with_host(|host| match host.metrics.get_mut(metric_id as usize) {
+        Some(metric) => {
+            metric.1 = value as i64;
+            Status::Ok
+        }
+        None => Status::NotFound,
+    })
+}
+
+#[no_mangle]
+pub unsafe extern "C" fn proxy_increment_metric(metric_id: u32, offset: i64) -> Status {
+    with_host(|host| match host.metrics.get_mut(metric_id as usize) {
+        Some(metric) => {
+            metric.1 += offset;
+            Status::Ok
+        }
+        None => Status::NotFound,
+    })
+}
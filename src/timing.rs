@@ -0,0 +1,247 @@
+// Exchange timestamps for latency analysis: request received, first response byte and
+// response complete, recorded as sp.timing.* attributes in epoch nanoseconds
+//
+// Only the request start reads the wall clock, which NTP can step mid-exchange. The
+// later timestamps are that anchor plus the monotonic time elapsed since, so TTFB and
+// total latency computed from them are true durations whatever the wall clock does.
+// The monotonic clock is WASI clock_time_get, which proxy-wasm hosts provide; if it
+// fails the wall clock stands in, clamped so the timestamps never run backwards.
+//
+// With timestampSource=monotonic-anchored the request start is not read from the wall
+// clock per exchange either: each worker takes one (wall, monotonic) anchor per export
+// batch, and every exchange is placed at the anchor plus its monotonic offset from it.
+
+use std::cell::Cell;
+
+use crate::otel::KeyValue;
+
+pub const REQUEST_START: &str = "sp.timing.request_start";
+pub const TTFB: &str = "sp.timing.ttfb";
+pub const RESPONSE_END: &str = "sp.timing.response_end";
+
+#[cfg(target_arch = "wasm32")]
+mod wasi {
+    const CLOCK_MONOTONIC: u32 = 1;
+
+    #[link(wasm_import_module = "wasi_snapshot_preview1")]
+    extern "C" {
+        fn clock_time_get(id: u32, precision: u64, time: *mut u64) -> u16;
+    }
+
+    pub fn monotonic_nanos() -> Option<u64> {
+        let mut time = 0u64;
+        match unsafe { clock_time_get(CLOCK_MONOTONIC, 1, &mut time) } {
+            0 => Some(time),
+            _ => None,
+        }
+    }
+}
+
+/// Monotonic clock reading in nanoseconds, None when the host cannot provide one
+#[cfg(target_arch = "wasm32")]
+pub fn monotonic_nanos() -> Option<u64> {
+    wasi::monotonic_nanos()
+}
+
+/// Monotonic clock reading in nanoseconds; native builds (tests) use std's clock
+#[cfg(not(target_arch = "wasm32"))]
+pub fn monotonic_nanos() -> Option<u64> {
+    thread_local! {
+        static ORIGIN: std::time::Instant = std::time::Instant::now();
+    }
+    ORIGIN.with(|origin| Some(origin.elapsed().as_nanos() as u64))
+}
+
+thread_local! {
+    // (wall, monotonic) nanos shared by the spans of the current export batch
+    static BATCH_ANCHOR: Cell<Option<(u64, u64)>> = Cell::new(None);
+}
+
+/// This worker's batch anchor, taken from the given readings if there is none yet
+fn batch_anchor(wall_nanos: u64, mono_nanos: u64) -> (u64, u64) {
+    BATCH_ANCHOR.with(|anchor| {
+        let current = anchor.get().unwrap_or((wall_nanos, mono_nanos));
+        anchor.set(Some(current));
+        current
+    })
+}
+
+/// Start a new anchor with the next batch; called whenever a batch is sent
+pub fn reset_batch_anchor() {
+    BATCH_ANCHOR.with(|anchor| anchor.set(None));
+}
+
+/// Epoch nanos of a monotonic reading, relative to an anchor
+fn anchored((anchor_wall, anchor_mono): (u64, u64), mono_nanos: u64) -> u64 {
+    if mono_nanos >= anchor_mono {
+        anchor_wall.saturating_add(mono_nanos - anchor_mono)
+    } else {
+        anchor_wall.saturating_sub(anchor_mono - mono_nanos)
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct ExchangeTimer {
+    request_start: u64,
+    start_mono: Option<u64>,
+    ttfb: Option<u64>,
+    response_end: Option<u64>,
+}
+
+impl ExchangeTimer {
+    pub fn start(wall_nanos: u64, mono_nanos: Option<u64>) -> Self {
+        Self { request_start: wall_nanos, start_mono: mono_nanos, ttfb: None, response_end: None }
+    }
+
+    /// Epoch nanos of a later event, from the monotonic time elapsed since the start
+    fn at(&self, wall_nanos: u64, mono_nanos: Option<u64>) -> u64 {
+        match (self.start_mono, mono_nanos) {
+            (Some(start), Some(now)) if now >= start => self.request_start.saturating_add(now - start),
+            _ => wall_nanos.max(self.request_start),
+        }
+    }
+
+    /// First response byte; later calls keep the first mark
+    pub fn mark_ttfb(&mut self, wall_nanos: u64, mono_nanos: Option<u64>) {
+        if self.ttfb.is_none() {
+            self.ttfb = Some(self.at(wall_nanos, mono_nanos));
+        }
+    }
+
+    /// Response complete; later calls keep the first mark
+    pub fn mark_response_end(&mut self, wall_nanos: u64, mono_nanos: Option<u64>) {
+        if self.response_end.is_none() {
+            let end = self.at(wall_nanos, mono_nanos);
+            self.response_end = Some(end.max(self.ttfb.unwrap_or(0)));
+        }
+    }
+
+    /// Move the timestamps onto the batch anchor (timestampSource=monotonic-anchored).
+    /// The offsets between them are kept. Without monotonic readings nothing changes.
+    pub fn anchor_to_batch(&mut self, wall_nanos: u64, mono_nanos: Option<u64>) {
+        if let (Some(start_mono), Some(now_mono)) = (self.start_mono, mono_nanos) {
+            self.rebase(anchored(batch_anchor(wall_nanos, now_mono), start_mono));
+        }
+    }
+
+    fn rebase(&mut self, request_start: u64) {
+        let old_start = self.request_start;
+        let shift = |t: u64| request_start.saturating_add(t.saturating_sub(old_start));
+        self.ttfb = self.ttfb.map(shift);
+        self.response_end = self.response_end.map(shift);
+        self.request_start = request_start;
+    }
+
+    /// First response byte, once the response headers arrived
+    pub fn ttfb(&self) -> Option<u64> {
+        self.ttfb
+    }
+
+    /// Span start and, once the response completed, end
+    pub fn span_times(&self) -> (u64, Option<u64>) {
+        (self.request_start, self.response_end)
+    }
+
+    /// The timestamps reached so far; an exchange reset before its response has no ttfb
+    pub fn attributes(&self) -> Vec<KeyValue> {
+        let mut attributes = vec![crate::otel::int_attribute(REQUEST_START, self.request_start as i64)];
+        if let Some(ttfb) = self.ttfb {
+            attributes.push(crate::otel::int_attribute(TTFB, ttfb as i64));
+        }
+        if let Some(response_end) = self.response_end {
+            attributes.push(crate::otel::int_attribute(RESPONSE_END, response_end as i64));
+        }
+        attributes
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn int_values(timer: &ExchangeTimer) -> Vec<(String, i64)> {
+        timer
+            .attributes()
+            .into_iter()
+            .map(|kv| match kv.value.and_then(|v| v.value) {
+                Some(crate::otel::any_value::Value::IntValue(value)) => (kv.key, value),
+                other => panic!("unexpected value {:?}", other),
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_offsets_follow_monotonic_clock() {
+        let mut timer = ExchangeTimer::start(1_000_000, Some(50));
+        // The wall clock stepped back a long way; the monotonic deltas still hold
+        timer.mark_ttfb(10, Some(550));
+        timer.mark_response_end(20, Some(2_050));
+        assert_eq!(
+            int_values(&timer),
+            vec![
+                (REQUEST_START.to_string(), 1_000_000),
+                (TTFB.to_string(), 1_000_500),
+                (RESPONSE_END.to_string(), 1_002_000),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_wall_clock_fallback_never_runs_backwards() {
+        let mut timer = ExchangeTimer::start(1_000, None);
+        timer.mark_ttfb(1_400, None);
+        timer.mark_response_end(900, None);
+        assert_eq!(timer.ttfb, Some(1_400));
+        assert_eq!(timer.response_end, Some(1_400));
+
+        let mut timer = ExchangeTimer::start(1_000, Some(100));
+        timer.mark_ttfb(1_200, None);
+        assert_eq!(timer.ttfb, Some(1_200));
+    }
+
+    #[test]
+    fn test_first_mark_wins() {
+        let mut timer = ExchangeTimer::start(0, Some(0));
+        timer.mark_ttfb(0, Some(5));
+        timer.mark_ttfb(0, Some(9));
+        timer.mark_response_end(0, Some(20));
+        timer.mark_response_end(0, Some(30));
+        assert_eq!((timer.ttfb, timer.response_end), (Some(5), Some(20)));
+    }
+
+    #[test]
+    fn test_anchored() {
+        assert_eq!(anchored((1_000, 500), 800), 1_300);
+        assert_eq!(anchored((1_000, 500), 200), 700);
+        assert_eq!(anchored((100, 500), 0), 0);
+    }
+
+    #[test]
+    fn test_anchor_to_batch_keeps_offsets() {
+        reset_batch_anchor();
+        // The first exchange of the batch sets the anchor at its end
+        let mut first = ExchangeTimer::start(5_000, Some(100));
+        first.mark_response_end(5_400, Some(400));
+        first.anchor_to_batch(9_999, Some(400));
+        assert_eq!(first.span_times(), (9_699, Some(9_999)));
+
+        // A later exchange whose own wall reading jumped is placed by the anchor alone
+        let mut second = ExchangeTimer::start(1, Some(1_000));
+        second.mark_ttfb(2, Some(1_050));
+        second.mark_response_end(3, Some(1_100));
+        second.anchor_to_batch(3, Some(1_100));
+        assert_eq!(second.span_times(), (10_599, Some(10_699)));
+        assert_eq!(second.ttfb, Some(10_649));
+
+        reset_batch_anchor();
+        let mut third = ExchangeTimer::start(7, None);
+        third.anchor_to_batch(8, Some(1));
+        assert_eq!(third.span_times(), (7, None));
+    }
+
+    #[test]
+    fn test_attributes_without_response() {
+        let timer = ExchangeTimer::start(7, Some(0));
+        assert_eq!(int_values(&timer), vec![(REQUEST_START.to_string(), 7)]);
+    }
+}
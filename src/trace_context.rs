@@ -1,18 +1,167 @@
 use std::collections::HashMap;
 
+/// Length of a version 00 traceparent: 2 + 1 + 32 + 1 + 16 + 1 + 2
+pub const TRACEPARENT_LEN: usize = 55;
+/// OTLP id widths in bytes; exported as 32 and 16 lowercase hex characters
+pub const TRACE_ID_LEN: usize = 16;
+pub const SPAN_ID_LEN: usize = 8;
+
+/// Whether OTLP accepts a trace id: 16 bytes, not all zero
+pub fn is_valid_trace_id(id: &[u8]) -> bool {
+    id.len() == TRACE_ID_LEN && id.iter().any(|b| *b != 0)
+}
+
+/// Whether OTLP accepts a span id: 8 bytes, not all zero
+pub fn is_valid_span_id(id: &[u8]) -> bool {
+    id.len() == SPAN_ID_LEN && id.iter().any(|b| *b != 0)
+}
+
+/// `len` id bytes spread from a seed with splitmix64; never all zero, so always a valid
+/// id of that width
+pub fn id_from_seed(seed: u64, len: usize) -> Vec<u8> {
+    let mut state = seed;
+    let mut id = Vec::with_capacity(len + 8);
+    while id.len() < len {
+        state = state.wrapping_add(0x9e37_79b9_7f4a_7c15);
+        let mut z = state;
+        z = (z ^ (z >> 30)).wrapping_mul(0xbf58_476d_1ce4_e5b9);
+        z = (z ^ (z >> 27)).wrapping_mul(0x94d0_49bb_1331_11eb);
+        id.extend_from_slice(&(z ^ (z >> 31)).to_be_bytes());
+    }
+    id.truncate(len);
+    if id.iter().all(|b| *b == 0) {
+        id[len - 1] = 1;
+    }
+    id
+}
+
+/// Replace ids OTLP would reject before they are propagated or exported: a bad trace id
+/// starts a new trace, dropping the parent; a bad parent span id is dropped; a bad span id
+/// is regenerated. Returns whether anything was replaced.
+pub fn repair_ids(trace_id: &mut Vec<u8>, span_id: &mut Vec<u8>, parent_span_id: &mut Option<Vec<u8>>, seed: u64) -> bool {
+    let mut repaired = false;
+    if !is_valid_trace_id(trace_id) {
+        crate::sp_warn!("Malformed trace id {:02x?}, starting a new trace", trace_id);
+        *trace_id = id_from_seed(seed, TRACE_ID_LEN);
+        *parent_span_id = None;
+        repaired = true;
+    }
+    if parent_span_id.as_deref().map_or(false, |parent| !is_valid_span_id(parent)) {
+        crate::sp_warn!("Malformed parent span id {:02x?}, dropping it", parent_span_id);
+        *parent_span_id = None;
+        repaired = true;
+    }
+    if !is_valid_span_id(span_id) {
+        crate::sp_warn!("Malformed span id {:02x?}, generating a new one", span_id);
+        *span_id = id_from_seed(seed.rotate_left(32), SPAN_ID_LEN);
+        repaired = true;
+    }
+    repaired
+}
+
 /// Parse traceparent value in format: 00-trace_id-span_id-01
+/// Rejects malformed values per W3C Trace Context: wrong length, non-lowercase-hex
+/// fields, version ff, or all-zero trace/span ids.
 pub fn parse_traceparent_value(traceparent: &str) -> Option<(Vec<u8>, Vec<u8>)> {
+    let traceparent = traceparent.trim();
+    if traceparent.len() != TRACEPARENT_LEN {
+        return None;
+    }
+
     let parts: Vec<&str> = traceparent.split('-').collect();
-    if parts.len() != 4 {
+    if parts.len() != 4
+        || parts[0].len() != 2
+        || parts[1].len() != 32
+        || parts[2].len() != 16
+        || parts[3].len() != 2
+    {
+        return None;
+    }
+    if !parts.iter().all(|p| p.chars().all(|c| matches!(c, '0'..='9' | 'a'..='f'))) {
+        return None;
+    }
+    if parts[0] == "ff" {
         return None;
     }
 
     let trace_id = hex_decode(parts[1])?;
     let span_id = hex_decode(parts[2])?;
+    if trace_id.iter().all(|b| *b == 0) || span_id.iter().all(|b| *b == 0) {
+        return None;
+    }
+
+    Some((trace_id, span_id))
+}
+
+/// Parse B3 multi-header trace context (X-B3-TraceId / X-B3-SpanId).
+/// 64-bit trace ids are left-padded with zeros to the 16-byte W3C width.
+pub fn parse_b3_headers(headers: &HashMap<String, String>) -> Option<(Vec<u8>, Vec<u8>)> {
+    let trace_id_hex = headers.get("x-b3-traceid")?.trim().to_ascii_lowercase();
+    let span_id_hex = headers.get("x-b3-spanid")?.trim().to_ascii_lowercase();
+
+    if trace_id_hex.len() != 16 && trace_id_hex.len() != 32 {
+        return None;
+    }
+    if span_id_hex.len() != 16 {
+        return None;
+    }
+    if !trace_id_hex.chars().chain(span_id_hex.chars()).all(|c| c.is_ascii_hexdigit()) {
+        return None;
+    }
+
+    let mut trace_id = vec![0u8; 16 - trace_id_hex.len() / 2];
+    trace_id.extend(hex_decode(&trace_id_hex)?);
+    let span_id = hex_decode(&span_id_hex)?;
+    if trace_id.iter().all(|b| *b == 0) || span_id.iter().all(|b| *b == 0) {
+        return None;
+    }
 
     Some((trace_id, span_id))
 }
 
+/// Parse a W3C baggage header into (key, value) pairs.
+/// Values are percent-decoded and member properties (`;k=v`) are dropped.
+/// Malformed members are skipped rather than failing the whole header.
+pub fn parse_baggage(baggage: &str) -> Vec<(String, String)> {
+    let mut entries = Vec::new();
+    for member in baggage.split(',') {
+        let key_value = member.split(';').next().unwrap_or("");
+        let (key, value) = match key_value.split_once('=') {
+            Some(pair) => pair,
+            None => continue,
+        };
+        let key = key.trim();
+        if key.is_empty() || !key.chars().all(|c| c.is_ascii_graphic() && !"\"(),/:;<=>?@[\\]{}".contains(c)) {
+            crate::sp_debug!("Skipping malformed baggage member: {}", member.trim());
+            continue;
+        }
+        match percent_decode(value.trim()) {
+            Some(value) => entries.push((key.to_string(), value)),
+            None => {
+                crate::sp_debug!("Skipping baggage member with invalid encoding: {}", key);
+            }
+        }
+    }
+    entries
+}
+
+fn percent_decode(value: &str) -> Option<String> {
+    let bytes = value.as_bytes();
+    let mut decoded = Vec::with_capacity(bytes.len());
+    let mut i = 0;
+    while i < bytes.len() {
+        if bytes[i] == b'%' {
+            let hex = value.get(i + 1..i + 3)?;
+            decoded.push(u8::from_str_radix(hex, 16).ok()?);
+            i += 3;
+        } else {
+            decoded.push(bytes[i]);
+            i += 1;
+        }
+    }
+    String::from_utf8(decoded).ok()
+}
+
 /// Helper function to decode hex string to bytes
 pub fn hex_decode(hex: &str) -> Option<Vec<u8>> {
     if hex.len() % 2 != 0 {
@@ -67,4 +216,124 @@ pub fn extract_and_propagate_trace_context(
     } else {
         crate::sp_debug!("No traceparent found in response headers");
     }
-}
\ No newline at end of file
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_traceparent_value_valid() {
+        let (trace_id, span_id) =
+            parse_traceparent_value("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01").unwrap();
+        assert_eq!(trace_id, hex_decode("4bf92f3577b34da6a3ce929d0e0e4736").unwrap());
+        assert_eq!(span_id, hex_decode("00f067aa0ba902b7").unwrap());
+    }
+
+    #[test]
+    fn test_parse_b3_headers() {
+        let mut headers = HashMap::new();
+        headers.insert("x-b3-traceid".to_string(), "463ac35c9f6413ad48485a3953bb6124".to_string());
+        headers.insert("x-b3-spanid".to_string(), "a2fb4a1d1a96d312".to_string());
+        headers.insert("x-b3-sampled".to_string(), "1".to_string());
+        let (trace_id, span_id) = parse_b3_headers(&headers).unwrap();
+        assert_eq!(trace_id, hex_decode("463ac35c9f6413ad48485a3953bb6124").unwrap());
+        assert_eq!(span_id, hex_decode("a2fb4a1d1a96d312").unwrap());
+
+        // 64-bit trace ids are widened to 128 bits
+        headers.insert("x-b3-traceid".to_string(), "48485A3953BB6124".to_string());
+        let (trace_id, _) = parse_b3_headers(&headers).unwrap();
+        assert_eq!(trace_id, hex_decode("000000000000000048485a3953bb6124").unwrap());
+
+        headers.insert("x-b3-traceid".to_string(), "48485a3953bb612".to_string());
+        assert!(parse_b3_headers(&headers).is_none());
+        headers.remove("x-b3-traceid");
+        assert!(parse_b3_headers(&headers).is_none());
+    }
+
+    #[test]
+    fn test_parse_b3_headers_non_ascii() {
+        // 16 bytes but not 16 hex digits; slicing by byte offset would split the 'é'
+        let mut headers = HashMap::new();
+        headers.insert("x-b3-traceid".to_string(), format!("a\u{e9}{}", "a".repeat(13)));
+        headers.insert("x-b3-spanid".to_string(), "a2fb4a1d1a96d312".to_string());
+        assert!(parse_b3_headers(&headers).is_none());
+
+        headers.insert("x-b3-traceid".to_string(), "48485a3953bb6124".to_string());
+        headers.insert("x-b3-spanid".to_string(), format!("\u{e9}{}", "a".repeat(14)));
+        assert!(parse_b3_headers(&headers).is_none());
+    }
+
+    #[test]
+    fn test_parse_baggage() {
+        let entries = parse_baggage("tenant=acme, user.id=u%2042;ttl=60,broken,=nokey,bad key=1,enc=%zz");
+        assert_eq!(
+            entries,
+            vec![
+                ("tenant".to_string(), "acme".to_string()),
+                ("user.id".to_string(), "u 42".to_string()),
+            ]
+        );
+        assert!(parse_baggage("").is_empty());
+    }
+
+    #[test]
+    fn test_parse_traceparent_value_malformed() {
+        let invalid = [
+            "",
+            "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+            "00-4bf92f3577b34da6a3ce929d0e0e473-600f067aa0ba902b7-01",
+            "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+            "00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+            "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+            "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+            "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+        ];
+        for value in invalid {
+            assert!(parse_traceparent_value(value).is_none(), "accepted {}", value);
+        }
+    }
+
+    #[test]
+    fn test_id_from_seed() {
+        for seed in [0, 1, u64::MAX, 0x9e37_79b9_7f4a_7c15u64.wrapping_neg()] {
+            assert!(is_valid_trace_id(&id_from_seed(seed, TRACE_ID_LEN)));
+            assert!(is_valid_span_id(&id_from_seed(seed, SPAN_ID_LEN)));
+        }
+        assert_ne!(id_from_seed(1, SPAN_ID_LEN), id_from_seed(2, SPAN_ID_LEN));
+    }
+
+    #[test]
+    fn test_repair_ids() {
+        let valid_trace_id = hex_decode("4bf92f3577b34da6a3ce929d0e0e4736").unwrap();
+        let valid_span_id = hex_decode("00f067aa0ba902b7").unwrap();
+        let malformed: [(Vec<u8>, Vec<u8>); 4] = [
+            (Vec::new(), Vec::new()),
+            (vec![0; TRACE_ID_LEN], valid_span_id.clone()),
+            (valid_trace_id[..15].to_vec(), valid_span_id.clone()),
+            (valid_trace_id.clone(), vec![0; SPAN_ID_LEN]),
+        ];
+        for (trace_id, parent) in malformed.iter().cloned() {
+            let (mut trace_id, mut parent_span_id, mut span_id) = (trace_id, Some(parent), Vec::new());
+            assert!(repair_ids(&mut trace_id, &mut span_id, &mut parent_span_id, 42));
+            assert!(is_valid_trace_id(&trace_id));
+            assert!(is_valid_span_id(&span_id));
+            assert!(parent_span_id.as_deref().map_or(true, is_valid_span_id));
+        }
+
+        // A valid trace with a malformed parent keeps its trace id
+        let mut trace_id = valid_trace_id.clone();
+        let mut parent_span_id = Some(vec![0; SPAN_ID_LEN]);
+        let mut span_id = id_from_seed(7, SPAN_ID_LEN);
+        let expected_span_id = span_id.clone();
+        assert!(repair_ids(&mut trace_id, &mut span_id, &mut parent_span_id, 42));
+        assert_eq!((trace_id, span_id, parent_span_id), (valid_trace_id.clone(), expected_span_id, None));
+
+        // Valid ids are left alone
+        let mut trace_id = valid_trace_id;
+        let mut parent_span_id = Some(valid_span_id.clone());
+        let mut span_id = id_from_seed(7, SPAN_ID_LEN);
+        assert!(!repair_ids(&mut trace_id, &mut span_id, &mut parent_span_id, 42));
+        assert_eq!(parent_span_id, Some(valid_span_id));
+    }
+}
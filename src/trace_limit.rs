@@ -0,0 +1,134 @@
+// Cap on spans exported per trace id, shared by all worker VMs through shared data
+//
+// Guards the backend against one runaway trace (a client looping under one session).
+// Like dedup, trace ids hash into a fixed set of slots, each holding the trace's hash,
+// its span count and when it expires. Every counted span pushes the expiry out by
+// TRACE_TTL_MS, so a trace stays capped while it is active and its slot frees up once it
+// goes quiet. A collision replaces the older trace, which at worst restarts its count.
+
+use proxy_wasm::traits::Context;
+use proxy_wasm::types::Status;
+
+use crate::sampling::fnv1a_hash;
+use crate::shared_data::{self, Feature};
+
+const TRACE_SLOTS: u64 = 4096;
+const SLOT_KEY_PREFIX: &str = "sp.trace.";
+/// A trace with no span for this long starts counting again
+pub const TRACE_TTL_MS: u64 = 10 * 60 * 1000;
+/// Slot value: trace id hash, span count, expiry (ms); all u64 LE
+const SLOT_VALUE_LEN: usize = 24;
+const MAX_CAS_ATTEMPTS: usize = 4;
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum Verdict {
+    Export,
+    /// The first span over the limit: exported with sp.trace.truncated=true
+    Truncate,
+    Drop,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+struct Slot {
+    trace_hash: u64,
+    count: u64,
+    expires_at_ms: u64,
+}
+
+impl Slot {
+    fn encode(&self) -> Vec<u8> {
+        let mut value = Vec::with_capacity(SLOT_VALUE_LEN);
+        value.extend_from_slice(&self.trace_hash.to_le_bytes());
+        value.extend_from_slice(&self.count.to_le_bytes());
+        value.extend_from_slice(&self.expires_at_ms.to_le_bytes());
+        value
+    }
+
+    fn decode(value: &[u8]) -> Option<Self> {
+        if value.len() != SLOT_VALUE_LEN {
+            return None;
+        }
+        let word = |i: usize| u64::from_le_bytes(value[i * 8..(i + 1) * 8].try_into().unwrap_or_default());
+        Some(Self {
+            trace_hash: word(0),
+            count: word(1),
+            expires_at_ms: word(2),
+        })
+    }
+}
+
+/// This span's position in its trace: the slot's count plus one when the slot holds
+/// the same, unexpired trace, else 1
+fn next_count(slot: Option<Slot>, trace_hash: u64, now_ms: u64) -> u64 {
+    match slot {
+        Some(slot) if slot.trace_hash == trace_hash && now_ms < slot.expires_at_ms => slot.count.saturating_add(1),
+        _ => 1,
+    }
+}
+
+fn verdict(count: u64, max_spans: u64) -> Verdict {
+    if count <= max_spans {
+        Verdict::Export
+    } else if count == max_spans + 1 {
+        Verdict::Truncate
+    } else {
+        Verdict::Drop
+    }
+}
+
+/// Count one span of `trace_id` against maxSpansPerTrace. Contention and host errors
+/// let the span through.
+pub fn check(ctx: &dyn Context, trace_id: &str, now_ms: u64, max_spans: u64) -> Verdict {
+    if max_spans == 0 {
+        return Verdict::Export;
+    }
+    let trace_hash = fnv1a_hash(trace_id.as_bytes());
+    let key = format!("{}{}", SLOT_KEY_PREFIX, trace_hash % TRACE_SLOTS);
+
+    for _ in 0..MAX_CAS_ATTEMPTS {
+        let (value, cas) = shared_data::get(ctx, Feature::TraceLimit, &key);
+        let count = next_count(value.as_deref().and_then(Slot::decode), trace_hash, now_ms);
+        let slot = Slot {
+            trace_hash,
+            count,
+            expires_at_ms: now_ms.saturating_add(TRACE_TTL_MS),
+        };
+        match shared_data::set(ctx, Feature::TraceLimit, &key, &slot.encode(), cas) {
+            Ok(()) => return verdict(count, max_spans),
+            Err(Status::CasMismatch) => continue,
+            Err(_) => return Verdict::Export,
+        }
+    }
+    crate::sp_debug!("Trace span count contended for {}, letting the span through", trace_id);
+    Verdict::Export
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_slot_round_trip() {
+        let slot = Slot { trace_hash: 0xfeed, count: 12, expires_at_ms: 1_700_000_000_000 };
+        assert_eq!(Slot::decode(&slot.encode()), Some(slot));
+        assert_eq!(Slot::decode(b"short"), None);
+    }
+
+    #[test]
+    fn test_next_count() {
+        let slot = Some(Slot { trace_hash: 7, count: 41, expires_at_ms: 2_000 });
+        assert_eq!(next_count(slot, 7, 1_000), 42);
+        // Expired, another trace, or a free slot all start over
+        assert_eq!(next_count(slot, 7, 2_000), 1);
+        assert_eq!(next_count(slot, 8, 1_000), 1);
+        assert_eq!(next_count(None, 7, 1_000), 1);
+    }
+
+    #[test]
+    fn test_verdict() {
+        assert_eq!(verdict(1, 3), Verdict::Export);
+        assert_eq!(verdict(3, 3), Verdict::Export);
+        assert_eq!(verdict(4, 3), Verdict::Truncate);
+        assert_eq!(verdict(5, 3), Verdict::Drop);
+    }
+}
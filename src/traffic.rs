@@ -11,6 +11,17 @@ pub trait TrafficAnalyzer {
     fn is_exempted(&self, config: &Config, request_headers: &HashMap<String, String>) -> bool;
 }
 
+/// Decode Envoy's listener_direction property: an int64 (little-endian) holding
+/// core.v3.TrafficDirection, where 1 is INBOUND and 2 is OUTBOUND
+fn decode_listener_direction(value: &[u8]) -> Option<&'static str> {
+    let bytes: [u8; 8] = value.get(..8)?.try_into().ok()?;
+    match i64::from_le_bytes(bytes) {
+        1 => Some("inbound"),
+        2 => Some("outbound"),
+        _ => None,
+    }
+}
+
 pub trait RequestHeadersAccess {
     fn get_context_property(&self, path: Vec<&str>) -> Option<Vec<u8>>;
     fn get_request_header(&self, name: &str) -> Option<String>;
@@ -28,6 +39,14 @@ impl<T: Context> TrafficAnalyzer for T where T: RequestHeadersAccess {
             };
         }
 
+        // Method 2: Listener direction set by Istio on the sidecar listeners; the most reliable signal
+        if let Some(listener_direction) = self.get_context_property(vec!["listener_direction"]) {
+            if let Some(direction) = decode_listener_direction(&listener_direction) {
+                crate::sp_debug!("Detected listener_direction: {}", direction);
+                return direction.to_string();
+            }
+        }
+
         // Method 2: Check if this is client or server role
         // Client (发起请求) → outbound, Server (接收请求) → inbound
         
@@ -74,14 +93,6 @@ impl<T: Context> TrafficAnalyzer for T where T: RequestHeadersAccess {
             }
         }
 
-        // Method 2: Check listener direction
-        if let Some(listener_direction) = self.get_context_property(vec!["listener_direction"]) {
-            if let Ok(direction) = String::from_utf8(listener_direction) {
-                crate::sp_debug!("Detected listener_direction: {}", direction);
-                return direction;
-            }
-        }
-
         // Method 2: Check metadata direction
         if let Some(metadata) = self.get_context_property(vec![
             "metadata",
@@ -2,11 +2,17 @@ package main
 
 import (
     "context"
+    "encoding/json"
+    "errors"
     "io"
     "log"
     "net/http"
     "os"
+    "os/signal"
+    "strconv"
     "strings"
+    "sync"
+    "syscall"
     "time"
 
     "go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
@@ -59,24 +65,95 @@ func initTracer() *sdktrace.TracerProvider {
 	return tp
 }
 
+// How long in-flight requests and span export get once a shutdown signal arrives
+const shutdownGracePeriod = 5 * time.Second
+
+// Upstream the test app proxies to; point it at a local mock to keep CI hermetic
+var upstreamBaseURL = strings.TrimRight(mustGetEnv("UPSTREAM_BASE_URL", "https://httpbin.org"), "/")
+
+func mustGetEnv(key, def string) string {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	return v
+}
+
+// Test-only: ECHO_TRACEPARENT=1 reports the traceparent the app received back to the caller
+var echoTraceparent = mustGetEnv("ECHO_TRACEPARENT", "") == "1"
+
+// Copy the incoming traceparent, as it reached the app, into X-Echo-Traceparent. Wraps the
+// otelhttp handler so the header is read before the app's own tracing touches it.
+func withTraceparentEcho(next http.Handler) http.Handler {
+    if !echoTraceparent {
+        return next
+    }
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("X-Echo-Traceparent", r.Header.Get("traceparent"))
+        next.ServeHTTP(w, r)
+    })
+}
+
+// Test-only: ENABLE_SLEEP=1 serves /sleep/{ms}, an artificially slow endpoint for the
+// minDurationMs check
+var enableSleep = mustGetEnv("ENABLE_SLEEP", "") == "1"
+
+// Longest /sleep/{ms} delay; stays under the test client's and Envoy's timeouts
+const maxSleep = 10 * time.Second
+
+// Sleep for the requested number of milliseconds, then respond. The client going away
+// ends the sleep early.
+func sleepHandler(w http.ResponseWriter, r *http.Request) {
+    ms, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/sleep/"))
+    if err != nil || ms < 0 || time.Duration(ms)*time.Millisecond > maxSleep {
+        http.Error(w, "want /sleep/{ms} with 0 <= ms <= 10000", http.StatusBadRequest)
+        return
+    }
+
+    timer := time.NewTimer(time.Duration(ms) * time.Millisecond)
+    defer timer.Stop()
+    select {
+    case <-timer.C:
+    case <-r.Context().Done():
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(map[string]int{"slept_ms": ms})
+}
+
 func healthHandler(w http.ResponseWriter, r *http.Request) {
     w.WriteHeader(http.StatusOK)
     _, _ = w.Write([]byte("ok"))
 }
 
-// Proxy httpbin
+// Echo the request headers the app received, so tests can see what the sidecar injected
+func echoHeadersHandler(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(r.Header)
+}
+
+// Proxy httpbin (or UPSTREAM_BASE_URL), keeping the method, path, query string and body
 func proxyHttpbin(w http.ResponseWriter, r *http.Request) {
     ctx := r.Context()
+    defer r.Body.Close()
 
-    path := r.URL.Path
-    httpbinPath := "https://httpbin.org" + path
+    upstreamURL := upstreamBaseURL + r.URL.RequestURI()
 
     client := &http.Client{Timeout: 10 * time.Second}
-    req, err := http.NewRequestWithContext(ctx, http.MethodGet, httpbinPath, nil)
+    // Stream the incoming body through; a nil body keeps GETs free of Content-Length: 0
+    var body io.Reader
+    if r.ContentLength != 0 {
+        body = r.Body
+    }
+    req, err := http.NewRequestWithContext(ctx, r.Method, upstreamURL, body)
     if err != nil {
         http.Error(w, "Failed to create request", http.StatusInternalServerError)
         return
     }
+    req.ContentLength = r.ContentLength
+    if contentType := r.Header.Get("Content-Type"); contentType != "" {
+        req.Header.Set("Content-Type", contentType)
+    }
 
     resp, err := client.Do(req)
     if err != nil {
@@ -94,19 +171,73 @@ func proxyHttpbin(w http.ResponseWriter, r *http.Request) {
     _, _ = io.Copy(w, resp.Body)
 }
 
+// Attempts seen per X-Test-Request-ID by flakyHandler
+var (
+    flakyMu       sync.Mutex
+    flakyAttempts = map[string]int{}
+)
+
+// Fail the first attempt of each X-Test-Request-ID with a 503 so Envoy's retry policy kicks in
+func flakyHandler(w http.ResponseWriter, r *http.Request) {
+    id := r.Header.Get("X-Test-Request-ID")
+    flakyMu.Lock()
+    flakyAttempts[id]++
+    attempt := flakyAttempts[id]
+    flakyMu.Unlock()
+
+    if attempt == 1 {
+        http.Error(w, "first attempt fails", http.StatusServiceUnavailable)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(map[string]int{"attempt": attempt})
+}
+
 func main() {
 	tp := initTracer()
-	defer func() {
-		if err := tp.Shutdown(context.Background()); err != nil {
-			log.Printf("Error shutting down tracer provider: %v", err)
-		}
-	}()
 
     http.HandleFunc("/health", otelhttp.NewHandler(http.HandlerFunc(healthHandler), "health").ServeHTTP)
-    http.HandleFunc("/json", otelhttp.NewHandler(http.HandlerFunc(proxyHttpbin), "json").ServeHTTP)
+    http.Handle("/json", withTraceparentEcho(otelhttp.NewHandler(http.HandlerFunc(proxyHttpbin), "json")))
     http.HandleFunc("/delay/", otelhttp.NewHandler(http.HandlerFunc(proxyHttpbin), "delay").ServeHTTP)
+    http.HandleFunc("/echo-headers", otelhttp.NewHandler(http.HandlerFunc(echoHeadersHandler), "echo-headers").ServeHTTP)
+    http.HandleFunc("/flaky", otelhttp.NewHandler(http.HandlerFunc(flakyHandler), "flaky").ServeHTTP)
+    if enableSleep {
+        http.HandleFunc("/sleep/", otelhttp.NewHandler(http.HandlerFunc(sleepHandler), "sleep").ServeHTTP)
+    }
 
-	// Start server
-	log.Println("Starting server on :80")
-	http.ListenAndServe(":80", nil)
+	// Start server; PORT lets it run unprivileged and side by side with other instances
+	port := mustGetEnv("PORT", "80")
+	server := &http.Server{
+		Addr:              ":" + port,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	log.Println("Proxying to upstream:", upstreamBaseURL)
+	log.Println("Starting server on :" + port)
+
+	// Stop on SIGTERM/SIGINT so in-flight requests finish and batched spans get exported
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Server error: %v", err)
+		}
+	case <-ctx.Done():
+		log.Println("Shutting down server")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down server: %v", err)
+	}
+	if err := tp.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down tracer provider: %v", err)
+	}
 }
@@ -2,12 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -20,6 +23,201 @@ func mustGetEnv(key, def string) string {
 	return v
 }
 
+func mustGetEnvInt(key string, def int) int {
+	v := mustGetEnv(key, strconv.Itoa(def))
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		fail(failure{Step: "config", Err: fmt.Errorf("%s must be a positive integer, got %q", key, v)})
+	}
+	return n
+}
+
+func mustGetEnvFloat(key string, def float64) float64 {
+	v := mustGetEnv(key, strconv.FormatFloat(def, 'f', -1, 64))
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 || f > 1 {
+		fail(failure{Step: "config", Err: fmt.Errorf("%s must be a number between 0 and 1, got %q", key, v)})
+	}
+	return f
+}
+
+// sessionSampled mirrors the filter's per-session sampling: FNV-1a of the session id,
+// mapped onto [0, 1) and compared against the rate
+func sessionSampled(sessionID string, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	if rate <= 0 {
+		return false
+	}
+	h := fnv.New64a()
+	h.Write([]byte(sessionID))
+	return float64(h.Sum64()>>11)/float64(uint64(1)<<53) < rate
+}
+
+// samplingSessionID returns the first id of the form <prefix>-<n> whose sampling decision
+// at rate is want; rate must be strictly between 0 and 1
+func samplingSessionID(prefix string, rate float64, want bool) string {
+	for n := 0; ; n++ {
+		id := fmt.Sprintf("%s-%d", prefix, n)
+		if sessionSampled(id, rate) == want {
+			return id
+		}
+	}
+}
+
+// failure describes what the integration test was doing when it gave up
+type failure struct {
+	Step       string
+	Err        error
+	LastStatus int
+	Body       []byte
+}
+
+// fail prints a failure report to stderr and exits non-zero
+func fail(f failure) {
+	fmt.Fprintf(os.Stderr, "FAIL: %s\n", f.Step)
+	if f.Err != nil {
+		fmt.Fprintf(os.Stderr, "  error: %v\n", f.Err)
+	}
+	if f.LastStatus != 0 {
+		fmt.Fprintf(os.Stderr, "  last status: %d\n", f.LastStatus)
+	}
+	if len(f.Body) > 0 {
+		fmt.Fprintf(os.Stderr, "  response: %s\n", snippet(f.Body))
+	}
+	os.Exit(1)
+}
+
+// otlpSpan is the part of an OTLP/JSON span the test inspects
+type otlpSpan struct {
+	Name       string `json:"name"`
+	Attributes []struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue string          `json:"stringValue"`
+			IntValue    json.RawMessage `json:"intValue"` // OTLP/JSON sends int64 as a string
+		} `json:"value"`
+	} `json:"attributes"`
+}
+
+func (s otlpSpan) attribute(key string) (string, bool) {
+	for _, attr := range s.Attributes {
+		if attr.Key == key {
+			return attr.Value.StringValue, true
+		}
+	}
+	return "", false
+}
+
+func (s otlpSpan) intAttribute(key string) (int64, bool) {
+	for _, attr := range s.Attributes {
+		if attr.Key == key && len(attr.Value.IntValue) > 0 {
+			n, err := strconv.ParseInt(strings.Trim(string(attr.Value.IntValue), `"`), 10, 64)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
+
+// findSpanByTestRequestID returns the span whose captured X-Test-Request-ID header matches
+func findSpanByTestRequestID(body []byte, testRequestID string) (otlpSpan, bool) {
+	return findSpan(body, func(span otlpSpan) bool {
+		v, _ := span.attribute("http.request.header.x-test-request-id")
+		return v == testRequestID
+	})
+}
+
+// findSpanByRequestID returns the span recorded for Envoy's x-request-id, for requests
+// sent without an X-Test-Request-ID
+func findSpanByRequestID(body []byte, requestID string) (otlpSpan, bool) {
+	return findSpan(body, func(span otlpSpan) bool {
+		v, _ := span.attribute("sp.request.id")
+		return v == requestID
+	})
+}
+
+// findSpan walks every resourceSpans list in a backend response and returns the first
+// span that matches
+func findSpan(body []byte, match func(otlpSpan) bool) (otlpSpan, bool) {
+	var doc any
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return otlpSpan{}, false
+	}
+
+	var found otlpSpan
+	ok := false
+	var walk func(node any)
+	walk = func(node any) {
+		if ok {
+			return
+		}
+		switch n := node.(type) {
+		case map[string]any:
+			if rs, exists := n["resourceSpans"]; exists {
+				raw, _ := json.Marshal(rs)
+				var resourceSpans []struct {
+					ScopeSpans []struct {
+						Spans []otlpSpan `json:"spans"`
+					} `json:"scopeSpans"`
+				}
+				_ = json.Unmarshal(raw, &resourceSpans)
+				for _, r := range resourceSpans {
+					for _, scope := range r.ScopeSpans {
+						for _, span := range scope.Spans {
+							if match(span) {
+								found, ok = span, true
+								return
+							}
+						}
+					}
+				}
+			}
+			for _, v := range n {
+				walk(v)
+			}
+		case []any:
+			for _, v := range n {
+				walk(v)
+			}
+		}
+	}
+	walk(doc)
+	return found, ok
+}
+
+// Trace id of a W3C traceparent (version-traceid-parentid-flags), lowercased; "" when malformed
+func traceIDOf(traceparent string) string {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 {
+		return ""
+	}
+	return strings.ToLower(parts[1])
+}
+
+// failPoll fails the test with the report of an unsuccessful poll, using notFound when
+// the last poll did not say what was wrong; a nil report means the poll succeeded
+func failPoll(step string, last *failure, notFound error) {
+	if last == nil {
+		return
+	}
+	last.Step = step
+	if last.Err == nil {
+		last.Err = notFound
+	}
+	fail(*last)
+}
+
+// snippet trims a response body for the failure report
+func snippet(body []byte) string {
+	const maxLen = 512
+	s := strings.TrimSpace(string(body))
+	if len(s) > maxLen {
+		return s[:maxLen] + "..."
+	}
+	return s
+}
+
 func main() {
 	rand.Seed(time.Now().UnixNano())
 	backendURL := mustGetEnv("BACKEND_URL", "https://o.softprobe.ai")
@@ -27,6 +225,11 @@ func main() {
 	sessionID := fmt.Sprintf("session-%d", time.Now().Unix())
 	testID := fmt.Sprintf("test-%d", rand.Intn(1_000_000))
 
+	// Backend polling budget; raise for slower ingest paths
+	pollAttempts := mustGetEnvInt("POLL_ATTEMPTS", 3)
+	pollInterval := time.Duration(mustGetEnvInt("POLL_INTERVAL_SECONDS", 5)) * time.Second
+	fmt.Printf("Polling backend up to %d times every %s\n", pollAttempts, pollInterval)
+
 	// Inside compose: talk to envoy by service DNS
 	envoyHost := mustGetEnv("ENVOY_HOST", "envoy")
 	inboundBase := fmt.Sprintf("http://%s:15006", envoyHost)
@@ -45,96 +248,379 @@ func main() {
 	req1.Header.Set("X-Test-Request-ID", testID)
 	resp1, err := client.Do(req1)
 	if err != nil {
-		panic(err)
-	}
-	if resp1.StatusCode/100 != 2 {
-		panic(fmt.Sprintf("/json status=%d", resp1.StatusCode))
+		fail(failure{Step: "GET /json", Err: err})
 	}
 	body1, _ := io.ReadAll(resp1.Body)
 	resp1.Body.Close()
+	if resp1.StatusCode/100 != 2 {
+		fail(failure{Step: "GET /json", LastStatus: resp1.StatusCode, Body: body1})
+	}
 	var js map[string]any
 	_ = json.Unmarshal(body1, &js)
 
-	// 2) POST /delay/2
-	req2, _ := http.NewRequest(http.MethodPost, inboundBase+"/delay/2", strings.NewReader("demo"))
+	// 2) POST /delay/2; its own request id so the captured span can be found by body check below
+	postTestID := testID + "-post"
+	postBody := "demo"
+	req2, _ := http.NewRequest(http.MethodPost, inboundBase+"/delay/2", strings.NewReader(postBody))
 	req2.Header.Set("Content-Type", "text/plain")
 	req2.Header.Set("X-Session-ID", sessionID)
-	req2.Header.Set("X-Test-Request-ID", testID)
+	req2.Header.Set("X-Test-Request-ID", postTestID)
 	resp2, err := client.Do(req2)
 	if err != nil {
-		panic(err)
+		fail(failure{Step: "POST /delay/2", Err: err})
 	}
+	body2, _ := io.ReadAll(resp2.Body)
+	resp2.Body.Close()
 	if resp2.StatusCode/100 != 2 {
-		panic(fmt.Sprintf("/delay status=%d", resp2.StatusCode))
+		fail(failure{Step: "POST /delay/2", LastStatus: resp2.StatusCode, Body: body2})
+	}
+
+	// 3) GET /json with a caller-supplied W3C traceparent; the captured span must join that trace
+	traceparentSessionID := sessionID + "-traceparent"
+	knownTraceID := fmt.Sprintf("%016x%016x", rand.Uint64()|1, rand.Uint64())
+	knownTraceparent := fmt.Sprintf("00-%s-%016x-01", knownTraceID, rand.Uint64()|1)
+	req5, _ := http.NewRequest(http.MethodGet, inboundBase+"/json", nil)
+	req5.Header.Set("traceparent", knownTraceparent)
+	req5.Header.Set("X-Session-ID", traceparentSessionID)
+	req5.Header.Set("X-Test-Request-ID", testID)
+	resp5, err := client.Do(req5)
+	if err != nil {
+		fail(failure{Step: "GET /json with traceparent", Err: err})
+	}
+	body5, _ := io.ReadAll(resp5.Body)
+	resp5.Body.Close()
+	if resp5.StatusCode/100 != 2 {
+		fail(failure{Step: "GET /json with traceparent", LastStatus: resp5.StatusCode, Body: body5})
+	}
+	if appTraceID := traceIDOf(resp5.Header.Get("X-Echo-Traceparent")); appTraceID != knownTraceID {
+		fail(failure{Step: "GET /json with traceparent", Err: fmt.Errorf("app saw trace id %q, caller sent %s (is ECHO_TRACEPARENT=1 set on go-app?)", appTraceID, knownTraceID), LastStatus: resp5.StatusCode})
+	}
+
+	// 4) GET /json without a traceparent: the filter starts the trace, and the trace id the app
+	// received must be the one on the captured span
+	propagationSessionID := sessionID + "-propagation"
+	reqT, _ := http.NewRequest(http.MethodGet, inboundBase+"/json", nil)
+	reqT.Header.Set("X-Session-ID", propagationSessionID)
+	reqT.Header.Set("X-Test-Request-ID", testID)
+	respT, err := client.Do(reqT)
+	if err != nil {
+		fail(failure{Step: "GET /json without traceparent", Err: err})
+	}
+	bodyT, _ := io.ReadAll(respT.Body)
+	respT.Body.Close()
+	if respT.StatusCode/100 != 2 {
+		fail(failure{Step: "GET /json without traceparent", LastStatus: respT.StatusCode, Body: bodyT})
+	}
+	propagatedTraceID := traceIDOf(respT.Header.Get("X-Echo-Traceparent"))
+	if propagatedTraceID == "" {
+		fail(failure{Step: "GET /json without traceparent", Err: errors.New("app received no traceparent (is ECHO_TRACEPARENT=1 set on go-app?)"), LastStatus: respT.StatusCode})
+	}
+
+	// 5) GET /echo-headers without a session or test request id header; the inbound filter
+	// must inject the session it generated, and Envoy's x-request-id identifies the span
+	req8, _ := http.NewRequest(http.MethodGet, inboundBase+"/echo-headers", nil)
+	resp8, err := client.Do(req8)
+	if err != nil {
+		fail(failure{Step: "GET /echo-headers", Err: err})
+	}
+	body8, _ := io.ReadAll(resp8.Body)
+	resp8.Body.Close()
+	if resp8.StatusCode/100 != 2 {
+		fail(failure{Step: "GET /echo-headers", LastStatus: resp8.StatusCode, Body: body8})
+	}
+	var upstreamHeaders http.Header
+	_ = json.Unmarshal(body8, &upstreamHeaders)
+	if upstreamHeaders.Get("X-Sp-Session-Id") == "" {
+		fail(failure{Step: "GET /echo-headers", Err: errors.New("injected x-sp-session-id header not seen upstream"), LastStatus: resp8.StatusCode, Body: body8})
+	}
+	generatedSessionID, envoyRequestID := upstreamHeaders.Get("X-Sp-Session-Id"), upstreamHeaders.Get("X-Request-Id")
+	if envoyRequestID == "" {
+		fail(failure{Step: "GET /echo-headers", Err: errors.New("no x-request-id seen upstream"), LastStatus: resp8.StatusCode, Body: body8})
+	}
+
+	// 6) Sampling determinism: N requests on each of two sessions through the route that
+	// overrides sampleRate, one session chosen to be sampled and one not; each must be
+	// captured completely or not at all
+	samplingRequests := mustGetEnvInt("SAMPLING_REQUESTS", 10)
+	samplingRate := mustGetEnvFloat("SAMPLING_RATE", 0.5) // must match the x-sp-sampling-test route in envoy.yaml
+	if samplingRate <= 0 || samplingRate >= 1 {
+		fail(failure{Step: "config", Err: fmt.Errorf("SAMPLING_RATE must be strictly between 0 and 1 to check both outcomes, got %g", samplingRate)})
+	}
+	samplingSessionIDs := []string{
+		samplingSessionID(sessionID+"-sampled", samplingRate, true),
+		samplingSessionID(sessionID+"-unsampled", samplingRate, false),
+	}
+	for _, id := range samplingSessionIDs {
+		for i := 0; i < samplingRequests; i++ {
+			reqS, _ := http.NewRequest(http.MethodGet, inboundBase+"/echo-headers", nil)
+			reqS.Header.Set("X-Session-ID", id)
+			reqS.Header.Set("X-Sp-Sampling-Test", "1")
+			reqS.Header.Set("X-Test-Request-ID", fmt.Sprintf("%s-%d", id, i))
+			respS, err := client.Do(reqS)
+			if err != nil {
+				fail(failure{Step: "GET /echo-headers for sampling session " + id, Err: err})
+			}
+			bodyS, _ := io.ReadAll(respS.Body)
+			respS.Body.Close()
+			if respS.StatusCode/100 != 2 {
+				fail(failure{Step: "GET /echo-headers for sampling session " + id, LastStatus: respS.StatusCode, Body: bodyS})
+			}
+		}
 	}
-	io.Copy(io.Discard, resp2.Body)
-	resp2.Body.Close()
 
-	// 3) Optional: check admin
+	// 7) GET /flaky: the first attempt fails with 503 and Envoy's retry policy tries again
+	retryTestID := testID + "-retry"
+	reqR, _ := http.NewRequest(http.MethodGet, inboundBase+"/flaky", nil)
+	reqR.Header.Set("X-Session-ID", sessionID)
+	reqR.Header.Set("X-Test-Request-ID", retryTestID)
+	respR, err := client.Do(reqR)
+	if err != nil {
+		fail(failure{Step: "GET /flaky", Err: err})
+	}
+	bodyR, _ := io.ReadAll(respR.Body)
+	respR.Body.Close()
+	if respR.StatusCode/100 != 2 {
+		fail(failure{Step: "GET /flaky", LastStatus: respR.StatusCode, Body: bodyR})
+	}
+
+	// 8) minDurationMs: /sleep/ is routed with a 500ms threshold, so the slow request is
+	// captured and the fast one is not. Both share a session of their own.
+	durationSessionID := sessionID + "-duration"
+	slowTestID, fastTestID := testID+"-slow", testID+"-fast"
+	for _, sleep := range []struct {
+		path, testRequestID string
+	}{{"/sleep/0", fastTestID}, {"/sleep/1000", slowTestID}} {
+		reqD, _ := http.NewRequest(http.MethodGet, inboundBase+sleep.path, nil)
+		reqD.Header.Set("X-Session-ID", durationSessionID)
+		reqD.Header.Set("X-Test-Request-ID", sleep.testRequestID)
+		respD, err := client.Do(reqD)
+		if err != nil {
+			fail(failure{Step: "GET " + sleep.path, Err: err})
+		}
+		bodyD, _ := io.ReadAll(respD.Body)
+		respD.Body.Close()
+		if respD.StatusCode/100 != 2 {
+			fail(failure{Step: "GET " + sleep.path + " (is ENABLE_SLEEP=1 set on go-app?)", LastStatus: respD.StatusCode, Body: bodyD})
+		}
+	}
+
+	// 9) GET /local-reply: Envoy answers with a 503 itself (direct_response in envoy.yaml),
+	// which must still be captured and tagged as a local reply
+	localReplyTestID := testID + "-local-reply"
+	reqL, _ := http.NewRequest(http.MethodGet, inboundBase+"/local-reply", nil)
+	reqL.Header.Set("X-Session-ID", sessionID)
+	reqL.Header.Set("X-Test-Request-ID", localReplyTestID)
+	respL, err := client.Do(reqL)
+	if err != nil {
+		fail(failure{Step: "GET /local-reply", Err: err})
+	}
+	bodyL, _ := io.ReadAll(respL.Body)
+	respL.Body.Close()
+	if respL.StatusCode != http.StatusServiceUnavailable {
+		fail(failure{Step: "GET /local-reply", LastStatus: respL.StatusCode, Body: bodyL})
+	}
+
+	// 10) Optional: check admin
 	_, _ = client.Get(adminBase + "/stats")
 
+	// 11) Flush the filter's export batches so polling does not wait out the batch timer.
+	// The filter answers /__sp_flush itself (enableFlushEndpoint in envoy.yaml).
+	respF, err := client.Post(inboundBase+"/__sp_flush", "text/plain", nil)
+	if err != nil {
+		fail(failure{Step: "POST /__sp_flush", Err: err})
+	}
+	bodyF, _ := io.ReadAll(respF.Body)
+	respF.Body.Close()
+	if respF.StatusCode != http.StatusNoContent {
+		fail(failure{Step: "POST /__sp_flush", LastStatus: respF.StatusCode, Body: bodyF})
+	}
+
 	// Build Softprobe query URLs (print for manual curl validation)
 	q := url.Values{}
 	q.Set("serviceName", serviceName)
 	q.Set("startTimeFrom", testStart)
 	q.Set("size", "10")
 	sessionURL := fmt.Sprintf("%s/api/tenants/test-with-userid-v3/sessions?%s", strings.TrimRight(backendURL, "/"), q.Encode())
-	tracesEndpoint := fmt.Sprintf("%s/api/tenants/test-with-userid-v3/sessions/%s", strings.TrimRight(backendURL, "/"), url.PathEscape(sessionID))
+	sessionEndpoint := func(id string) string {
+		return fmt.Sprintf("%s/api/tenants/test-with-userid-v3/sessions/%s", strings.TrimRight(backendURL, "/"), url.PathEscape(id))
+	}
+	tracesEndpoint := sessionEndpoint(sessionID)
 	fmt.Println("Softprobe traces URL:", tracesEndpoint)
 	fmt.Println("Softprobe session URL:", sessionURL)
 	fmt.Println("Suggested curl (JSON): curl -s -H 'Accept: application/json' '" + tracesEndpoint + "' | jq .")
 	fmt.Println("Suggested curl (JSON): curl -s -H 'Accept: application/json' '" + sessionURL + "' | jq .")
 
-	// Poll traces by service
-	found := false
-	for i := 0; i < 3; i++ { // up to ~15s
-		time.Sleep(5 * time.Second)
-		req3, _ := http.NewRequest(http.MethodGet, tracesEndpoint, nil)
-		req3.Header.Set("Accept", "application/json")
-		resp3, err := client.Do(req3)
-		if err == nil {
-			body3, _ := io.ReadAll(resp3.Body)
-			resp3.Body.Close()
-			if resp3.StatusCode/100 == 2 {
-				var tracesResp struct {
-					Traces []any `json:"traces"`
-				}
-				_ = json.Unmarshal(body3, &tracesResp)
-				if len(tracesResp.Traces) > 0 {
-					found = true
-					break
+	// pollSession GETs endpoint until check reports done or the polling budget runs out,
+	// and returns the report of the last poll unless check succeeded. check sees the body
+	// of each 2xx response, and nil for a 404, so an unknown session reads as empty. An
+	// error returned with done ends polling at once; one without done only describes the
+	// latest poll, for the report if the budget runs out.
+	pollSession := func(endpoint string, check func(body []byte) (done bool, err error)) *failure {
+		last := &failure{}
+		for i := 0; i < pollAttempts; i++ {
+			time.Sleep(pollInterval)
+			req, _ := http.NewRequest(http.MethodGet, endpoint, nil)
+			req.Header.Set("Accept", "application/json")
+			resp, err := client.Do(req)
+			last.Err = err
+			if err != nil {
+				continue
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			last.LastStatus, last.Body = resp.StatusCode, body
+			var seen []byte
+			if resp.StatusCode/100 == 2 {
+				seen = body
+			} else if resp.StatusCode != http.StatusNotFound {
+				continue
+			}
+			done, err := check(seen)
+			last.Err = err
+			if done {
+				if err == nil {
+					return nil
 				}
+				return last
 			}
 		}
-	}
-	if !found {
-		panic("no traces found in Softprobe backend for service during test window")
+		return last
 	}
 
+	// Poll traces by service
+	lastPoll := pollSession(tracesEndpoint, func(body []byte) (bool, error) {
+		var tracesResp struct {
+			Traces []any `json:"traces"`
+		}
+		_ = json.Unmarshal(body, &tracesResp)
+		return len(tracesResp.Traces) > 0, nil
+	})
+	failPoll("poll traces for "+tracesEndpoint, lastPoll, errors.New("no traces found in Softprobe backend for service during test window"))
+
 	// Poll session traces
-	sessFound := false
-	for i := 0; i < 3; i++ { // up to ~15s
-		time.Sleep(5 * time.Second)
-		req4, _ := http.NewRequest(http.MethodGet, sessionURL, nil)
-		req4.Header.Set("Accept", "application/json")
-		resp4, err := client.Do(req4)
-		if err == nil {
-			body4, _ := io.ReadAll(resp4.Body)
-			resp4.Body.Close()
-			if resp4.StatusCode/100 == 2 {
-				var ses struct {
-					TotalCount int `json:"totalCount"`
-				}
-				_ = json.Unmarshal(body4, &ses)
-				if ses.TotalCount > 0 {
-					sessFound = true
-					break
-				}
+	lastPoll = pollSession(sessionURL, func(body []byte) (bool, error) {
+		var ses struct {
+			TotalCount int `json:"totalCount"`
+		}
+		_ = json.Unmarshal(body, &ses)
+		return ses.TotalCount > 0, nil
+	})
+	failPoll("poll sessions for "+sessionURL, lastPoll, errors.New("no session traces found for test session"))
+
+	// Poll the session detail and require the POST span to carry the body that was sent
+	lastPoll = pollSession(tracesEndpoint, func(body []byte) (bool, error) {
+		span, ok := findSpanByTestRequestID(body, postTestID)
+		if !ok {
+			return false, nil
+		}
+		if captured, _ := span.attribute("http.request.body"); captured != postBody {
+			return false, fmt.Errorf("span %q captured request body %q, want %q", span.Name, captured, postBody)
+		}
+		return true, nil
+	})
+	failPoll("poll captured POST body for "+tracesEndpoint, lastPoll, fmt.Errorf("no captured span with X-Test-Request-ID %s", postTestID))
+
+	// Poll the session detail and require the retried span to record both attempts
+	lastPoll = pollSession(tracesEndpoint, func(body []byte) (bool, error) {
+		span, ok := findSpanByTestRequestID(body, retryTestID)
+		if !ok {
+			return false, nil
+		}
+		if attempts, _ := span.intAttribute("sp.upstream.attempts"); attempts != 2 {
+			return false, fmt.Errorf("span %q recorded sp.upstream.attempts=%d, want 2", span.Name, attempts)
+		}
+		return true, nil
+	})
+	failPoll("poll retried span for "+tracesEndpoint, lastPoll, fmt.Errorf("no captured span with X-Test-Request-ID %s", retryTestID))
+
+	// Poll the session detail and require the local reply's span, tagged with its reason
+	lastPoll = pollSession(tracesEndpoint, func(body []byte) (bool, error) {
+		span, ok := findSpanByTestRequestID(body, localReplyTestID)
+		if !ok {
+			return false, nil
+		}
+		source, _ := span.attribute("sp.response.source")
+		reason, _ := span.attribute("sp.response.local_reply_reason")
+		if source != "local_reply" || reason != "direct_response" {
+			return false, fmt.Errorf("span %q recorded sp.response.source=%q, sp.response.local_reply_reason=%q; want local_reply, direct_response", span.Name, source, reason)
+		}
+		return true, nil
+	})
+	failPoll("poll local reply span for "+tracesEndpoint, lastPoll, fmt.Errorf("no captured span with X-Test-Request-ID %s", localReplyTestID))
+
+	// Poll the traceparent session and require the inbound trace id on the captured span
+	traceparentEndpoint := sessionEndpoint(traceparentSessionID)
+	lastPoll = pollSession(traceparentEndpoint, func(body []byte) (bool, error) {
+		return strings.Contains(strings.ToLower(string(body)), knownTraceID), nil
+	})
+	failPoll("poll traceparent session "+traceparentEndpoint, lastPoll, fmt.Errorf("captured span does not share inbound trace id %s", knownTraceID))
+
+	// Poll the propagation session and require the trace id the app saw on the captured span
+	propagationEndpoint := sessionEndpoint(propagationSessionID)
+	lastPoll = pollSession(propagationEndpoint, func(body []byte) (bool, error) {
+		return strings.Contains(strings.ToLower(string(body)), propagatedTraceID), nil
+	})
+	failPoll("poll propagation session "+propagationEndpoint, lastPoll, fmt.Errorf("captured span does not carry trace id %s the app received", propagatedTraceID))
+
+	// Poll the duration session: the slow span must arrive, and by then the fast one, sent
+	// first, would have too had it been captured
+	durationEndpoint := sessionEndpoint(durationSessionID)
+	lastPoll = pollSession(durationEndpoint, func(body []byte) (bool, error) {
+		if span, ok := findSpanByTestRequestID(body, fastTestID); ok {
+			return true, fmt.Errorf("fast span %q was captured despite minDurationMs", span.Name)
+		}
+		_, ok := findSpanByTestRequestID(body, slowTestID)
+		return ok, nil
+	})
+	failPoll("poll duration session "+durationEndpoint, lastPoll, fmt.Errorf("no captured span with X-Test-Request-ID %s", slowTestID))
+
+	// Poll the generated session and find the span by x-request-id alone
+	generatedEndpoint := sessionEndpoint(generatedSessionID)
+	lastPoll = pollSession(generatedEndpoint, func(body []byte) (bool, error) {
+		span, ok := findSpanByRequestID(body, envoyRequestID)
+		if !ok {
+			return false, nil
+		}
+		if _, flagged := span.attribute("sp.request.id_mismatch"); flagged {
+			return true, fmt.Errorf("span %q flagged sp.request.id_mismatch", span.Name)
+		}
+		return true, nil
+	})
+	failPoll("poll generated session "+generatedEndpoint, lastPoll, fmt.Errorf("no captured span with sp.request.id %s", envoyRequestID))
+
+	// Poll each sampling session and compare its span counts with the expected decision.
+	// An unsampled session is polled for the whole budget and must never show a span.
+	for _, id := range samplingSessionIDs {
+		samplingEndpoint := sessionEndpoint(id)
+		sampled := sessionSampled(id, samplingRate)
+		fmt.Printf("Sampling session %s: expect sampled=%t at rate %g\n", id, sampled, samplingRate)
+		sawSpans := false
+		lastPoll = pollSession(samplingEndpoint, func(body []byte) (bool, error) {
+			var counts struct {
+				TotalTraces int `json:"totalTraces"`
+				TotalSpans  int `json:"totalSpans"`
 			}
+			_ = json.Unmarshal(body, &counts)
+			switch {
+			case !sampled && counts.TotalSpans > 0:
+				sawSpans = true
+				return true, fmt.Errorf("session %s should not be sampled but has %d spans", id, counts.TotalSpans)
+			case !sampled:
+				return false, nil
+			case counts.TotalSpans > samplingRequests:
+				return true, fmt.Errorf("session %s has %d spans, sent %d requests", id, counts.TotalSpans, samplingRequests)
+			case counts.TotalSpans == samplingRequests:
+				return true, nil
+			}
+			// Fewer spans may still be in flight; only the last poll decides
+			return false, fmt.Errorf("session %s captured %d of %d requests (%d traces); sampling must be all or none",
+				id, counts.TotalSpans, samplingRequests, counts.TotalTraces)
+		})
+		if !sampled && !sawSpans {
+			// Polled out without seeing a span: the expected outcome
+			continue
 		}
-	}
-	if !sessFound {
-		panic("no session traces found for test session")
+		failPoll("poll sampling session "+samplingEndpoint, lastPoll, fmt.Errorf("sampled session %s not found in Softprobe backend", id))
 	}
 
 	fmt.Println("OK")